@@ -0,0 +1,133 @@
+// Command reconcile compares the generated images, and images `ollama run`
+// left in the working directory, with the database. It lists orphan
+// images, generations whose image is missing and duplicate images, and
+// with -import records the orphans as generations.
+//
+// Run it from the directory the server runs in, with the same storage
+// environment variables:
+//
+//	go run ./cmd/reconcile [-import] [file ...]
+//
+// Files limit -import to the given orphans, named as listed (those in the
+// working directory start with ./).
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"meme-generator/internal/db"
+	"meme-generator/internal/ollama"
+	"meme-generator/internal/reconcile"
+	"meme-generator/internal/storage"
+	"os"
+	"path/filepath"
+
+	"github.com/dustin/go-humanize"
+)
+
+func main() {
+	dbPath := flag.String("db", "meme_generator.db", "database file")
+	generatedDir := flag.String("dir", "generated", "directory of generated images")
+	importOrphans := flag.Bool("import", false, "import orphan images as generations")
+	flag.Parse()
+
+	if _, err := os.Stat(*dbPath); err != nil {
+		log.Fatalf("Database not found: %v", err)
+	}
+	database, err := db.New(*dbPath)
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer database.Close()
+
+	store, _, err := storage.FromEnv(*generatedDir)
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	reconciler := reconcile.New(database, ollama.NewClient(*generatedDir, store), store, *generatedDir, ".")
+	report, err := reconciler.Scan()
+	if err != nil {
+		log.Fatalf("Failed to scan files: %v", err)
+	}
+
+	printReport(report)
+	if !*importOrphans {
+		return
+	}
+
+	// Import the named orphans, or every one that is not a duplicate
+	orphans := report.Orphans
+	if flag.NArg() > 0 {
+		orphans = nil
+		for _, key := range flag.Args() {
+			orphan, ok := report.Orphan(key)
+			if !ok {
+				log.Fatalf("Not an orphan image: %s", key)
+			}
+			orphans = append(orphans, orphan)
+		}
+	}
+
+	fmt.Println()
+	imported, failed := 0, 0
+	for _, orphan := range orphans {
+		if !orphan.Importable() {
+			fmt.Printf("Skipped %s: a copy of an existing image\n", orphan.Key())
+			continue
+		}
+		id, err := reconciler.Import(orphan)
+		if err != nil {
+			log.Printf("Error importing %s: %v", orphan.Key(), err)
+			failed++
+			continue
+		}
+		fmt.Printf("Imported %s as #%d %q\n", orphan.Key(), id, orphan.Prompt)
+		imported++
+
+		// Store the image like the server stores new ones, for other replicas
+		gen, err := database.GetGeneration(id)
+		if err != nil {
+			log.Printf("Error fetching generation #%d: %v", id, err)
+			failed++
+			continue
+		}
+		if err := storage.PutFile(store, filepath.ToSlash(gen.ImagePath), filepath.Join(*generatedDir, gen.ImagePath)); err != nil {
+			log.Printf("Error storing %s: %v", gen.ImagePath, err)
+			failed++
+		}
+	}
+	fmt.Printf("Imported %d image(s)\n", imported)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// printReport lists what a scan found
+func printReport(report *reconcile.Report) {
+	fmt.Printf("Orphan images (%d):\n", len(report.Orphans))
+	for _, o := range report.Orphans {
+		note := ""
+		if o.DuplicateOf != 0 {
+			note = fmt.Sprintf(" [same image as #%d]", o.DuplicateOf)
+		} else if o.SameAs != "" {
+			note = fmt.Sprintf(" [same image as %s]", o.SameAs)
+		}
+		fmt.Printf("  %s  %s  %q  %s%s\n", o.Key(), humanize.Bytes(uint64(o.Size)), o.Prompt, o.Created.Format("2006-01-02 15:04"), note)
+	}
+
+	fmt.Printf("Generations with a missing image (%d):\n", len(report.Missing))
+	for _, gen := range report.Missing {
+		fmt.Printf("  #%d  %s  %q\n", gen.ID, gen.ImagePath, gen.Prompt)
+	}
+
+	fmt.Printf("Duplicate images (%d):\n", len(report.Duplicates))
+	for _, d := range report.Duplicates {
+		fmt.Print(" ")
+		for _, gen := range d.Generations {
+			fmt.Printf(" #%d", gen.ID)
+		}
+		fmt.Println()
+	}
+}
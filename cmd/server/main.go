@@ -4,7 +4,9 @@ import (
 	"log"
 	"meme-generator/internal/db"
 	"meme-generator/internal/handlers"
+	"meme-generator/internal/library"
 	"meme-generator/internal/ollama"
+	"meme-generator/internal/storage"
 	"net/http"
 	"os"
 )
@@ -14,6 +16,7 @@ func main() {
 		dbPath       = "meme_generator.db"
 		generatedDir = "generated"
 		templatesDir = "web/templates"
+		libraryDir   = "meme-templates"
 		staticDir    = "static"
 		port         = ":8080"
 	)
@@ -28,20 +31,76 @@ func main() {
 	}
 	defer database.Close()
 
-	ollamaClient := ollama.NewClient(generatedDir)
+	store, storeName, err := storage.FromEnv(generatedDir)
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+	log.Printf("Storing images in %s", storeName)
 
-	handler, err := handlers.New(database, ollamaClient, templatesDir, generatedDir)
+	ollamaClient := ollama.NewClient(generatedDir, store)
+
+	memeTemplates, err := library.Load(libraryDir)
+	if err != nil {
+		log.Fatalf("Failed to load meme templates: %v", err)
+	}
+
+	handler, err := handlers.New(database, ollamaClient, memeTemplates, store, templatesDir, generatedDir)
 	if err != nil {
 		log.Fatalf("Failed to initialize handlers: %v", err)
 	}
 
+	handler.StartJanitor()
+
 	http.HandleFunc("/", handler.Home)
 	http.HandleFunc("/generate", handler.Generate)
+	http.HandleFunc("/comic", handler.GenerateComic)
+	http.HandleFunc("/comic/panel", handler.RedrawPanel)
+	http.HandleFunc("/upload", handler.Upload)
+	http.HandleFunc("/gif", handler.CaptionGIF)
+	http.HandleFunc("/import", handler.Import)
+	http.HandleFunc("/templates", handler.Templates)
+	http.HandleFunc("/templates/generate", handler.GenerateFromTemplate)
 	http.HandleFunc("/generation", handler.GetGeneration)
+	http.HandleFunc("/download", handler.Download)
+	http.HandleFunc("/generation/alt-text", handler.UpdateAltText)
+	http.HandleFunc("/generation/rerender", handler.Rerender)
+	http.HandleFunc("/generation/effects", handler.UpdateEffects)
+	http.HandleFunc("/generation/effects/preview", handler.PreviewEffects)
+	http.HandleFunc("/generation/layers", handler.UpdateLayers)
+	http.HandleFunc("/generation/watermark", handler.UpdateWatermark)
+	http.HandleFunc("/generation/share", handler.Share)
+	http.HandleFunc("/generation/rating", handler.GetRating)
+	http.HandleFunc("/generation/rate", handler.Rate)
+	http.HandleFunc("/generation/favorite", handler.Favorite)
+	http.HandleFunc("/generation/delete", handler.DeleteGeneration)
+	http.HandleFunc("/generation/restore", handler.RestoreGeneration)
+	http.HandleFunc("/generation/tags", handler.UpdateTags)
+	http.HandleFunc("/generation/collections", handler.UpdateGenerationCollections)
+	http.HandleFunc("/s/", handler.ServeShared)
+	http.HandleFunc("/alt-text", handler.DownloadAltText)
 	http.HandleFunc("/history", handler.History)
+	http.HandleFunc("/history/delete", handler.DeleteHistory)
+	http.HandleFunc("/trash", handler.Trash)
+	http.HandleFunc("/trash/restore", handler.RestoreTrash)
+	http.HandleFunc("/trash/purge", handler.PurgeTrash)
+	http.HandleFunc("/similar", handler.Similar)
+	http.HandleFunc("/similar/index", handler.IndexEmbeddings)
+	http.HandleFunc("/best", handler.BestOf)
+	http.HandleFunc("/ratings/report", handler.RatingReport)
+	http.HandleFunc("/collections", handler.Collections)
+	http.HandleFunc("/collections/create", handler.CreateCollection)
+	http.HandleFunc("/collections/delete", handler.DeleteCollection)
+	http.HandleFunc("/collections/export", handler.ExportCollection)
 	http.HandleFunc("/settings", handler.GetSettings)
 	http.HandleFunc("/settings/update", handler.UpdateSettings)
+	http.HandleFunc("/settings/watermark-logo", handler.UpdateWatermarkLogo)
+	http.HandleFunc("/janitor", handler.Janitor)
+	http.HandleFunc("/janitor/run", handler.RunJanitor)
+	http.HandleFunc("/reconcile", handler.Reconcile)
+	http.HandleFunc("/reconcile/import", handler.ImportOrphans)
+	http.HandleFunc("/reconcile/trash", handler.TrashMissing)
 	http.Handle("/images/", http.StripPrefix("/images/", http.HandlerFunc(handler.ServeImage)))
+	http.Handle("/template-images/", http.StripPrefix("/template-images/", http.HandlerFunc(handler.ServeTemplateImage)))
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(staticDir))))
 
 	log.Printf("Server starting on http://localhost%s", port)
@@ -0,0 +1,107 @@
+package db
+
+import "database/sql"
+
+// CreateCollection creates a named collection. Names are unique regardless
+// of case.
+func (db *DB) CreateCollection(name string) (int64, error) {
+	result, err := db.Exec(`INSERT INTO collections (name) VALUES (?)`, name)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// DeleteCollection deletes a collection. Its generations are kept.
+func (db *DB) DeleteCollection(id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM collection_items WHERE collection_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM collections WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetCollection returns a collection with its item count
+func (db *DB) GetCollection(id int64) (*Collection, error) {
+	collections, err := db.queryCollections(`WHERE c.id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(collections) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &collections[0], nil
+}
+
+// ListCollections returns every collection, sorted by name
+func (db *DB) ListCollections() ([]Collection, error) {
+	return db.queryCollections(``)
+}
+
+// ListGenerationCollections returns the collections a generation is in,
+// sorted by name
+func (db *DB) ListGenerationCollections(generationID int64) ([]Collection, error) {
+	return db.queryCollections(`WHERE c.id IN (SELECT collection_id FROM collection_items WHERE generation_id = ?)`, generationID)
+}
+
+func (db *DB) queryCollections(where string, args ...interface{}) ([]Collection, error) {
+	query := `
+	SELECT c.id, c.name, c.created_at, COUNT(i.generation_id)
+	FROM collections c
+	LEFT JOIN collection_items i ON i.collection_id = c.id
+		AND i.generation_id IN (SELECT id FROM generations WHERE deleted_at IS NULL)
+	` + where + `
+	GROUP BY c.id
+	ORDER BY c.name COLLATE NOCASE
+	`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var collections []Collection
+	for rows.Next() {
+		var c Collection
+		if err := rows.Scan(&c.ID, &c.Name, &c.CreatedAt, &c.Count); err != nil {
+			return nil, err
+		}
+		collections = append(collections, c)
+	}
+	return collections, rows.Err()
+}
+
+// AddToCollection adds a generation to a collection, if it is not in it
+func (db *DB) AddToCollection(collectionID, generationID int64) error {
+	_, err := db.Exec(`INSERT OR IGNORE INTO collection_items (collection_id, generation_id) VALUES (?, ?)`, collectionID, generationID)
+	return err
+}
+
+// RemoveFromCollection removes a generation from a collection
+func (db *DB) RemoveFromCollection(collectionID, generationID int64) error {
+	_, err := db.Exec(`DELETE FROM collection_items WHERE collection_id = ? AND generation_id = ?`, collectionID, generationID)
+	return err
+}
+
+// ListCollectionItems returns a collection's generations in the order they
+// were added, leaving out those in the trash
+func (db *DB) ListCollectionItems(collectionID int64) ([]Generation, error) {
+	query := `
+	SELECT ` + generationColumns + `
+	FROM generations
+	JOIN collection_items ON collection_items.generation_id = generations.id
+	WHERE collection_items.collection_id = ? AND generations.deleted_at IS NULL
+	ORDER BY collection_items.added_at, generations.id
+	`
+
+	return db.queryGenerations(query, collectionID)
+}
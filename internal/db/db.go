@@ -2,7 +2,12 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"meme-generator/internal/spec"
+	"sort"
+	"strings"
+	"time"
 
 	_ "modernc.org/sqlite"
 )
@@ -22,50 +27,22 @@ func New(dataSourceName string) (*DB, error) {
 	}
 
 	database := &DB{db}
-	if err := database.createTables(); err != nil {
-		return nil, fmt.Errorf("failed to create tables: %w", err)
+	if err := database.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
 	return database, nil
 }
 
-func (db *DB) createTables() error {
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS generations (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			prompt TEXT NOT NULL,
-			image_path TEXT NOT NULL,
-			top_text TEXT DEFAULT '',
-			bottom_text TEXT DEFAULT '',
-			status TEXT NOT NULL,
-			error_message TEXT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		);`,
-		`CREATE TABLE IF NOT EXISTS settings (
-			key TEXT PRIMARY KEY,
-			value TEXT NOT NULL
-		);`,
-		`INSERT OR IGNORE INTO settings (key, value) 
-		 VALUES ('system_prompt', 'You are a creative meme generator. Generate images based on the following description:');`,
-		// Migration: Add text columns if they don't exist (for existing databases)
-		`ALTER TABLE generations ADD COLUMN top_text TEXT DEFAULT '';`,
-		`ALTER TABLE generations ADD COLUMN bottom_text TEXT DEFAULT '';`,
-	}
-
-	for _, query := range queries {
-		// Ignore errors for ALTER TABLE (columns might already exist)
-		db.Exec(query)
-	}
-	return nil
-}
-
-func (db *DB) InsertGeneration(prompt, imagePath, status, errorMessage string) (int64, error) {
+// InsertGeneration creates a generation. Source records where the base
+// image came from (SourceModel, SourceTemplate or SourceUpload).
+func (db *DB) InsertGeneration(prompt, source, imagePath, status, errorMessage string) (int64, error) {
 	query := `
-	INSERT INTO generations (prompt, image_path, top_text, bottom_text, status, error_message)
-	VALUES (?, ?, '', '', ?, ?)
+	INSERT INTO generations (prompt, source, image_path, top_text, bottom_text, status, error_message)
+	VALUES (?, ?, ?, '', '', ?, ?)
 	`
 
-	result, err := db.Exec(query, prompt, imagePath, status, errorMessage)
+	result, err := db.Exec(query, prompt, source, imagePath, status, errorMessage)
 	if err != nil {
 		return 0, err
 	}
@@ -95,41 +72,490 @@ func (db *DB) UpdateGenerationText(id int64, topText, bottomText string) error {
 	return err
 }
 
-func (db *DB) GetGeneration(id int64) (*Generation, error) {
+// UpdateGenerationBase records the uncaptioned source image of a generation
+func (db *DB) UpdateGenerationBase(id int64, basePath string) error {
 	query := `
-	SELECT id, prompt, image_path, top_text, bottom_text, status, error_message, created_at
-	FROM generations
+	UPDATE generations
+	SET base_path = ?
+	WHERE id = ?
+	`
+
+	_, err := db.Exec(query, basePath, id)
+	return err
+}
+
+// UpdateGenerationTemplate records the library template a generation was made from
+func (db *DB) UpdateGenerationTemplate(id int64, templateID string) error {
+	query := `
+	UPDATE generations
+	SET template_id = ?
+	WHERE id = ?
+	`
+
+	_, err := db.Exec(query, templateID, id)
+	return err
+}
+
+// UpdateGenerationCaptions stores the text of each template text box
+func (db *DB) UpdateGenerationCaptions(id int64, captions []string) error {
+	data, err := json.Marshal(captions)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	UPDATE generations
+	SET captions = ?
+	WHERE id = ?
+	`
+
+	_, err = db.Exec(query, string(data), id)
+	return err
+}
+
+// UpdateGenerationEffects stores a generation's effects pipeline
+func (db *DB) UpdateGenerationEffects(id int64, effects []spec.Effect) error {
+	data := ""
+	if len(effects) > 0 {
+		encoded, err := json.Marshal(effects)
+		if err != nil {
+			return err
+		}
+		data = string(encoded)
+	}
+
+	query := `
+	UPDATE generations
+	SET effects = ?
+	WHERE id = ?
+	`
+
+	_, err := db.Exec(query, data, id)
+	return err
+}
+
+// UpdateGenerationLayers stores a generation's annotation layers, bottom
+// to top
+func (db *DB) UpdateGenerationLayers(id int64, layers []spec.Layer) error {
+	data := ""
+	if len(layers) > 0 {
+		encoded, err := json.Marshal(layers)
+		if err != nil {
+			return err
+		}
+		data = string(encoded)
+	}
+
+	query := `
+	UPDATE generations
+	SET layers = ?
+	WHERE id = ?
+	`
+
+	_, err := db.Exec(query, data, id)
+	return err
+}
+
+// UpdateGenerationParent makes a generation a panel of the comic strip
+// generation parentID
+func (db *DB) UpdateGenerationParent(id, parentID int64) error {
+	query := `
+	UPDATE generations
+	SET parent_id = ?
+	WHERE id = ?
+	`
+
+	_, err := db.Exec(query, parentID, id)
+	return err
+}
+
+// UpdateGenerationComic stores the script of a comic strip generation
+func (db *DB) UpdateGenerationComic(id int64, script *spec.ComicScript) error {
+	data := ""
+	if script != nil {
+		encoded, err := json.Marshal(script)
+		if err != nil {
+			return err
+		}
+		data = string(encoded)
+	}
+
+	query := `
+	UPDATE generations
+	SET comic = ?
 	WHERE id = ?
 	`
 
+	_, err := db.Exec(query, data, id)
+	return err
+}
+
+// UpdateGenerationWatermark records whether a generation's image is watermarked
+func (db *DB) UpdateGenerationWatermark(id int64, watermark bool) error {
+	query := `
+	UPDATE generations
+	SET watermark = ?
+	WHERE id = ?
+	`
+
+	_, err := db.Exec(query, watermark, id)
+	return err
+}
+
+// UpdateGenerationShareToken sets the token of a generation's public share
+// link. An empty token revokes the link.
+func (db *DB) UpdateGenerationShareToken(id int64, token string) error {
+	query := `
+	UPDATE generations
+	SET share_token = ?
+	WHERE id = ?
+	`
+
+	_, err := db.Exec(query, token, id)
+	return err
+}
+
+// UpdateGenerationDescription stores the vision model's description of the base image
+func (db *DB) UpdateGenerationDescription(id int64, description string) error {
+	query := `
+	UPDATE generations
+	SET description = ?
+	WHERE id = ?
+	`
+
+	_, err := db.Exec(query, description, id)
+	return err
+}
+
+// UpdateGenerationAltText stores user-visible alt text for a generation's image
+func (db *DB) UpdateGenerationAltText(id int64, altText string) error {
+	query := `
+	UPDATE generations
+	SET alt_text = ?
+	WHERE id = ?
+	`
+
+	_, err := db.Exec(query, altText, id)
+	return err
+}
+
+// UpdateGenerationHash records the content hash of a generation's image
+func (db *DB) UpdateGenerationHash(id int64, hash string) error {
+	query := `
+	UPDATE generations
+	SET image_hash = ?
+	WHERE id = ?
+	`
+
+	_, err := db.Exec(query, hash, id)
+	return err
+}
+
+// UpdateGenerationPlacement records whether a generation's captions are
+// placed with smart placement, so re-renders and exports place them alike
+func (db *DB) UpdateGenerationPlacement(id int64, smartPlacement bool) error {
+	query := `
+	UPDATE generations
+	SET smart_placement = ?
+	WHERE id = ?
+	`
+
+	_, err := db.Exec(query, smartPlacement, id)
+	return err
+}
+
+// UpdateGenerationWidth records the width of a generation's image, for
+// responsive image sizes
+func (db *DB) UpdateGenerationWidth(id int64, width int) error {
+	query := `
+	UPDATE generations
+	SET image_width = ?
+	WHERE id = ?
+	`
+
+	_, err := db.Exec(query, width, id)
+	return err
+}
+
+// UpdateGenerationModels records the system prompt and models a
+// generation was made with. Empty values mean the step did not use a model.
+func (db *DB) UpdateGenerationModels(id int64, systemPrompt, imageModel, textModel string) error {
+	query := `
+	UPDATE generations
+	SET system_prompt = ?, image_model = ?, text_model = ?
+	WHERE id = ?
+	`
+
+	_, err := db.Exec(query, systemPrompt, imageModel, textModel, id)
+	return err
+}
+
+// UpdateGenerationSeed records the seed the image model draws a
+// generation with
+func (db *DB) UpdateGenerationSeed(id, seed int64) error {
+	query := `
+	UPDATE generations
+	SET seed = ?
+	WHERE id = ?
+	`
+
+	_, err := db.Exec(query, seed, id)
+	return err
+}
+
+// generationColumns lists the columns scanned by scanGeneration, in order.
+// Tag names are joined in from generation_tags, so queries using it must
+// select from generations without an alias.
+const generationColumns = `id, prompt, source, image_path, image_hash, image_width, base_path, template_id, captions, effects, layers, parent_id, comic, watermark, smart_placement, favorite, rating_count, rating_total, system_prompt, image_model, text_model, seed, share_token, description, alt_text, top_text, bottom_text, status, error_message, created_at, deleted_at,
+	(SELECT group_concat(t.name, ',') FROM generation_tags gt JOIN tags t ON t.id = gt.tag_id WHERE gt.generation_id = generations.id)`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanGeneration(row rowScanner) (*Generation, error) {
 	var gen Generation
-	err := db.QueryRow(query, id).Scan(
+	var captions, effects, layers, comic string
+	var tags sql.NullString
+	var deletedAt sql.NullTime
+	err := row.Scan(
 		&gen.ID,
 		&gen.Prompt,
+		&gen.Source,
 		&gen.ImagePath,
+		&gen.ImageHash,
+		&gen.ImageWidth,
+		&gen.BasePath,
+		&gen.TemplateID,
+		&captions,
+		&effects,
+		&layers,
+		&gen.ParentID,
+		&comic,
+		&gen.Watermark,
+		&gen.SmartPlacement,
+		&gen.Favorite,
+		&gen.RatingCount,
+		&gen.RatingTotal,
+		&gen.SystemPrompt,
+		&gen.ImageModel,
+		&gen.TextModel,
+		&gen.Seed,
+		&gen.ShareToken,
+		&gen.Description,
+		&gen.AltText,
 		&gen.TopText,
 		&gen.BottomText,
 		&gen.Status,
 		&gen.ErrorMessage,
 		&gen.CreatedAt,
+		&deletedAt,
+		&tags,
 	)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if captions != "" {
+		if err := json.Unmarshal([]byte(captions), &gen.Captions); err != nil {
+			return nil, fmt.Errorf("invalid captions for generation %d: %w", gen.ID, err)
+		}
+	}
+	if effects != "" {
+		if err := json.Unmarshal([]byte(effects), &gen.Effects); err != nil {
+			return nil, fmt.Errorf("invalid effects for generation %d: %w", gen.ID, err)
+		}
+	}
+	if layers != "" {
+		if err := json.Unmarshal([]byte(layers), &gen.Layers); err != nil {
+			return nil, fmt.Errorf("invalid layers for generation %d: %w", gen.ID, err)
+		}
+	}
+	if deletedAt.Valid {
+		gen.DeletedAt = &deletedAt.Time
+	}
+	if tags.String != "" {
+		gen.Tags = strings.Split(tags.String, ",")
+		sort.Strings(gen.Tags)
+	}
+	if comic != "" {
+		gen.Comic = &spec.ComicScript{}
+		if err := json.Unmarshal([]byte(comic), gen.Comic); err != nil {
+			return nil, fmt.Errorf("invalid comic script for generation %d: %w", gen.ID, err)
+		}
+	}
+
 	return &gen, nil
 }
 
-func (db *DB) ListGenerations(limit int) ([]Generation, error) {
+func (db *DB) GetGeneration(id int64) (*Generation, error) {
 	query := `
-	SELECT id, prompt, image_path, top_text, bottom_text, status, error_message, created_at
+	SELECT ` + generationColumns + `
 	FROM generations
-	ORDER BY created_at DESC
+	WHERE id = ?
+	`
+
+	return scanGeneration(db.QueryRow(query, id))
+}
+
+// GetGenerationByShareToken returns the generation a share link points to
+func (db *DB) GetGenerationByShareToken(token string) (*Generation, error) {
+	query := `
+	SELECT ` + generationColumns + `
+	FROM generations
+	WHERE share_token = ? AND share_token != '' AND deleted_at IS NULL
+	`
+
+	return scanGeneration(db.QueryRow(query, token))
+}
+
+// HistoryFilter narrows the generations listed in the history. Zero
+// fields match everything.
+type HistoryFilter struct {
+	Query      string    // full-text search over prompts and captions
+	Status     string    // StatusProcessing, StatusSuccess or StatusFailed
+	Source     string    // SourceModel, SourceTemplate, SourceUpload or SourceComic
+	Model      string    // image or text model name
+	From       time.Time // created at or after
+	To         time.Time // created before
+	Tag        string    // tag name
+	Collection int64     // collection ID
+	Favorites  bool      // only favorites
+	Before     int64     // cursor: only generations with a lower ID
+}
+
+// ListGenerations returns up to limit top-level generations matching the
+// filter, newest first, leaving out those in the trash. Pass the ID of the
+// last one as Before to get the next page.
+func (db *DB) ListGenerations(filter HistoryFilter, limit int) ([]Generation, error) {
+	conditions := []string{"parent_id = 0", "deleted_at IS NULL"}
+	var args []interface{}
+
+	if match := ftsQuery(filter.Query); match != "" {
+		conditions = append(conditions, "id IN (SELECT rowid FROM generations_fts WHERE generations_fts MATCH ?)")
+		args = append(args, match)
+	}
+	if filter.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, filter.Status)
+	}
+	if filter.Source != "" {
+		conditions = append(conditions, "source = ?")
+		args = append(args, filter.Source)
+	}
+	if filter.Model != "" {
+		conditions = append(conditions, "(image_model = ? OR text_model = ?)")
+		args = append(args, filter.Model, filter.Model)
+	}
+	// created_at is stored by CURRENT_TIMESTAMP as UTC text
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.From.UTC().Format(timestampLayout))
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, filter.To.UTC().Format(timestampLayout))
+	}
+	if filter.Tag != "" {
+		conditions = append(conditions, "id IN (SELECT gt.generation_id FROM generation_tags gt JOIN tags t ON t.id = gt.tag_id WHERE t.name = ?)")
+		args = append(args, filter.Tag)
+	}
+	if filter.Collection > 0 {
+		conditions = append(conditions, "id IN (SELECT generation_id FROM collection_items WHERE collection_id = ?)")
+		args = append(args, filter.Collection)
+	}
+	if filter.Favorites {
+		conditions = append(conditions, "favorite != 0")
+	}
+	if filter.Before > 0 {
+		conditions = append(conditions, "id < ?")
+		args = append(args, filter.Before)
+	}
+
+	query := `
+	SELECT ` + generationColumns + `
+	FROM generations
+	WHERE ` + strings.Join(conditions, " AND ") + `
+	ORDER BY id DESC
 	LIMIT ?
 	`
 
-	rows, err := db.Query(query, limit)
+	return db.queryGenerations(query, append(args, limit)...)
+}
+
+// ListModels returns the image and text models recorded on top-level
+// generations outside the trash, in name order
+func (db *DB) ListModels() ([]string, error) {
+	rows, err := db.Query(`
+	SELECT image_model FROM generations WHERE parent_id = 0 AND deleted_at IS NULL AND image_model != ''
+	UNION
+	SELECT text_model FROM generations WHERE parent_id = 0 AND deleted_at IS NULL AND text_model != ''
+	ORDER BY 1
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var models []string
+	for rows.Next() {
+		var model string
+		if err := rows.Scan(&model); err != nil {
+			return nil, err
+		}
+		models = append(models, model)
+	}
+	return models, rows.Err()
+}
+
+// timestampLayout is how SQLite's CURRENT_TIMESTAMP formats times
+const timestampLayout = "2006-01-02 15:04:05"
+
+// ftsQuery turns search box input into an FTS5 query that matches every
+// word as a prefix, quoting each so punctuation and FTS5 operators in the
+// input are taken literally
+func ftsQuery(input string) string {
+	var terms []string
+	for _, word := range strings.Fields(input) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// ListPanels returns the panels of a comic strip generation, in order
+func (db *DB) ListPanels(parentID int64) ([]Generation, error) {
+	query := `
+	SELECT ` + generationColumns + `
+	FROM generations
+	WHERE parent_id = ?
+	ORDER BY id
+	`
+
+	return db.queryGenerations(query, parentID)
+}
+
+// ListAllGenerations returns every generation, including comic panels and
+// those in the trash
+func (db *DB) ListAllGenerations() ([]Generation, error) {
+	query := `
+	SELECT ` + generationColumns + `
+	FROM generations
+	ORDER BY id
+	`
+
+	return db.queryGenerations(query)
+}
+
+// queryGenerations runs a query selecting generationColumns and scans the rows
+func (db *DB) queryGenerations(query string, args ...interface{}) ([]Generation, error) {
+	return queryGenerations(db, query, args...)
+}
+
+// queryGenerations is queryGenerations in a transaction or on the database
+func queryGenerations(q querier, query string, args ...interface{}) ([]Generation, error) {
+	rows, err := q.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -137,24 +563,149 @@ func (db *DB) ListGenerations(limit int) ([]Generation, error) {
 
 	var generations []Generation
 	for rows.Next() {
-		var gen Generation
+		gen, err := scanGeneration(rows)
+		if err != nil {
+			return nil, err
+		}
+		generations = append(generations, *gen)
+	}
+
+	return generations, rows.Err()
+}
+
+func (db *DB) UpsertVariant(v Variant) error {
+	query := `
+	INSERT OR REPLACE INTO generation_variants (generation_id, format, quality, filename, size_bytes)
+	VALUES (?, ?, ?, ?, ?)
+	`
+
+	_, err := db.Exec(query, v.GenerationID, v.Format, v.Quality, v.Filename, v.SizeBytes)
+	return err
+}
+
+func (db *DB) GetVariant(generationID int64, format string, quality int) (*Variant, error) {
+	query := `
+	SELECT generation_id, format, quality, filename, size_bytes, created_at
+	FROM generation_variants
+	WHERE generation_id = ? AND format = ? AND quality = ?
+	`
+
+	var v Variant
+	err := db.QueryRow(query, generationID, format, quality).Scan(
+		&v.GenerationID,
+		&v.Format,
+		&v.Quality,
+		&v.Filename,
+		&v.SizeBytes,
+		&v.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+func (db *DB) ListVariants(generationID int64) ([]Variant, error) {
+	query := `
+	SELECT generation_id, format, quality, filename, size_bytes, created_at
+	FROM generation_variants
+	WHERE generation_id = ?
+	ORDER BY size_bytes ASC
+	`
+
+	return db.queryVariants(query, generationID)
+}
+
+// ListAllVariants returns the variants of every generation
+func (db *DB) ListAllVariants() ([]Variant, error) {
+	query := `
+	SELECT generation_id, format, quality, filename, size_bytes, created_at
+	FROM generation_variants
+	ORDER BY generation_id
+	`
+
+	return db.queryVariants(query)
+}
+
+// queryVariants runs a query selecting variant columns and scans the rows
+func (db *DB) queryVariants(query string, args ...interface{}) ([]Variant, error) {
+	return queryVariants(db, query, args...)
+}
+
+// queryVariants is queryVariants in a transaction or on the database
+func queryVariants(q querier, query string, args ...interface{}) ([]Variant, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var variants []Variant
+	for rows.Next() {
+		var v Variant
 		err := rows.Scan(
-			&gen.ID,
-			&gen.Prompt,
-			&gen.ImagePath,
-			&gen.TopText,
-			&gen.BottomText,
-			&gen.Status,
-			&gen.ErrorMessage,
-			&gen.CreatedAt,
+			&v.GenerationID,
+			&v.Format,
+			&v.Quality,
+			&v.Filename,
+			&v.SizeBytes,
+			&v.CreatedAt,
 		)
 		if err != nil {
 			return nil, err
 		}
-		generations = append(generations, gen)
+		variants = append(variants, v)
 	}
 
-	return generations, rows.Err()
+	return variants, rows.Err()
+}
+
+// DeleteVariants forgets every exported copy of a generation, returning
+// them so their files can be removed
+func (db *DB) DeleteVariants(generationID int64) ([]Variant, error) {
+	variants, err := db.ListVariants(generationID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `DELETE FROM generation_variants WHERE generation_id = ?`
+	if _, err := db.Exec(query, generationID); err != nil {
+		return nil, err
+	}
+
+	return variants, nil
+}
+
+// DeleteWatermarkedVariants forgets the exports in the given formats of
+// every watermarked generation, returning them so their files can be
+// removed. Formats that draw the watermark at export time use it to go
+// stale when the watermark changes.
+func (db *DB) DeleteWatermarkedVariants(formats []string) ([]Variant, error) {
+	if len(formats) == 0 {
+		return nil, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(formats)), ", ")
+	where := `format IN (` + placeholders + `)
+	AND generation_id IN (SELECT id FROM generations WHERE watermark = 1)`
+	args := make([]interface{}, len(formats))
+	for i, f := range formats {
+		args[i] = f
+	}
+
+	variants, err := db.queryVariants(`
+	SELECT generation_id, format, quality, filename, size_bytes, created_at
+	FROM generation_variants
+	WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(`DELETE FROM generation_variants WHERE `+where, args...); err != nil {
+		return nil, err
+	}
+	return variants, nil
 }
 
 func (db *DB) GetSetting(key string) (string, error) {
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// UpsertEmbedding stores a generation's embedding, replacing any earlier one
+func (db *DB) UpsertEmbedding(e Embedding) error {
+	query := `
+	INSERT OR REPLACE INTO generation_embeddings (generation_id, model, text_hash, vector)
+	VALUES (?, ?, ?, ?)
+	`
+
+	_, err := db.Exec(query, e.GenerationID, e.Model, e.TextHash, encodeVector(e.Vector))
+	return err
+}
+
+// GetEmbedding returns a generation's embedding, or nil if it has none
+func (db *DB) GetEmbedding(generationID int64) (*Embedding, error) {
+	embeddings, err := db.queryEmbeddings(`
+	SELECT generation_id, model, text_hash, vector
+	FROM generation_embeddings
+	WHERE generation_id = ?
+	`, generationID)
+	if err != nil || len(embeddings) == 0 {
+		return nil, err
+	}
+	return &embeddings[0], nil
+}
+
+// ListEmbeddings returns the embeddings made with a model for successful
+// top-level generations, which are the ones semantic search can return
+func (db *DB) ListEmbeddings(model string) ([]Embedding, error) {
+	return db.queryEmbeddings(`
+	SELECT e.generation_id, e.model, e.text_hash, e.vector
+	FROM generation_embeddings e
+	JOIN generations g ON g.id = e.generation_id
+	WHERE e.model = ? AND g.parent_id = 0 AND g.status = ? AND g.deleted_at IS NULL
+	`, model, StatusSuccess)
+}
+
+// ListUnembedded returns up to limit successful top-level generations with
+// no embedding from a model, newest first
+func (db *DB) ListUnembedded(model string, limit int) ([]Generation, error) {
+	query := `
+	SELECT ` + generationColumns + `
+	FROM generations
+	WHERE parent_id = 0 AND status = ? AND deleted_at IS NULL
+	AND id NOT IN (SELECT generation_id FROM generation_embeddings WHERE model = ?)
+	ORDER BY id DESC
+	LIMIT ?
+	`
+
+	return db.queryGenerations(query, StatusSuccess, model, limit)
+}
+
+func (db *DB) queryEmbeddings(query string, args ...interface{}) ([]Embedding, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var embeddings []Embedding
+	for rows.Next() {
+		var e Embedding
+		var vector []byte
+		if err := rows.Scan(&e.GenerationID, &e.Model, &e.TextHash, &vector); err != nil {
+			return nil, err
+		}
+		if e.Vector, err = decodeVector(vector); err != nil {
+			return nil, fmt.Errorf("invalid embedding for generation %d: %w", e.GenerationID, err)
+		}
+		embeddings = append(embeddings, e)
+	}
+	return embeddings, rows.Err()
+}
+
+// encodeVector packs a vector as little-endian float32s
+func encodeVector(vector []float32) []byte {
+	data := make([]byte, 4*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(v))
+	}
+	return data
+}
+
+func decodeVector(data []byte) ([]float32, error) {
+	if len(data)%4 != 0 {
+		return nil, fmt.Errorf("vector is %d bytes, not a multiple of 4", len(data))
+	}
+	vector := make([]float32, len(data)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return vector, nil
+}
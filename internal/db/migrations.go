@@ -0,0 +1,348 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// migration is one versioned change to the schema. Migrations are applied
+// in order, each in its own transaction, and recorded in schema_migrations.
+// Never edit or reorder a migration once released; append a new one.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change, oldest first. Versions start at 1
+// and have no gaps.
+var migrations = []migration{
+	{1, "create tables", execAll(
+		`CREATE TABLE IF NOT EXISTS generations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			prompt TEXT NOT NULL,
+			image_path TEXT NOT NULL,
+			top_text TEXT DEFAULT '',
+			bottom_text TEXT DEFAULT '',
+			status TEXT NOT NULL,
+			error_message TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS settings (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS generation_variants (
+			generation_id INTEGER NOT NULL REFERENCES generations(id),
+			format TEXT NOT NULL,
+			quality INTEGER NOT NULL,
+			filename TEXT NOT NULL,
+			size_bytes INTEGER NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (generation_id, format, quality)
+		);`,
+		`INSERT OR IGNORE INTO settings (key, value)
+		 VALUES ('system_prompt', 'You are a creative meme generator. Generate images based on the following description:');`,
+		`INSERT OR IGNORE INTO settings (key, value) VALUES ('smart_placement', 'false');`,
+		`INSERT OR IGNORE INTO settings (key, value) VALUES ('output_format', 'png');`,
+		`INSERT OR IGNORE INTO settings (key, value) VALUES ('output_quality', '85');`,
+		`INSERT OR IGNORE INTO settings (key, value) VALUES ('vision_captions', 'false');`,
+		`INSERT OR IGNORE INTO settings (key, value) VALUES ('vision_model', 'llava');`,
+		`INSERT OR IGNORE INTO settings (key, value) VALUES ('watermark_text', '');`,
+		`INSERT OR IGNORE INTO settings (key, value) VALUES ('watermark_logo', '');`,
+		`INSERT OR IGNORE INTO settings (key, value) VALUES ('watermark_position', 'bottom-right');`,
+		`INSERT OR IGNORE INTO settings (key, value) VALUES ('watermark_opacity', '60');`,
+		`INSERT OR IGNORE INTO settings (key, value) VALUES ('watermark_scale', '20');`,
+		`INSERT OR IGNORE INTO settings (key, value) VALUES ('watermark_default', 'false');`,
+	)},
+	{2, "add generation columns", adoptGenerationColumns},
+	{3, "add full-text search", execAll(
+		// Prompts and caption text, keyed by generation ID. Captions are
+		// indexed as their JSON array; the tokenizer skips the punctuation.
+		`CREATE VIRTUAL TABLE generations_fts USING fts5(prompt, captions);`,
+		`INSERT INTO generations_fts (rowid, prompt, captions)
+		 SELECT id, prompt, top_text || ' ' || bottom_text || ' ' || captions FROM generations;`,
+		`CREATE TRIGGER generations_fts_insert AFTER INSERT ON generations BEGIN
+			INSERT INTO generations_fts (rowid, prompt, captions)
+			VALUES (new.id, new.prompt, new.top_text || ' ' || new.bottom_text || ' ' || new.captions);
+		END;`,
+		`CREATE TRIGGER generations_fts_update AFTER UPDATE OF prompt, top_text, bottom_text, captions ON generations BEGIN
+			DELETE FROM generations_fts WHERE rowid = old.id;
+			INSERT INTO generations_fts (rowid, prompt, captions)
+			VALUES (new.id, new.prompt, new.top_text || ' ' || new.bottom_text || ' ' || new.captions);
+		END;`,
+		`CREATE TRIGGER generations_fts_delete AFTER DELETE ON generations BEGIN
+			DELETE FROM generations_fts WHERE rowid = old.id;
+		END;`,
+		`CREATE INDEX idx_generations_status ON generations(status);`,
+		`CREATE INDEX idx_generations_created_at ON generations(created_at);`,
+	)},
+	{4, "add embeddings", execAll(
+		`CREATE TABLE generation_embeddings (
+			generation_id INTEGER PRIMARY KEY REFERENCES generations(id),
+			model TEXT NOT NULL,
+			text_hash TEXT NOT NULL,
+			vector BLOB NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`INSERT OR IGNORE INTO settings (key, value) VALUES ('semantic_search', 'false');`,
+		`INSERT OR IGNORE INTO settings (key, value) VALUES ('embedding_model', 'nomic-embed-text');`,
+	)},
+	{5, "add tags and collections", execAll(
+		`CREATE TABLE tags (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE
+		);`,
+		`CREATE TABLE generation_tags (
+			generation_id INTEGER NOT NULL REFERENCES generations(id),
+			tag_id INTEGER NOT NULL REFERENCES tags(id),
+			suggested INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (generation_id, tag_id)
+		);`,
+		`CREATE INDEX idx_generation_tags_tag_id ON generation_tags(tag_id);`,
+		`CREATE TABLE collections (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE collection_items (
+			collection_id INTEGER NOT NULL REFERENCES collections(id),
+			generation_id INTEGER NOT NULL REFERENCES generations(id),
+			added_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (collection_id, generation_id)
+		);`,
+		`CREATE INDEX idx_collection_items_generation_id ON collection_items(generation_id);`,
+		`INSERT OR IGNORE INTO settings (key, value) VALUES ('suggest_tags', 'true');`,
+	)},
+	{6, "add favorites and ratings", execAll(
+		`ALTER TABLE generations ADD COLUMN favorite INTEGER DEFAULT 0;`,
+		// Aggregates of generation_ratings, kept in sync by triggers
+		`ALTER TABLE generations ADD COLUMN rating_count INTEGER DEFAULT 0;`,
+		`ALTER TABLE generations ADD COLUMN rating_total INTEGER DEFAULT 0;`,
+		// What made the meme, so ratings can be compared across system
+		// prompts and models. Empty for generations made before this.
+		`ALTER TABLE generations ADD COLUMN system_prompt TEXT DEFAULT '';`,
+		`ALTER TABLE generations ADD COLUMN image_model TEXT DEFAULT '';`,
+		`ALTER TABLE generations ADD COLUMN text_model TEXT DEFAULT '';`,
+		`CREATE TABLE generation_ratings (
+			generation_id INTEGER NOT NULL REFERENCES generations(id),
+			rater TEXT NOT NULL,
+			stars INTEGER NOT NULL CHECK (stars BETWEEN 1 AND 5),
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (generation_id, rater)
+		);`,
+		`CREATE TRIGGER generation_ratings_insert AFTER INSERT ON generation_ratings BEGIN
+			UPDATE generations SET rating_count = rating_count + 1, rating_total = rating_total + new.stars
+			WHERE id = new.generation_id;
+		END;`,
+		`CREATE TRIGGER generation_ratings_update AFTER UPDATE OF stars ON generation_ratings BEGIN
+			UPDATE generations SET rating_total = rating_total - old.stars + new.stars
+			WHERE id = new.generation_id;
+		END;`,
+		`CREATE TRIGGER generation_ratings_delete AFTER DELETE ON generation_ratings BEGIN
+			UPDATE generations SET rating_count = rating_count - 1, rating_total = rating_total - old.stars
+			WHERE id = old.generation_id;
+		END;`,
+		`CREATE INDEX idx_generations_favorite ON generations(favorite) WHERE favorite != 0;`,
+	)},
+	{7, "add trash", execAll(
+		// Set when a generation is moved to the trash; NULL otherwise
+		`ALTER TABLE generations ADD COLUMN deleted_at DATETIME DEFAULT NULL;`,
+		`CREATE INDEX idx_generations_deleted_at ON generations(deleted_at) WHERE deleted_at IS NOT NULL;`,
+	)},
+	{8, "add retention", execAll(
+		// 0 turns a rule off
+		`INSERT OR IGNORE INTO settings (key, value) VALUES ('retention_failed_days', '0');`,
+		`INSERT OR IGNORE INTO settings (key, value) VALUES ('retention_max_disk_mb', '0');`,
+		`CREATE TABLE janitor_runs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			started_at DATETIME NOT NULL,
+			finished_at DATETIME NOT NULL,
+			freed_bytes INTEGER NOT NULL DEFAULT 0,
+			disk_bytes INTEGER NOT NULL DEFAULT 0,
+			error_message TEXT NOT NULL DEFAULT ''
+		);`,
+		// Prompts are copied, as the generations are gone
+		`CREATE TABLE janitor_removals (
+			run_id INTEGER NOT NULL REFERENCES janitor_runs(id),
+			generation_id INTEGER NOT NULL,
+			prompt TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			bytes INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE INDEX idx_janitor_removals_run_id ON janitor_removals(run_id);`,
+	)},
+	{9, "add image width", execAll(
+		// 0 until the image is finalized again
+		`ALTER TABLE generations ADD COLUMN image_width INTEGER NOT NULL DEFAULT 0;`,
+	)},
+	{10, "add smart placement", execAll(
+		`ALTER TABLE generations ADD COLUMN smart_placement BOOLEAN NOT NULL DEFAULT 0;`,
+		// The best guess for existing memes is the current setting
+		`UPDATE generations SET smart_placement = (SELECT value = 'true' FROM settings WHERE key = 'smart_placement')
+		WHERE EXISTS (SELECT 1 FROM settings WHERE key = 'smart_placement');`,
+	)},
+	{11, "add seed", execAll(
+		// 0 for images drawn before seeds were recorded
+		`ALTER TABLE generations ADD COLUMN seed INTEGER NOT NULL DEFAULT 0;`,
+	)},
+}
+
+// adoptGenerationColumns adds the generation columns that used to be
+// added on every startup with errors ignored. Databases from before
+// versioned migrations may already have some of them, so each column is
+// only added if missing.
+func adoptGenerationColumns(tx *sql.Tx) error {
+	columns := []struct{ name, definition string }{
+		{"top_text", "TEXT DEFAULT ''"},
+		{"bottom_text", "TEXT DEFAULT ''"},
+		{"base_path", "TEXT DEFAULT ''"},
+		{"template_id", "TEXT DEFAULT ''"},
+		{"captions", "TEXT DEFAULT ''"},
+		{"source", "TEXT DEFAULT 'model'"},
+		{"description", "TEXT DEFAULT ''"},
+		{"alt_text", "TEXT DEFAULT ''"},
+		{"image_hash", "TEXT DEFAULT ''"},
+		{"effects", "TEXT DEFAULT ''"},
+		{"watermark", "INTEGER DEFAULT 0"},
+		{"share_token", "TEXT DEFAULT ''"},
+		{"layers", "TEXT DEFAULT ''"},
+		{"parent_id", "INTEGER DEFAULT 0"},
+		{"comic", "TEXT DEFAULT ''"},
+	}
+	for _, c := range columns {
+		if err := addColumn(tx, "generations", c.name, c.definition); err != nil {
+			return err
+		}
+	}
+
+	return execAll(
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_generations_share_token ON generations(share_token) WHERE share_token != '';`,
+		`CREATE INDEX IF NOT EXISTS idx_generations_parent_id ON generations(parent_id) WHERE parent_id != 0;`,
+		// Backfill sources for rows created before the column existed
+		`UPDATE generations SET source = 'template' WHERE source = 'model' AND template_id != '';`,
+		`UPDATE generations SET source = 'upload' WHERE source = 'model' AND base_path LIKE '%.gif';`,
+	)(tx)
+}
+
+// execAll returns a migration step that runs SQL statements in order
+func execAll(queries ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, query := range queries {
+			if _, err := tx.Exec(query); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumn adds a column to a table unless it already exists
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// migrate brings the schema up to date. It refuses to run against a
+// database migrated by a newer build, or one whose recorded migrations do
+// not match this build's in version or name, rather than guess at the
+// schema.
+func (db *DB) migrate() error {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return fmt.Errorf("migration %q has version %d, expected %d", m.name, m.version, i+1)
+		}
+	}
+
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return err
+	}
+	latest := len(migrations)
+	for i, m := range applied {
+		if m.version > latest {
+			return fmt.Errorf("database schema version %d is newer than this build supports (%d)", m.version, latest)
+		}
+		if m.version != i+1 {
+			return fmt.Errorf("database has migration %d recorded without migration %d", m.version, i+1)
+		}
+		if want := migrations[i].name; m.name != want {
+			return fmt.Errorf("database has migration %d recorded as %q, but this build's is %q", m.version, m.name, want)
+		}
+	}
+
+	for _, m := range migrations[len(applied):] {
+		if err := db.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		log.Printf("Applied database migration %d: %s", m.version, m.name)
+	}
+	return nil
+}
+
+// appliedMigrations returns the recorded migrations in version order,
+// with only their versions and names set
+func (db *DB) appliedMigrations() ([]migration, error) {
+	rows, err := db.Query(`SELECT version, name FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	var applied []migration
+	for rows.Next() {
+		var m migration
+		if err := rows.Scan(&m.version, &m.name); err != nil {
+			return nil, err
+		}
+		applied = append(applied, m)
+	}
+	return applied, rows.Err()
+}
+
+// applyMigration runs a migration and records it in one transaction, so a
+// failed migration leaves the schema as it was
+func (db *DB) applyMigration(m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.version, m.name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,201 @@
+package db
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openRaw opens a database file without migrating it
+func openRaw(t *testing.T, path string) *sql.DB {
+	t.Helper()
+	raw, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { raw.Close() })
+	return raw
+}
+
+// execRaw runs setup statements against a database file
+func execRaw(t *testing.T, raw *sql.DB, queries ...string) {
+	t.Helper()
+	for _, query := range queries {
+		if _, err := raw.Exec(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+}
+
+// checkVersions fails unless every migration is recorded, once, in order,
+// under its name
+func checkVersions(t *testing.T, database *DB) {
+	t.Helper()
+	applied, err := database.appliedMigrations()
+	if err != nil {
+		t.Fatalf("appliedMigrations: %v", err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("applied %d migrations, want %d", len(applied), len(migrations))
+	}
+	for i, m := range applied {
+		if m.version != i+1 || m.name != migrations[i].name {
+			t.Fatalf("migration %d (%s) recorded as version %d (%s)", i+1, migrations[i].name, m.version, m.name)
+		}
+	}
+}
+
+func TestMigrateEmptyDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memes.db")
+	database, err := New(path)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	checkVersions(t, database)
+
+	id, err := database.InsertGeneration("a cat", SourceModel, "cat.png", StatusSuccess, "")
+	if err != nil {
+		t.Fatalf("InsertGeneration: %v", err)
+	}
+	if _, err := database.GetGeneration(id); err != nil {
+		t.Fatalf("GetGeneration: %v", err)
+	}
+	if value, err := database.GetSetting("output_format"); err != nil || value != "png" {
+		t.Fatalf("output_format setting = %q, %v; want png", value, err)
+	}
+	database.Close()
+
+	// Opening it again applies nothing
+	database, err = New(path)
+	if err != nil {
+		t.Fatalf("New again: %v", err)
+	}
+	defer database.Close()
+	checkVersions(t, database)
+}
+
+func TestMigrateAdoptsPreVersionedDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memes.db")
+	raw := openRaw(t, path)
+	// The schema as left by builds that added columns on every startup:
+	// some of the generation columns, and no schema_migrations
+	execRaw(t, raw,
+		`CREATE TABLE generations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			prompt TEXT NOT NULL,
+			image_path TEXT NOT NULL,
+			top_text TEXT DEFAULT '',
+			bottom_text TEXT DEFAULT '',
+			status TEXT NOT NULL,
+			error_message TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			base_path TEXT DEFAULT '',
+			template_id TEXT DEFAULT '',
+			captions TEXT DEFAULT ''
+		);`,
+		`CREATE TABLE settings (key TEXT PRIMARY KEY, value TEXT NOT NULL);`,
+		`INSERT INTO settings (key, value) VALUES ('system_prompt', 'Draw memes'), ('smart_placement', 'true');`,
+		`INSERT INTO generations (prompt, image_path, top_text, bottom_text, status, base_path, template_id)
+		 VALUES ('drake', 'drake-meme.png', 'tests', 'prod', 'success', 'drake.png', 'drake');`,
+		`INSERT INTO generations (prompt, image_path, status, base_path)
+		 VALUES ('dancing', 'dance.gif', 'success', 'dance.gif');`,
+	)
+	raw.Close()
+
+	database, err := New(path)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer database.Close()
+	checkVersions(t, database)
+
+	tests := []struct {
+		id     int64
+		source string
+	}{
+		{1, SourceTemplate},
+		{2, SourceUpload},
+	}
+	for _, tt := range tests {
+		gen, err := database.GetGeneration(tt.id)
+		if err != nil {
+			t.Fatalf("GetGeneration(%d): %v", tt.id, err)
+		}
+		if gen.Source != tt.source {
+			t.Errorf("generation %d source = %q, want %q", tt.id, gen.Source, tt.source)
+		}
+		if !gen.SmartPlacement {
+			t.Errorf("generation %d smart placement not taken from the setting", tt.id)
+		}
+	}
+
+	// Existing rows are indexed for search, and settings are kept
+	var matches int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM generations_fts WHERE generations_fts MATCH 'prod'`).Scan(&matches); err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	if matches != 1 {
+		t.Errorf("search for adopted caption found %d rows, want 1", matches)
+	}
+	if value, _ := database.GetSetting("system_prompt"); value != "Draw memes" {
+		t.Errorf("system_prompt = %q, want the existing value", value)
+	}
+}
+
+func TestMigrateRefusesUnknownSchema(t *testing.T) {
+	var newer []int
+	for version := 1; version <= len(migrations)+1; version++ {
+		newer = append(newer, version)
+	}
+
+	tests := []struct {
+		name     string
+		versions []int
+		renamed  int
+		want     string
+	}{
+		{"newer", newer, 0, "newer than this build"},
+		{"gapped", []int{1, 3}, 0, "recorded without migration 2"},
+		{"renamed", []int{1, 2}, 2, `recorded as "renamed"`},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "memes.db")
+		raw := openRaw(t, path)
+		execRaw(t, raw, `CREATE TABLE schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);`)
+		for _, version := range tt.versions {
+			name := "renamed"
+			if version <= len(migrations) && version != tt.renamed {
+				name = migrations[version-1].name
+			}
+			if _, err := raw.Exec(`INSERT OR IGNORE INTO schema_migrations (version, name) VALUES (?, ?)`, version, name); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		raw.Close()
+
+		database, err := New(path)
+		if err == nil {
+			database.Close()
+			t.Fatalf("%s: New succeeded, want an error", tt.name)
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %q, want it to mention %q", tt.name, err, tt.want)
+		}
+
+		// Nothing was applied
+		raw = openRaw(t, path)
+		var tables int
+		if err := raw.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'generations'`).Scan(&tables); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tables != 0 {
+			t.Errorf("%s: migrations ran against a refused database", tt.name)
+		}
+	}
+}
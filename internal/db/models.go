@@ -1,18 +1,254 @@
 package db
 
-import "time"
+import (
+	"fmt"
+	"meme-generator/internal/spec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
 
 type Generation struct {
-	ID           int64     `json:"id"`
-	Prompt       string    `json:"prompt"`
-	ImagePath    string    `json:"image_path"`
-	TopText      string    `json:"top_text"`
-	BottomText   string    `json:"bottom_text"`
-	Status       string    `json:"status"`
-	ErrorMessage *string   `json:"error_message,omitempty"`
+	ID             int64             `json:"id"`
+	Prompt         string            `json:"prompt"`
+	Source         string            `json:"source"`
+	ImagePath      string            `json:"image_path"`
+	ImageHash      string            `json:"image_hash,omitempty"`  // content hash of ImagePath
+	ImageWidth     int               `json:"image_width,omitempty"` // of ImagePath in pixels; 0 if not recorded
+	BasePath       string            `json:"base_path,omitempty"`
+	TemplateID     string            `json:"template_id,omitempty"`
+	Captions       []string          `json:"captions,omitempty"`    // one per template text box
+	Effects        []spec.Effect     `json:"effects,omitempty"`     // applied when rendering from BasePath
+	Layers         []spec.Layer      `json:"layers,omitempty"`      // annotations drawn over the captions, bottom to top
+	ParentID       int64             `json:"parent_id,omitempty"`   // comic strip this is a panel of
+	Comic          *spec.ComicScript `json:"comic,omitempty"`       // script, for comic strips
+	Tags           []string          `json:"tags,omitempty"`        // tag names, sorted
+	Description    string            `json:"description,omitempty"` // from the vision model
+	AltText        string            `json:"alt_text,omitempty"`
+	TopText        string            `json:"top_text"`
+	BottomText     string            `json:"bottom_text"`
+	Watermark      bool              `json:"watermark"`
+	SmartPlacement bool              `json:"smart_placement"` // captions were placed with smart placement
+	Favorite       bool              `json:"favorite"`
+	RatingCount    int               `json:"rating_count"`            // number of ratings
+	RatingTotal    int               `json:"rating_total"`            // sum of their stars
+	SystemPrompt   string            `json:"system_prompt,omitempty"` // prepended to the prompt for the image model
+	ImageModel     string            `json:"image_model,omitempty"`   // empty for templates and uploads
+	TextModel      string            `json:"text_model,omitempty"`    // empty if the captions were not generated
+	Seed           int64             `json:"seed,omitempty"`          // the image model was seeded with; 0 if not recorded
+	ShareToken     string            `json:"-"`                       // token of the public share link, if shared
+	Status         string            `json:"status"`
+	ErrorMessage   *string           `json:"error_message,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	DeletedAt      *time.Time        `json:"deleted_at,omitempty"` // when it was moved to the trash
+}
+
+// MaxStars is the highest rating; ratings are 1 to MaxStars stars
+const MaxStars = 5
+
+// AverageRating returns the mean stars of the generation's ratings, or 0
+// if it has none
+func (g Generation) AverageRating() float64 {
+	if g.RatingCount == 0 {
+		return 0
+	}
+	return float64(g.RatingTotal) / float64(g.RatingCount)
+}
+
+// Effect returns the generation's effect with the given name, or nil
+func (g Generation) Effect(name string) *spec.Effect {
+	for i := range g.Effects {
+		if g.Effects[i].Name == name {
+			return &g.Effects[i]
+		}
+	}
+	return nil
+}
+
+// IsAnimated reports whether the generation's image is an animated GIF
+func (g Generation) IsAnimated() bool {
+	return strings.EqualFold(filepath.Ext(g.ImagePath), ".gif")
+}
+
+// MaxAltTextLength is the longest alt text accepted, matching the limit of
+// common social platforms
+const MaxAltTextLength = 1000
+
+// Alt returns the alt text for the generation's image: the stored alt text
+// if set, otherwise DefaultAltText
+func (g Generation) Alt(templateName string) string {
+	if g.AltText != "" {
+		return g.AltText
+	}
+	return g.DefaultAltText(templateName)
+}
+
+// DefaultAltText describes the finished meme from the vision model's
+// description (or the prompt if there is none) and the rendered caption
+// text. templateName is the display name of the generation's template; the
+// template ID stands in for it when empty, as when the template is no
+// longer installed.
+func (g Generation) DefaultAltText(templateName string) string {
+	var b strings.Builder
+
+	switch {
+	case g.Description != "":
+		b.WriteString(strings.TrimSpace(g.Description))
+	case g.Source == SourceTemplate && g.TemplateID != "":
+		if templateName == "" {
+			templateName = g.TemplateID
+		}
+		fmt.Fprintf(&b, "Meme made from the %s template", templateName)
+	case g.Source == SourceComic && g.Comic != nil:
+		fmt.Fprintf(&b, "%d panel comic strip about %s", len(g.Comic.Panels), strings.TrimSpace(g.Prompt))
+	default:
+		fmt.Fprintf(&b, "Image of %s", strings.TrimSpace(g.Prompt))
+	}
+	if text := strings.TrimRight(b.String(), " "); !strings.HasSuffix(text, ".") {
+		b.WriteString(".")
+	}
+
+	var captions []string
+	for _, text := range append([]string{g.TopText, g.BottomText}, g.Captions...) {
+		if text = strings.TrimSpace(text); text != "" {
+			captions = append(captions, `"`+text+`"`)
+		}
+	}
+	if len(captions) > 0 {
+		fmt.Fprintf(&b, " Caption: %s", strings.Join(captions, " / "))
+	}
+	if g.Comic != nil {
+		for i, panel := range g.Comic.Panels {
+			fmt.Fprintf(&b, " Panel %d: %s.", i+1, strings.TrimRight(strings.TrimSpace(panel.Scene), "."))
+			for _, line := range panel.Dialogue {
+				if line.Speaker != "" {
+					fmt.Fprintf(&b, " %s: %q", line.Speaker, line.Text)
+				} else {
+					fmt.Fprintf(&b, " %q", line.Text)
+				}
+			}
+		}
+	}
+
+	alt := []rune(b.String())
+	if len(alt) > MaxAltTextLength {
+		alt = alt[:MaxAltTextLength]
+	}
+	return string(alt)
+}
+
+// Variant is an exported copy of a generation's image in a specific format
+type Variant struct {
+	GenerationID int64     `json:"generation_id"`
+	Format       string    `json:"format"`
+	Quality      int       `json:"quality"`
+	Filename     string    `json:"filename"`
+	SizeBytes    int64     `json:"size_bytes"`
 	CreatedAt    time.Time `json:"created_at"`
 }
 
+const (
+	// MaxTagLength limits the length of a tag name
+	MaxTagLength = 32
+	// MaxTagsPerGeneration limits the tags on one generation
+	MaxTagsPerGeneration = 10
+	// MaxCollectionNameLength limits the length of a collection name
+	MaxCollectionNameLength = 60
+)
+
+// Tag is a label on a generation
+type Tag struct {
+	Name      string `json:"name"`
+	Suggested bool   `json:"suggested"` // added by the text model rather than the user
+}
+
+// NormalizeTag turns user or model input into a tag name: lowercase
+// letters, digits and single hyphens, with a leading # dropped
+func NormalizeTag(input string) (string, error) {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(strings.TrimPrefix(strings.TrimSpace(input), "#")) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+			hyphen = false
+		case !hyphen && b.Len() > 0:
+			b.WriteRune('-')
+			hyphen = true
+		}
+	}
+	name := strings.TrimSuffix(b.String(), "-")
+	if name == "" {
+		return "", fmt.Errorf("tags need at least one letter or digit")
+	}
+	if utf8.RuneCountInString(name) > MaxTagLength {
+		return "", fmt.Errorf("tags must be at most %d characters", MaxTagLength)
+	}
+	return name, nil
+}
+
+// Collection is a named board of generations
+type Collection struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Count     int       `json:"count"` // generations in the collection
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Embedding is the vector a generation's text was embedded as, for
+// semantic search
+type Embedding struct {
+	GenerationID int64
+	Model        string
+	TextHash     string // hash of the embedded text, to tell when it changed
+	Vector       []float32
+}
+
+// EmbeddingText is what a generation is embedded from: the prompt, the
+// caption text and the vision model's description
+func (g Generation) EmbeddingText() string {
+	parts := []string{g.Prompt}
+	for _, text := range append([]string{g.TopText, g.BottomText}, g.Captions...) {
+		if text = strings.TrimSpace(text); text != "" {
+			parts = append(parts, text)
+		}
+	}
+	if g.Comic != nil {
+		for _, panel := range g.Comic.Panels {
+			for _, line := range panel.Dialogue {
+				parts = append(parts, line.Text)
+			}
+		}
+	}
+	if g.Description != "" {
+		parts = append(parts, g.Description)
+	}
+	return strings.Join(parts, "\n")
+}
+
+// PresetFormatPrefix marks variants exported for a preset, whose format is
+// stored as "preset:<name>"
+const PresetFormatPrefix = "preset:"
+
+// Preset returns the name of the preset a variant was exported for, or ""
+// for plain format exports
+func (v Variant) Preset() string {
+	if name, ok := strings.CutPrefix(v.Format, PresetFormatPrefix); ok {
+		return name
+	}
+	return ""
+}
+
+// Sources of a generation's base image
+const (
+	SourceModel    = "model"    // generated by the image model
+	SourceTemplate = "template" // copied from the template library
+	SourceUpload   = "upload"   // uploaded by the user
+	SourceComic    = "comic"    // comic strip composed from panel generations
+)
+
 const (
 	StatusProcessing = "processing"
 	StatusSuccess    = "success"
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// ratingPriorStars and ratingPriorWeight pull the scores of memes with
+	// few ratings towards an average meme, so one five-star rating does not
+	// outrank many fours
+	ratingPriorStars  = 3
+	ratingPriorWeight = 2
+)
+
+// scoreExpression ranks generations for the best of view: the mean of
+// their ratings and the prior, with a favorite counting as one more
+// five-star rating
+var scoreExpression = fmt.Sprintf(
+	"(rating_total + %d * favorite + %d) * 1.0 / (rating_count + favorite + %d)",
+	MaxStars, ratingPriorStars*ratingPriorWeight, ratingPriorWeight,
+)
+
+// SetFavorite stars or unstars a generation
+func (db *DB) SetFavorite(id int64, favorite bool) error {
+	query := `
+	UPDATE generations
+	SET favorite = ?
+	WHERE id = ?
+	`
+
+	_, err := db.Exec(query, favorite, id)
+	return err
+}
+
+// RateGeneration records a rater's stars for a generation, replacing their
+// earlier rating. Triggers keep the generation's aggregates in sync.
+func (db *DB) RateGeneration(id int64, rater string, stars int) error {
+	query := `
+	INSERT INTO generation_ratings (generation_id, rater, stars)
+	VALUES (?, ?, ?)
+	ON CONFLICT (generation_id, rater) DO UPDATE SET stars = excluded.stars
+	`
+
+	_, err := db.Exec(query, id, rater, stars)
+	return err
+}
+
+// ClearRating removes a rater's rating of a generation
+func (db *DB) ClearRating(id int64, rater string) error {
+	_, err := db.Exec(`DELETE FROM generation_ratings WHERE generation_id = ? AND rater = ?`, id, rater)
+	return err
+}
+
+// GetRating returns a rater's stars for a generation, or 0 if they have
+// not rated it
+func (db *DB) GetRating(id int64, rater string) (int, error) {
+	var stars int
+	err := db.QueryRow(`
+	SELECT COALESCE(MAX(stars), 0) FROM generation_ratings WHERE generation_id = ? AND rater = ?
+	`, id, rater).Scan(&stars)
+	return stars, err
+}
+
+// ListBestOf returns up to limit rated or favorite top-level generations
+// made since the given time (or ever, if zero), best first. Generations
+// with equal scores are ordered newest first.
+func (db *DB) ListBestOf(since time.Time, limit int) ([]Generation, error) {
+	query := `
+	SELECT ` + generationColumns + `
+	FROM generations
+	WHERE parent_id = 0 AND status = ? AND deleted_at IS NULL AND (rating_count > 0 OR favorite != 0) AND created_at >= ?
+	ORDER BY ` + scoreExpression + ` DESC, id DESC
+	LIMIT ?
+	`
+
+	// created_at is stored by CURRENT_TIMESTAMP as UTC text
+	return db.queryGenerations(query, StatusSuccess, since.UTC().Format(timestampLayout), limit)
+}
+
+// RatingGroup summarizes the ratings of memes made with the same system
+// prompt and models
+type RatingGroup struct {
+	SystemPrompt string
+	ImageModel   string
+	TextModel    string
+	Generations  int // successful top-level generations
+	Rated        int // how many of them have ratings
+	Ratings      int
+	Stars        int // total stars
+	Favorites    int
+}
+
+// AverageRating returns the mean stars of the group's ratings, or 0 if it
+// has none
+func (g RatingGroup) AverageRating() float64 {
+	if g.Ratings == 0 {
+		return 0
+	}
+	return float64(g.Stars) / float64(g.Ratings)
+}
+
+// ListRatingGroups summarizes ratings by system prompt and models, so
+// prompts and models can be compared by how well their memes are liked.
+// Groups with the best average rating come first.
+func (db *DB) ListRatingGroups() ([]RatingGroup, error) {
+	query := `
+	SELECT system_prompt, image_model, text_model, COUNT(*),
+		SUM(rating_count > 0), SUM(rating_count), SUM(rating_total), SUM(favorite != 0)
+	FROM generations
+	WHERE parent_id = 0 AND status = ? AND deleted_at IS NULL
+	GROUP BY system_prompt, image_model, text_model
+	ORDER BY SUM(rating_total) * 1.0 / MAX(SUM(rating_count), 1) DESC, COUNT(*) DESC
+	`
+
+	rows, err := db.Query(query, StatusSuccess)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []RatingGroup
+	for rows.Next() {
+		var g RatingGroup
+		if err := rows.Scan(&g.SystemPrompt, &g.ImageModel, &g.TextModel, &g.Generations,
+			&g.Rated, &g.Ratings, &g.Stars, &g.Favorites); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
@@ -0,0 +1,58 @@
+package db
+
+import "time"
+
+// ListReferencedFiles returns every image, base and variant filename a
+// generation refers to, in or out of the trash, relative to the image
+// directory
+func (db *DB) ListReferencedFiles() (map[string]bool, error) {
+	rows, err := db.Query(`
+	SELECT image_path FROM generations WHERE image_path != ''
+	UNION SELECT base_path FROM generations WHERE base_path != ''
+	UNION SELECT filename FROM generation_variants
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make(map[string]bool)
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			return nil, err
+		}
+		files[filename] = true
+	}
+	return files, rows.Err()
+}
+
+// ListImageGenerations returns every generation outside the trash that has
+// an image, oldest first
+func (db *DB) ListImageGenerations() ([]Generation, error) {
+	query := `
+	SELECT ` + generationColumns + `
+	FROM generations
+	WHERE image_path != '' AND deleted_at IS NULL
+	ORDER BY id
+	`
+
+	return db.queryGenerations(query)
+}
+
+// InsertImportedGeneration records an image found on disk as a finished
+// generation made at createdAt. The image is also its base, so it can be
+// captioned later.
+func (db *DB) InsertImportedGeneration(prompt, source, imagePath, imageHash string, createdAt time.Time) (int64, error) {
+	query := `
+	INSERT INTO generations (prompt, source, image_path, base_path, image_hash, top_text, bottom_text, status, error_message, created_at)
+	VALUES (?, ?, ?, ?, ?, '', '', ?, '', ?)
+	`
+
+	// created_at is stored as UTC text, like CURRENT_TIMESTAMP
+	result, err := db.Exec(query, prompt, source, imagePath, imagePath, imageHash, StatusSuccess, createdAt.UTC().Format(timestampLayout))
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
@@ -0,0 +1,160 @@
+package db
+
+import "time"
+
+// Reasons the janitor removed a generation
+const (
+	RemovalFailed = "failed" // failed longer ago than the retention period
+	RemovalQuota  = "quota"  // evicted to bring disk usage under the cap
+)
+
+// janitorRunsKept is how many janitor runs are kept for the report
+const janitorRunsKept = 100
+
+// JanitorRun is one run of the retention janitor that removed something or
+// failed
+type JanitorRun struct {
+	ID         int64
+	StartedAt  time.Time
+	FinishedAt time.Time
+	FreedBytes int64
+	DiskBytes  int64 // disk usage of the image directory after the run
+	Error      string
+	Removals   []JanitorRemoval
+}
+
+// JanitorRemoval is a generation the janitor deleted forever
+type JanitorRemoval struct {
+	GenerationID int64
+	Prompt       string
+	Reason       string
+	Bytes        int64
+}
+
+// ListExpiredFailed returns the failed top-level generations made before
+// the given time, in or out of the trash. Favorites are kept forever.
+func (db *DB) ListExpiredFailed(before time.Time) ([]Generation, error) {
+	query := `
+	SELECT ` + generationColumns + `
+	FROM generations
+	WHERE parent_id = 0 AND status = ? AND favorite = 0 AND created_at < ?
+	ORDER BY id
+	`
+
+	// created_at is stored by CURRENT_TIMESTAMP as UTC text
+	return db.queryGenerations(query, StatusFailed, before.UTC().Format(timestampLayout))
+}
+
+// ListEvictionCandidates returns the top-level generations that may be
+// removed to free disk space, in the order they should go: the trash
+// first, then the oldest. Favorites and generations still processing are
+// never returned.
+func (db *DB) ListEvictionCandidates() ([]Generation, error) {
+	query := `
+	SELECT ` + generationColumns + `
+	FROM generations
+	WHERE parent_id = 0 AND status != ? AND favorite = 0
+	ORDER BY deleted_at IS NULL, created_at, id
+	`
+
+	return db.queryGenerations(query, StatusProcessing)
+}
+
+// InsertJanitorRun records a janitor run with its removals, and forgets
+// the oldest runs beyond the ones kept for the report
+func (db *DB) InsertJanitorRun(run JanitorRun) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+	INSERT INTO janitor_runs (started_at, finished_at, freed_bytes, disk_bytes, error_message)
+	VALUES (?, ?, ?, ?, ?)
+	`, run.StartedAt.UTC().Format(timestampLayout), run.FinishedAt.UTC().Format(timestampLayout), run.FreedBytes, run.DiskBytes, run.Error)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, removal := range run.Removals {
+		if _, err := tx.Exec(`
+		INSERT INTO janitor_removals (run_id, generation_id, prompt, reason, bytes)
+		VALUES (?, ?, ?, ?, ?)
+		`, id, removal.GenerationID, removal.Prompt, removal.Reason, removal.Bytes); err != nil {
+			return 0, err
+		}
+	}
+
+	cutoff := `SELECT id FROM janitor_runs ORDER BY id DESC LIMIT -1 OFFSET ?`
+	if _, err := tx.Exec(`DELETE FROM janitor_removals WHERE run_id IN (`+cutoff+`)`, janitorRunsKept); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM janitor_runs WHERE id IN (`+cutoff+`)`, janitorRunsKept); err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// ListJanitorRuns returns up to limit janitor runs with their removals,
+// newest first
+func (db *DB) ListJanitorRuns(limit int) ([]JanitorRun, error) {
+	rows, err := db.Query(`
+	SELECT id, started_at, finished_at, freed_bytes, disk_bytes, error_message
+	FROM janitor_runs
+	ORDER BY id DESC
+	LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []JanitorRun
+	index := map[int64]int{}
+	for rows.Next() {
+		var run JanitorRun
+		if err := rows.Scan(&run.ID, &run.StartedAt, &run.FinishedAt, &run.FreedBytes, &run.DiskBytes, &run.Error); err != nil {
+			return nil, err
+		}
+		index[run.ID] = len(runs)
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]int64, 0, len(runs))
+	for _, run := range runs {
+		ids = append(ids, run.ID)
+	}
+	removalRows, err := db.Query(`
+	SELECT run_id, generation_id, prompt, reason, bytes
+	FROM janitor_removals
+	WHERE run_id IN (`+placeholders(len(ids))+`)
+	ORDER BY rowid
+	`, idArgs(ids)...)
+	if err != nil {
+		return nil, err
+	}
+	defer removalRows.Close()
+
+	for removalRows.Next() {
+		var runID int64
+		var removal JanitorRemoval
+		if err := removalRows.Scan(&runID, &removal.GenerationID, &removal.Prompt, &removal.Reason, &removal.Bytes); err != nil {
+			return nil, err
+		}
+		i := index[runID]
+		runs[i].Removals = append(runs[i].Removals, removal)
+	}
+	return runs, removalRows.Err()
+}
@@ -0,0 +1,108 @@
+package db
+
+import "fmt"
+
+// ListGenerationTags returns a generation's tags, sorted by name
+func (db *DB) ListGenerationTags(generationID int64) ([]Tag, error) {
+	query := `
+	SELECT t.name, gt.suggested
+	FROM generation_tags gt
+	JOIN tags t ON t.id = gt.tag_id
+	WHERE gt.generation_id = ?
+	ORDER BY t.name
+	`
+
+	rows, err := db.Query(query, generationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []Tag
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.Name, &tag.Suggested); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// AddGenerationTags tags a generation with normalized tag names, creating
+// tags as needed. Adding a suggested tag manually keeps it, but a manual
+// tag is never downgraded to a suggestion. Tags past MaxTagsPerGeneration
+// are rejected.
+func (db *DB) AddGenerationTags(generationID int64, names []string, suggested bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, name := range names {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO tags (name) VALUES (?)`, name); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+		INSERT INTO generation_tags (generation_id, tag_id, suggested)
+		SELECT ?, id, ? FROM tags WHERE name = ?
+		ON CONFLICT (generation_id, tag_id) DO UPDATE SET suggested = suggested AND excluded.suggested
+		`, generationID, suggested, name); err != nil {
+			return err
+		}
+	}
+
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM generation_tags WHERE generation_id = ?`, generationID).Scan(&count); err != nil {
+		return err
+	}
+	if count > MaxTagsPerGeneration {
+		return fmt.Errorf("a meme can have at most %d tags", MaxTagsPerGeneration)
+	}
+	return tx.Commit()
+}
+
+// RemoveGenerationTag removes a tag from a generation. Tags no generation
+// uses any more are deleted.
+func (db *DB) RemoveGenerationTag(generationID int64, name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+	DELETE FROM generation_tags
+	WHERE generation_id = ? AND tag_id = (SELECT id FROM tags WHERE name = ?)
+	`, generationID, name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM tags WHERE id NOT IN (SELECT tag_id FROM generation_tags)`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListTags returns every tag in use outside the trash, sorted by name
+func (db *DB) ListTags() ([]string, error) {
+	rows, err := db.Query(`
+	SELECT name FROM tags
+	WHERE id IN (SELECT tag_id FROM generation_tags WHERE generation_id IN (SELECT id FROM generations WHERE deleted_at IS NULL))
+	ORDER BY name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
@@ -0,0 +1,289 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// TrashGenerations moves top-level generations to the trash, hiding them
+// from the history, search, collections and share links. Comic panels go
+// with their strip. It returns how many were moved.
+func (db *DB) TrashGenerations(ids []int64) (int64, error) {
+	return db.updateEach(ids, `
+	UPDATE generations
+	SET deleted_at = CURRENT_TIMESTAMP
+	WHERE id IN (%s) AND parent_id = 0 AND deleted_at IS NULL
+	`)
+}
+
+// RestoreGenerations takes generations back out of the trash. It returns
+// how many were restored.
+func (db *DB) RestoreGenerations(ids []int64) (int64, error) {
+	return db.updateEach(ids, `
+	UPDATE generations
+	SET deleted_at = NULL
+	WHERE id IN (%s) AND deleted_at IS NOT NULL
+	`)
+}
+
+// updateEach runs an update whose %s takes a list of IDs over ids, in
+// batches in one transaction, and returns how many rows it changed
+func (db *DB) updateEach(ids []int64, query string) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var changed int64
+	for _, batch := range batches(ids) {
+		result, err := tx.Exec(fmt.Sprintf(query, placeholders(len(batch))), idArgs(batch)...)
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		changed += n
+	}
+	return changed, tx.Commit()
+}
+
+// ListTrash returns up to limit generations in the trash, most recently
+// deleted first
+func (db *DB) ListTrash(limit int) ([]Generation, error) {
+	query := `
+	SELECT ` + generationColumns + `
+	FROM generations
+	WHERE deleted_at IS NOT NULL AND parent_id = 0
+	ORDER BY deleted_at DESC, id DESC
+	LIMIT ?
+	`
+
+	return db.queryGenerations(query, limit)
+}
+
+// ListTrashIDs returns the IDs of every generation in the trash
+func (db *DB) ListTrashIDs() ([]int64, error) {
+	rows, err := db.Query(`SELECT id FROM generations WHERE deleted_at IS NOT NULL AND parent_id = 0`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// PurgeGenerations permanently deletes generations in the trash, with
+// their comic panels and everything recorded about them, in one
+// transaction. Generations not in the trash are left alone.
+//
+// Before committing, stage is called with the generations being deleted,
+// their variants and the files among theirs that surviving generations
+// still use, such as an imported duplicate's image, to move the others out
+// of the way. If it fails, nothing is deleted; if the commit fails after it
+// succeeded, the caller must put the files back. It returns how many
+// top-level generations were deleted.
+func (db *DB) PurgeGenerations(ids []int64, stage func(gens []Generation, variants []Variant, kept map[string]bool) error) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Step 1: Find the trashed generations and their panels
+	var gens []Generation
+	for _, batch := range batches(ids) {
+		in := placeholders(len(batch))
+		found, err := queryGenerations(tx, `
+		SELECT `+generationColumns+`
+		FROM generations
+		WHERE (id IN (`+in+`) AND parent_id = 0 AND deleted_at IS NOT NULL)
+		OR parent_id IN (SELECT id FROM generations WHERE id IN (`+in+`) AND parent_id = 0 AND deleted_at IS NOT NULL)
+		`, append(idArgs(batch), idArgs(batch)...)...)
+		if err != nil {
+			return 0, err
+		}
+		gens = append(gens, found...)
+	}
+	if len(gens) == 0 {
+		return 0, nil
+	}
+
+	purged := make([]int64, 0, len(gens))
+	topLevel := 0
+	for _, gen := range gens {
+		purged = append(purged, gen.ID)
+		if gen.ParentID == 0 {
+			topLevel++
+		}
+	}
+
+	// Step 2: Find their variants
+	var variants []Variant
+	for _, batch := range batches(purged) {
+		found, err := queryVariants(tx, `
+		SELECT generation_id, format, quality, filename, size_bytes, created_at
+		FROM generation_variants
+		WHERE generation_id IN (`+placeholders(len(batch))+`)
+		`, idArgs(batch)...)
+		if err != nil {
+			return 0, err
+		}
+		variants = append(variants, found...)
+	}
+
+	// Step 3: Delete every row about them. The full-text index is cleaned
+	// up by its trigger.
+	for _, batch := range batches(purged) {
+		in, args := placeholders(len(batch)), idArgs(batch)
+		for _, table := range []string{"generation_variants", "generation_embeddings", "generation_tags", "collection_items", "generation_ratings"} {
+			if _, err := tx.Exec(`DELETE FROM `+table+` WHERE generation_id IN (`+in+`)`, args...); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := tx.Exec(`DELETE FROM generations WHERE id IN (`+in+`)`, args...); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM tags WHERE id NOT IN (SELECT tag_id FROM generation_tags)`); err != nil {
+		return 0, err
+	}
+
+	// Step 4: Move the files no other generation uses aside, then commit
+	kept, err := filesUsedElsewhere(tx, purged, Files(gens, variants))
+	if err != nil {
+		return 0, err
+	}
+	if err := stage(gens, variants, kept); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return topLevel, nil
+}
+
+// Files lists the images, bases and variant files recorded for
+// generations, without duplicates
+func Files(gens []Generation, variants []Variant) []string {
+	var files []string
+	seen := map[string]bool{}
+	add := func(filename string) {
+		if filename != "" && !seen[filename] {
+			seen[filename] = true
+			files = append(files, filename)
+		}
+	}
+	for _, gen := range gens {
+		add(gen.ImagePath)
+		add(gen.BasePath)
+	}
+	for _, v := range variants {
+		add(v.Filename)
+	}
+	return files
+}
+
+// FilesUsedElsewhere returns which of filenames are recorded as the image,
+// base or a variant of a generation other than ids
+func (db *DB) FilesUsedElsewhere(ids []int64, filenames []string) (map[string]bool, error) {
+	return filesUsedElsewhere(db, ids, filenames)
+}
+
+// querier is what the query helpers need from a DB or a transaction
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// filesUsedElsewhere looks filenames up in batches along with the
+// generations using them, and leaves out ids in Go rather than in the query
+func filesUsedElsewhere(q querier, ids []int64, filenames []string) (map[string]bool, error) {
+	used := map[string]bool{}
+	excluded := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		excluded[id] = true
+	}
+
+	for _, batch := range batches(filenames) {
+		in := placeholders(len(batch))
+		files := make([]interface{}, len(batch))
+		for i, filename := range batch {
+			files[i] = filename
+		}
+		rows, err := q.Query(`
+		SELECT image_path, id FROM generations WHERE image_path IN (`+in+`)
+		UNION
+		SELECT base_path, id FROM generations WHERE base_path IN (`+in+`)
+		UNION
+		SELECT filename, generation_id FROM generation_variants WHERE filename IN (`+in+`)
+		`, append(append(files, files...), files...)...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var filename string
+			var id int64
+			if err := rows.Scan(&filename, &id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if !excluded[id] {
+				used[filename] = true
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return used, nil
+}
+
+// maxBatch is how many values are bound in one IN list, well under
+// SQLite's limit of 32766 parameters per statement even when a statement
+// repeats the list
+const maxBatch = 500
+
+// batches splits values into slices of at most maxBatch
+func batches[T any](values []T) [][]T {
+	var out [][]T
+	for len(values) > 0 {
+		n := min(len(values), maxBatch)
+		out = append(out, values[:n])
+		values = values[n:]
+	}
+	return out
+}
+
+// placeholders returns n comma-separated query placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// idArgs converts IDs to query arguments
+func idArgs(ids []int64) []interface{} {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return args
+}
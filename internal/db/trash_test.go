@@ -0,0 +1,124 @@
+package db
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestPurgeKeepsFilesOtherGenerationsUse(t *testing.T) {
+	database, err := New(filepath.Join(t.TempDir(), "memes.db"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer database.Close()
+
+	insert := func(prompt, image, base string) int64 {
+		t.Helper()
+		id, err := database.InsertGeneration(prompt, SourceUpload, image, StatusSuccess, "")
+		if err != nil {
+			t.Fatalf("InsertGeneration: %v", err)
+		}
+		if err := database.UpdateGenerationBase(id, base); err != nil {
+			t.Fatalf("UpdateGenerationBase: %v", err)
+		}
+		return id
+	}
+	// An import of the same file as the purged meme, and a meme captioned
+	// from the same base
+	purged := insert("original", "cat-meme.png", "cat.png")
+	duplicate := insert("imported duplicate", "cat-meme.png", "cat-meme.png")
+	insert("same base", "cat-other.png", "cat.png")
+	for _, v := range []Variant{
+		{GenerationID: purged, Format: "jpeg", Quality: 85, Filename: "cat-meme.jpg"},
+		{GenerationID: purged, Format: "webp", Quality: 85, Filename: "cat-meme.webp"},
+		{GenerationID: duplicate, Format: "jpeg", Quality: 85, Filename: "cat-meme.jpg"},
+	} {
+		if err := database.UpsertVariant(v); err != nil {
+			t.Fatalf("UpsertVariant: %v", err)
+		}
+	}
+	if _, err := database.TrashGenerations([]int64{purged}); err != nil {
+		t.Fatalf("TrashGenerations: %v", err)
+	}
+
+	var got []string
+	n, err := database.PurgeGenerations([]int64{purged}, func(gens []Generation, variants []Variant, kept map[string]bool) error {
+		for _, filename := range Files(gens, variants) {
+			if !kept[filename] {
+				got = append(got, filename)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("PurgeGenerations: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("purged %d generations, want 1", n)
+	}
+
+	sort.Strings(got)
+	if want := []string{"cat-meme.webp"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("files to delete = %v, want %v", got, want)
+	}
+}
+
+// TestPurgeManyGenerations purges more files than SQLite binds parameters
+// in one statement
+func TestPurgeManyGenerations(t *testing.T) {
+	database, err := New(filepath.Join(t.TempDir(), "memes.db"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer database.Close()
+
+	const count = 12000
+	_, err = database.Exec(`
+	WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < ?)
+	INSERT INTO generations (prompt, source, image_path, base_path, status)
+	SELECT 'meme ' || i, ?, 'meme-' || i || '.png', 'base-' || i || '.png', ? FROM n
+	`, count, SourceUpload, StatusSuccess)
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	kept, err := database.InsertGeneration("kept", SourceUpload, "meme-1.png", StatusSuccess, "")
+	if err != nil {
+		t.Fatalf("InsertGeneration: %v", err)
+	}
+
+	ids := make([]int64, 0, count)
+	for id := int64(1); id <= count; id++ {
+		ids = append(ids, id)
+	}
+	trashed, err := database.TrashGenerations(ids)
+	if err != nil {
+		t.Fatalf("TrashGenerations: %v", err)
+	}
+	if trashed != count {
+		t.Fatalf("trashed %d generations, want %d", trashed, count)
+	}
+
+	deleted := 0
+	n, err := database.PurgeGenerations(ids, func(gens []Generation, variants []Variant, used map[string]bool) error {
+		for _, filename := range Files(gens, variants) {
+			if !used[filename] {
+				deleted++
+			}
+		}
+		if !used["meme-1.png"] {
+			t.Error("meme-1.png is to be deleted, but another generation uses it")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("PurgeGenerations: %v", err)
+	}
+	if n != count || deleted != 2*count-1 {
+		t.Errorf("purged %d generations and %d files, want %d and %d", n, deleted, count, 2*count-1)
+	}
+	if _, err := database.GetGeneration(kept); err != nil {
+		t.Errorf("GetGeneration of the kept generation: %v", err)
+	}
+}
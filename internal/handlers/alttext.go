@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"meme-generator/internal/db"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// UpdateAltText saves edited alt text for a generation. Submitting an empty
+// value resets it to the generated description.
+func (h *Handler) UpdateAltText(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	altText := strings.Join(strings.Fields(r.FormValue("alt_text")), " ")
+	if utf8.RuneCountInString(altText) > db.MaxAltTextLength {
+		http.Error(w, fmt.Sprintf("Alt text must be at most %d characters", db.MaxAltTextLength), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.db.GetGeneration(id); err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Generation not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.db.UpdateGenerationAltText(id, altText); err != nil {
+		log.Printf("Error updating alt text: %v", err)
+		http.Error(w, "Failed to update alt text", http.StatusInternalServerError)
+		return
+	}
+
+	gen, err := h.db.GetGeneration(id)
+	if err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Failed to fetch generation", http.StatusInternalServerError)
+		return
+	}
+
+	h.renderGeneration(w, gen)
+}
+
+// DownloadAltText serves a generation's alt text as a .txt file named after
+// its image, to go alongside downloaded images
+func (h *Handler) DownloadAltText(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	gen, err := h.db.GetGeneration(id)
+	if err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Generation not found", http.StatusNotFound)
+		return
+	}
+
+	name := fmt.Sprintf("generation-%d", gen.ID)
+	if gen.ImagePath != "" {
+		name = strings.TrimSuffix(gen.ImagePath, filepath.Ext(gen.ImagePath))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"-alt.txt"))
+	fmt.Fprintln(w, h.alt(*gen))
+}
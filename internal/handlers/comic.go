@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"meme-generator/internal/db"
+	"meme-generator/internal/ollama"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// GenerateComic turns a premise into a comic strip: the text model writes
+// a script, each panel is generated as a child generation, and the panels
+// are composed into one strip with the dialogue in speech bubble layers
+func (h *Handler) GenerateComic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	prompt := r.FormValue("prompt")
+	if prompt == "" {
+		http.Error(w, "Premise is required", http.StatusBadRequest)
+		return
+	}
+	panels := ollama.MaxComicPanels
+	if value := r.FormValue("panels"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < ollama.MinComicPanels || n > ollama.MaxComicPanels {
+			http.Error(w, fmt.Sprintf("Panels must be between %d and %d", ollama.MinComicPanels, ollama.MaxComicPanels), http.StatusBadRequest)
+			return
+		}
+		panels = n
+	}
+
+	id, err := h.db.InsertGeneration(prompt, db.SourceComic, "", db.StatusProcessing, "")
+	if err != nil {
+		log.Printf("Error inserting generation: %v", err)
+		http.Error(w, "Failed to create generation", http.StatusInternalServerError)
+		return
+	}
+
+	fail := func(err error) {
+		h.failPanels(id, err)
+		h.failGeneration(w, id, err)
+	}
+
+	// Step 1: Write the script using gemma3:270m
+	script, err := h.ollama.GenerateComicScript(prompt, panels)
+	if err != nil {
+		log.Printf("Error generating comic script: %v", err)
+		fail(err)
+		return
+	}
+	if err := h.db.UpdateGenerationComic(id, script); err != nil {
+		log.Printf("Error updating generation comic: %v", err)
+	}
+
+	// Step 2: Generate each panel using flux2-klein with the strip's seed,
+	// as a panel generation of the strip
+	systemPrompt, err := h.db.GetSetting("system_prompt")
+	if err != nil {
+		log.Printf("Error fetching system prompt: %v", err)
+		systemPrompt = ""
+	}
+	if err := h.db.UpdateGenerationModels(id, systemPrompt, ollama.ImageModel, ollama.TextModel); err != nil {
+		log.Printf("Error updating generation models: %v", err)
+	}
+	seed := ollama.NewSeed()
+	if err := h.db.UpdateGenerationSeed(id, seed); err != nil {
+		log.Printf("Error updating generation seed: %v", err)
+	}
+
+	var panelPaths []string
+	for i := range script.Panels {
+		filename, err := h.generatePanel(id, script.PanelPrompt(i), systemPrompt, seed)
+		if err != nil {
+			log.Printf("Error generating panel %d: %v", i+1, err)
+			fail(fmt.Errorf("panel %d: %w", i+1, err))
+			return
+		}
+		panelPaths = append(panelPaths, filepath.Join(h.imageDir, filename))
+	}
+
+	// Step 3: Compose the strip and keep it as the base, so the bubbles
+	// can be edited like any other layers
+	stripFilename, err := h.ollama.NewFilename(prompt, ".png")
+	if err != nil {
+		log.Printf("Error composing comic strip: %v", err)
+		fail(err)
+		return
+	}
+	if err := h.ollama.ComposeStrip(panelPaths, filepath.Join(h.imageDir, stripFilename)); err != nil {
+		log.Printf("Error composing comic strip: %v", err)
+		os.Remove(filepath.Join(h.imageDir, stripFilename))
+		fail(err)
+		return
+	}
+	if err := h.db.UpdateGenerationBase(id, stripFilename); err != nil {
+		log.Printf("Error updating generation base: %v", err)
+	}
+	if err := h.db.UpdateGenerationStatus(id, db.StatusSuccess, stripFilename, ""); err != nil {
+		log.Printf("Error updating generation status: %v", err)
+	}
+
+	gen, err := h.db.GetGeneration(id)
+	if err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Failed to fetch generation", http.StatusInternalServerError)
+		return
+	}
+
+	// Step 4: Draw the dialogue in speech bubbles
+	if bubbles := ollama.ComicBubbles(script); len(bubbles) > 0 {
+		spec := renderSpecFor(gen)
+		spec.layers = bubbles
+		if updated, err := h.replaceImage(gen, spec); err != nil {
+			log.Printf("Warning: Failed to draw speech bubbles (will continue without them): %v", err)
+		} else {
+			gen = updated
+		}
+	}
+
+	// Step 5: Watermark if new memes are watermarked, then export the
+	// configured default format and record variant sizes
+	gen = h.watermarkNew(gen)
+	h.finalizeGeneration(gen)
+
+	// Step 6: Suggest tags using gemma3:270m, if enabled
+	h.tagNew(gen)
+
+	h.renderGeneration(w, gen)
+}
+
+// generatePanel generates the image for one comic panel with seed and
+// records it as a panel generation of the strip parentID. It returns the
+// image filename.
+func (h *Handler) generatePanel(parentID int64, prompt, systemPrompt string, seed int64) (string, error) {
+	id, err := h.db.InsertGeneration(prompt, db.SourceModel, "", db.StatusProcessing, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to create panel generation: %w", err)
+	}
+	if err := h.db.UpdateGenerationParent(id, parentID); err != nil {
+		return "", fmt.Errorf("failed to link panel generation: %w", err)
+	}
+	if err := h.db.UpdateGenerationModels(id, systemPrompt, ollama.ImageModel, ""); err != nil {
+		log.Printf("Error updating generation models: %v", err)
+	}
+	if err := h.db.UpdateGenerationSeed(id, seed); err != nil {
+		log.Printf("Error updating generation seed: %v", err)
+	}
+
+	filename, err := h.ollama.GenerateImage(prompt, systemPrompt, seed)
+	if err != nil {
+		if updateErr := h.db.UpdateGenerationStatus(id, db.StatusFailed, "", err.Error()); updateErr != nil {
+			log.Printf("Error updating generation status: %v", updateErr)
+		}
+		return "", err
+	}
+
+	if err := h.db.UpdateGenerationBase(id, filename); err != nil {
+		log.Printf("Error updating generation base: %v", err)
+	}
+	if err := h.db.UpdateGenerationStatus(id, db.StatusSuccess, filename, ""); err != nil {
+		log.Printf("Error updating generation status: %v", err)
+	}
+	return filename, nil
+}
+
+// failPanels marks the panels already drawn for a strip that failed as
+// failed too, so none of them looks like a finished comic. They keep their
+// images, which go with the strip when it is purged.
+func (h *Handler) failPanels(parentID int64, err error) {
+	panels, listErr := h.db.ListPanels(parentID)
+	if listErr != nil {
+		log.Printf("Error fetching panels: %v", listErr)
+		return
+	}
+	for _, p := range panels {
+		if p.Status == db.StatusFailed {
+			continue
+		}
+		message := fmt.Sprintf("comic strip failed: %v", err)
+		if updateErr := h.db.UpdateGenerationStatus(p.ID, db.StatusFailed, p.ImagePath, message); updateErr != nil {
+			log.Printf("Error updating panel %d status: %v", p.ID, updateErr)
+		}
+	}
+}
+
+// RedrawPanel generates one panel of a comic strip again from the same
+// prompt and the strip's seed, so it still matches the other panels, and
+// composes the strip again. The strip's layers, effects and watermark are
+// kept.
+func (h *Handler) RedrawPanel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	panel, err := h.db.GetGeneration(id)
+	if err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Generation not found", http.StatusNotFound)
+		return
+	}
+	if panel.ParentID == 0 {
+		http.Error(w, "This generation is not a comic panel", http.StatusBadRequest)
+		return
+	}
+
+	strip, err := h.db.GetGeneration(panel.ParentID)
+	if err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Comic strip not found", http.StatusNotFound)
+		return
+	}
+	if !h.checkRenderable(w, strip) {
+		return
+	}
+	// Every other panel must have an image to compose the strip from
+	siblings, err := h.db.ListPanels(strip.ID)
+	if err != nil {
+		log.Printf("Error fetching panels: %v", err)
+		http.Error(w, "Failed to fetch panels", http.StatusInternalServerError)
+		return
+	}
+	for _, p := range siblings {
+		if p.ID != panel.ID && p.BasePath == "" {
+			http.Error(w, "Another panel of this strip has no image, so the strip cannot be composed again", http.StatusConflict)
+			return
+		}
+	}
+
+	// Step 1: Generate the panel again using flux2-klein
+	systemPrompt, err := h.db.GetSetting("system_prompt")
+	if err != nil {
+		log.Printf("Error fetching system prompt: %v", err)
+		systemPrompt = ""
+	}
+
+	// Strips from before seeds were recorded get one now, for the panels
+	// redrawn after this one
+	seed := strip.Seed
+	if seed == 0 {
+		seed = ollama.NewSeed()
+		if err := h.db.UpdateGenerationSeed(strip.ID, seed); err != nil {
+			log.Printf("Error updating generation seed: %v", err)
+		}
+	}
+	filename, err := h.ollama.GenerateImage(panel.Prompt, systemPrompt, seed)
+	if err != nil {
+		log.Printf("Error redrawing panel %d: %v", id, err)
+		http.Error(w, "Failed to redraw panel", http.StatusInternalServerError)
+		return
+	}
+	if err := h.db.UpdateGenerationSeed(id, seed); err != nil {
+		log.Printf("Error updating generation seed: %v", err)
+	}
+	if err := h.db.UpdateGenerationBase(id, filename); err != nil {
+		log.Printf("Error updating generation base: %v", err)
+	}
+	if err := h.db.UpdateGenerationStatus(id, db.StatusSuccess, filename, ""); err != nil {
+		log.Printf("Error updating generation status: %v", err)
+	}
+	if err := h.db.UpdateGenerationModels(id, systemPrompt, ollama.ImageModel, ""); err != nil {
+		log.Printf("Error updating generation models: %v", err)
+	}
+	if panel.BasePath != "" {
+		if err := h.ollama.RemoveFile(panel.BasePath); err != nil {
+			log.Printf("Warning: Failed to remove old panel %s: %v", panel.BasePath, err)
+		}
+	}
+
+	// Step 2: Compose the strip's base again and render it with the
+	// strip's current spec
+	panels, err := h.db.ListPanels(strip.ID)
+	if err != nil {
+		log.Printf("Error fetching panels: %v", err)
+		http.Error(w, "Failed to fetch panels", http.StatusInternalServerError)
+		return
+	}
+	var panelPaths []string
+	for _, p := range panels {
+		if p.BasePath == "" {
+			log.Printf("Error composing comic strip %d: panel %d has no image", strip.ID, p.ID)
+			http.Error(w, "Failed to compose comic strip", http.StatusInternalServerError)
+			return
+		}
+		panelPaths = append(panelPaths, filepath.Join(h.imageDir, p.BasePath))
+	}
+	if err := h.ollama.ComposeStrip(panelPaths, filepath.Join(h.imageDir, strip.BasePath)); err != nil {
+		log.Printf("Error composing comic strip %d: %v", strip.ID, err)
+		http.Error(w, "Failed to compose comic strip", http.StatusInternalServerError)
+		return
+	}
+
+	updated, err := h.replaceImage(strip, renderSpecFor(strip))
+	if err != nil {
+		log.Printf("Error re-rendering comic strip %d: %v", strip.ID, err)
+		http.Error(w, "Failed to re-render comic strip", http.StatusInternalServerError)
+		return
+	}
+
+	h.finalizeGeneration(updated)
+
+	h.renderGeneration(w, updated)
+}
@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"meme-generator/internal/db"
+	"meme-generator/internal/ollama"
+	"net/http"
+	"path/filepath"
+	"strconv"
+)
+
+// Download serves a generation's image in the requested format, exporting
+// and recording the variant on first use. Format and quality default to the
+// output settings and can be overridden with ?format= and ?quality=, or
+// ?preset= can name an export preset instead. ?format=svg and ?format=pdf
+// give vector exports. Still images carry the generation's metadata.
+func (h *Handler) Download(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	gen, err := h.db.GetGeneration(id)
+	if err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Generation not found", http.StatusNotFound)
+		return
+	}
+
+	if gen.Status != db.StatusSuccess || gen.ImagePath == "" {
+		http.Error(w, "Generation has no image", http.StatusNotFound)
+		return
+	}
+	h.fetch(gen.ImagePath)
+
+	if name := r.URL.Query().Get("preset"); name != "" {
+		h.downloadPreset(w, r, gen, name)
+		return
+	}
+	if format, ok := ollama.ParseVectorFormat(r.URL.Query().Get("format")); ok {
+		h.downloadVector(w, r, gen, format)
+		return
+	}
+
+	// Animated GIFs would lose their animation in any other format
+	if gen.IsAnimated() {
+		w.Header().Set("Content-Type", "image/gif")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", gen.ImagePath))
+		http.ServeFile(w, r, filepath.Join(h.imageDir, gen.ImagePath))
+		return
+	}
+
+	format, quality := h.outputSettings()
+	if f := r.URL.Query().Get("format"); f != "" {
+		format, err = ollama.ParseOutputFormat(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if q := r.URL.Query().Get("quality"); q != "" {
+		quality, err = strconv.Atoi(q)
+		if err != nil || quality < 1 || quality > 100 {
+			http.Error(w, "Quality must be a number from 1 to 100", http.StatusBadRequest)
+			return
+		}
+	}
+
+	variant, err := h.exportVariant(gen, format, quality)
+	if err != nil {
+		log.Printf("Error exporting generation %d as %s: %v", gen.ID, format, err)
+		http.Error(w, "Failed to export image", http.StatusInternalServerError)
+		return
+	}
+
+	h.serveWithMetadata(w, r, gen, variant.Filename, format.ContentType())
+}
+
+// downloadPreset serves a generation's image rendered for an export preset
+func (h *Handler) downloadPreset(w http.ResponseWriter, r *http.Request, gen *db.Generation, name string) {
+	preset, ok := ollama.LookupPreset(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown preset: %q", name), http.StatusBadRequest)
+		return
+	}
+	if gen.IsAnimated() {
+		http.Error(w, "Presets are not available for animated GIFs", http.StatusBadRequest)
+		return
+	}
+
+	variant, err := h.exportPreset(gen, preset)
+	if err != nil {
+		log.Printf("Error exporting generation %d for preset %s: %v", gen.ID, preset.Name, err)
+		http.Error(w, "Failed to export image", http.StatusInternalServerError)
+		return
+	}
+
+	h.serveWithMetadata(w, r, gen, variant.Filename, preset.Format.ContentType())
+}
+
+// downloadVector serves a generation as SVG or PDF with vector captions.
+// It is rendered from the base image like a re-render, so it needs the base.
+func (h *Handler) downloadVector(w http.ResponseWriter, r *http.Request, gen *db.Generation, format ollama.VectorFormat) {
+	if gen.IsAnimated() {
+		http.Error(w, "Vector export is not available for animated GIFs", http.StatusBadRequest)
+		return
+	}
+	if len(ollama.EffectsForStage(gen.Effects, ollama.StageFinal)) > 0 {
+		http.Error(w, "Vector export is not available with effects applied after the captions", http.StatusBadRequest)
+		return
+	}
+	if !h.checkRenderable(w, gen) {
+		return
+	}
+
+	variant, err := h.recordVariant(gen, string(format), 100, func() (string, int64, error) {
+		spec, err := h.vectorSpec(gen)
+		if err != nil {
+			return "", 0, err
+		}
+		return h.ollama.ExportVector(gen.ImagePath, spec, format)
+	})
+	if err != nil {
+		log.Printf("Error exporting generation %d as %s: %v", gen.ID, format, err)
+		http.Error(w, "Failed to export image", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", variant.Filename))
+	http.ServeFile(w, r, filepath.Join(h.imageDir, variant.Filename))
+}
+
+// vectorSpec returns the inputs a generation's image was last rendered
+// from, for a vector export. The watermark is the current one, so vector
+// exports of watermarked generations are discarded when it changes.
+func (h *Handler) vectorSpec(gen *db.Generation) (ollama.VectorSpec, error) {
+	spec := ollama.VectorSpec{
+		Title:      gen.Prompt,
+		BasePath:   filepath.Join(h.imageDir, gen.BasePath),
+		Effects:    gen.Effects,
+		TopText:    gen.TopText,
+		BottomText: gen.BottomText,
+		Captions:   gen.Captions,
+		Layers:     gen.Layers,
+		Overlay: ollama.OverlayOptions{
+			SmartPlacement: gen.SmartPlacement,
+		},
+	}
+	if gen.TemplateID != "" {
+		t, ok := h.library.Get(gen.TemplateID)
+		if !ok {
+			return spec, fmt.Errorf("template %q is not installed", gen.TemplateID)
+		}
+		spec.Boxes = t.Boxes
+	}
+	if gen.Watermark {
+		wm := h.watermarkSettings()
+		if !wm.Configured() {
+			return spec, fmt.Errorf("no watermark is configured")
+		}
+		spec.Watermark = &wm
+	}
+	return spec, nil
+}
+
+// exportVariant returns the recorded variant for a format, exporting it if
+// it has not been created yet
+func (h *Handler) exportVariant(gen *db.Generation, format ollama.OutputFormat, quality int) (*db.Variant, error) {
+	quality = format.NormalizeQuality(quality)
+	return h.recordVariant(gen, string(format), quality, func() (string, int64, error) {
+		return h.ollama.ExportImage(gen.ImagePath, format, quality)
+	})
+}
+
+// exportPreset returns the recorded variant for a preset, exporting it if it
+// has not been created yet
+func (h *Handler) exportPreset(gen *db.Generation, preset ollama.Preset) (*db.Variant, error) {
+	quality := preset.Format.NormalizeQuality(preset.Quality)
+	return h.recordVariant(gen, db.PresetFormatPrefix+preset.Name, quality, func() (string, int64, error) {
+		return h.ollama.ExportPreset(gen.ImagePath, preset)
+	})
+}
+
+// recordVariant returns the variant recorded under format and quality if
+// its file still exists, and otherwise runs export and records the result
+func (h *Handler) recordVariant(gen *db.Generation, format string, quality int, export func() (string, int64, error)) (*db.Variant, error) {
+	if variant, err := h.db.GetVariant(gen.ID, format, quality); err == nil {
+		if fileExists(filepath.Join(h.imageDir, variant.Filename)) {
+			return variant, nil
+		}
+	}
+
+	filename, size, err := export()
+	if err != nil {
+		return nil, err
+	}
+
+	variant := db.Variant{
+		GenerationID: gen.ID,
+		Format:       format,
+		Quality:      quality,
+		Filename:     filename,
+		SizeBytes:    size,
+	}
+	if err := h.db.UpsertVariant(variant); err != nil {
+		return nil, fmt.Errorf("failed to record variant: %w", err)
+	}
+
+	return &variant, nil
+}
+
+// finalizeGeneration runs after a generation succeeds or is re-rendered. It
+// records the image's content hash for versioned URLs and its width for
+// responsive sizes, puts the image and
+// its base in storage, embeds its text for semantic search if enabled,
+// records the size of the rendered PNG, eagerly exports the configured
+// default format and renders the responsive sizes.
+func (h *Handler) finalizeGeneration(gen *db.Generation) {
+	if gen.Status != db.StatusSuccess || gen.ImagePath == "" {
+		return
+	}
+
+	if hash, err := h.hashes.hash(filepath.Join(h.imageDir, gen.ImagePath)); err != nil {
+		log.Printf("Warning: Failed to hash image: %v", err)
+	} else if err := h.db.UpdateGenerationHash(gen.ID, hash); err != nil {
+		log.Printf("Error updating generation hash: %v", err)
+	} else {
+		gen.ImageHash = hash
+	}
+	if width, err := imageWidth(filepath.Join(h.imageDir, gen.ImagePath)); err != nil {
+		log.Printf("Warning: Failed to read image width: %v", err)
+	} else if err := h.db.UpdateGenerationWidth(gen.ID, width); err != nil {
+		log.Printf("Error updating generation width: %v", err)
+	} else {
+		gen.ImageWidth = width
+	}
+
+	// The ollama client stores the bases it writes; this catches template
+	// copies, which the handler writes itself
+	h.publish(gen.ImagePath)
+	if gen.BasePath != "" && gen.BasePath != gen.ImagePath {
+		if _, err := h.store.Stat(filepath.ToSlash(gen.BasePath)); errors.Is(err, fs.ErrNotExist) {
+			h.publish(gen.BasePath)
+		}
+	}
+
+	h.embedGeneration(gen)
+
+	if gen.IsAnimated() {
+		return
+	}
+
+	format, quality := h.outputSettings()
+	for _, f := range []ollama.OutputFormat{ollama.FormatPNG, format} {
+		if _, err := h.exportVariant(gen, f, quality); err != nil {
+			log.Printf("Warning: Failed to export %s variant: %v", f, err)
+		}
+	}
+
+	for _, size := range ollama.ImageSizes {
+		if _, err := h.ollama.ResizeImage(gen.ImagePath, size.Width); err != nil {
+			log.Printf("Warning: Failed to render %s size: %v", size.Name, err)
+		}
+	}
+}
+
+// outputSettings returns the configured default output format and quality
+func (h *Handler) outputSettings() (ollama.OutputFormat, int) {
+	format := ollama.FormatPNG
+	if value, err := h.db.GetSetting("output_format"); err == nil {
+		if f, err := ollama.ParseOutputFormat(value); err == nil {
+			format = f
+		}
+	}
+
+	quality := ollama.DefaultQuality
+	if value, err := h.db.GetSetting("output_quality"); err == nil {
+		if q, err := strconv.Atoi(value); err == nil {
+			quality = q
+		}
+	}
+
+	return format, quality
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"meme-generator/internal/db"
+	"meme-generator/internal/ollama"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// previewWidth is the width effect previews are rendered at
+const previewWidth = 768
+
+// UpdateEffects sets a generation's effects pipeline and renders its image
+// again with the current captions
+func (h *Handler) UpdateEffects(w http.ResponseWriter, r *http.Request) {
+	gen, effects, ok := h.effectsRequest(w, r)
+	if !ok {
+		return
+	}
+
+	spec := renderSpecFor(gen)
+	spec.effects = effects
+	updated, err := h.replaceImage(gen, spec)
+	if err != nil {
+		log.Printf("Error applying effects to generation %d: %v", gen.ID, err)
+		http.Error(w, "Failed to apply effects", http.StatusInternalServerError)
+		return
+	}
+
+	h.finalizeGeneration(updated)
+
+	h.renderGeneration(w, updated)
+}
+
+// PreviewEffects renders a generation with an effects pipeline without
+// saving anything, and returns the result as an inline image
+func (h *Handler) PreviewEffects(w http.ResponseWriter, r *http.Request) {
+	gen, effects, ok := h.effectsRequest(w, r)
+	if !ok {
+		return
+	}
+
+	tmp, err := os.CreateTemp("", "preview-*.png")
+	if err != nil {
+		log.Printf("Error creating preview file: %v", err)
+		http.Error(w, "Failed to render preview", http.StatusInternalServerError)
+		return
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	spec := renderSpecFor(gen)
+	spec.effects = effects
+	var preview bytes.Buffer
+	err = h.renderImage(gen, tmp.Name(), spec)
+	if err == nil {
+		err = ollama.WritePreview(&preview, tmp.Name(), previewWidth)
+	}
+	if err != nil {
+		log.Printf("Error rendering effects preview for generation %d: %v", gen.ID, err)
+		http.Error(w, "Failed to render preview", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(w, `<img src="data:image/jpeg;base64,%s" alt="Preview of the selected effects">`,
+		base64.StdEncoding.EncodeToString(preview.Bytes()))
+}
+
+// effectsRequest reads the generation and effects pipeline of an effects
+// form, writing an error response if either is invalid
+func (h *Handler) effectsRequest(w http.ResponseWriter, r *http.Request) (*db.Generation, []ollama.Effect, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, nil, false
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	effects, err := parseEffects(r.PostForm)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	gen, err := h.db.GetGeneration(id)
+	if err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Generation not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	if gen.IsAnimated() && len(effects) > 0 {
+		http.Error(w, "Effects are not available for animated GIFs", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if !h.checkRenderable(w, gen) {
+		return nil, nil, false
+	}
+
+	return gen, effects, true
+}
+
+// parseEffects reads an effects pipeline from a form. Each "effect" value
+// names an effect, applied in the order given; its stage and parameters are
+// read from "<effect>.stage" and "<effect>.<param>".
+func parseEffects(form url.Values) ([]ollama.Effect, error) {
+	var effects []ollama.Effect
+	for _, name := range form["effect"] {
+		def, ok := ollama.LookupEffect(name)
+		if !ok {
+			return nil, fmt.Errorf("Unknown effect: %q", name)
+		}
+
+		effect := ollama.Effect{
+			Name:   name,
+			Stage:  ollama.EffectStage(form.Get(name + ".stage")),
+			Params: make(map[string]float64),
+		}
+		for _, p := range def.Params {
+			value := form.Get(name + "." + p.Name)
+			if value == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s must be a number", def.Label, p.Label)
+			}
+			effect.Params[p.Name] = v
+		}
+		effects = append(effects, effect)
+	}
+
+	effects, err := ollama.NormalizeEffects(effects)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid effects: %w", err)
+	}
+	return effects, nil
+}
@@ -1,30 +1,64 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"html/template"
 	"log"
 	"meme-generator/internal/db"
+	"meme-generator/internal/library"
 	"meme-generator/internal/ollama"
+	"meme-generator/internal/reconcile"
+	"meme-generator/internal/storage"
 	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dustin/go-humanize"
 )
 
+var templateFuncs = template.FuncMap{
+	"bytes": func(n int64) string { return humanize.Bytes(uint64(n)) },
+	"inc":   func(i int) int { return i + 1 },
+}
+
 type Handler struct {
 	db       *db.DB
 	ollama   *ollama.Client
+	library  *library.Library
 	tmpl     *template.Template
 	imageDir string
+	// store keeps finished images where every replica can reach them; the
+	// image directory is this replica's working copy
+	store   storage.Storage
+	hashes  *hashCache
+	janitor janitor
+	// reconciler looks for orphan images in the image directory and the
+	// working directory, where `ollama run` saves them
+	reconciler *reconcile.Reconciler
 }
 
-func New(database *db.DB, ollamaClient *ollama.Client, templatesDir, imageDir string) (*Handler, error) {
-	tmpl, err := template.ParseGlob(filepath.Join(templatesDir, "*.html"))
+func New(database *db.DB, ollamaClient *ollama.Client, memeTemplates *library.Library, store storage.Storage, templatesDir, imageDir string) (*Handler, error) {
+	imageFuncs := template.FuncMap{
+		"imageURL": imageURL,
+		"srcset":   srcset,
+		"alt": func(gen db.Generation) string {
+			return gen.Alt(templateName(memeTemplates, gen.TemplateID))
+		},
+	}
+
+	tmpl, err := template.New("").Funcs(templateFuncs).Funcs(imageFuncs).ParseGlob(filepath.Join(templatesDir, "*.html"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse templates: %w", err)
 	}
 
-	partials, err := template.ParseGlob(filepath.Join(templatesDir, "partials", "*.html"))
+	partials, err := template.New("").Funcs(templateFuncs).Funcs(imageFuncs).ParseGlob(filepath.Join(templatesDir, "partials", "*.html"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse partial templates: %w", err)
 	}
@@ -34,10 +68,14 @@ func New(database *db.DB, ollamaClient *ollama.Client, templatesDir, imageDir st
 	}
 
 	return &Handler{
-		db:       database,
-		ollama:   ollamaClient,
-		tmpl:     tmpl,
-		imageDir: imageDir,
+		db:         database,
+		ollama:     ollamaClient,
+		library:    memeTemplates,
+		tmpl:       tmpl,
+		imageDir:   imageDir,
+		store:      store,
+		hashes:     newHashCache(),
+		reconciler: reconcile.New(database, ollamaClient, store, imageDir, "."),
 	}, nil
 }
 
@@ -47,15 +85,23 @@ func (h *Handler) Home(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	generations, err := h.db.ListGenerations(10)
+	data, err := h.historyData(url.Values{}, db.HistoryFilter{})
 	if err != nil {
 		log.Printf("Error fetching generations: %v", err)
-		generations = []db.Generation{}
+		data = map[string]interface{}{}
 	}
 
-	data := map[string]interface{}{
-		"Generations": generations,
+	// Choices for the model, tag and collection history filters
+	if data["Models"], err = h.db.ListModels(); err != nil {
+		log.Printf("Error fetching models: %v", err)
 	}
+	if data["Tags"], err = h.db.ListTags(); err != nil {
+		log.Printf("Error fetching tags: %v", err)
+	}
+	if data["Collections"], err = h.db.ListCollections(); err != nil {
+		log.Printf("Error fetching collections: %v", err)
+	}
+	data["MaxCollectionNameLength"] = db.MaxCollectionNameLength
 
 	if err := h.tmpl.ExecuteTemplate(w, "index.html", data); err != nil {
 		log.Printf("Error executing template: %v", err)
@@ -74,58 +120,92 @@ func (h *Handler) Generate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Prompt is required", http.StatusBadRequest)
 		return
 	}
+	topText := strings.TrimSpace(r.FormValue("top_text"))
+	bottomText := strings.TrimSpace(r.FormValue("bottom_text"))
+	// A seed is given when reproducing an imported meme
+	seed := ollama.NewSeed()
+	if value := r.FormValue("seed"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			http.Error(w, "Seed must be a positive number", http.StatusBadRequest)
+			return
+		}
+		seed = n
+	}
 
-	id, err := h.db.InsertGeneration(prompt, "", db.StatusProcessing, "")
+	id, err := h.db.InsertGeneration(prompt, db.SourceModel, "", db.StatusProcessing, "")
 	if err != nil {
 		log.Printf("Error inserting generation: %v", err)
 		http.Error(w, "Failed to create generation", http.StatusInternalServerError)
 		return
 	}
-
-	// Step 1: Generate meme text using gemma3:270m
-	topText, bottomText, textErr := h.ollama.GenerateText(prompt)
-	if textErr != nil {
-		log.Printf("Warning: Text generation failed (will continue without text): %v", textErr)
-		// Continue with image generation even if text fails (graceful degradation)
-	} else {
-		log.Printf("Generated text - Top: %s, Bottom: %s", topText, bottomText)
+	if err := h.db.UpdateGenerationSeed(id, seed); err != nil {
+		log.Printf("Error updating generation seed: %v", err)
 	}
 
-	// Step 2: Generate image using flux2-klein
+	// Step 1: Generate image using flux2-klein
 	systemPrompt, err := h.db.GetSetting("system_prompt")
 	if err != nil {
 		log.Printf("Error fetching system prompt: %v", err)
 		systemPrompt = ""
 	}
 
-	filename, err := h.ollama.GenerateImage(prompt, systemPrompt)
+	filename, err := h.ollama.GenerateImage(prompt, systemPrompt, seed)
 	if err != nil {
 		log.Printf("Error generating image: %v", err)
 		h.db.UpdateGenerationStatus(id, db.StatusFailed, "", err.Error())
 
 		gen, _ := h.db.GetGeneration(id)
-		data := map[string]interface{}{
-			"Generation": gen,
-		}
+		h.renderGeneration(w, gen)
+		return
+	}
+	imagePath := filepath.Join(h.imageDir, filename)
 
-		w.Header().Set("Content-Type", "text/html")
-		if err := h.tmpl.ExecuteTemplate(w, "image.html", data); err != nil {
-			log.Printf("Error executing template: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	// Step 2: Describe the image with a vision model, if enabled
+	description := h.describeImage(id, imagePath)
+
+	// Step 3: Generate meme text using gemma3:270m, unless captions were
+	// given (as when reproducing an imported meme)
+	var textErr error
+	textModel := ""
+	if topText == "" && bottomText == "" {
+		topText, bottomText, textErr = h.ollama.GenerateText(prompt, description)
+		if textErr != nil {
+			log.Printf("Warning: Text generation failed (will continue without text): %v", textErr)
+			// Continue without text (graceful degradation)
+		} else {
+			log.Printf("Generated text - Top: %s, Bottom: %s", topText, bottomText)
+			textModel = ollama.TextModel
 		}
-		return
 	}
 
-	// Step 3: Overlay text on image if text generation succeeded
+	// Step 4: Overlay text onto a copy if text generation succeeded, keeping
+	// the generated image as the base so captions can be re-rendered
+	if err := h.db.UpdateGenerationBase(id, filename); err != nil {
+		log.Printf("Error updating generation base: %v", err)
+	}
 	if textErr == nil && (topText != "" || bottomText != "") {
-		imagePath := filepath.Join(h.imageDir, filename)
-		if overlayErr := h.ollama.OverlayMemeText(imagePath, topText, bottomText); overlayErr != nil {
+		memeFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + "-meme.png"
+		memePath := filepath.Join(h.imageDir, memeFilename)
+		opts := ollama.OverlayOptions{
+			SmartPlacement: h.boolSetting("smart_placement"),
+		}
+		if err := h.db.UpdateGenerationPlacement(id, opts.SmartPlacement); err != nil {
+			log.Printf("Error updating generation placement: %v", err)
+		}
+		overlayErr := copyFile(imagePath, memePath)
+		if overlayErr == nil {
+			overlayErr = h.ollama.OverlayMemeText(memePath, topText, bottomText, opts)
+		}
+		if overlayErr != nil {
 			log.Printf("Warning: Failed to overlay text on image: %v", overlayErr)
 			// Continue anyway - image was generated successfully
+		} else {
+			filename = memeFilename
 		}
 	}
 
-	// Step 4: Update database with results
+	// Step 5: Update database with results
 	if err := h.db.UpdateGenerationStatus(id, db.StatusSuccess, filename, ""); err != nil {
 		log.Printf("Error updating generation status: %v", err)
 	}
@@ -136,6 +216,9 @@ func (h *Handler) Generate(w http.ResponseWriter, r *http.Request) {
 			log.Printf("Error updating generation text: %v", err)
 		}
 	}
+	if err := h.db.UpdateGenerationModels(id, systemPrompt, ollama.ImageModel, textModel); err != nil {
+		log.Printf("Error updating generation models: %v", err)
+	}
 
 	gen, err := h.db.GetGeneration(id)
 	if err != nil {
@@ -144,15 +227,15 @@ func (h *Handler) Generate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data := map[string]interface{}{
-		"Generation": gen,
-	}
+	// Step 6: Watermark if new memes are watermarked, then export the
+	// configured default format and record variant sizes
+	gen = h.watermarkNew(gen)
+	h.finalizeGeneration(gen)
 
-	w.Header().Set("Content-Type", "text/html")
-	if err := h.tmpl.ExecuteTemplate(w, "image.html", data); err != nil {
-		log.Printf("Error executing template: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-	}
+	// Step 7: Suggest tags using gemma3:270m, if enabled
+	h.tagNew(gen)
+
+	h.renderGeneration(w, gen)
 }
 
 func (h *Handler) GetGeneration(w http.ResponseWriter, r *http.Request) {
@@ -175,8 +258,40 @@ func (h *Handler) GetGeneration(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.renderGeneration(w, gen)
+}
+
+// renderGeneration writes the image.html partial for a single generation
+func (h *Handler) renderGeneration(w http.ResponseWriter, gen *db.Generation) {
+	var variants []db.Variant
+	var panels []db.Generation
+	if gen != nil {
+		var err error
+		variants, err = h.db.ListVariants(gen.ID)
+		if err != nil {
+			log.Printf("Error fetching variants: %v", err)
+		}
+		if gen.Source == db.SourceComic {
+			if panels, err = h.db.ListPanels(gen.ID); err != nil {
+				log.Printf("Error fetching panels: %v", err)
+			}
+		}
+	}
+
+	format, quality := h.outputSettings()
 	data := map[string]interface{}{
-		"Generation": gen,
+		"Generation":     gen,
+		"Variants":       variants,
+		"Panels":         panels,
+		"OutputFormats":  ollama.OutputFormats,
+		"DefaultFormat":  format,
+		"DefaultQuality": quality,
+		"Presets":        ollama.Presets,
+		"VectorFormats":  ollama.VectorFormats,
+		"Effects":        ollama.Effects,
+		"LayerKinds":     ollama.LayerKinds,
+		"Stickers":       h.stickerChoices(),
+		"Organize":       h.organizeData(gen),
 	}
 
 	w.Header().Set("Content-Type", "text/html")
@@ -186,16 +301,25 @@ func (h *Handler) GetGeneration(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// historyPageSize is how many generations each page of the history shows
+const historyPageSize = 12
+
+// History lists past generations, filtered by the query parameters q
+// (full-text search), status, source, from and to (YYYY-MM-DD, inclusive),
+// tag, collection (an ID) and favorites=on.
+// With before, it returns only the next page of items, for infinite scroll.
 func (h *Handler) History(w http.ResponseWriter, r *http.Request) {
-	generations, err := h.db.ListGenerations(10)
+	filter, err := parseHistoryFilter(r.URL.Query())
 	if err != nil {
-		log.Printf("Error fetching generations: %v", err)
-		http.Error(w, "Failed to fetch history", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	data := map[string]interface{}{
-		"Generations": generations,
+	data, err := h.historyData(r.URL.Query(), filter)
+	if err != nil {
+		log.Printf("Error fetching generations: %v", err)
+		http.Error(w, "Failed to fetch history", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "text/html")
@@ -205,22 +329,131 @@ func (h *Handler) History(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *Handler) ServeImage(w http.ResponseWriter, r *http.Request) {
-	filename := filepath.Base(r.URL.Path)
-	imagePath := filepath.Join(h.imageDir, filename)
+// historyData fetches a page of the history for history.html, with the URL
+// of the next page if there is one
+func (h *Handler) historyData(query url.Values, filter db.HistoryFilter) (map[string]interface{}, error) {
+	generations, err := h.db.ListGenerations(filter, historyPageSize+1)
+	if err != nil {
+		return nil, err
+	}
+
+	nextURL := ""
+	if len(generations) > historyPageSize {
+		generations = generations[:historyPageSize]
+		next := url.Values{}
+		for key, values := range query {
+			next[key] = values
+		}
+		next.Set("before", strconv.FormatInt(generations[len(generations)-1].ID, 10))
+		nextURL = "/history?" + next.Encode()
+	}
 
-	http.ServeFile(w, r, imagePath)
+	return map[string]interface{}{
+		"Generations":    generations,
+		"SemanticSearch": h.boolSetting("semantic_search"),
+		"NextURL":        nextURL,
+		"More":           filter.Before > 0,
+		"Filtered":       filter.Query != "" || filter.Status != "" || filter.Source != "" || filter.Model != "" || !filter.From.IsZero() || !filter.To.IsZero() || filter.Tag != "" || filter.Collection > 0 || filter.Favorites,
+	}, nil
+}
+
+// parseHistoryFilter reads history filters from query parameters. The
+// returned error is safe to show to the user.
+func parseHistoryFilter(query url.Values) (db.HistoryFilter, error) {
+	filter := db.HistoryFilter{
+		Query:     strings.TrimSpace(query.Get("q")),
+		Status:    query.Get("status"),
+		Source:    query.Get("source"),
+		Model:     strings.TrimSpace(query.Get("model")),
+		Favorites: query.Get("favorites") == "on",
+	}
+
+	switch filter.Status {
+	case "", db.StatusProcessing, db.StatusSuccess, db.StatusFailed:
+	default:
+		return filter, fmt.Errorf("Unknown status: %q", filter.Status)
+	}
+	switch filter.Source {
+	case "", db.SourceModel, db.SourceTemplate, db.SourceUpload, db.SourceComic:
+	default:
+		return filter, fmt.Errorf("Unknown source: %q", filter.Source)
+	}
+
+	var err error
+	if from := query.Get("from"); from != "" {
+		if filter.From, err = time.ParseInLocation(time.DateOnly, from, time.Local); err != nil {
+			return filter, fmt.Errorf("From must be a date (YYYY-MM-DD)")
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		if filter.To, err = time.ParseInLocation(time.DateOnly, to, time.Local); err != nil {
+			return filter, fmt.Errorf("To must be a date (YYYY-MM-DD)")
+		}
+		// Include the whole of the last day
+		filter.To = filter.To.AddDate(0, 0, 1)
+	}
+	if tag := query.Get("tag"); strings.TrimSpace(tag) != "" {
+		if filter.Tag, err = db.NormalizeTag(tag); err != nil {
+			return filter, fmt.Errorf("Invalid tag: %v", err)
+		}
+	}
+	if collection := query.Get("collection"); collection != "" {
+		if filter.Collection, err = strconv.ParseInt(collection, 10, 64); err != nil || filter.Collection <= 0 {
+			return filter, fmt.Errorf("Invalid collection")
+		}
+	}
+	if before := query.Get("before"); before != "" {
+		if filter.Before, err = strconv.ParseInt(before, 10, 64); err != nil || filter.Before <= 0 {
+			return filter, fmt.Errorf("Invalid cursor")
+		}
+	}
+	return filter, nil
 }
 
 func (h *Handler) GetSettings(w http.ResponseWriter, r *http.Request) {
+	h.renderSettings(w, false)
+}
+
+// renderSettings writes the settings.html partial with the current settings
+func (h *Handler) renderSettings(w http.ResponseWriter, success bool) {
 	systemPrompt, err := h.db.GetSetting("system_prompt")
 	if err != nil {
 		log.Printf("Error fetching system prompt: %v", err)
 		systemPrompt = ""
 	}
 
+	visionModel, err := h.db.GetSetting("vision_model")
+	if err != nil {
+		visionModel = ollama.DefaultVisionModel
+	}
+
+	embeddingModel := h.embeddingModel()
+
+	watermarkLogo, _ := h.db.GetSetting("watermark_logo")
+	wm := h.watermarkSettings()
+
+	format, quality := h.outputSettings()
 	data := map[string]interface{}{
-		"SystemPrompt": systemPrompt,
+		"SystemPrompt":        systemPrompt,
+		"SmartPlacement":      h.boolSetting("smart_placement"),
+		"VisionCaptions":      h.boolSetting("vision_captions"),
+		"VisionModel":         visionModel,
+		"SemanticSearch":      h.boolSetting("semantic_search"),
+		"EmbeddingModel":      embeddingModel,
+		"SuggestTags":         h.boolSetting("suggest_tags"),
+		"OutputFormats":       ollama.OutputFormats,
+		"OutputFormat":        format,
+		"OutputQuality":       quality,
+		"WatermarkText":       wm.Text,
+		"WatermarkLogo":       watermarkLogo,
+		"WatermarkPosition":   wm.Position,
+		"WatermarkPositions":  ollama.WatermarkPositions,
+		"WatermarkOpacity":    h.intSetting("watermark_opacity", 60),
+		"WatermarkScale":      h.intSetting("watermark_scale", 20),
+		"WatermarkDefault":    h.boolSetting("watermark_default"),
+		"RetentionFailedDays": h.intSetting("retention_failed_days", 0),
+		"RetentionMaxDiskMB":  h.intSetting("retention_max_disk_mb", 0),
+		"Success":             success,
 	}
 
 	w.Header().Set("Content-Type", "text/html")
@@ -237,6 +470,63 @@ func (h *Handler) UpdateSettings(w http.ResponseWriter, r *http.Request) {
 	}
 
 	systemPrompt := r.FormValue("system_prompt")
+	smartPlacement := r.FormValue("smart_placement") == "on"
+	visionCaptions := r.FormValue("vision_captions") == "on"
+	visionModel := strings.TrimSpace(r.FormValue("vision_model"))
+	if visionModel == "" {
+		visionModel = ollama.DefaultVisionModel
+	}
+	semanticSearch := r.FormValue("semantic_search") == "on"
+	embeddingModel := strings.TrimSpace(r.FormValue("embedding_model"))
+	if embeddingModel == "" {
+		embeddingModel = ollama.DefaultEmbeddingModel
+	}
+	suggestTags := r.FormValue("suggest_tags") == "on"
+
+	format, err := ollama.ParseOutputFormat(r.FormValue("output_format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	quality, err := strconv.Atoi(r.FormValue("output_quality"))
+	if err != nil || quality < 1 || quality > 100 {
+		http.Error(w, "Quality must be a number from 1 to 100", http.StatusBadRequest)
+		return
+	}
+
+	watermarkText := strings.TrimSpace(r.FormValue("watermark_text"))
+	if utf8.RuneCountInString(watermarkText) > maxWatermarkTextLength {
+		http.Error(w, fmt.Sprintf("Watermark text must be at most %d characters", maxWatermarkTextLength), http.StatusBadRequest)
+		return
+	}
+	watermarkPosition, err := ollama.ParseWatermarkPosition(r.FormValue("watermark_position"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	watermarkOpacity, err := strconv.Atoi(r.FormValue("watermark_opacity"))
+	if err != nil || watermarkOpacity < 5 || watermarkOpacity > 100 {
+		http.Error(w, "Watermark opacity must be a number from 5 to 100", http.StatusBadRequest)
+		return
+	}
+	watermarkScale, err := strconv.Atoi(r.FormValue("watermark_scale"))
+	if err != nil || watermarkScale < 5 || watermarkScale > 100 {
+		http.Error(w, "Watermark size must be a number from 5 to 100", http.StatusBadRequest)
+		return
+	}
+	watermarkDefault := r.FormValue("watermark_default") == "on"
+
+	retentionFailedDays, err := strconv.Atoi(r.FormValue("retention_failed_days"))
+	if err != nil || retentionFailedDays < 0 {
+		http.Error(w, "Failed meme retention must be a number of days, or 0 to keep them", http.StatusBadRequest)
+		return
+	}
+	retentionMaxDiskMB, err := strconv.Atoi(r.FormValue("retention_max_disk_mb"))
+	if err != nil || retentionMaxDiskMB < 0 {
+		http.Error(w, "Disk cap must be a number of MB, or 0 for no cap", http.StatusBadRequest)
+		return
+	}
 
 	if err := h.db.SetSetting("system_prompt", systemPrompt); err != nil {
 		log.Printf("Error updating system prompt: %v", err)
@@ -244,14 +534,162 @@ func (h *Handler) UpdateSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data := map[string]interface{}{
-		"SystemPrompt": systemPrompt,
-		"Success":      true,
+	if err := h.db.SetSetting("smart_placement", strconv.FormatBool(smartPlacement)); err != nil {
+		log.Printf("Error updating smart placement: %v", err)
+		http.Error(w, "Failed to update settings", http.StatusInternalServerError)
+		return
 	}
 
-	w.Header().Set("Content-Type", "text/html")
-	if err := h.tmpl.ExecuteTemplate(w, "settings.html", data); err != nil {
-		log.Printf("Error executing template: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	if err := h.db.SetSetting("vision_captions", strconv.FormatBool(visionCaptions)); err != nil {
+		log.Printf("Error updating vision captions: %v", err)
+		http.Error(w, "Failed to update settings", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.SetSetting("vision_model", visionModel); err != nil {
+		log.Printf("Error updating vision model: %v", err)
+		http.Error(w, "Failed to update settings", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.SetSetting("semantic_search", strconv.FormatBool(semanticSearch)); err != nil {
+		log.Printf("Error updating semantic search: %v", err)
+		http.Error(w, "Failed to update settings", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.SetSetting("embedding_model", embeddingModel); err != nil {
+		log.Printf("Error updating embedding model: %v", err)
+		http.Error(w, "Failed to update settings", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.SetSetting("suggest_tags", strconv.FormatBool(suggestTags)); err != nil {
+		log.Printf("Error updating suggest tags: %v", err)
+		http.Error(w, "Failed to update settings", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.SetSetting("output_format", string(format)); err != nil {
+		log.Printf("Error updating output format: %v", err)
+		http.Error(w, "Failed to update settings", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.SetSetting("output_quality", strconv.Itoa(quality)); err != nil {
+		log.Printf("Error updating output quality: %v", err)
+		http.Error(w, "Failed to update settings", http.StatusInternalServerError)
+		return
+	}
+
+	watermarkBefore := h.watermarkSettings()
+	watermarkSettings := []struct{ key, value string }{
+		{"watermark_text", watermarkText},
+		{"watermark_position", string(watermarkPosition)},
+		{"watermark_opacity", strconv.Itoa(watermarkOpacity)},
+		{"watermark_scale", strconv.Itoa(watermarkScale)},
+		{"watermark_default", strconv.FormatBool(watermarkDefault)},
+	}
+	for _, setting := range watermarkSettings {
+		if err := h.db.SetSetting(setting.key, setting.value); err != nil {
+			log.Printf("Error updating %s: %v", setting.key, err)
+			http.Error(w, "Failed to update settings", http.StatusInternalServerError)
+			return
+		}
+	}
+	if h.watermarkSettings() != watermarkBefore {
+		h.invalidateWatermarkedVectors()
+	}
+
+	retentionSettings := []struct{ key, value string }{
+		{"retention_failed_days", strconv.Itoa(retentionFailedDays)},
+		{"retention_max_disk_mb", strconv.Itoa(retentionMaxDiskMB)},
+	}
+	for _, setting := range retentionSettings {
+		if err := h.db.SetSetting(setting.key, setting.value); err != nil {
+			log.Printf("Error updating %s: %v", setting.key, err)
+			http.Error(w, "Failed to update settings", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	h.renderSettings(w, true)
+}
+
+// intSetting reads a numeric setting, using fallback for missing or invalid values
+func (h *Handler) intSetting(key string, fallback int) int {
+	value, err := h.db.GetSetting(key)
+	if err != nil {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+// boolSetting reads a "true"/"false" setting, treating missing values as false
+func (h *Handler) boolSetting(key string) bool {
+	value, err := h.db.GetSetting(key)
+	if err != nil {
+		return false
 	}
+	enabled, _ := strconv.ParseBool(value)
+	return enabled
+}
+
+// describeImage runs the optional vision step and stores the result. It
+// returns "" when the step is disabled or fails, so captions fall back to
+// the prompt alone.
+func (h *Handler) describeImage(id int64, imagePath string) string {
+	if !h.boolSetting("vision_captions") {
+		return ""
+	}
+
+	model, err := h.db.GetSetting("vision_model")
+	if err != nil {
+		model = ollama.DefaultVisionModel
+	}
+
+	description, err := h.ollama.DescribeImage(imagePath, model)
+	if err != nil {
+		log.Printf("Warning: Image description failed (captions will use the prompt only): %v", err)
+		return ""
+	}
+	log.Printf("Image description: %s", description)
+
+	if err := h.db.UpdateGenerationDescription(id, description); err != nil {
+		log.Printf("Error updating generation description: %v", err)
+	}
+	return description
+}
+
+// randomToken returns a random, unguessable URL-safe token, for share links,
+// rater cookies and temporary names
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// fileExists reports whether a regular file exists at path
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// templateName returns the display name of an installed template, or ""
+func templateName(lib *library.Library, id string) string {
+	if t, ok := lib.Get(id); ok {
+		return t.Name
+	}
+	return ""
+}
+
+// alt returns a generation's alt text, naming its template by display name
+func (h *Handler) alt(gen db.Generation) string {
+	return gen.Alt(templateName(h.library, gen.TemplateID))
 }
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+	"log"
+	"meme-generator/internal/db"
+	"meme-generator/internal/ollama"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// immutableCacheControl is sent for versioned image URLs, whose content
+// never changes because the version is the content hash
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// ServeImage serves a generated image. ?size=thumb or ?size=medium serves a
+// resized copy, rendered and cached on first request. URLs carrying the
+// current content hash as ?v= are cacheable forever; all other responses
+// must be revalidated with their ETag, since captions can be re-rendered.
+//
+// Images this replica lacks, or holds an older version of than ?v= asks
+// for, are fetched from storage. Storage that can sign URLs serves full
+// size images this replica lacks itself.
+func (h *Handler) ServeImage(w http.ResponseWriter, r *http.Request) {
+	filename := filepath.Base(r.URL.Path)
+	originalPath := filepath.Join(h.imageDir, filename)
+	size := r.URL.Query().Get("size")
+	v := r.URL.Query().Get("v")
+
+	if !fileExists(originalPath) {
+		// Only redirect to objects storage has, so missing images are 404s
+		// here rather than at the signed URL
+		if _, err := h.store.Stat(filename); errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			log.Printf("Warning: Failed to check storage for %s: %v", filename, err)
+		} else if size == "" || size == "full" {
+			if signed, err := h.store.SignedURL(filename, signedURLExpiry); err == nil {
+				w.Header().Set("Cache-Control", "no-store")
+				http.Redirect(w, r, signed, http.StatusFound)
+				return
+			}
+		}
+		h.fetchMissing(filename)
+	} else if v != "" {
+		if hash, err := h.hashes.hash(originalPath); err == nil && hash != v {
+			h.fetch(filename)
+		}
+	}
+	if !fileExists(originalPath) {
+		http.NotFound(w, r)
+		return
+	}
+
+	imagePath := originalPath
+	if size != "" && size != "full" {
+		width, ok := ollama.LookupImageSize(size)
+		if !ok {
+			http.Error(w, "Unknown image size", http.StatusBadRequest)
+			return
+		}
+
+		resized, err := h.ollama.ResizeImage(filename, width)
+		if err != nil {
+			log.Printf("Warning: Failed to resize %s (serving full size): %v", filename, err)
+		} else {
+			imagePath = filepath.Join(h.imageDir, resized)
+		}
+	}
+
+	cacheControl := "no-cache"
+	if v != "" {
+		if hash, err := h.hashes.hash(originalPath); err == nil && hash == v {
+			cacheControl = immutableCacheControl
+		}
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+
+	// ServeFile answers If-None-Match from the ETag header
+	if etag, err := h.hashes.hash(imagePath); err == nil {
+		w.Header().Set("ETag", `"`+etag+`"`)
+	}
+
+	http.ServeFile(w, r, imagePath)
+}
+
+// imageURL returns the versioned URL of a generation's image at a named
+// size ("" or "full" for the original)
+func imageURL(gen db.Generation, size string) string {
+	query := url.Values{}
+	if size != "" && size != "full" {
+		query.Set("size", size)
+	}
+	if gen.ImageHash != "" {
+		query.Set("v", gen.ImageHash)
+	}
+
+	u := "/images/" + url.PathEscape(gen.ImagePath)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// srcset lists the responsive sizes of a generation's image for an img
+// srcset attribute, from the width recorded by finalizeGeneration, so
+// rendering the history reads no image files. Sizes at least as wide as the
+// image itself are left out.
+func srcset(gen db.Generation) string {
+	if gen.ImagePath == "" || gen.ImageWidth == 0 || gen.IsAnimated() {
+		return ""
+	}
+
+	var candidates []string
+	for _, size := range ollama.ImageSizes {
+		if size.Width < gen.ImageWidth {
+			candidates = append(candidates, fmt.Sprintf("%s %dw", imageURL(gen, size.Name), size.Width))
+		}
+	}
+	candidates = append(candidates, fmt.Sprintf("%s %dw", imageURL(gen, ""), gen.ImageWidth))
+
+	return strings.Join(candidates, ", ")
+}
+
+// imageWidth returns the width of the image at path in pixels
+func imageWidth(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, err
+	}
+	return config.Width, nil
+}
+
+// hashCache remembers file hashes by path, size and modification time so
+// serving an ETag does not mean reading the whole file on every request
+type hashCache struct {
+	mu      sync.Mutex
+	entries map[string]hashEntry
+}
+
+type hashEntry struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+func newHashCache() *hashCache {
+	return &hashCache{entries: make(map[string]hashEntry)}
+}
+
+// hash returns the content hash of the file at path
+func (c *hashCache) hash(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[path]
+	c.mu.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.hash, nil
+	}
+
+	hash, err := ollama.FileHash(path)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.entries[path] = hashEntry{size: info.Size(), modTime: info.ModTime(), hash: hash}
+	c.mu.Unlock()
+	return hash, nil
+}
+
+// forget drops the cached hash of a deleted file
+func (c *hashCache) forget(path string) {
+	c.mu.Lock()
+	delete(c.entries, path)
+	c.mu.Unlock()
+}
@@ -0,0 +1,431 @@
+package handlers
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"meme-generator/internal/db"
+	"meme-generator/internal/ollama"
+	"meme-generator/internal/storage"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	// janitorInterval is how often the janitor enforces the retention rules
+	janitorInterval = time.Hour
+	// janitorRunsShown is how many janitor runs the report lists
+	janitorRunsShown = 20
+	// cacheMinAge is how long the janitor leaves new files in the image
+	// directory alone, so it never deletes one a request has just fetched
+	// or rendered and is about to read
+	cacheMinAge = 10 * time.Minute
+	// janitorBatch is how many generations the janitor removes at a time.
+	// Disk usage is measured again between batches, so eviction stops once
+	// it is under the cap rather than going by estimates made up front.
+	janitorBatch = 50
+)
+
+// janitor serializes janitor runs and manual purges, and remembers when
+// the last run finished, as runs are only recorded if they removed
+// something or failed
+type janitor struct {
+	mu      sync.Mutex
+	lastRun time.Time
+}
+
+// StartJanitor enforces the retention rules now and then every
+// janitorInterval, in the background
+func (h *Handler) StartJanitor() {
+	go func() {
+		for {
+			if _, err := h.runJanitor(); err != nil {
+				log.Printf("Error running janitor: %v", err)
+			}
+			time.Sleep(janitorInterval)
+		}
+	}()
+}
+
+// runJanitor removes failed generations past the retention period, then
+// evicts generations until their files fit the disk cap.
+// Favorites are never removed.
+func (h *Handler) runJanitor() (db.JanitorRun, error) {
+	h.janitor.mu.Lock()
+	defer h.janitor.mu.Unlock()
+
+	run := db.JanitorRun{StartedAt: time.Now()}
+	err := h.enforceRetention(&run)
+	run.FinishedAt = time.Now()
+	if err != nil {
+		run.Error = err.Error()
+	}
+
+	h.janitor.lastRun = run.FinishedAt
+	if len(run.Removals) > 0 || err != nil {
+		if _, err := h.db.InsertJanitorRun(run); err != nil {
+			log.Printf("Warning: Failed to record janitor run: %v", err)
+		}
+	}
+	return run, err
+}
+
+// enforceRetention applies the retention rules, adding what it removes to
+// run
+func (h *Handler) enforceRetention(run *db.JanitorRun) error {
+	// Step 1: Remove failed generations older than the retention period
+	if days := h.intSetting("retention_failed_days", 0); days > 0 {
+		expired, err := h.db.ListExpiredFailed(time.Now().AddDate(0, 0, -days))
+		if err != nil {
+			return fmt.Errorf("failed to list expired generations: %w", err)
+		}
+		// The sizes are only reported, so removing goes ahead without them
+		sizes, err := h.storedSizes()
+		if err != nil && len(expired) > 0 {
+			log.Printf("Warning: Failed to measure disk usage: %v", err)
+		}
+		for len(expired) > 0 {
+			n := min(len(expired), janitorBatch)
+			if err := h.removeGenerations(expired[:n], sizes, db.RemovalFailed, run); err != nil {
+				return err
+			}
+			expired = expired[n:]
+		}
+	}
+
+	// Step 2: Measure the disk usage the janitor can free
+	sizes, err := h.storedSizes()
+	if err != nil {
+		return fmt.Errorf("failed to measure disk usage: %w", err)
+	}
+	usage, err := h.memeUsage(sizes)
+	if err != nil {
+		return fmt.Errorf("failed to measure disk usage: %w", err)
+	}
+	run.DiskBytes = usage
+
+	// Step 3: Evict the trash, then the oldest generations, a batch at a
+	// time until under the cap
+	limit := int64(h.intSetting("retention_max_disk_mb", 0)) * humanize.MByte
+	if limit <= 0 {
+		return nil
+	}
+	var candidates []db.Generation
+	if usage > limit {
+		if candidates, err = h.db.ListEvictionCandidates(); err != nil {
+			return fmt.Errorf("failed to list eviction candidates: %w", err)
+		}
+	}
+	for usage > limit && len(candidates) > 0 {
+		var evict []db.Generation
+		expected := usage
+		for len(candidates) > 0 && len(evict) < janitorBatch && expected > limit {
+			gen := candidates[0]
+			candidates = candidates[1:]
+			// Generations without files would free nothing
+			if size := h.generationSize(gen, sizes); size > 0 {
+				evict = append(evict, gen)
+				expected -= size
+			}
+		}
+		if err := h.removeGenerations(evict, sizes, db.RemovalQuota, run); err != nil {
+			return err
+		}
+
+		if sizes, err = h.storedSizes(); err != nil {
+			return fmt.Errorf("failed to measure disk usage: %w", err)
+		}
+		if usage, err = h.memeUsage(sizes); err != nil {
+			return fmt.Errorf("failed to measure disk usage: %w", err)
+		}
+		run.DiskBytes = usage
+	}
+	if usage > limit {
+		log.Printf("Warning: %s still over the disk cap after evicting every candidate", humanize.Bytes(uint64(usage)))
+	}
+
+	// Step 4: Hold this replica's image directory to the cap too, when it
+	// only caches what storage keeps
+	return h.trimLocalCache(limit, sizes)
+}
+
+// trimLocalCache deletes this replica's copies of stored files, and the
+// exports, resized copies and share copies rendered here, least recently
+// written first, until the image directory fits limit. Each is fetched or
+// rendered again when next needed. Copies whose size differs from the
+// stored object's may hold changes storage lacks, so they are kept, as are
+// files storage keeps in the image directory itself, as with local storage
+// there. stored comes from storedSizes.
+func (h *Handler) trimLocalCache(limit int64, stored map[string]int64) error {
+	variants, err := h.db.ListAllVariants()
+	if err != nil {
+		return fmt.Errorf("failed to list variants: %w", err)
+	}
+	exports := make(map[string]bool, len(variants))
+	for _, v := range variants {
+		exports[filepath.ToSlash(v.Filename)] = true
+	}
+
+	// Step 1: Measure the image directory and find what can be deleted.
+	// Hidden files are being written or staged for a purge.
+	type cachedFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var usage int64
+	var cached []cachedFile
+	err = filepath.WalkDir(h.imageDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != h.imageDir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			// Deleted since the directory was read
+			return nil
+		}
+		usage += info.Size()
+
+		rel, err := filepath.Rel(h.imageDir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if storage.Holds(h.store, key, path) || time.Since(info.ModTime()) < cacheMinAge {
+			return nil
+		}
+		rendered := exports[key] || strings.HasPrefix(key, ollama.SizesDir+"/") || strings.HasPrefix(key, ollama.SharedDir+"/")
+		if size, ok := stored[key]; rendered || (ok && size == info.Size()) {
+			cached = append(cached, cachedFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to measure image directory: %w", err)
+	}
+	if usage <= limit {
+		return nil
+	}
+
+	// Step 2: Delete the oldest until under the cap
+	sort.Slice(cached, func(i, j int) bool { return cached[i].modTime.Before(cached[j].modTime) })
+	removed, freed := 0, int64(0)
+	for _, file := range cached {
+		if usage <= limit {
+			break
+		}
+		if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: Failed to delete cached %s: %v", file.path, err)
+			continue
+		}
+		usage -= file.size
+		freed += file.size
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("Janitor removed %d cached file%s (%s)", removed, plural(removed), humanize.Bytes(uint64(freed)))
+	}
+	if removed > 0 && usage > limit {
+		log.Printf("Warning: Image directory still holds %s over the disk cap after removing every cached file", humanize.Bytes(uint64(usage-limit)))
+	}
+	return nil
+}
+
+// removeGenerations deletes top-level generations and their files forever,
+// recording them in run with their sizes in stored, which comes from
+// storedSizes. Generations are moved to the trash first, as only trashed
+// generations can be purged, and taken back out if the purge fails.
+func (h *Handler) removeGenerations(gens []db.Generation, stored map[string]int64, reason string, run *db.JanitorRun) error {
+	if len(gens) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(gens))
+	var trashed []int64
+	sizes := make(map[int64]int64, len(gens))
+	for _, gen := range gens {
+		ids = append(ids, gen.ID)
+		if gen.DeletedAt == nil {
+			trashed = append(trashed, gen.ID)
+		}
+		sizes[gen.ID] = h.generationSize(gen, stored)
+	}
+
+	if _, err := h.db.TrashGenerations(trashed); err != nil {
+		return fmt.Errorf("failed to trash generations: %w", err)
+	}
+	if _, err := h.purgeGenerations(ids); err != nil {
+		if _, restoreErr := h.db.RestoreGenerations(trashed); restoreErr != nil {
+			log.Printf("Error restoring generations after failed purge: %v", restoreErr)
+		}
+		return fmt.Errorf("failed to purge generations: %w", err)
+	}
+
+	for _, gen := range gens {
+		run.Removals = append(run.Removals, db.JanitorRemoval{
+			GenerationID: gen.ID,
+			Prompt:       gen.Prompt,
+			Reason:       reason,
+			Bytes:        sizes[gen.ID],
+		})
+		run.FreedBytes += sizes[gen.ID]
+	}
+	log.Printf("Janitor removed %d generation%s (%s)", len(gens), plural(len(gens)), reason)
+	return nil
+}
+
+// generationSize returns the bytes in storage used by a generation's
+// files, including those of its comic panels, leaving out files other
+// generations also use, as removing it would not free them. sizes comes
+// from storedSizes.
+func (h *Handler) generationSize(gen db.Generation, sizes map[string]int64) int64 {
+	gens := []db.Generation{gen}
+	panels, err := h.db.ListPanels(gen.ID)
+	if err != nil {
+		log.Printf("Warning: Failed to list panels of generation %d: %v", gen.ID, err)
+	}
+	gens = append(gens, panels...)
+
+	var variants []db.Variant
+	for _, g := range gens {
+		v, err := h.db.ListVariants(g.ID)
+		if err != nil {
+			log.Printf("Warning: Failed to list variants of generation %d: %v", g.ID, err)
+		}
+		variants = append(variants, v...)
+	}
+
+	ids := make([]int64, len(gens))
+	for i, g := range gens {
+		ids[i] = g.ID
+	}
+	kept, err := h.db.FilesUsedElsewhere(ids, db.Files(gens, variants))
+	if err != nil {
+		log.Printf("Warning: Failed to check which files of generation %d are shared: %v", gen.ID, err)
+	}
+
+	var size int64
+	for _, filename := range h.generationFiles(gens, variants, kept) {
+		size += sizes[filepath.ToSlash(filename)]
+	}
+	return size
+}
+
+// storedSizes returns the size of every object in storage by key. The disk
+// cap measures storage rather than this replica's image directory, as
+// purging deletes the stored files every replica shares, while exports,
+// resized copies and share copies are local and made again as needed.
+// With local storage the image directory is the storage, so everything in
+// it counts.
+func (h *Handler) storedSizes() (map[string]int64, error) {
+	objects, err := h.store.List("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list storage: %w", err)
+	}
+	sizes := make(map[string]int64, len(objects))
+	for _, obj := range objects {
+		sizes[obj.Key] = obj.Size
+	}
+	return sizes, nil
+}
+
+// memeUsage returns the bytes in storage used by the files of every
+// generation, including those in the trash. Logos, stickers, orphans and
+// other files the janitor never deletes are left out, so evicting every
+// candidate always brings usage under the cap unless favorites or memes
+// still being generated fill it. sizes comes from storedSizes.
+func (h *Handler) memeUsage(sizes map[string]int64) (int64, error) {
+	gens, err := h.db.ListAllGenerations()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list generations: %w", err)
+	}
+	variants, err := h.db.ListAllVariants()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list variants: %w", err)
+	}
+
+	var total int64
+	for _, filename := range h.generationFiles(gens, variants, nil) {
+		total += sizes[filepath.ToSlash(filename)]
+	}
+	return total, nil
+}
+
+// Janitor reports the retention rules, disk usage and what the janitor
+// has removed
+func (h *Handler) Janitor(w http.ResponseWriter, r *http.Request) {
+	h.renderJanitor(w, "")
+}
+
+// RunJanitor enforces the retention rules now
+func (h *Handler) RunJanitor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	run, err := h.runJanitor()
+	if err != nil {
+		log.Printf("Error running janitor: %v", err)
+		http.Error(w, "Failed to enforce retention rules", http.StatusInternalServerError)
+		return
+	}
+
+	message := "Nothing to remove."
+	if n := len(run.Removals); n > 0 {
+		message = fmt.Sprintf("Removed %d meme%s, freeing %s.", n, plural(n), humanize.Bytes(uint64(run.FreedBytes)))
+	}
+	h.renderJanitor(w, message)
+}
+
+// renderJanitor writes the janitor.html partial with an optional message
+func (h *Handler) renderJanitor(w http.ResponseWriter, message string) {
+	runs, err := h.db.ListJanitorRuns(janitorRunsShown)
+	if err != nil {
+		log.Printf("Error fetching janitor runs: %v", err)
+		http.Error(w, "Failed to fetch janitor report", http.StatusInternalServerError)
+		return
+	}
+
+	h.janitor.mu.Lock()
+	lastRun := h.janitor.lastRun
+	h.janitor.mu.Unlock()
+
+	var usage int64
+	if sizes, err := h.storedSizes(); err != nil {
+		log.Printf("Warning: Failed to measure disk usage: %v", err)
+	} else if usage, err = h.memeUsage(sizes); err != nil {
+		log.Printf("Warning: Failed to measure disk usage: %v", err)
+	}
+
+	data := map[string]interface{}{
+		"Runs":         runs,
+		"LastRun":      lastRun,
+		"DiskBytes":    usage,
+		"MaxDiskBytes": int64(h.intSetting("retention_max_disk_mb", 0)) * humanize.MByte,
+		"FailedDays":   h.intSetting("retention_failed_days", 0),
+		"Message":      message,
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := h.tmpl.ExecuteTemplate(w, "janitor.html", data); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
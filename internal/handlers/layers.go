@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"meme-generator/internal/ollama"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// UpdateLayers edits a generation's annotation layers and renders its
+// image again. The action is "add", which adds a layer on top, or "remove",
+// "raise" or "lower" for the layer at index. Sticker layers can upload a
+// new sticker in sticker_file.
+func (h *Handler) UpdateLayers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	if err := r.ParseMultipartForm(maxUploadBytes); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, "File must be smaller than 20 MB", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	gen, err := h.db.GetGeneration(id)
+	if err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Generation not found", http.StatusNotFound)
+		return
+	}
+
+	if !h.checkRenderable(w, gen) {
+		return
+	}
+
+	layers := append([]ollama.Layer(nil), gen.Layers...)
+	action := r.FormValue("action")
+	if action == "add" {
+		layer, err := h.parseLayer(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		layers = append(layers, layer)
+	} else {
+		i, err := strconv.Atoi(r.FormValue("index"))
+		if err != nil || i < 0 || i >= len(layers) {
+			http.Error(w, "Invalid layer", http.StatusBadRequest)
+			return
+		}
+		switch action {
+		case "remove":
+			layers = append(layers[:i], layers[i+1:]...)
+		case "raise":
+			if i < len(layers)-1 {
+				layers[i], layers[i+1] = layers[i+1], layers[i]
+			}
+		case "lower":
+			if i > 0 {
+				layers[i], layers[i-1] = layers[i-1], layers[i]
+			}
+		default:
+			http.Error(w, fmt.Sprintf("Unknown action: %q", action), http.StatusBadRequest)
+			return
+		}
+	}
+
+	layers, err = ollama.NormalizeLayers(layers)
+	if err != nil {
+		http.Error(w, "Invalid layers: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	spec := renderSpecFor(gen)
+	spec.layers = layers
+	updated, err := h.replaceImage(gen, spec)
+	if err != nil {
+		log.Printf("Error rendering layers for generation %d: %v", id, err)
+		http.Error(w, "Failed to update layers", http.StatusInternalServerError)
+		return
+	}
+
+	h.finalizeGeneration(updated)
+
+	h.renderGeneration(w, updated)
+}
+
+// parseLayer reads a new layer from the add layer form, where positions
+// are percentages of the image size. The returned error is safe to show to
+// the user.
+func (h *Handler) parseLayer(w http.ResponseWriter, r *http.Request) (ollama.Layer, error) {
+	layer := ollama.Layer{
+		Kind:    ollama.LayerKind(r.FormValue("kind")),
+		Text:    r.FormValue("text"),
+		Color:   r.FormValue("color"),
+		Sticker: r.FormValue("sticker"),
+	}
+
+	fields := []struct {
+		name  string
+		label string
+		dest  *float64
+	}{
+		{"x", "X", &layer.X},
+		{"y", "Y", &layer.Y},
+		{"width", "Width", &layer.Width},
+		{"height", "Height", &layer.Height},
+		{"tail_x", "Pointer X", &layer.TailX},
+		{"tail_y", "Pointer Y", &layer.TailY},
+	}
+	for _, f := range fields {
+		value := strings.TrimSpace(r.FormValue(f.name))
+		if value == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return layer, fmt.Errorf("%s must be a number", f.label)
+		}
+		*f.dest = v / 100
+	}
+
+	if layer.Kind == ollama.LayerSticker && r.MultipartForm != nil && len(r.MultipartForm.File["sticker_file"]) > 0 {
+		up, err := readUpload(w, r, "sticker_file", logoFormats)
+		if err != nil {
+			return layer, err
+		}
+		if layer.Sticker, err = h.ollama.SaveSticker(up.data); err != nil {
+			log.Printf("Error saving sticker: %v", err)
+			return layer, fmt.Errorf("Failed to save sticker")
+		}
+	}
+
+	return layer, nil
+}
+
+// stickerChoices lists the stickers layers can use: built-in ones first,
+// then uploaded ones, including those uploaded to other replicas
+func (h *Handler) stickerChoices() []string {
+	stickers := append([]string(nil), ollama.BuiltinStickers...)
+	uploaded, err := h.ollama.ListStickers()
+	if err != nil {
+		log.Printf("Warning: Failed to list stickers: %v", err)
+	}
+	return append(stickers, uploaded...)
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"meme-generator/internal/db"
+	"meme-generator/internal/ollama"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// serveWithMetadata serves an exported image as a download with the
+// generation's metadata embedded. Metadata is added on the way out so the
+// cached variants stay valid when alt text or settings change.
+func (h *Handler) serveWithMetadata(w http.ResponseWriter, r *http.Request, gen *db.Generation, filename, contentType string) {
+	path := filepath.Join(h.imageDir, filename)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Error reading %s: %v", filename, err)
+		http.Error(w, "Failed to read image", http.StatusInternalServerError)
+		return
+	}
+
+	modTime := time.Time{}
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+
+	if embedded, err := ollama.EmbedMetadata(data, h.metadataFor(gen)); err != nil {
+		log.Printf("Warning: Failed to embed metadata in %s (serving without): %v", filename, err)
+	} else {
+		data = embedded
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	http.ServeContent(w, r, filename, modTime, bytes.NewReader(data))
+}
+
+// metadataFor describes how a generation was made, naming only the models
+// that took part in it
+func (h *Handler) metadataFor(gen *db.Generation) ollama.Metadata {
+	meta := ollama.Metadata{
+		GenerationID: gen.ID,
+		Prompt:       gen.Prompt,
+		Source:       gen.Source,
+		TemplateID:   gen.TemplateID,
+		TopText:      gen.TopText,
+		BottomText:   gen.BottomText,
+		Captions:     gen.Captions,
+		Effects:      gen.Effects,
+		Layers:       gen.Layers,
+		Comic:        gen.Comic,
+		AltText:      h.alt(*gen),
+		CreatedAt:    gen.CreatedAt,
+	}
+	// Generations made before models were recorded are described by what
+	// they must have used
+	meta.ImageModel, meta.TextModel, meta.Seed = gen.ImageModel, gen.TextModel, gen.Seed
+	if meta.ImageModel == "" && (gen.Source == db.SourceModel || gen.Source == db.SourceComic) {
+		meta.ImageModel = ollama.ImageModel
+	}
+	if meta.TextModel == "" && (gen.TopText != "" || gen.BottomText != "" || len(gen.Captions) > 0 || gen.Comic != nil) {
+		meta.TextModel = ollama.TextModel
+	}
+	if gen.Description != "" {
+		meta.VisionModel = ollama.DefaultVisionModel
+		if model, err := h.db.GetSetting("vision_model"); err == nil && model != "" {
+			meta.VisionModel = model
+		}
+	}
+	return meta
+}
+
+// Import reads the metadata embedded in a downloaded meme and shows where
+// it came from, linking to the original generation if it is still here and
+// offering to make it again
+func (h *Handler) Import(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	up, err := readUpload(w, r, "image", stillFormats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	meta, err := ollama.ReadMetadata(up.data)
+	if err != nil {
+		http.Error(w, "The file's meme-generator metadata could not be read", http.StatusBadRequest)
+		return
+	}
+	if meta == nil {
+		http.Error(w, "No meme-generator metadata found in this file", http.StatusBadRequest)
+		return
+	}
+
+	// The ID only identifies the original if the prompt matches too, since
+	// the file may come from another install
+	var original *db.Generation
+	if gen, err := h.db.GetGeneration(meta.GenerationID); err == nil && gen.Prompt == meta.Prompt {
+		original = gen
+	}
+
+	_, hasTemplate := h.library.Get(meta.TemplateID)
+	data := map[string]interface{}{
+		"Metadata":    meta,
+		"Original":    original,
+		"HasTemplate": hasTemplate,
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := h.tmpl.ExecuteTemplate(w, "import.html", data); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
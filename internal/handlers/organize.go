@@ -0,0 +1,406 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"meme-generator/internal/db"
+	"meme-generator/internal/ollama"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// tagNew asks the text model for tags for a new generation, if enabled,
+// and adds them as suggestions. Failures are logged, since the meme itself
+// is fine.
+func (h *Handler) tagNew(gen *db.Generation) {
+	if gen.Status != db.StatusSuccess || !h.boolSetting("suggest_tags") {
+		return
+	}
+
+	var captions []string
+	for _, text := range append([]string{gen.TopText, gen.BottomText}, gen.Captions...) {
+		if text = strings.TrimSpace(text); text != "" {
+			captions = append(captions, text)
+		}
+	}
+	suggestions, err := h.ollama.SuggestTags(gen.Prompt, strings.Join(captions, " / "))
+	if err != nil {
+		log.Printf("Warning: Tag suggestion failed (will continue without tags): %v", err)
+		return
+	}
+
+	names := normalizeTags(suggestions)
+	if len(names) > db.MaxTagsPerGeneration {
+		names = names[:db.MaxTagsPerGeneration]
+	}
+	if err := h.db.AddGenerationTags(gen.ID, names, true); err != nil {
+		log.Printf("Warning: Failed to add suggested tags: %v", err)
+		return
+	}
+	gen.Tags = names
+}
+
+// normalizeTags normalizes tag names, dropping invalid ones and duplicates
+func normalizeTags(inputs []string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, input := range inputs {
+		name, err := db.NormalizeTag(input)
+		if err != nil || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// organizeData returns the tags and collections shown for a generation by
+// the organize.html partial
+func (h *Handler) organizeData(gen *db.Generation) map[string]interface{} {
+	data := map[string]interface{}{"Generation": gen}
+	if gen == nil {
+		return data
+	}
+
+	tags, err := h.db.ListGenerationTags(gen.ID)
+	if err != nil {
+		log.Printf("Error fetching tags: %v", err)
+	}
+	inCollections, err := h.db.ListGenerationCollections(gen.ID)
+	if err != nil {
+		log.Printf("Error fetching collections: %v", err)
+	}
+	collections, err := h.db.ListCollections()
+	if err != nil {
+		log.Printf("Error fetching collections: %v", err)
+	}
+
+	data["Tags"] = tags
+	data["InCollections"] = inCollections
+	data["Collections"] = collections
+	data["MaxTagLength"] = db.MaxTagLength
+	data["MaxCollectionNameLength"] = db.MaxCollectionNameLength
+	return data
+}
+
+// renderOrganize writes the organize.html partial for a generation
+func (h *Handler) renderOrganize(w http.ResponseWriter, gen *db.Generation) {
+	w.Header().Set("Content-Type", "text/html")
+	if err := h.tmpl.ExecuteTemplate(w, "organize.html", h.organizeData(gen)); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// UpdateTags adds tags to a generation or removes one. The action is "add"
+// with tags separated by commas in tags, or "remove" with the tag name in
+// tag.
+func (h *Handler) UpdateTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	gen, ok := h.formGeneration(w, r)
+	if !ok {
+		return
+	}
+
+	switch action := r.FormValue("action"); action {
+	case "add":
+		var names []string
+		for _, input := range strings.Split(r.FormValue("tags"), ",") {
+			if strings.TrimSpace(input) == "" {
+				continue
+			}
+			name, err := db.NormalizeTag(input)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid tag %q: %v", strings.TrimSpace(input), err), http.StatusBadRequest)
+				return
+			}
+			names = append(names, name)
+		}
+		if len(names) == 0 {
+			http.Error(w, "Enter at least one tag", http.StatusBadRequest)
+			return
+		}
+		if err := h.db.AddGenerationTags(gen.ID, names, false); err != nil {
+			log.Printf("Error adding tags to generation %d: %v", gen.ID, err)
+			http.Error(w, fmt.Sprintf("Failed to add tags (a meme can have at most %d)", db.MaxTagsPerGeneration), http.StatusBadRequest)
+			return
+		}
+	case "remove":
+		if err := h.db.RemoveGenerationTag(gen.ID, r.FormValue("tag")); err != nil {
+			log.Printf("Error removing tag from generation %d: %v", gen.ID, err)
+			http.Error(w, "Failed to remove tag", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("Unknown action: %q", action), http.StatusBadRequest)
+		return
+	}
+
+	h.renderOrganize(w, gen)
+}
+
+// UpdateGenerationCollections adds a generation to a collection or removes
+// it from one. The action is "add" with a collection ID in collection, or a
+// new collection's name in name, or "remove" with a collection ID.
+func (h *Handler) UpdateGenerationCollections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	gen, ok := h.formGeneration(w, r)
+	if !ok {
+		return
+	}
+
+	action := r.FormValue("action")
+	var collectionID int64
+	if name := strings.TrimSpace(r.FormValue("name")); action == "add" && name != "" {
+		var ok bool
+		if collectionID, ok = h.createCollection(w, name); !ok {
+			return
+		}
+	} else {
+		var err error
+		if collectionID, err = strconv.ParseInt(r.FormValue("collection"), 10, 64); err != nil {
+			http.Error(w, "Choose a collection", http.StatusBadRequest)
+			return
+		}
+		if _, err := h.db.GetCollection(collectionID); err != nil {
+			http.Error(w, "Collection not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	var err error
+	switch action {
+	case "add":
+		err = h.db.AddToCollection(collectionID, gen.ID)
+	case "remove":
+		err = h.db.RemoveFromCollection(collectionID, gen.ID)
+	default:
+		http.Error(w, fmt.Sprintf("Unknown action: %q", action), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating collection %d: %v", collectionID, err)
+		http.Error(w, "Failed to update collection", http.StatusInternalServerError)
+		return
+	}
+
+	h.renderOrganize(w, gen)
+}
+
+// formGeneration fetches the generation named by the id form value, and
+// writes an error response if there is none
+func (h *Handler) formGeneration(w http.ResponseWriter, r *http.Request) (*db.Generation, bool) {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	gen, err := h.db.GetGeneration(id)
+	if err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Generation not found", http.StatusNotFound)
+		return nil, false
+	}
+	return gen, true
+}
+
+// createCollection creates a collection, writing an error response if the
+// name is invalid or taken
+func (h *Handler) createCollection(w http.ResponseWriter, name string) (int64, bool) {
+	if utf8.RuneCountInString(name) > db.MaxCollectionNameLength {
+		http.Error(w, fmt.Sprintf("Collection names must be at most %d characters", db.MaxCollectionNameLength), http.StatusBadRequest)
+		return 0, false
+	}
+	id, err := h.db.CreateCollection(name)
+	if err != nil {
+		log.Printf("Error creating collection %q: %v", name, err)
+		http.Error(w, fmt.Sprintf("Failed to create collection; is %q already taken?", name), http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// Collections lists the collections, with forms to create and delete them
+func (h *Handler) Collections(w http.ResponseWriter, r *http.Request) {
+	h.renderCollections(w)
+}
+
+// CreateCollection creates an empty collection named name and lists the
+// collections again
+func (h *Handler) CreateCollection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if _, ok := h.createCollection(w, name); !ok {
+		return
+	}
+
+	h.renderCollections(w)
+}
+
+// DeleteCollection deletes a collection. Its memes are kept.
+func (h *Handler) DeleteCollection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if err := h.db.DeleteCollection(id); err != nil {
+		log.Printf("Error deleting collection %d: %v", id, err)
+		http.Error(w, "Failed to delete collection", http.StatusInternalServerError)
+		return
+	}
+
+	h.renderCollections(w)
+}
+
+// renderCollections writes the collections.html partial
+func (h *Handler) renderCollections(w http.ResponseWriter) {
+	collections, err := h.db.ListCollections()
+	if err != nil {
+		log.Printf("Error fetching collections: %v", err)
+		http.Error(w, "Failed to fetch collections", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Collections":             collections,
+		"MaxCollectionNameLength": db.MaxCollectionNameLength,
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := h.tmpl.ExecuteTemplate(w, "collections.html", data); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// collectionManifestItem describes one meme in a collection export
+type collectionManifestItem struct {
+	File       string   `json:"file"`
+	Prompt     string   `json:"prompt"`
+	TopText    string   `json:"top_text,omitempty"`
+	BottomText string   `json:"bottom_text,omitempty"`
+	Captions   []string `json:"captions,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	AltText    string   `json:"alt_text"`
+}
+
+// ExportCollection downloads a collection as a zip of its memes, numbered
+// in the order they were added, with the generation metadata embedded as in
+// single downloads and a collection.json manifest
+func (h *Handler) ExportCollection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	collection, err := h.db.GetCollection(id)
+	if err != nil {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+	items, err := h.db.ListCollectionItems(id)
+	if err != nil {
+		log.Printf("Error fetching collection items: %v", err)
+		http.Error(w, "Failed to fetch collection", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", ollama.Filename(collection.Name, ".zip")))
+
+	// Errors after this point can only be logged, as the zip is streamed
+	zw := zip.NewWriter(w)
+	var manifest []collectionManifestItem
+	for i, gen := range items {
+		if gen.Status != db.StatusSuccess || gen.ImagePath == "" {
+			continue
+		}
+		h.fetch(gen.ImagePath)
+		data, err := os.ReadFile(filepath.Join(h.imageDir, gen.ImagePath))
+		if err != nil {
+			log.Printf("Warning: Skipping generation %d in collection export: %v", gen.ID, err)
+			continue
+		}
+		if embedded, err := ollama.EmbedMetadata(data, h.metadataFor(&gen)); err != nil {
+			log.Printf("Warning: Failed to embed metadata in %s (exporting without): %v", gen.ImagePath, err)
+		} else {
+			data = embedded
+		}
+
+		name := fmt.Sprintf("%03d-%s", i+1, gen.ImagePath)
+		if err := writeZipFile(zw, name, data, gen.CreatedAt); err != nil {
+			log.Printf("Error writing collection export: %v", err)
+			return
+		}
+		manifest = append(manifest, collectionManifestItem{
+			File:       name,
+			Prompt:     gen.Prompt,
+			TopText:    gen.TopText,
+			BottomText: gen.BottomText,
+			Captions:   gen.Captions,
+			Tags:       gen.Tags,
+			AltText:    h.alt(gen),
+		})
+	}
+
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"name":  collection.Name,
+		"memes": manifest,
+	}, "", "  ")
+	if err == nil {
+		err = writeZipFile(zw, "collection.json", data, time.Now())
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		log.Printf("Error writing collection export: %v", err)
+	}
+}
+
+// writeZipFile adds a file to a zip. Images are stored rather than
+// deflated, since they are already compressed.
+func writeZipFile(zw *zip.Writer, name string, data []byte, modified time.Time) error {
+	method := zip.Store
+	if strings.HasSuffix(name, ".json") {
+		method = zip.Deflate
+	}
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"meme-generator/internal/db"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// raterCookie identifies a browser's ratings, so rating a meme again
+// replaces the earlier rating instead of adding another
+const raterCookie = "rater"
+
+// bestOfSize is how many memes the best of view shows
+const bestOfSize = 24
+
+// bestOfPeriods are the time windows the best of view can cover, in the
+// order offered
+var bestOfPeriods = []struct {
+	Name, Label string
+	Days        int
+}{
+	{"week", "This week", 7},
+	{"month", "This month", 30},
+	{"year", "This year", 365},
+	{"all", "All time", 0},
+}
+
+// rater returns the browser's rater ID, setting the cookie if it has none
+func rater(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(raterCookie); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	id, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     raterCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   10 * 365 * 24 * 60 * 60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id, nil
+}
+
+// GetRating renders a generation's favorite star and rating
+func (h *Handler) GetRating(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	gen, err := h.db.GetGeneration(id)
+	if err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Generation not found", http.StatusNotFound)
+		return
+	}
+
+	h.renderRating(w, gen, h.raterStars(r, gen.ID))
+}
+
+// Rate records the browser's stars (1 to 5) for a generation, or clears
+// its rating with stars=0
+func (h *Handler) Rate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	gen, ok := h.formGeneration(w, r)
+	if !ok {
+		return
+	}
+	stars, err := strconv.Atoi(r.FormValue("stars"))
+	if err != nil || stars < 0 || stars > db.MaxStars {
+		http.Error(w, fmt.Sprintf("Stars must be a number from 1 to %d, or 0 to clear", db.MaxStars), http.StatusBadRequest)
+		return
+	}
+	if gen.Status != db.StatusSuccess {
+		http.Error(w, "Only finished memes can be rated", http.StatusBadRequest)
+		return
+	}
+
+	raterID, err := rater(w, r)
+	if err != nil {
+		log.Printf("Error creating rater ID: %v", err)
+		http.Error(w, "Failed to save rating", http.StatusInternalServerError)
+		return
+	}
+	if stars == 0 {
+		err = h.db.ClearRating(gen.ID, raterID)
+	} else {
+		err = h.db.RateGeneration(gen.ID, raterID, stars)
+	}
+	if err != nil {
+		log.Printf("Error rating generation %d: %v", gen.ID, err)
+		http.Error(w, "Failed to save rating", http.StatusInternalServerError)
+		return
+	}
+
+	h.rerenderRating(w, gen.ID, stars)
+}
+
+// Favorite stars a generation with favorite=on, or unstars it
+func (h *Handler) Favorite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	gen, ok := h.formGeneration(w, r)
+	if !ok {
+		return
+	}
+	if err := h.db.SetFavorite(gen.ID, r.FormValue("favorite") == "on"); err != nil {
+		log.Printf("Error updating favorite: %v", err)
+		http.Error(w, "Failed to update favorite", http.StatusInternalServerError)
+		return
+	}
+
+	h.rerenderRating(w, gen.ID, h.raterStars(r, gen.ID))
+}
+
+// rerenderRating renders the rating partial with a generation's updated
+// aggregates
+func (h *Handler) rerenderRating(w http.ResponseWriter, id int64, stars int) {
+	gen, err := h.db.GetGeneration(id)
+	if err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Failed to fetch generation", http.StatusInternalServerError)
+		return
+	}
+	h.renderRating(w, gen, stars)
+}
+
+// raterStars returns the browser's stars for a generation, or 0 if it has
+// not rated it
+func (h *Handler) raterStars(r *http.Request, id int64) int {
+	cookie, err := r.Cookie(raterCookie)
+	if err != nil {
+		return 0
+	}
+	stars, err := h.db.GetRating(id, cookie.Value)
+	if err != nil {
+		log.Printf("Error fetching rating: %v", err)
+	}
+	return stars
+}
+
+// renderRating writes the rating.html partial, with the browser's own
+// stars highlighted
+func (h *Handler) renderRating(w http.ResponseWriter, gen *db.Generation, stars int) {
+	var choices []int
+	for i := 1; i <= db.MaxStars; i++ {
+		choices = append(choices, i)
+	}
+
+	data := map[string]interface{}{
+		"Generation": gen,
+		"Stars":      stars,
+		"Choices":    choices,
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := h.tmpl.ExecuteTemplate(w, "rating.html", data); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// BestOf lists the best rated and favorite memes, best first and then
+// newest, made within period (week, month, year or all, the default)
+func (h *Handler) BestOf(w http.ResponseWriter, r *http.Request) {
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "all"
+	}
+
+	var since time.Time
+	found := false
+	for _, p := range bestOfPeriods {
+		if p.Name == period {
+			found = true
+			if p.Days > 0 {
+				since = time.Now().AddDate(0, 0, -p.Days)
+			}
+		}
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("Unknown period: %q", period), http.StatusBadRequest)
+		return
+	}
+
+	generations, err := h.db.ListBestOf(since, bestOfSize)
+	if err != nil {
+		log.Printf("Error fetching best of: %v", err)
+		http.Error(w, "Failed to fetch best of", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Generations": generations,
+		"Period":      period,
+		"Periods":     bestOfPeriods,
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := h.tmpl.ExecuteTemplate(w, "best.html", data); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// RatingReport compares system prompts and models by the ratings of the
+// memes they made
+func (h *Handler) RatingReport(w http.ResponseWriter, r *http.Request) {
+	groups, err := h.db.ListRatingGroups()
+	if err != nil {
+		log.Printf("Error fetching rating report: %v", err)
+		http.Error(w, "Failed to fetch rating report", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Groups": groups,
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := h.tmpl.ExecuteTemplate(w, "ratings.html", data); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Reconcile reports orphan images, generations whose image is missing and
+// duplicate images
+func (h *Handler) Reconcile(w http.ResponseWriter, r *http.Request) {
+	h.renderReconcile(w, "")
+}
+
+// ImportOrphans imports the given orphan images (one file per image, by
+// key) as generations
+func (h *Handler) ImportOrphans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	keys := r.Form["file"]
+	if len(keys) == 0 {
+		http.Error(w, "Select at least one image", http.StatusBadRequest)
+		return
+	}
+
+	// Step 1: Scan again, so only files that are still orphans are imported
+	report, err := h.reconciler.Scan()
+	if err != nil {
+		log.Printf("Error scanning files: %v", err)
+		http.Error(w, "Failed to scan files", http.StatusInternalServerError)
+		return
+	}
+
+	// Step 2: Import each one, then finish it like a new generation
+	imported := 0
+	var skipped []string
+	for _, key := range keys {
+		orphan, ok := report.Orphan(key)
+		if !ok || !orphan.Importable() {
+			skipped = append(skipped, key)
+			continue
+		}
+		id, err := h.reconciler.Import(orphan)
+		if err != nil {
+			log.Printf("Error importing %s: %v", key, err)
+			skipped = append(skipped, key)
+			continue
+		}
+		imported++
+
+		gen, err := h.db.GetGeneration(id)
+		if err != nil {
+			log.Printf("Error fetching generation: %v", err)
+			continue
+		}
+		h.finalizeGeneration(gen)
+		h.tagNew(gen)
+	}
+
+	message := fmt.Sprintf("Imported %d image%s.", imported, plural(imported))
+	if len(skipped) > 0 {
+		message += fmt.Sprintf(" Skipped %s.", strings.Join(skipped, ", "))
+	}
+	h.renderReconcile(w, message)
+}
+
+// TrashMissing moves generations whose image is missing (one id each) to
+// the trash
+func (h *Handler) TrashMissing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ids, ok := formIDs(w, r)
+	if !ok {
+		return
+	}
+	trashed, err := h.db.TrashGenerations(ids)
+	if err != nil {
+		log.Printf("Error trashing generations: %v", err)
+		http.Error(w, "Failed to delete generations", http.StatusInternalServerError)
+		return
+	}
+
+	h.renderReconcile(w, fmt.Sprintf("Moved %d meme%s to the trash.", trashed, plural(int(trashed))))
+}
+
+// renderReconcile scans the files and writes the reconcile.html partial
+// with an optional message
+func (h *Handler) renderReconcile(w http.ResponseWriter, message string) {
+	report, err := h.reconciler.Scan()
+	if err != nil {
+		log.Printf("Error scanning files: %v", err)
+		http.Error(w, "Failed to scan files", http.StatusInternalServerError)
+		return
+	}
+
+	importable := 0
+	for _, o := range report.Orphans {
+		if o.Importable() {
+			importable++
+		}
+	}
+
+	data := map[string]interface{}{
+		"Report":     report,
+		"Importable": importable,
+		"Message":    message,
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := h.tmpl.ExecuteTemplate(w, "reconcile.html", data); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"meme-generator/internal/db"
+	"meme-generator/internal/library"
+	"meme-generator/internal/ollama"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Rerender captions a generation's base image again with edited text. The
+// image keeps its filename but gets a new content hash, so versioned URLs
+// change, and exports and resized copies of the old image are discarded.
+func (h *Handler) Rerender(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	gen, err := h.db.GetGeneration(id)
+	if err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Generation not found", http.StatusNotFound)
+		return
+	}
+
+	if !h.checkRenderable(w, gen) {
+		return
+	}
+
+	spec := renderSpecFor(gen)
+	spec.topText = strings.TrimSpace(r.FormValue("top_text"))
+	spec.bottomText = strings.TrimSpace(r.FormValue("bottom_text"))
+	spec.captions = nil
+	if t, ok := h.library.Get(gen.TemplateID); ok {
+		spec.captions = make([]string, len(t.Boxes))
+		for i, text := range r.Form["text"] {
+			if i < len(spec.captions) {
+				spec.captions[i] = strings.TrimSpace(text)
+			}
+		}
+	}
+
+	gen, err = h.replaceImage(gen, spec)
+	if err != nil {
+		log.Printf("Error re-rendering generation %d: %v", id, err)
+		http.Error(w, "Failed to re-render image", http.StatusInternalServerError)
+		return
+	}
+
+	h.finalizeGeneration(gen)
+
+	h.renderGeneration(w, gen)
+}
+
+// renderSpec is the text, layers, effects and watermark a generation's
+// image is rendered with
+type renderSpec struct {
+	topText        string
+	bottomText     string
+	captions       []string // one per text box, for template memes
+	layers         []ollama.Layer
+	effects        []ollama.Effect
+	watermark      bool
+	smartPlacement bool
+}
+
+// renderSpecFor returns the spec a generation's image was last rendered with
+func renderSpecFor(gen *db.Generation) renderSpec {
+	return renderSpec{
+		topText:        gen.TopText,
+		bottomText:     gen.BottomText,
+		captions:       gen.Captions,
+		layers:         gen.Layers,
+		effects:        gen.Effects,
+		watermark:      gen.Watermark,
+		smartPlacement: gen.SmartPlacement,
+	}
+}
+
+// checkRenderable reports whether a generation's image can be rendered
+// again from its base image, and writes an error response if not. The base
+// is fetched from storage if this replica lacks it or holds an old copy.
+func (h *Handler) checkRenderable(w http.ResponseWriter, gen *db.Generation) bool {
+	h.fetch(gen.BasePath)
+
+	if gen.Status != db.StatusSuccess || gen.BasePath == "" || !fileExists(filepath.Join(h.imageDir, gen.BasePath)) {
+		http.Error(w, "The original image was not kept, so this meme cannot be re-rendered", http.StatusConflict)
+		return false
+	}
+	if gen.TemplateID != "" {
+		if _, ok := h.library.Get(gen.TemplateID); !ok {
+			http.Error(w, fmt.Sprintf("Template %q is no longer installed", gen.TemplateID), http.StatusConflict)
+			return false
+		}
+	}
+	return true
+}
+
+// renderImage renders a generation's base image into destPath: base stage
+// effects first, then the captions and layers, then final stage effects
+// and finally the watermark
+func (h *Handler) renderImage(gen *db.Generation, destPath string, spec renderSpec) error {
+	if err := h.renderCaptioned(gen, destPath, spec); err != nil {
+		return err
+	}
+	if !spec.watermark {
+		return nil
+	}
+
+	wm := h.watermarkSettings()
+	if !wm.Configured() {
+		return fmt.Errorf("no watermark is configured")
+	}
+	return h.ollama.ApplyWatermark(destPath, destPath, wm)
+}
+
+// renderCaptioned renders everything before the watermark
+func (h *Handler) renderCaptioned(gen *db.Generation, destPath string, spec renderSpec) error {
+	basePath := filepath.Join(h.imageDir, gen.BasePath)
+
+	var t *library.Template
+	if gen.TemplateID != "" {
+		var ok bool
+		if t, ok = h.library.Get(gen.TemplateID); !ok {
+			return fmt.Errorf("template %q is not installed", gen.TemplateID)
+		}
+	}
+	opts := ollama.OverlayOptions{
+		SmartPlacement: spec.smartPlacement,
+	}
+
+	if gen.IsAnimated() {
+		if len(spec.effects) > 0 {
+			return fmt.Errorf("effects are not available for animated GIFs")
+		}
+		var err error
+		if gen.TemplateID != "" {
+			err = h.ollama.OverlayGIFTemplateText(basePath, destPath, t.Boxes, spec.captions)
+		} else {
+			err = h.ollama.OverlayGIFText(basePath, destPath, spec.topText, spec.bottomText, opts)
+		}
+		if err != nil || len(spec.layers) == 0 {
+			return err
+		}
+		return h.ollama.ApplyLayers(destPath, destPath, spec.layers)
+	}
+
+	src := basePath
+	if effects := ollama.EffectsForStage(spec.effects, ollama.StageBase); len(effects) > 0 {
+		if err := h.ollama.ApplyEffects(basePath, destPath, effects); err != nil {
+			return err
+		}
+		src = destPath
+	}
+
+	if gen.TemplateID != "" {
+		if err := h.ollama.OverlayTemplateText(src, destPath, t.Boxes, spec.captions); err != nil {
+			return err
+		}
+	} else {
+		if src != destPath {
+			if err := copyFile(src, destPath); err != nil {
+				return err
+			}
+		}
+		if err := h.ollama.OverlayMemeText(destPath, spec.topText, spec.bottomText, opts); err != nil {
+			return err
+		}
+	}
+
+	if len(spec.layers) > 0 {
+		if err := h.ollama.ApplyLayers(destPath, destPath, spec.layers); err != nil {
+			return err
+		}
+	}
+
+	if effects := ollama.EffectsForStage(spec.effects, ollama.StageFinal); len(effects) > 0 {
+		return h.ollama.ApplyEffects(destPath, destPath, effects)
+	}
+	return nil
+}
+
+// replaceImage renders a generation's image again and swaps it in, then
+// records what it was rendered with and returns the updated generation.
+// Callers finalize the result.
+func (h *Handler) replaceImage(gen *db.Generation, spec renderSpec) (*db.Generation, error) {
+	filename := renderFilename(gen)
+
+	// Render next to the image and rename over it, so the old image is
+	// served until the new one is complete. Each render gets its own temp
+	// file, as two may run for one generation at once; the pattern keeps
+	// the extension the renderers choose the format by.
+	tmp, err := os.CreateTemp(h.imageDir, ".rerender-*-"+filename)
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	if err := h.renderImage(gen, tmpPath, spec); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(h.imageDir, filename)); err != nil {
+		return nil, err
+	}
+
+	gen.ImagePath = filename
+	h.invalidateVariants(gen)
+
+	if err := h.db.UpdateGenerationStatus(gen.ID, db.StatusSuccess, filename, ""); err != nil {
+		log.Printf("Error updating generation status: %v", err)
+	}
+	if gen.TemplateID != "" {
+		err = h.db.UpdateGenerationCaptions(gen.ID, spec.captions)
+	} else {
+		err = h.db.UpdateGenerationText(gen.ID, spec.topText, spec.bottomText)
+	}
+	if err != nil {
+		log.Printf("Error updating generation text: %v", err)
+	}
+	if err := h.db.UpdateGenerationLayers(gen.ID, spec.layers); err != nil {
+		log.Printf("Error updating generation layers: %v", err)
+	}
+	if err := h.db.UpdateGenerationEffects(gen.ID, spec.effects); err != nil {
+		log.Printf("Error updating generation effects: %v", err)
+	}
+	if err := h.db.UpdateGenerationWatermark(gen.ID, spec.watermark); err != nil {
+		log.Printf("Error updating generation watermark: %v", err)
+	}
+	if err := h.db.UpdateGenerationPlacement(gen.ID, spec.smartPlacement); err != nil {
+		log.Printf("Error updating generation placement: %v", err)
+	}
+
+	updated, err := h.db.GetGeneration(gen.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch generation: %w", err)
+	}
+	return updated, nil
+}
+
+// renderFilename returns the file a generation's image is rendered into.
+// Generations without text show the base image itself; renders go into a
+// separate file so the base stays clean.
+func renderFilename(gen *db.Generation) string {
+	if gen.ImagePath != gen.BasePath {
+		return gen.ImagePath
+	}
+	return strings.TrimSuffix(gen.BasePath, filepath.Ext(gen.BasePath)) + "-meme" + filepath.Ext(gen.BasePath)
+}
+
+// invalidateVariants forgets and deletes the exports, resized copies and
+// share link copies of a generation's image after the image changes
+func (h *Handler) invalidateVariants(gen *db.Generation) {
+	variants, err := h.db.DeleteVariants(gen.ID)
+	if err != nil {
+		log.Printf("Error deleting variants: %v", err)
+	}
+
+	var stale []string
+	for _, v := range variants {
+		// A PNG export of a PNG is the image itself
+		if v.Filename != gen.ImagePath && v.Filename != gen.BasePath {
+			stale = append(stale, v.Filename)
+		}
+	}
+	for _, size := range ollama.ImageSizes {
+		stale = append(stale, ollama.SizedFilename(gen.ImagePath, size.Width))
+	}
+
+	for _, filename := range stale {
+		if err := os.Remove(filepath.Join(h.imageDir, filename)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: Failed to remove stale variant %s: %v", filename, err)
+		}
+	}
+	if err := h.ollama.RemoveWatermarkedCopies(gen.ImagePath); err != nil {
+		log.Printf("Warning: Failed to remove shared copies: %v", err)
+	}
+}
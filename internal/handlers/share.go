@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"log"
+	"meme-generator/internal/db"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Share creates a public share link for a generation, or revokes it when
+// revoke=true. Shared images are always served with the watermark.
+func (h *Handler) Share(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	gen, err := h.db.GetGeneration(id)
+	if err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Generation not found", http.StatusNotFound)
+		return
+	}
+
+	token := ""
+	if r.FormValue("revoke") != "true" {
+		if gen.Status != db.StatusSuccess || gen.ImagePath == "" {
+			http.Error(w, "Generation has no image", http.StatusNotFound)
+			return
+		}
+		if !h.watermarkSettings().Configured() {
+			http.Error(w, "Set up a watermark in Settings before sharing", http.StatusConflict)
+			return
+		}
+
+		token = gen.ShareToken
+		if token == "" {
+			if token, err = randomToken(); err != nil {
+				log.Printf("Error creating share token: %v", err)
+				http.Error(w, "Failed to create share link", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	if err := h.db.UpdateGenerationShareToken(id, token); err != nil {
+		log.Printf("Error updating share token: %v", err)
+		http.Error(w, "Failed to update share link", http.StatusInternalServerError)
+		return
+	}
+
+	gen, err = h.db.GetGeneration(id)
+	if err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Failed to fetch generation", http.StatusInternalServerError)
+		return
+	}
+
+	h.renderGeneration(w, gen)
+}
+
+// ServeShared serves the image behind a share link. Images that were not
+// rendered with the watermark get a watermarked copy, so a share link never
+// exposes an unmarked image.
+func (h *Handler) ServeShared(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/s/")
+	gen, err := h.db.GetGenerationByShareToken(token)
+	if err != nil || gen.Status != db.StatusSuccess || gen.ImagePath == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	wm := h.watermarkSettings()
+	if !wm.Configured() {
+		http.Error(w, "Sharing is unavailable until a watermark is configured", http.StatusForbidden)
+		return
+	}
+
+	h.fetch(gen.ImagePath)
+	filename := gen.ImagePath
+	if !gen.Watermark {
+		filename, err = h.ollama.WatermarkedCopy(gen.ImagePath, wm)
+		if err != nil {
+			log.Printf("Error watermarking shared generation %d: %v", gen.ID, err)
+			http.Error(w, "Failed to render image", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Revoking a link must take effect straight away
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, filepath.Join(h.imageDir, filename))
+}
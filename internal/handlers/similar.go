@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"meme-generator/internal/db"
+	"meme-generator/internal/ollama"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// similarLimit is how many memes a similarity search returns
+	similarLimit = 12
+	// indexBatchSize is how many past memes one indexing request embeds,
+	// so the request finishes in reasonable time
+	indexBatchSize = 50
+)
+
+// similarResult is a meme found by semantic search and how alike it is to
+// the query, from -1 to 1
+type similarResult struct {
+	Generation db.Generation
+	Score      float64
+}
+
+// Percent returns the score as a whole percentage for display
+func (s similarResult) Percent() int {
+	return int(max(0, s.Score) * 100)
+}
+
+// Similar finds memes by meaning: either those most like the generation
+// id, or those best matching the text q. Embeddings are compared by cosine
+// similarity in memory, which is plenty fast for a personal history.
+func (h *Handler) Similar(w http.ResponseWriter, r *http.Request) {
+	if !h.boolSetting("semantic_search") {
+		http.Error(w, "Semantic search is turned off in Settings", http.StatusConflict)
+		return
+	}
+	model := h.embeddingModel()
+
+	var source *db.Generation
+	var vector []float32
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if idStr := r.URL.Query().Get("id"); idStr != "" {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		if source, err = h.db.GetGeneration(id); err != nil {
+			log.Printf("Error fetching generation: %v", err)
+			http.Error(w, "Generation not found", http.StatusNotFound)
+			return
+		}
+		// Embed on demand, for memes made before semantic search was on
+		if vector, err = h.embedding(source, model); err != nil {
+			log.Printf("Error embedding generation %d: %v", id, err)
+			http.Error(w, "Failed to embed this meme", http.StatusInternalServerError)
+			return
+		}
+	} else if query != "" {
+		var err error
+		if vector, err = h.ollama.Embed(query, model); err != nil {
+			log.Printf("Error embedding query: %v", err)
+			http.Error(w, "Failed to embed the search", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		http.Error(w, "ID or search text is required", http.StatusBadRequest)
+		return
+	}
+
+	embeddings, err := h.db.ListEmbeddings(model)
+	if err != nil {
+		log.Printf("Error fetching embeddings: %v", err)
+		http.Error(w, "Failed to search memes", http.StatusInternalServerError)
+		return
+	}
+
+	var scored []similarResult
+	for _, e := range embeddings {
+		if source != nil && e.GenerationID == source.ID {
+			continue
+		}
+		scored = append(scored, similarResult{
+			Generation: db.Generation{ID: e.GenerationID},
+			Score:      ollama.CosineSimilarity(vector, e.Vector),
+		})
+	}
+	sort.Slice(scored, func(i, j int) bool { return scored[i].Score > scored[j].Score })
+
+	var results []similarResult
+	for _, s := range scored[:min(len(scored), similarLimit)] {
+		gen, err := h.db.GetGeneration(s.Generation.ID)
+		if err != nil {
+			log.Printf("Warning: Failed to fetch generation %d: %v", s.Generation.ID, err)
+			continue
+		}
+		s.Generation = *gen
+		results = append(results, s)
+	}
+
+	unindexed, err := h.db.ListUnembedded(model, 1)
+	if err != nil {
+		log.Printf("Warning: Failed to count unindexed memes: %v", err)
+	}
+
+	data := map[string]interface{}{
+		"Source":    source,
+		"Query":     query,
+		"Results":   results,
+		"Unindexed": len(unindexed) > 0,
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := h.tmpl.ExecuteTemplate(w, "similar.html", data); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// IndexEmbeddings embeds a batch of past memes that have no embedding yet
+func (h *Handler) IndexEmbeddings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.boolSetting("semantic_search") {
+		http.Error(w, "Semantic search is turned off in Settings", http.StatusConflict)
+		return
+	}
+	model := h.embeddingModel()
+
+	pending, err := h.db.ListUnembedded(model, indexBatchSize)
+	if err != nil {
+		log.Printf("Error fetching unindexed memes: %v", err)
+		http.Error(w, "Failed to index memes", http.StatusInternalServerError)
+		return
+	}
+
+	indexed := 0
+	for i := range pending {
+		if _, err := h.embedding(&pending[i], model); err != nil {
+			log.Printf("Error embedding generation %d: %v", pending[i].ID, err)
+			http.Error(w, fmt.Sprintf("Indexed %d memes, then embedding failed; is %s installed?", indexed, model), http.StatusInternalServerError)
+			return
+		}
+		indexed++
+	}
+
+	remaining, err := h.db.ListUnembedded(model, 1)
+	if err != nil {
+		log.Printf("Warning: Failed to count unindexed memes: %v", err)
+	}
+
+	memes := "memes"
+	if indexed == 1 {
+		memes = "meme"
+	}
+	status := "Every meme is indexed."
+	if len(remaining) > 0 {
+		status = "More remain; index again to continue."
+	}
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(w, `<p><small>Indexed %d %s. %s</small></p>`, indexed, memes, status)
+}
+
+// embedGeneration keeps a generation's embedding up to date after it is
+// made or re-rendered, if semantic search is on. Failures are logged, since
+// the meme itself is fine.
+func (h *Handler) embedGeneration(gen *db.Generation) {
+	if gen.ParentID != 0 || !h.boolSetting("semantic_search") {
+		return
+	}
+	if _, err := h.embedding(gen, h.embeddingModel()); err != nil {
+		log.Printf("Warning: Failed to embed generation %d: %v", gen.ID, err)
+	}
+}
+
+// embedding returns a generation's embedding from model, embedding it
+// again if it is missing, from another model or its text has changed
+func (h *Handler) embedding(gen *db.Generation, model string) ([]float32, error) {
+	text := gen.EmbeddingText()
+	sum := sha256.Sum256([]byte(text))
+	textHash := hex.EncodeToString(sum[:12])
+
+	existing, err := h.db.GetEmbedding(gen.ID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.Model == model && existing.TextHash == textHash {
+		return existing.Vector, nil
+	}
+
+	vector, err := h.ollama.Embed(text, model)
+	if err != nil {
+		return nil, err
+	}
+	err = h.db.UpsertEmbedding(db.Embedding{
+		GenerationID: gen.ID,
+		Model:        model,
+		TextHash:     textHash,
+		Vector:       vector,
+	})
+	return vector, err
+}
+
+// embeddingModel returns the configured embedding model
+func (h *Handler) embeddingModel() string {
+	if model, err := h.db.GetSetting("embedding_model"); err == nil && model != "" {
+		return model
+	}
+	return ollama.DefaultEmbeddingModel
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"meme-generator/internal/storage"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// signedURLExpiry is how long a redirect to storage stays valid
+const signedURLExpiry = time.Hour
+
+// publish puts files from the image directory in storage, so other
+// replicas can find them. Failures are only logged, as this replica can
+// still serve the files itself.
+func (h *Handler) publish(filenames ...string) {
+	for _, filename := range filenames {
+		if filename == "" {
+			continue
+		}
+		if err := storage.PutFile(h.store, filepath.ToSlash(filename), filepath.Join(h.imageDir, filename)); err != nil {
+			log.Printf("Warning: Failed to store %s: %v", filename, err)
+		}
+	}
+}
+
+// unpublish deletes files from storage
+func (h *Handler) unpublish(filenames ...string) {
+	for _, filename := range filenames {
+		if filename == "" {
+			continue
+		}
+		if err := h.store.Delete(filepath.ToSlash(filename)); err != nil {
+			log.Printf("Warning: Failed to delete %s from storage: %v", filename, err)
+		}
+	}
+}
+
+// fetch downloads files from storage into the image directory when they
+// are missing here or their content differs from storage's, as when
+// another replica re-rendered them. Objects stored without a content hash
+// are only fetched when missing. Files storage does not have are left for
+// the caller to report.
+func (h *Handler) fetch(filenames ...string) {
+	for _, filename := range filenames {
+		if filename == "" {
+			continue
+		}
+		key := filepath.ToSlash(filename)
+		localPath := filepath.Join(h.imageDir, filename)
+		if storage.Holds(h.store, key, localPath) {
+			continue
+		}
+		obj, err := h.store.Stat(key)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("Warning: Failed to check storage for %s: %v", filename, err)
+			}
+			continue
+		}
+		if fileExists(localPath) {
+			if obj.SHA256 == "" {
+				continue
+			}
+			// Cached hashes are a prefix of the full digest
+			if hash, err := h.hashes.hash(localPath); err == nil && strings.HasPrefix(obj.SHA256, hash) {
+				continue
+			}
+		}
+		if err := storage.GetFile(h.store, key, localPath); err != nil {
+			log.Printf("Warning: Failed to fetch %s from storage: %v", filename, err)
+		}
+	}
+}
+
+// fetchMissing downloads files from storage only when they are missing
+// here. It suits files whose names change with their content, such as
+// stickers, and requests where a round trip to storage would be wasted.
+func (h *Handler) fetchMissing(filenames ...string) {
+	for _, filename := range filenames {
+		localPath := filepath.Join(h.imageDir, filename)
+		if filename == "" || fileExists(localPath) {
+			continue
+		}
+		err := storage.GetFile(h.store, filepath.ToSlash(filename), localPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Warning: Failed to fetch %s from storage: %v", filename, err)
+		}
+	}
+}
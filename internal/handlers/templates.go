@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"meme-generator/internal/db"
+	"meme-generator/internal/ollama"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Templates renders the template picker, filtered by ?q= on name and tags
+func (h *Handler) Templates(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+
+	data := map[string]interface{}{
+		"Templates": h.library.Search(query),
+		"Query":     query,
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := h.tmpl.ExecuteTemplate(w, "templates.html", data); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// GenerateFromTemplate captions a library template without generating an
+// image. Text boxes the user leaves blank are written by the text model.
+func (h *Handler) GenerateFromTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	t, ok := h.library.Get(r.FormValue("template_id"))
+	if !ok {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+
+	texts := make([]string, len(t.Boxes))
+	hasText, hasBlank := false, false
+	for i := range texts {
+		if i < len(r.Form["text"]) {
+			texts[i] = strings.TrimSpace(r.Form["text"][i])
+		}
+		if texts[i] != "" {
+			hasText = true
+		} else {
+			hasBlank = true
+		}
+	}
+
+	prompt := strings.TrimSpace(r.FormValue("prompt"))
+	if prompt == "" && !hasText {
+		http.Error(w, "Describe the meme or fill in at least one text box", http.StatusBadRequest)
+		return
+	}
+	if prompt == "" {
+		prompt = t.Name
+	}
+
+	id, err := h.db.InsertGeneration(prompt, db.SourceTemplate, "", db.StatusProcessing, "")
+	if err != nil {
+		log.Printf("Error inserting generation: %v", err)
+		http.Error(w, "Failed to create generation", http.StatusInternalServerError)
+		return
+	}
+	if err := h.db.UpdateGenerationTemplate(id, t.ID); err != nil {
+		log.Printf("Error updating generation template: %v", err)
+	}
+
+	// Step 1: Generate text for the boxes the user left blank
+	if hasBlank {
+		generated, err := h.ollama.GenerateBoxText(prompt, t.Name, t.Labels(), texts)
+		if err != nil {
+			log.Printf("Warning: Text generation failed (will continue without text): %v", err)
+		} else {
+			texts = generated
+			if err := h.db.UpdateGenerationModels(id, "", "", ollama.TextModel); err != nil {
+				log.Printf("Error updating generation models: %v", err)
+			}
+		}
+	}
+
+	// Step 2: Copy the template image so the generation does not depend on
+	// the library staying unchanged
+	ext := strings.ToLower(filepath.Ext(t.Image))
+	baseFilename, err := h.ollama.NewFilename(prompt, ext)
+	if err != nil {
+		h.failGeneration(w, id, err)
+		return
+	}
+	if err := copyFile(h.library.ImagePath(t), filepath.Join(h.imageDir, baseFilename)); err != nil {
+		os.Remove(filepath.Join(h.imageDir, baseFilename))
+		h.failGeneration(w, id, err)
+		return
+	}
+	if err := h.db.UpdateGenerationBase(id, baseFilename); err != nil {
+		log.Printf("Error updating generation base: %v", err)
+	}
+
+	// Step 3: Fill the text boxes into a separate file
+	basePath := filepath.Join(h.imageDir, baseFilename)
+	stem := strings.TrimSuffix(baseFilename, ext)
+	var filename string
+	if t.IsAnimated() {
+		filename = stem + "-meme.gif"
+		err = h.ollama.OverlayGIFTemplateText(basePath, filepath.Join(h.imageDir, filename), t.Boxes, texts)
+	} else {
+		filename = stem + "-meme.png"
+		err = h.ollama.OverlayTemplateText(basePath, filepath.Join(h.imageDir, filename), t.Boxes, texts)
+	}
+	if err != nil {
+		h.failGeneration(w, id, err)
+		return
+	}
+
+	// Step 4: Update database with results
+	if err := h.db.UpdateGenerationStatus(id, db.StatusSuccess, filename, ""); err != nil {
+		log.Printf("Error updating generation status: %v", err)
+	}
+	if err := h.db.UpdateGenerationCaptions(id, texts); err != nil {
+		log.Printf("Error updating generation captions: %v", err)
+	}
+
+	gen, err := h.db.GetGeneration(id)
+	if err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Failed to fetch generation", http.StatusInternalServerError)
+		return
+	}
+
+	// Step 5: Watermark if new memes are watermarked, then export the
+	// configured default format and record variant sizes
+	gen = h.watermarkNew(gen)
+	h.finalizeGeneration(gen)
+
+	// Step 6: Suggest tags using gemma3:270m, if enabled
+	h.tagNew(gen)
+
+	h.renderGeneration(w, gen)
+}
+
+// ServeTemplateImage serves a template's blank base image, by template
+// ID. Only images templates declare are served, not their descriptors or
+// anything else in the library directory.
+func (h *Handler) ServeTemplateImage(w http.ResponseWriter, r *http.Request) {
+	t, ok := h.library.Get(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, h.library.ImagePath(t))
+}
+
+// copyFile copies src to dst, creating or truncating dst
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", src, err)
+	}
+	if err := os.WriteFile(dst, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", dst, err)
+	}
+	return nil
+}
@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"meme-generator/internal/db"
+	"meme-generator/internal/ollama"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// trashPageSize is how many generations the trash view shows
+const trashPageSize = 60
+
+// DeleteGeneration moves a generation to the trash and shows it with the
+// option to restore it
+func (h *Handler) DeleteGeneration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	gen, ok := h.formGeneration(w, r)
+	if !ok {
+		return
+	}
+	if gen.ParentID != 0 {
+		http.Error(w, "Comic panels are deleted with their strip", http.StatusBadRequest)
+		return
+	}
+	if _, err := h.db.TrashGenerations([]int64{gen.ID}); err != nil {
+		log.Printf("Error trashing generation %d: %v", gen.ID, err)
+		http.Error(w, "Failed to delete generation", http.StatusInternalServerError)
+		return
+	}
+
+	h.rerenderGeneration(w, gen.ID)
+}
+
+// RestoreGeneration takes a generation back out of the trash
+func (h *Handler) RestoreGeneration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	gen, ok := h.formGeneration(w, r)
+	if !ok {
+		return
+	}
+	if _, err := h.db.RestoreGenerations([]int64{gen.ID}); err != nil {
+		log.Printf("Error restoring generation %d: %v", gen.ID, err)
+		http.Error(w, "Failed to restore generation", http.StatusInternalServerError)
+		return
+	}
+
+	h.rerenderGeneration(w, gen.ID)
+}
+
+// rerenderGeneration renders a generation after changing it
+func (h *Handler) rerenderGeneration(w http.ResponseWriter, id int64) {
+	gen, err := h.db.GetGeneration(id)
+	if err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Failed to fetch generation", http.StatusInternalServerError)
+		return
+	}
+	h.renderGeneration(w, gen)
+}
+
+// DeleteHistory moves the generations selected in the history (one id per
+// generation) to the trash, and lists the first page of the history again
+// with the filters sent along
+func (h *Handler) DeleteHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ids, ok := formIDs(w, r)
+	if !ok {
+		return
+	}
+	if _, err := h.db.TrashGenerations(ids); err != nil {
+		log.Printf("Error trashing generations: %v", err)
+		http.Error(w, "Failed to delete generations", http.StatusInternalServerError)
+		return
+	}
+
+	filter, err := parseHistoryFilter(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Before = 0
+	query := r.Form
+	query.Del("id")
+	query.Del("before")
+
+	data, err := h.historyData(query, filter)
+	if err != nil {
+		log.Printf("Error fetching generations: %v", err)
+		http.Error(w, "Failed to fetch history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := h.tmpl.ExecuteTemplate(w, "history.html", data); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// Trash lists the generations in the trash
+func (h *Handler) Trash(w http.ResponseWriter, r *http.Request) {
+	h.renderTrash(w, "")
+}
+
+// RestoreTrash takes the given generations (one id each) back out of the
+// trash
+func (h *Handler) RestoreTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ids, ok := formIDs(w, r)
+	if !ok {
+		return
+	}
+	restored, err := h.db.RestoreGenerations(ids)
+	if err != nil {
+		log.Printf("Error restoring generations: %v", err)
+		http.Error(w, "Failed to restore generations", http.StatusInternalServerError)
+		return
+	}
+
+	h.renderTrash(w, fmt.Sprintf("Restored %d meme%s.", restored, plural(int(restored))))
+}
+
+// PurgeTrash permanently deletes the given generations (one id each), or
+// every generation in the trash with all=on, with all their files
+func (h *Handler) PurgeTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ids []int64
+	if r.FormValue("all") == "on" {
+		var err error
+		if ids, err = h.db.ListTrashIDs(); err != nil {
+			log.Printf("Error fetching trash: %v", err)
+			http.Error(w, "Failed to fetch trash", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		var ok bool
+		if ids, ok = formIDs(w, r); !ok {
+			return
+		}
+	}
+
+	// The janitor must not purge or measure the same files meanwhile
+	h.janitor.mu.Lock()
+	purged, err := h.purgeGenerations(ids)
+	h.janitor.mu.Unlock()
+	if err != nil {
+		log.Printf("Error purging generations: %v", err)
+		http.Error(w, "Failed to delete generations", http.StatusInternalServerError)
+		return
+	}
+
+	h.renderTrash(w, fmt.Sprintf("Deleted %d meme%s forever.", purged, plural(purged)))
+}
+
+// purgeGenerations permanently deletes trashed generations and their
+// files. The files are moved aside while the database transaction runs,
+// then deleted if it commits or put back if it does not, so the database
+// never points at missing files. Images and bases are deleted from
+// storage after the commit. Files other generations still use are kept.
+func (h *Handler) purgeGenerations(ids []int64) (int, error) {
+	token, err := randomToken()
+	if err != nil {
+		return 0, err
+	}
+	staged := &stagedFiles{dir: filepath.Join(h.imageDir, ".purge-"+token)}
+
+	var stored []string
+	purged, err := h.db.PurgeGenerations(ids, func(gens []db.Generation, variants []db.Variant, kept map[string]bool) error {
+		for _, gen := range gens {
+			if !kept[gen.ImagePath] {
+				stored = append(stored, gen.ImagePath)
+			}
+			if gen.BasePath != gen.ImagePath && !kept[gen.BasePath] {
+				stored = append(stored, gen.BasePath)
+			}
+		}
+		return staged.stage(h.imageDir, h.generationFiles(gens, variants, kept))
+	})
+	if err != nil {
+		staged.restore()
+		return 0, err
+	}
+
+	staged.remove()
+	for original := range staged.moved {
+		h.hashes.forget(original)
+	}
+	h.unpublish(stored...)
+	return purged, nil
+}
+
+// generationFiles lists every file belonging to generations, relative to
+// the image directory: images, bases, exports, resized copies and share
+// link copies. Files in kept, and the copies of a kept image, are left
+// out, as other generations use them.
+func (h *Handler) generationFiles(gens []db.Generation, variants []db.Variant, kept map[string]bool) []string {
+	var files []string
+	seen := map[string]bool{}
+	add := func(filename string) {
+		if filename != "" && !seen[filename] && !kept[filename] {
+			seen[filename] = true
+			files = append(files, filename)
+		}
+	}
+
+	for _, gen := range gens {
+		add(gen.ImagePath)
+		add(gen.BasePath)
+		if gen.ImagePath == "" || kept[gen.ImagePath] {
+			continue
+		}
+		for _, size := range ollama.ImageSizes {
+			add(ollama.SizedFilename(gen.ImagePath, size.Width))
+		}
+		copies, err := h.ollama.WatermarkedCopies(gen.ImagePath)
+		if err != nil {
+			log.Printf("Warning: Failed to list shared copies of %s: %v", gen.ImagePath, err)
+		}
+		for _, shared := range copies {
+			add(shared)
+		}
+	}
+	for _, v := range variants {
+		add(v.Filename)
+	}
+	return files
+}
+
+// stagedFiles moves files into a directory of their own, so they can be
+// deleted or put back together with a database transaction
+type stagedFiles struct {
+	dir   string
+	moved map[string]string // original path to staged path
+}
+
+// stage moves the files that exist into the staging directory. If one
+// cannot be moved, those already moved are put back.
+func (s *stagedFiles) stage(imageDir string, filenames []string) error {
+	if s.moved == nil {
+		s.moved = make(map[string]string)
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+
+	for i, filename := range filenames {
+		original := filepath.Join(imageDir, filename)
+		if !fileExists(original) {
+			continue
+		}
+		staged := filepath.Join(s.dir, fmt.Sprintf("%d-%s", i, filepath.Base(filename)))
+		if err := os.Rename(original, staged); err != nil {
+			s.restore()
+			return fmt.Errorf("failed to move %s aside: %w", filename, err)
+		}
+		s.moved[original] = staged
+	}
+	return nil
+}
+
+// restore puts the staged files back where they were
+func (s *stagedFiles) restore() {
+	for original, staged := range s.moved {
+		if err := os.Rename(staged, original); err != nil {
+			log.Printf("Error restoring %s from %s: %v", original, staged, err)
+			continue
+		}
+		delete(s.moved, original)
+	}
+	s.remove()
+}
+
+// remove deletes the staging directory and the files in it
+func (s *stagedFiles) remove() {
+	if err := os.RemoveAll(s.dir); err != nil {
+		log.Printf("Warning: Failed to remove %s: %v", s.dir, err)
+	}
+}
+
+// renderTrash writes the trash.html partial with an optional message
+func (h *Handler) renderTrash(w http.ResponseWriter, message string) {
+	generations, err := h.db.ListTrash(trashPageSize + 1)
+	if err != nil {
+		log.Printf("Error fetching trash: %v", err)
+		http.Error(w, "Failed to fetch trash", http.StatusInternalServerError)
+		return
+	}
+
+	more := len(generations) > trashPageSize
+	if more {
+		generations = generations[:trashPageSize]
+	}
+
+	data := map[string]interface{}{
+		"Generations": generations,
+		"More":        more,
+		"Message":     message,
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := h.tmpl.ExecuteTemplate(w, "trash.html", data); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// formIDs parses the id form values, writing an error response if there
+// are none or one is invalid
+func formIDs(w http.ResponseWriter, r *http.Request) ([]int64, bool) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return nil, false
+	}
+
+	var ids []int64
+	for _, value := range r.Form["id"] {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return nil, false
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		http.Error(w, "Select at least one meme", http.StatusBadRequest)
+		return nil, false
+	}
+	return ids, true
+}
+
+// plural returns "s" unless n is 1
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
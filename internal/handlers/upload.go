@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"meme-generator/internal/db"
+	"meme-generator/internal/ollama"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// maxUploadBytes limits uploaded file size
+	maxUploadBytes = 20 << 20
+	// maxUploadPixels limits the dimensions of uploaded still images
+	maxUploadPixels = 4096 * 4096
+	// maxGIFPixels limits the canvas size of uploaded GIFs, which are
+	// decoded frame by frame
+	maxGIFPixels = 2048 * 2048
+	// maxGIFFrames and maxGIFFramePixels limit how much an uploaded GIF
+	// decodes to: each frame is held as a byte per pixel, and copied again
+	// when captioned
+	maxGIFFrames      = 1000
+	maxGIFFramePixels = 64 << 20
+)
+
+// stillFormats and gifFormats are the upload types each endpoint accepts,
+// as named by image.DecodeConfig
+var (
+	stillFormats = map[string]bool{"jpeg": true, "png": true, "webp": true, "gif": true}
+	gifFormats   = map[string]bool{"gif": true}
+)
+
+// Upload accepts an uploaded image (JPEG, PNG, WebP or GIF) and captions it
+// with top/bottom text. If no text is given it is generated from the prompt.
+func (h *Handler) Upload(w http.ResponseWriter, r *http.Request) {
+	h.captionUpload(w, r, "image", stillFormats)
+}
+
+// CaptionGIF accepts an uploaded animated GIF and renders top/bottom text
+// onto every frame. If no text is given it is generated from the prompt.
+func (h *Handler) CaptionGIF(w http.ResponseWriter, r *http.Request) {
+	h.captionUpload(w, r, "gif", gifFormats)
+}
+
+// upload is a validated image file from a multipart form
+type upload struct {
+	data     []byte
+	format   string
+	filename string
+}
+
+// readUpload reads and validates the image in a multipart form field. The
+// returned error is safe to show to the user.
+func readUpload(w http.ResponseWriter, r *http.Request, field string, formats map[string]bool) (*upload, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	if err := r.ParseMultipartForm(maxUploadBytes); err != nil {
+		return nil, fmt.Errorf("File must be smaller than 20 MB")
+	}
+
+	file, header, err := r.FormFile(field)
+	if err != nil {
+		return nil, fmt.Errorf("An image file is required")
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read upload")
+	}
+
+	// Sniff the real type from the content rather than trusting the
+	// filename or the browser's Content-Type
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || !formats[format] {
+		var names []string
+		for _, name := range []string{"JPEG", "PNG", "WebP", "GIF"} {
+			if formats[strings.ToLower(name)] {
+				names = append(names, name)
+			}
+		}
+		list := names[len(names)-1]
+		if len(names) > 1 {
+			list = strings.Join(names[:len(names)-1], ", ") + " or " + list
+		}
+		return nil, fmt.Errorf("File must be a %s image", list)
+	}
+
+	maxPixels := maxUploadPixels
+	if format == "gif" {
+		maxPixels = maxGIFPixels
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, fmt.Errorf("Image dimensions are too large")
+	}
+	if format == "gif" {
+		frames, pixels, err := ollama.ScanGIF(data)
+		if err != nil {
+			return nil, fmt.Errorf("File must be a GIF image")
+		}
+		if frames > maxGIFFrames {
+			return nil, fmt.Errorf("GIF must have at most %d frames", maxGIFFrames)
+		}
+		if pixels > maxGIFFramePixels {
+			return nil, fmt.Errorf("GIF frames are too large in total")
+		}
+	}
+
+	return &upload{data: data, format: format, filename: header.Filename}, nil
+}
+
+// captionUpload stores an uploaded image as a generation's base image and
+// captions it into a separate file. GIFs are captioned frame by frame.
+func (h *Handler) captionUpload(w http.ResponseWriter, r *http.Request, field string, formats map[string]bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	up, err := readUpload(w, r, field, formats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prompt := strings.TrimSpace(r.FormValue("prompt"))
+	if prompt == "" {
+		prompt = strings.TrimSuffix(up.filename, filepath.Ext(up.filename))
+	}
+	topText := strings.TrimSpace(r.FormValue("top_text"))
+	bottomText := strings.TrimSpace(r.FormValue("bottom_text"))
+
+	id, err := h.db.InsertGeneration(prompt, db.SourceUpload, "", db.StatusProcessing, "")
+	if err != nil {
+		log.Printf("Error inserting generation: %v", err)
+		http.Error(w, "Failed to create generation", http.StatusInternalServerError)
+		return
+	}
+
+	// Step 1: Keep the upload, upright and without metadata, as the base image
+	baseFilename, err := h.ollama.SaveUpload(up.data, up.format, prompt)
+	if err != nil {
+		h.failGeneration(w, id, err)
+		return
+	}
+	if err := h.db.UpdateGenerationBase(id, baseFilename); err != nil {
+		log.Printf("Error updating generation base: %v", err)
+	}
+	basePath := filepath.Join(h.imageDir, baseFilename)
+
+	// Step 2: Generate meme text unless the user supplied their own, using
+	// a vision model description of the upload if enabled
+	if topText == "" && bottomText == "" {
+		description := h.describeImage(id, basePath)
+		topText, bottomText, err = h.ollama.GenerateText(prompt, description)
+		if err != nil {
+			log.Printf("Warning: Text generation failed (will continue without text): %v", err)
+		} else if err := h.db.UpdateGenerationModels(id, "", "", ollama.TextModel); err != nil {
+			log.Printf("Error updating generation models: %v", err)
+		}
+	}
+
+	// Step 3: Caption into a separate file
+	ext := filepath.Ext(baseFilename)
+	filename := strings.TrimSuffix(baseFilename, ext) + "-meme" + ext
+	imagePath := filepath.Join(h.imageDir, filename)
+	opts := ollama.OverlayOptions{
+		SmartPlacement: h.boolSetting("smart_placement"),
+	}
+	if err := h.db.UpdateGenerationPlacement(id, opts.SmartPlacement); err != nil {
+		log.Printf("Error updating generation placement: %v", err)
+	}
+	if up.format == "gif" {
+		err = h.ollama.OverlayGIFText(basePath, imagePath, topText, bottomText, opts)
+	} else if err = copyFile(basePath, imagePath); err == nil {
+		err = h.ollama.OverlayMemeText(imagePath, topText, bottomText, opts)
+	}
+	if err != nil {
+		h.failGeneration(w, id, err)
+		return
+	}
+
+	// Step 4: Update database with results
+	if err := h.db.UpdateGenerationStatus(id, db.StatusSuccess, filename, ""); err != nil {
+		log.Printf("Error updating generation status: %v", err)
+	}
+	if err := h.db.UpdateGenerationText(id, topText, bottomText); err != nil {
+		log.Printf("Error updating generation text: %v", err)
+	}
+
+	gen, err := h.db.GetGeneration(id)
+	if err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Failed to fetch generation", http.StatusInternalServerError)
+		return
+	}
+
+	// Step 5: Watermark if new memes are watermarked, then export the
+	// configured default format and record variant sizes
+	gen = h.watermarkNew(gen)
+	h.finalizeGeneration(gen)
+
+	// Step 6: Suggest tags using gemma3:270m, if enabled
+	h.tagNew(gen)
+
+	h.renderGeneration(w, gen)
+}
+
+// failGeneration marks a generation as failed and renders its error state
+func (h *Handler) failGeneration(w http.ResponseWriter, id int64, err error) {
+	log.Printf("Error processing generation %d: %v", id, err)
+	if updateErr := h.db.UpdateGenerationStatus(id, db.StatusFailed, "", err.Error()); updateErr != nil {
+		log.Printf("Error updating generation status: %v", updateErr)
+	}
+
+	gen, _ := h.db.GetGeneration(id)
+	h.renderGeneration(w, gen)
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"log"
+	"meme-generator/internal/db"
+	"meme-generator/internal/ollama"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// maxWatermarkTextLength is the longest watermark text that can be set
+const maxWatermarkTextLength = 100
+
+// logoFormats are the image formats accepted as watermark logos
+var logoFormats = map[string]bool{"jpeg": true, "png": true, "webp": true}
+
+// UpdateWatermark turns the watermark on or off for a generation and renders
+// its image again
+func (h *Handler) UpdateWatermark(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	gen, err := h.db.GetGeneration(id)
+	if err != nil {
+		log.Printf("Error fetching generation: %v", err)
+		http.Error(w, "Generation not found", http.StatusNotFound)
+		return
+	}
+
+	if !h.checkRenderable(w, gen) {
+		return
+	}
+
+	spec := renderSpecFor(gen)
+	spec.watermark = r.FormValue("watermark") == "on"
+	if spec.watermark && !h.watermarkSettings().Configured() {
+		http.Error(w, "Set up a watermark in Settings first", http.StatusConflict)
+		return
+	}
+
+	updated, err := h.replaceImage(gen, spec)
+	if err != nil {
+		log.Printf("Error watermarking generation %d: %v", id, err)
+		http.Error(w, "Failed to update watermark", http.StatusInternalServerError)
+		return
+	}
+
+	h.finalizeGeneration(updated)
+
+	h.renderGeneration(w, updated)
+}
+
+// UpdateWatermarkLogo replaces the watermark logo with an uploaded image, or
+// removes it with ?remove=1 so the text watermark is used instead
+func (h *Handler) UpdateWatermarkLogo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logo := ""
+	if r.URL.Query().Get("remove") == "" {
+		up, err := readUpload(w, r, "logo", logoFormats)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logo, err = h.ollama.SaveWatermarkLogo(up.data)
+		if err != nil {
+			log.Printf("Error saving watermark logo: %v", err)
+			http.Error(w, "Failed to save logo", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	previous, _ := h.db.GetSetting("watermark_logo")
+	before := h.watermarkSettings()
+	if err := h.db.SetSetting("watermark_logo", logo); err != nil {
+		log.Printf("Error updating watermark logo: %v", err)
+		http.Error(w, "Failed to update settings", http.StatusInternalServerError)
+		return
+	}
+	if h.watermarkSettings() != before {
+		h.invalidateWatermarkedVectors()
+	}
+	if previous != "" && previous != logo {
+		if err := h.ollama.RemoveFile(previous); err != nil {
+			log.Printf("Warning: Failed to remove old watermark logo: %v", err)
+		}
+	}
+
+	h.renderSettings(w, true)
+}
+
+// watermarkSettings returns the configured watermark. It draws nothing
+// unless watermark text or a logo has been set.
+func (h *Handler) watermarkSettings() ollama.Watermark {
+	wm := ollama.Watermark{
+		Position: ollama.WatermarkBottomRight,
+		Opacity:  float64(h.intSetting("watermark_opacity", 60)) / 100,
+		Scale:    float64(h.intSetting("watermark_scale", 20)) / 100,
+	}
+	if text, err := h.db.GetSetting("watermark_text"); err == nil {
+		wm.Text = text
+	}
+	if logo, err := h.db.GetSetting("watermark_logo"); err == nil && logo != "" {
+		wm.LogoPath = filepath.Join(h.imageDir, logo)
+	}
+	if value, err := h.db.GetSetting("watermark_position"); err == nil {
+		if position, err := ollama.ParseWatermarkPosition(value); err == nil {
+			wm.Position = position
+		}
+	}
+	return wm
+}
+
+// invalidateWatermarkedVectors forgets and deletes the vector exports of
+// watermarked generations. Vector exports draw the current watermark, so
+// they go stale when it changes; raster images carry theirs baked in.
+func (h *Handler) invalidateWatermarkedVectors() {
+	formats := make([]string, len(ollama.VectorFormats))
+	for i, f := range ollama.VectorFormats {
+		formats[i] = string(f)
+	}
+	variants, err := h.db.DeleteWatermarkedVariants(formats)
+	if err != nil {
+		log.Printf("Error deleting watermarked vector exports: %v", err)
+		return
+	}
+	for _, v := range variants {
+		if err := os.Remove(filepath.Join(h.imageDir, v.Filename)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: Failed to remove stale variant %s: %v", v.Filename, err)
+		}
+	}
+}
+
+// watermarkNew renders a newly created generation again with the watermark
+// when new memes are watermarked by default
+func (h *Handler) watermarkNew(gen *db.Generation) *db.Generation {
+	if gen.Status != db.StatusSuccess || gen.BasePath == "" || !h.boolSetting("watermark_default") {
+		return gen
+	}
+	if !h.watermarkSettings().Configured() {
+		return gen
+	}
+
+	spec := renderSpecFor(gen)
+	spec.watermark = true
+	updated, err := h.replaceImage(gen, spec)
+	if err != nil {
+		log.Printf("Warning: Failed to watermark generation %d: %v", gen.ID, err)
+		return gen
+	}
+	return updated
+}
@@ -0,0 +1,151 @@
+// Package library loads blank meme templates (classic formats with fixed
+// text boxes) so memes can be made without generating an image.
+package library
+
+import (
+	"encoding/json"
+	"fmt"
+	"meme-generator/internal/ollama"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Template is a blank meme format. Each template is described by a JSON
+// file in the library directory whose name (minus .json) is the ID, and
+// whose image is stored alongside it.
+type Template struct {
+	ID    string           `json:"id"`
+	Name  string           `json:"name"`
+	Tags  []string         `json:"tags"`
+	Image string           `json:"image"`
+	Boxes []ollama.TextBox `json:"boxes"`
+}
+
+// IsAnimated reports whether the template image is an animated GIF
+func (t Template) IsAnimated() bool {
+	return strings.EqualFold(filepath.Ext(t.Image), ".gif")
+}
+
+// Labels returns the label of each text box, in order
+func (t Template) Labels() []string {
+	labels := make([]string, len(t.Boxes))
+	for i, box := range t.Boxes {
+		labels[i] = box.Label
+	}
+	return labels
+}
+
+// Library is the set of templates found in a directory
+type Library struct {
+	dir       string
+	templates []Template
+}
+
+// Load reads every template in dir. A missing directory is an empty
+// library; an invalid template is an error so mistakes are caught at startup.
+func Load(dir string) (*Library, error) {
+	lib := &Library{dir: dir}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list templates: %w", err)
+	}
+
+	for _, path := range paths {
+		t, err := loadTemplate(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template %s: %w", filepath.Base(path), err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, t.Image)); err != nil {
+			return nil, fmt.Errorf("invalid template %s: image %q not found", filepath.Base(path), t.Image)
+		}
+		lib.templates = append(lib.templates, *t)
+	}
+
+	sort.Slice(lib.templates, func(i, j int) bool {
+		return lib.templates[i].Name < lib.templates[j].Name
+	})
+
+	return lib, nil
+}
+
+func loadTemplate(path string) (*Template, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var t Template
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, err
+	}
+
+	t.ID = strings.TrimSuffix(filepath.Base(path), ".json")
+	if t.Name == "" {
+		t.Name = t.ID
+	}
+	if t.Image == "" || filepath.Base(t.Image) != t.Image {
+		return nil, fmt.Errorf("image must be a filename in the template directory")
+	}
+	if len(t.Boxes) == 0 {
+		return nil, fmt.Errorf("at least one text box is required")
+	}
+	for _, box := range t.Boxes {
+		if err := box.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &t, nil
+}
+
+// Dir returns the directory templates are loaded from
+func (l *Library) Dir() string {
+	return l.dir
+}
+
+// List returns every template, sorted by name
+func (l *Library) List() []Template {
+	return l.templates
+}
+
+// Search returns templates whose name or tags contain query, ignoring case.
+// An empty query returns every template.
+func (l *Library) Search(query string) []Template {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return l.templates
+	}
+
+	var matches []Template
+	for _, t := range l.templates {
+		if strings.Contains(strings.ToLower(t.Name), query) {
+			matches = append(matches, t)
+			continue
+		}
+		for _, tag := range t.Tags {
+			if strings.Contains(strings.ToLower(tag), query) {
+				matches = append(matches, t)
+				break
+			}
+		}
+	}
+	return matches
+}
+
+// Get returns the template with the given ID
+func (l *Library) Get(id string) (*Template, bool) {
+	for i := range l.templates {
+		if l.templates[i].ID == id {
+			return &l.templates[i], true
+		}
+	}
+	return nil, false
+}
+
+// ImagePath returns the path of a template's base image
+func (l *Library) ImagePath(t *Template) string {
+	return filepath.Join(l.dir, t.Image)
+}
@@ -0,0 +1,230 @@
+package ollama
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"meme-generator/internal/spec"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// MinComicPanels and MaxComicPanels bound the panels in a comic strip
+	MinComicPanels = 3
+	MaxComicPanels = 4
+	// maxComicLines limits the speech bubbles in one panel, so they fit
+	// without covering the scene
+	maxComicLines = 2
+	// comicPanelSize is the side of each square panel in a composed strip
+	comicPanelSize = 768
+)
+
+// ComicScript is a panel-by-panel script for a comic strip, written by the
+// text model from a premise
+type ComicScript = spec.ComicScript
+
+// ComicPanel is one panel of a comic script
+type ComicPanel = spec.ComicPanel
+
+// ComicLine is a line of dialogue, shown in a speech bubble
+type ComicLine = spec.ComicLine
+
+// GenerateComicScript calls Ollama with gemma3:270m to write a comic strip
+// script of the given number of panels about a premise
+func (c *Client) GenerateComicScript(premise string, panels int) (*ComicScript, error) {
+	fullPrompt := fmt.Sprintf(
+		"Write a funny %d panel comic strip about: %s\n\nDescribe the art style and the characters' appearance once, then for each panel describe the scene (what is drawn, without any text) and give at most %d short lines of dialogue.\n\nRespond ONLY with valid JSON in this exact format: {\"title\":\"title\",\"style\":\"art style\",\"characters\":\"who appears and what they look like\",\"panels\":[{\"scene\":\"what the panel shows\",\"dialogue\":[{\"speaker\":\"name\",\"text\":\"what they say\"}]}]} with exactly %d panels. Keep dialogue SHORT and FUNNY.",
+		panels, premise, maxComicLines, panels,
+	)
+
+	cmd := exec.Command("ollama", "run", TextModel, fullPrompt)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ollama text generation failed: %w, stderr: %s", err, stderr.String())
+	}
+
+	output := strings.TrimSpace(stdout.String())
+	if output == "" {
+		return nil, fmt.Errorf("ollama produced no text output")
+	}
+
+	script, err := parseComicJSON(output, panels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse comic JSON: %w (output: %s)", err, output)
+	}
+
+	return script, nil
+}
+
+// parseComicJSON extracts a comic script, accepting dialogue as a list of
+// objects, a list of strings or a single string. Scripts with too few
+// panels are rejected and extra panels are dropped.
+func parseComicJSON(output string, panels int) (*ComicScript, error) {
+	jsonStart := strings.Index(output, "{")
+	jsonEnd := strings.LastIndex(output, "}")
+	if jsonStart == -1 || jsonEnd == -1 || jsonEnd <= jsonStart {
+		return nil, fmt.Errorf("no JSON object found in output")
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal([]byte(output[jsonStart:jsonEnd+1]), &result); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	script := &ComicScript{
+		Title:      strings.TrimSpace(getStringField(result, "title", "Title")),
+		Style:      strings.TrimSpace(getStringField(result, "style", "art_style", "artStyle", "Style")),
+		Characters: strings.TrimSpace(getStringField(result, "characters", "Characters", "cast")),
+	}
+
+	rawPanels, _ := result["panels"].([]interface{})
+	for _, raw := range rawPanels {
+		m, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		panel := ComicPanel{
+			Scene: strings.TrimSpace(getStringField(m, "scene", "description", "Scene", "image")),
+		}
+		if panel.Scene == "" {
+			continue
+		}
+		panel.Dialogue = parseComicDialogue(m["dialogue"])
+		script.Panels = append(script.Panels, panel)
+		if len(script.Panels) == panels {
+			break
+		}
+	}
+
+	if len(script.Panels) < panels {
+		return nil, fmt.Errorf("expected %d panels, got %d", panels, len(script.Panels))
+	}
+	return script, nil
+}
+
+// parseComicDialogue reads a panel's dialogue, keeping the first lines that
+// fit in the panel
+func parseComicDialogue(raw interface{}) []ComicLine {
+	var items []interface{}
+	switch v := raw.(type) {
+	case []interface{}:
+		items = v
+	case string:
+		items = []interface{}{v}
+	}
+
+	var lines []ComicLine
+	for _, item := range items {
+		var line ComicLine
+		switch v := item.(type) {
+		case string:
+			line.Text = v
+		case map[string]interface{}:
+			line.Speaker = strings.TrimSpace(getStringField(v, "speaker", "character", "name"))
+			line.Text = getStringField(v, "text", "line", "says")
+		}
+		line.Text = strings.TrimSpace(line.Text)
+		if line.Text == "" {
+			continue
+		}
+		if runes := []rune(line.Text); len(runes) > MaxLayerTextLength {
+			line.Text = string(runes[:MaxLayerTextLength])
+		}
+		lines = append(lines, line)
+		if len(lines) == maxComicLines {
+			break
+		}
+	}
+	return lines
+}
+
+// ComposeStrip crops each panel image to a square, lays them side by side
+// with gutters on a white background and writes the strip to destPath as a
+// PNG. The layout only depends on the number of panels, so ComicBubbles
+// positions stay valid when a panel is redrawn.
+func (c *Client) ComposeStrip(panelPaths []string, destPath string) error {
+	n := len(panelPaths)
+	size, gutter, border := comicPanelSize, comicPanelSize/24, comicPanelSize/128
+	strip := image.NewRGBA(image.Rect(0, 0, n*size+(n+1)*gutter, size+2*gutter))
+	draw.Draw(strip, strip.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	for i, path := range panelPaths {
+		c.fetchMissing(path)
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open panel %d: %w", i+1, err)
+		}
+		img, _, err := image.Decode(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decode panel %d: %w", i+1, err)
+		}
+
+		bounds := img.Bounds()
+		side := min(bounds.Dx(), bounds.Dy())
+		cell := image.Rect(0, 0, size, size).Add(image.Pt(gutter+i*(size+gutter), gutter))
+		draw.Draw(strip, cell.Inset(-border), image.NewUniform(color.Black), image.Point{}, draw.Src)
+		draw.CatmullRom.Scale(strip, cell, img, cropWindow(img, side, side), draw.Src, nil)
+	}
+
+	err := writeFileAtomic(destPath, func(w io.Writer) error {
+		if err := png.Encode(w, strip); err != nil {
+			return fmt.Errorf("failed to encode strip: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.publish(destPath)
+	return nil
+}
+
+// ComicBubbles returns speech bubble layers for a script's dialogue,
+// positioned over the panels of a strip made by ComposeStrip. The first
+// line of a panel sits top left and the second top right, lower down, so
+// they read in order.
+func ComicBubbles(s *ComicScript) []Layer {
+	n := float64(len(s.Panels))
+	size, gutter := float64(comicPanelSize), float64(comicPanelSize/24)
+	stripW, stripH := n*size+(n+1)*gutter, size+2*gutter
+
+	var layers []Layer
+	for i, panel := range s.Panels {
+		// Panel bounds as fractions of the strip
+		px, py := (gutter+float64(i)*(size+gutter))/stripW, gutter/stripH
+		pw, ph := size/stripW, size/stripH
+
+		for j, line := range panel.Dialogue {
+			x, tailX := px+0.04*pw, px+0.3*pw
+			y := py + 0.04*ph
+			if j == 1 {
+				x, tailX = px+0.36*pw, px+0.7*pw
+				y = py + 0.3*ph
+			}
+			layers = append(layers, Layer{
+				Kind:   LayerBubble,
+				X:      x,
+				Y:      y,
+				Width:  0.6 * pw,
+				Height: 0.24 * ph,
+				TailX:  tailX,
+				TailY:  y + 0.4*ph,
+				Text:   line.Text,
+			})
+		}
+	}
+	return layers
+}
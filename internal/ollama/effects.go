@@ -0,0 +1,376 @@
+package ollama
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"math/rand/v2"
+	"meme-generator/internal/spec"
+	"os"
+)
+
+// EffectStage is the point in rendering an effect is applied at
+type EffectStage = spec.EffectStage
+
+const (
+	StageBase  EffectStage = "base"  // before captions, so the text stays clean
+	StageFinal EffectStage = "final" // after captions, so the text is affected too
+)
+
+// MaxEffects is the longest effects pipeline a generation can have
+const MaxEffects = 10
+
+// Effect is one step of a generation's effects pipeline
+type Effect = spec.Effect
+
+// EffectParam is a numeric parameter of an effect
+type EffectParam struct {
+	Name    string
+	Label   string
+	Min     float64
+	Max     float64
+	Step    float64
+	Default float64
+}
+
+// EffectDef is an effect that can be added to a pipeline. Apply edits the
+// image in place or returns a replacement.
+type EffectDef struct {
+	Name   string
+	Label  string
+	Params []EffectParam
+	apply  func(img *image.NRGBA, param func(name string) float64) (*image.NRGBA, error)
+}
+
+// Effects is the registry of image effects, in display order
+var Effects = []EffectDef{
+	{
+		Name:   "saturation",
+		Label:  "Saturation boost",
+		Params: []EffectParam{{Name: "amount", Label: "Amount", Min: 0, Max: 4, Step: 0.1, Default: 2}},
+		apply:  applySaturation,
+	},
+	{
+		Name:   "contrast",
+		Label:  "Contrast boost",
+		Params: []EffectParam{{Name: "amount", Label: "Amount", Min: 0, Max: 4, Step: 0.1, Default: 1.5}},
+		apply:  applyContrast,
+	},
+	{
+		Name:   "noise",
+		Label:  "Noise",
+		Params: []EffectParam{{Name: "amount", Label: "Amount", Min: 0, Max: 1, Step: 0.05, Default: 0.2}},
+		apply:  applyNoise,
+	},
+	{
+		Name:  "jpeg",
+		Label: "JPEG crush",
+		Params: []EffectParam{
+			{Name: "quality", Label: "Quality", Min: 1, Max: 100, Step: 1, Default: 8},
+			{Name: "passes", Label: "Passes", Min: 1, Max: 10, Step: 1, Default: 3},
+		},
+		apply: applyJPEGCrush,
+	},
+	{
+		Name:  "vignette",
+		Label: "Vignette",
+		Params: []EffectParam{
+			{Name: "strength", Label: "Strength", Min: 0, Max: 1, Step: 0.05, Default: 0.6},
+			{Name: "radius", Label: "Radius", Min: 0.1, Max: 1, Step: 0.05, Default: 0.5},
+		},
+		apply: applyVignette,
+	},
+	{
+		Name:   "pixelate",
+		Label:  "Pixelate",
+		Params: []EffectParam{{Name: "size", Label: "Block size", Min: 2, Max: 64, Step: 1, Default: 12}},
+		apply:  applyPixelate,
+	},
+	{
+		Name:   "grayscale",
+		Label:  "Grayscale",
+		Params: []EffectParam{{Name: "amount", Label: "Amount", Min: 0, Max: 1, Step: 0.05, Default: 1}},
+		apply:  applyGrayscale,
+	},
+	{
+		Name:   "sepia",
+		Label:  "Sepia",
+		Params: []EffectParam{{Name: "amount", Label: "Amount", Min: 0, Max: 1, Step: 0.05, Default: 1}},
+		apply:  applySepia,
+	},
+}
+
+// LookupEffect returns the registered effect with the given name
+func LookupEffect(name string) (EffectDef, bool) {
+	for _, def := range Effects {
+		if def.Name == name {
+			return def, true
+		}
+	}
+	return EffectDef{}, false
+}
+
+// NormalizeEffects checks a pipeline against the registry, defaulting the
+// stage to final, filling in missing parameters and clamping the rest to
+// their ranges
+func NormalizeEffects(effects []Effect) ([]Effect, error) {
+	if len(effects) > MaxEffects {
+		return nil, fmt.Errorf("at most %d effects can be applied", MaxEffects)
+	}
+
+	normalized := make([]Effect, 0, len(effects))
+	for _, e := range effects {
+		def, ok := LookupEffect(e.Name)
+		if !ok {
+			return nil, fmt.Errorf("unknown effect: %q", e.Name)
+		}
+
+		switch e.Stage {
+		case "":
+			e.Stage = StageFinal
+		case StageBase, StageFinal:
+		default:
+			return nil, fmt.Errorf("unknown stage for %s: %q", e.Name, e.Stage)
+		}
+
+		params := make(map[string]float64, len(def.Params))
+		for _, p := range def.Params {
+			value, ok := e.Params[p.Name]
+			if !ok || math.IsNaN(value) {
+				value = p.Default
+			}
+			params[p.Name] = math.Max(p.Min, math.Min(p.Max, value))
+		}
+		for name := range e.Params {
+			if _, ok := params[name]; !ok {
+				return nil, fmt.Errorf("unknown parameter for %s: %q", e.Name, name)
+			}
+		}
+
+		normalized = append(normalized, Effect{Name: e.Name, Stage: e.Stage, Params: params})
+	}
+	return normalized, nil
+}
+
+// EffectsForStage returns the effects of a pipeline applied at stage
+func EffectsForStage(effects []Effect, stage EffectStage) []Effect {
+	var selected []Effect
+	for _, e := range effects {
+		if e.Stage == stage || (e.Stage == "" && stage == StageFinal) {
+			selected = append(selected, e)
+		}
+	}
+	return selected
+}
+
+// ApplyEffects runs an effects pipeline over the image at srcPath and
+// writes the result to destPath as a PNG. srcPath and destPath may be the
+// same file.
+func (c *Client) ApplyEffects(srcPath, destPath string, effects []Effect) error {
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+	src, _, err := image.Decode(file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	img, err := applyEffects(src, effects)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(destPath, func(w io.Writer) error {
+		if err := png.Encode(w, img); err != nil {
+			return fmt.Errorf("failed to encode image: %w", err)
+		}
+		return nil
+	})
+}
+
+// applyEffects runs an effects pipeline over a decoded image
+func applyEffects(src image.Image, effects []Effect) (*image.NRGBA, error) {
+	img := toNRGBA(src)
+	var err error
+	for _, e := range effects {
+		def, ok := LookupEffect(e.Name)
+		if !ok {
+			return nil, fmt.Errorf("unknown effect: %q", e.Name)
+		}
+		param := func(name string) float64 {
+			if value, ok := e.Params[name]; ok {
+				return value
+			}
+			for _, p := range def.Params {
+				if p.Name == name {
+					return p.Default
+				}
+			}
+			return 0
+		}
+		if img, err = def.apply(img, param); err != nil {
+			return nil, fmt.Errorf("failed to apply %s: %w", e.Name, err)
+		}
+	}
+	return img, nil
+}
+
+// toNRGBA copies an image into an NRGBA image with its origin at 0,0
+func toNRGBA(src image.Image) *image.NRGBA {
+	bounds := src.Bounds()
+	img := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(img, img.Bounds(), src, bounds.Min, draw.Src)
+	return img
+}
+
+// mapPixels replaces the color channels of every pixel, leaving alpha alone
+func mapPixels(img *image.NRGBA, f func(x, y int, r, g, b float64) (float64, float64, float64)) {
+	bounds := img.Bounds()
+	for y := 0; y < bounds.Dy(); y++ {
+		row := img.Pix[y*img.Stride:]
+		for x := 0; x < bounds.Dx(); x++ {
+			p := row[x*4 : x*4+4]
+			r, g, b := f(x, y, float64(p[0]), float64(p[1]), float64(p[2]))
+			p[0], p[1], p[2] = clampChannel(r), clampChannel(g), clampChannel(b)
+		}
+	}
+}
+
+func clampChannel(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
+
+// luma is the Rec. 601 brightness of a color, 0 to 255
+func luma(r, g, b float64) float64 {
+	return 0.299*r + 0.587*g + 0.114*b
+}
+
+func applySaturation(img *image.NRGBA, param func(string) float64) (*image.NRGBA, error) {
+	amount := param("amount")
+	mapPixels(img, func(_, _ int, r, g, b float64) (float64, float64, float64) {
+		l := luma(r, g, b)
+		return l + (r-l)*amount, l + (g-l)*amount, l + (b-l)*amount
+	})
+	return img, nil
+}
+
+func applyContrast(img *image.NRGBA, param func(string) float64) (*image.NRGBA, error) {
+	amount := param("amount")
+	mapPixels(img, func(_, _ int, r, g, b float64) (float64, float64, float64) {
+		return (r-128)*amount + 128, (g-128)*amount + 128, (b-128)*amount + 128
+	})
+	return img, nil
+}
+
+// applyNoise adds color noise. The generator is seeded from the image size
+// so re-rendering the same image gives the same grain.
+func applyNoise(img *image.NRGBA, param func(string) float64) (*image.NRGBA, error) {
+	spread := param("amount") * 128
+	bounds := img.Bounds()
+	rng := rand.New(rand.NewPCG(uint64(bounds.Dx()), uint64(bounds.Dy())))
+	mapPixels(img, func(_, _ int, r, g, b float64) (float64, float64, float64) {
+		return r + (rng.Float64()*2-1)*spread, g + (rng.Float64()*2-1)*spread, b + (rng.Float64()*2-1)*spread
+	})
+	return img, nil
+}
+
+// applyJPEGCrush re-encodes the image as a low quality JPEG several times to
+// pile up compression artifacts. Transparency is flattened onto white.
+func applyJPEGCrush(img *image.NRGBA, param func(string) float64) (*image.NRGBA, error) {
+	quality := int(param("quality"))
+	passes := int(param("passes"))
+
+	var current image.Image = flatten(img, color.White)
+	for i := 0; i < passes; i++ {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, current, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, err
+		}
+		decoded, err := jpeg.Decode(&buf)
+		if err != nil {
+			return nil, err
+		}
+		current = decoded
+	}
+	return toNRGBA(current), nil
+}
+
+// applyVignette darkens the corners. Radius is the fraction of the distance
+// from the centre to the corners that stays untouched.
+func applyVignette(img *image.NRGBA, param func(string) float64) (*image.NRGBA, error) {
+	strength := param("strength")
+	radius := param("radius")
+
+	bounds := img.Bounds()
+	cx, cy := float64(bounds.Dx())/2, float64(bounds.Dy())/2
+	corner := math.Hypot(cx, cy)
+	mapPixels(img, func(x, y int, r, g, b float64) (float64, float64, float64) {
+		d := math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy) / corner
+		t := math.Max(0, math.Min(1, (d-radius)/(1-radius+1e-9)))
+		shade := 1 - strength*t*t*(3-2*t)
+		return r * shade, g * shade, b * shade
+	})
+	return img, nil
+}
+
+// applyPixelate averages square blocks. The block size is relative to a
+// 1024 pixel image so it looks the same at any resolution.
+func applyPixelate(img *image.NRGBA, param func(string) float64) (*image.NRGBA, error) {
+	bounds := img.Bounds()
+	block := max(2, int(math.Round(param("size")*float64(max(bounds.Dx(), bounds.Dy()))/1024)))
+
+	for by := 0; by < bounds.Dy(); by += block {
+		for bx := 0; bx < bounds.Dx(); bx += block {
+			cell := image.Rect(bx, by, min(bx+block, bounds.Dx()), min(by+block, bounds.Dy()))
+
+			var sum [4]float64
+			for y := cell.Min.Y; y < cell.Max.Y; y++ {
+				for x := cell.Min.X; x < cell.Max.X; x++ {
+					p := img.Pix[img.PixOffset(x, y):]
+					for i := range sum {
+						sum[i] += float64(p[i])
+					}
+				}
+			}
+			n := float64(cell.Dx() * cell.Dy())
+
+			for y := cell.Min.Y; y < cell.Max.Y; y++ {
+				for x := cell.Min.X; x < cell.Max.X; x++ {
+					p := img.Pix[img.PixOffset(x, y):]
+					for i := range sum {
+						p[i] = clampChannel(sum[i] / n)
+					}
+				}
+			}
+		}
+	}
+	return img, nil
+}
+
+func applyGrayscale(img *image.NRGBA, param func(string) float64) (*image.NRGBA, error) {
+	amount := param("amount")
+	mapPixels(img, func(_, _ int, r, g, b float64) (float64, float64, float64) {
+		l := luma(r, g, b)
+		return r + (l-r)*amount, g + (l-g)*amount, b + (l-b)*amount
+	})
+	return img, nil
+}
+
+func applySepia(img *image.NRGBA, param func(string) float64) (*image.NRGBA, error) {
+	amount := param("amount")
+	mapPixels(img, func(_, _ int, r, g, b float64) (float64, float64, float64) {
+		sr := 0.393*r + 0.769*g + 0.189*b
+		sg := 0.349*r + 0.686*g + 0.168*b
+		sb := 0.272*r + 0.534*g + 0.131*b
+		return r + (sr-r)*amount, g + (sg-g)*amount, b + (sb-b)*amount
+	})
+	return img, nil
+}
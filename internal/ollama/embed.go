@@ -0,0 +1,66 @@
+package ollama
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"strings"
+)
+
+// DefaultEmbeddingModel is used when no embedding model is configured
+const DefaultEmbeddingModel = "nomic-embed-text"
+
+// Embed asks a local embedding model for a vector representing text, so
+// memes can be found by meaning rather than exact words. `ollama run` on an
+// embedding model prints the vector as a JSON array.
+func (c *Client) Embed(text, model string) ([]float32, error) {
+	if model == "" {
+		model = DefaultEmbeddingModel
+	}
+
+	cmd := exec.Command("ollama", "run", model, text)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ollama embedding failed: %w, stderr: %s", err, stderr.String())
+	}
+
+	output := strings.TrimSpace(stdout.String())
+	start, end := strings.Index(output, "["), strings.LastIndex(output, "]")
+	if start == -1 || end <= start {
+		return nil, fmt.Errorf("no embedding found in output (is %s an embedding model?)", model)
+	}
+
+	var vector []float32
+	if err := json.Unmarshal([]byte(output[start:end+1]), &vector); err != nil {
+		return nil, fmt.Errorf("invalid embedding: %w", err)
+	}
+	if len(vector) == 0 {
+		return nil, fmt.Errorf("ollama produced an empty embedding")
+	}
+	return vector, nil
+}
+
+// CosineSimilarity returns how alike two embeddings are, from -1 to 1.
+// Vectors of different lengths, from different models, score 0.
+func CosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
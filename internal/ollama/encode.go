@@ -0,0 +1,204 @@
+package ollama
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// OutputFormat is an encoding memes can be exported in
+type OutputFormat string
+
+const (
+	FormatPNG              OutputFormat = "png"
+	FormatJPEG             OutputFormat = "jpeg"
+	FormatWebP             OutputFormat = "webp"               // lossless
+	FormatWebPNearLossless OutputFormat = "webp-near-lossless" // lossless encoding of quantized pixels, see encodeWebP
+	FormatWebPLossy        OutputFormat = "webp-lossy"         // VP8, see encodeWebPLossy
+)
+
+// OutputFormats lists every supported format in display order
+var OutputFormats = []OutputFormat{FormatPNG, FormatJPEG, FormatWebP, FormatWebPNearLossless, FormatWebPLossy}
+
+// DefaultQuality is used when no quality setting is configured
+const DefaultQuality = 85
+
+// ParseOutputFormat validates a format name, accepting common aliases
+func ParseOutputFormat(s string) (OutputFormat, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "png":
+		return FormatPNG, nil
+	case "jpeg", "jpg":
+		return FormatJPEG, nil
+	case "webp", "webp-lossless":
+		return FormatWebP, nil
+	case "webp-near-lossless":
+		return FormatWebPNearLossless, nil
+	case "webp-lossy":
+		return FormatWebPLossy, nil
+	}
+	return "", fmt.Errorf("unsupported output format: %q", s)
+}
+
+// Label returns the format's name for display
+func (f OutputFormat) Label() string {
+	switch f {
+	case FormatPNG:
+		return "PNG"
+	case FormatJPEG:
+		return "JPEG"
+	case FormatWebP:
+		return "WebP (lossless)"
+	case FormatWebPNearLossless:
+		return "WebP (near-lossless)"
+	case FormatWebPLossy:
+		return "WebP (lossy)"
+	}
+	return string(f)
+}
+
+// Extension returns the file extension for the format, including the dot
+func (f OutputFormat) Extension() string {
+	switch f {
+	case FormatJPEG:
+		return ".jpg"
+	case FormatWebP, FormatWebPNearLossless, FormatWebPLossy:
+		return ".webp"
+	}
+	return ".png"
+}
+
+// ContentType returns the MIME type for the format
+func (f OutputFormat) ContentType() string {
+	switch f {
+	case FormatJPEG:
+		return "image/jpeg"
+	case FormatWebP, FormatWebPNearLossless, FormatWebPLossy:
+		return "image/webp"
+	}
+	return "image/png"
+}
+
+// UsesQuality reports whether the quality setting affects the output.
+// PNG and lossless WebP always store every pixel exactly. Near-lossless
+// WebP drops low bits of each channel at lower quality, but is still
+// losslessly compressed, so it saves less than JPEG or lossy WebP at the
+// same quality.
+func (f OutputFormat) UsesQuality() bool {
+	return f == FormatJPEG || f == FormatWebPNearLossless || f == FormatWebPLossy
+}
+
+// NormalizeQuality clamps quality to 1-100, and to 100 for lossless formats
+// so that each lossless variant is only stored once
+func (f OutputFormat) NormalizeQuality(quality int) int {
+	if !f.UsesQuality() {
+		return 100
+	}
+	return max(1, min(100, quality))
+}
+
+// EncodeImage writes img in the given format. Quality is 1-100 and is
+// ignored by lossless formats.
+func EncodeImage(w io.Writer, img image.Image, format OutputFormat, quality int) error {
+	quality = format.NormalizeQuality(quality)
+
+	switch format {
+	case FormatPNG:
+		return png.Encode(w, img)
+	case FormatJPEG:
+		return jpeg.Encode(w, flatten(img, color.White), &jpeg.Options{Quality: quality})
+	case FormatWebP:
+		return encodeWebP(w, img, 0)
+	case FormatWebPNearLossless:
+		return encodeWebP(w, img, webpQuantBits(quality))
+	case FormatWebPLossy:
+		return encodeWebPLossy(w, img, quality)
+	}
+	return fmt.Errorf("unsupported output format: %q", format)
+}
+
+// flatten composites an image over a solid background, for formats
+// without an alpha channel
+func flatten(img image.Image, background color.Color) image.Image {
+	bounds := img.Bounds()
+	out := image.NewRGBA(bounds)
+	draw.Draw(out, bounds, image.NewUniform(background), image.Point{}, draw.Src)
+	draw.Draw(out, bounds, img, bounds.Min, draw.Over)
+	return out
+}
+
+// VariantFilename returns the filename used for an exported copy of an image
+func VariantFilename(filename string, format OutputFormat, quality int) string {
+	stem := strings.TrimSuffix(filename, filepath.Ext(filename))
+	if format.UsesQuality() {
+		return fmt.Sprintf("%s-%s-q%d%s", stem, format, format.NormalizeQuality(quality), format.Extension())
+	}
+	return fmt.Sprintf("%s-%s%s", stem, format, format.Extension())
+}
+
+// ExportImage re-encodes an image in the output directory and returns the
+// exported filename and its size in bytes. PNG exports of a PNG are the
+// original file. Existing exports newer than the image are reused.
+func (c *Client) ExportImage(filename string, format OutputFormat, quality int) (string, int64, error) {
+	exported := VariantFilename(filename, format, quality)
+	if format == FormatPNG && strings.EqualFold(filepath.Ext(filename), ".png") {
+		exported = filename
+	}
+	return c.export(filename, exported, format, quality, nil)
+}
+
+// ExportPreset renders an image for a preset and returns the exported
+// filename and its size in bytes. Existing exports newer than the image are
+// reused.
+func (c *Client) ExportPreset(filename string, p Preset) (string, int64, error) {
+	return c.export(filename, PresetFilename(filename, p), p.Format, p.Quality, p.Render)
+}
+
+// export encodes an image in the output directory to exported, passing it
+// through transform first if one is given
+func (c *Client) export(filename, exported string, format OutputFormat, quality int, transform func(image.Image) image.Image) (string, int64, error) {
+	srcPath := filepath.Join(c.outputDir, filename)
+	destPath := filepath.Join(c.outputDir, exported)
+
+	if info, err := os.Stat(destPath); err == nil && isFresh(destPath, srcPath) {
+		return exported, info.Size(), nil
+	}
+
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to open image: %w", err)
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to decode image: %w", err)
+	}
+	if transform != nil {
+		img = transform(img)
+	}
+
+	// Write atomically so a failed encode never leaves a truncated export
+	// behind to be reused
+	if err := writeFileAtomic(destPath, func(w io.Writer) error {
+		if err := EncodeImage(w, img, format, quality); err != nil {
+			return fmt.Errorf("failed to encode %s: %w", format, err)
+		}
+		return nil
+	}); err != nil {
+		return "", 0, err
+	}
+
+	info, err := os.Stat(destPath)
+	if err != nil {
+		return "", 0, err
+	}
+	return exported, info.Size(), nil
+}
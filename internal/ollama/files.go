@@ -0,0 +1,104 @@
+package ollama
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxSlugLength matches the prompt prefix length ollama uses in filenames
+const maxSlugLength = 50
+
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// NewFilename creates an empty file in the output directory and returns
+// its name, so concurrent requests never pick the same one. It is named
+// like `ollama run` output, a slug of the prompt followed by a timestamp,
+// plus a random suffix so replicas sharing storage do not collide either
+// (e.g. a-cat-wearing-a-hat-20260224-172500-3f9c1a.png). The caller
+// replaces the file, or removes it if it cannot.
+func (c *Client) NewFilename(prompt, ext string) (string, error) {
+	for {
+		suffix := make([]byte, 3)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", fmt.Errorf("failed to name file: %w", err)
+		}
+		filename := Filename(prompt, "-"+hex.EncodeToString(suffix)+ext)
+		file, err := os.OpenFile(filepath.Join(c.outputDir, filename), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to create %s: %w", filename, err)
+		}
+		file.Close()
+		return filename, nil
+	}
+}
+
+// Filename returns a name like `ollama run` output, a slug of the prompt
+// followed by a timestamp (e.g. a-cat-wearing-a-hat-20260224-172500.zip).
+// Unlike NewFilename it creates nothing, so it suits downloads that are
+// never saved.
+func Filename(prompt, ext string) string {
+	slug := nonSlugChars.ReplaceAllString(strings.ToLower(prompt), "-")
+	slug = strings.Trim(slug, "-")
+	if len(slug) > maxSlugLength {
+		slug = strings.Trim(slug[:maxSlugLength], "-")
+	}
+	if slug == "" {
+		slug = "image"
+	}
+	return fmt.Sprintf("%s-%s%s", slug, time.Now().Format("20060102-150405"), ext)
+}
+
+// ollamaFilename matches filenames from `ollama run` and NewFilename: a
+// prompt slug, a timestamp and optional suffixes such as -meme or a
+// random suffix. The slug is greedy, so the timestamp is the last one
+// in the name and numbers in the prompt stay part of the slug.
+var ollamaFilename = regexp.MustCompile(`^([a-z0-9-]*)-(\d{8}-\d{6})(?:-[a-z0-9]+)*\.[a-z0-9]+$`)
+
+// ParseFilename recovers the prompt and creation time from a filename in
+// the `ollama run` format (a-cat-wearing-a-hat-20260224-172500.png gives
+// "a cat wearing a hat" at 17:25:00 local time). The prompt is lowercase
+// and cut short like the slug. ok is false for other filenames.
+func ParseFilename(filename string) (prompt string, created time.Time, ok bool) {
+	matches := ollamaFilename.FindStringSubmatch(strings.ToLower(filepath.Base(filename)))
+	if matches == nil {
+		return "", time.Time{}, false
+	}
+	created, err := time.ParseInLocation("20060102-150405", matches[2], time.Local)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	prompt = strings.Join(strings.FieldsFunc(matches[1], func(r rune) bool { return r == '-' }), " ")
+	if prompt == "" {
+		return "", time.Time{}, false
+	}
+	return prompt, created, true
+}
+
+// FileHash returns a short hex digest of a file's contents, used for
+// versioned image URLs and ETags
+func FileHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)[:12]), nil
+}
@@ -0,0 +1,83 @@
+package ollama
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseFilename(t *testing.T) {
+	at := func(value string) time.Time {
+		created, err := time.ParseInLocation("20060102-150405", value, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return created
+	}
+
+	tests := []struct {
+		filename string
+		prompt   string
+		created  time.Time
+		ok       bool
+	}{
+		{"a-cat-wearing-a-hat-20260224-172500.png", "a cat wearing a hat", at("20260224-172500"), true},
+		{"cat-12345678-123456-20260224-172500.png", "cat 12345678 123456", at("20260224-172500"), true},
+		{"room-101-20260224-172500.png", "room 101", at("20260224-172500"), true},
+		{"cat-20260224-172500-meme.png", "cat", at("20260224-172500"), true},
+		{"cat-20260224-172500-2-meme.webp", "cat", at("20260224-172500"), true},
+		{"trailing-dash--20260224-172500.png", "trailing dash", at("20260224-172500"), true},
+		{"Upper-Case-20260224-172500.PNG", "upper case", at("20260224-172500"), true},
+		{"generated/sub/cat-20260224-172500.png", "cat", at("20260224-172500"), true},
+		{"20260224-172500.png", "", time.Time{}, false},
+		{"cat-20261399-172500.png", "", time.Time{}, false},
+		{"cat.png", "", time.Time{}, false},
+		{"cat-20260224-172500", "", time.Time{}, false},
+	}
+
+	for _, tt := range tests {
+		prompt, created, ok := ParseFilename(tt.filename)
+		if ok != tt.ok || prompt != tt.prompt || !created.Equal(tt.created) {
+			t.Errorf("ParseFilename(%q) = %q, %v, %v; want %q, %v, %v",
+				tt.filename, prompt, created, ok, tt.prompt, tt.created, tt.ok)
+		}
+	}
+}
+
+func TestNewFilename(t *testing.T) {
+	dir := t.TempDir()
+	c := &Client{outputDir: dir}
+
+	// Requests in the same second each get a file of their own
+	const count = 50
+	names := make([]string, count)
+	var wg sync.WaitGroup
+	for i := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			filename, err := c.NewFilename("A cat, wearing a hat!", ".png")
+			if err != nil {
+				t.Errorf("NewFilename: %v", err)
+			}
+			names[i] = filename
+		}()
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, filename := range names {
+		if seen[filename] {
+			t.Errorf("NewFilename returned %q twice", filename)
+		}
+		seen[filename] = true
+		if _, err := os.Stat(filepath.Join(dir, filename)); err != nil {
+			t.Errorf("NewFilename did not create %q: %v", filename, err)
+		}
+		if prompt, _, ok := ParseFilename(filename); !ok || prompt != "a cat wearing a hat" {
+			t.Errorf("ParseFilename(%q) = %q, %v; want %q", filename, prompt, ok, "a cat wearing a hat")
+		}
+	}
+}
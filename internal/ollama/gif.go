@@ -0,0 +1,482 @@
+package ollama
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+
+	"github.com/fogleman/gg"
+)
+
+// textAlphaThreshold is the overlay alpha above which a pixel becomes text.
+// GIF has no partial transparency, so anti-aliased edges are snapped rather
+// than blended to keep outlines crisp after palette quantization.
+const textAlphaThreshold = 128
+
+// OverlayGIFText captions every frame of an animated GIF. Captions are sized
+// and placed once (using the first frame for smart placement) and stamped
+// onto each frame. Frame delays, disposal methods and loop count are kept.
+func (c *Client) OverlayGIFText(srcPath, destPath, topText, bottomText string, opts OverlayOptions) error {
+	return c.rewriteGIF(srcPath, destPath, func(g *gif.GIF) error {
+		if topText == "" && bottomText == "" {
+			return nil
+		}
+		return c.captionGIF(g, func(dc *gg.Context, first image.Image) []Caption {
+			return c.layoutCaptions(dc, first, topText, bottomText, opts)
+		})
+	})
+}
+
+// ScanGIF counts the frames of a GIF and the pixels decoding them takes
+// (the sum of the frames' areas) by walking its blocks, without decoding
+// any image data. LZW packs a plain frame into a few bytes, so a small
+// file can decode to far more memory than its size suggests; checking this
+// first keeps such files from being decoded at all.
+func ScanGIF(data []byte) (frames int, pixels int64, err error) {
+	errTruncated := fmt.Errorf("gif is truncated")
+	if len(data) < 13 || (string(data[:6]) != "GIF87a" && string(data[:6]) != "GIF89a") {
+		return 0, 0, fmt.Errorf("not a gif")
+	}
+	colorTable := func(flags byte) int {
+		if flags&0x80 == 0 {
+			return 0
+		}
+		return 3 << (flags&0x07 + 1)
+	}
+	// skipSubBlocks returns the offset after the sub-blocks at i
+	skipSubBlocks := func(i int) (int, error) {
+		for {
+			if i >= len(data) {
+				return 0, errTruncated
+			}
+			size := int(data[i])
+			i++
+			if size == 0 {
+				return i, nil
+			}
+			i += size
+		}
+	}
+
+	i := 13 + colorTable(data[10])
+	for {
+		if i >= len(data) {
+			return 0, 0, errTruncated
+		}
+		switch data[i] {
+		case 0x21: // extension: label, then sub-blocks
+			if i+2 > len(data) {
+				return 0, 0, errTruncated
+			}
+			if i, err = skipSubBlocks(i + 2); err != nil {
+				return 0, 0, err
+			}
+		case 0x2c: // image descriptor, color table, LZW code size, data
+			if i+10 > len(data) {
+				return 0, 0, errTruncated
+			}
+			width := int64(data[i+5]) | int64(data[i+6])<<8
+			height := int64(data[i+7]) | int64(data[i+8])<<8
+			frames++
+			pixels += width * height
+			if i, err = skipSubBlocks(i + 10 + colorTable(data[i+9]) + 1); err != nil {
+				return 0, 0, err
+			}
+		case 0x3b: // trailer
+			return frames, pixels, nil
+		default:
+			return 0, 0, fmt.Errorf("gif has an unknown block 0x%02x", data[i])
+		}
+	}
+}
+
+// rewriteGIF decodes srcPath, applies edit and encodes the result to
+// destPath, which may be the same file. The result is written atomically,
+// so a failed encode leaves destPath as it was.
+func (c *Client) rewriteGIF(srcPath, destPath string, edit func(g *gif.GIF) error) error {
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to open gif: %w", err)
+	}
+	g, err := gif.DecodeAll(file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to decode gif: %w", err)
+	}
+
+	if err := edit(g); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(destPath, func(w io.Writer) error {
+		if err := gif.EncodeAll(w, g); err != nil {
+			return fmt.Errorf("failed to encode gif: %w", err)
+		}
+		return nil
+	})
+}
+
+// captionGIF lays out captions once against the first frame and stamps them
+// onto every frame of g
+func (c *Client) captionGIF(g *gif.GIF, layout func(dc *gg.Context, first image.Image) []Caption) error {
+	canvas := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if canvas.Empty() {
+		for _, frame := range g.Image {
+			canvas = canvas.Union(frame.Bounds())
+		}
+		canvas.Min = image.Point{}
+	}
+
+	first := image.NewRGBA(canvas)
+	draw.Draw(first, g.Image[0].Bounds(), g.Image[0], g.Image[0].Bounds().Min, draw.Over)
+
+	captions := layout(gg.NewContextForImage(first), first)
+
+	overlayDC := gg.NewContext(canvas.Dx(), canvas.Dy())
+	if err := c.drawCaptions(overlayDC, captions); err != nil {
+		return err
+	}
+	overlay, ok := overlayDC.Image().(*image.RGBA)
+	if !ok {
+		return fmt.Errorf("unexpected overlay image type %T", overlayDC.Image())
+	}
+
+	var textColors []color.Color
+	for _, caption := range captions {
+		textColors = appendColor(textColors, caption.Fill)
+		if caption.Stroke != nil {
+			textColors = appendColor(textColors, caption.Stroke)
+		}
+	}
+
+	stampGIF(g, canvas, overlay, textColors)
+	return nil
+}
+
+// stampGIF draws the text overlay onto every frame of g. Frames are played
+// back as a viewer shows them, so that when a frame grown to fit the text
+// is disposed of to the background, the next frame can paint back what the
+// disposal cleared outside the original frame.
+func stampGIF(g *gif.GIF, canvas image.Rectangle, overlay *image.RGBA, textColors []color.Color) {
+	textRect := opaqueBounds(overlay)
+	if textRect.Empty() {
+		return
+	}
+
+	playback := newGIFPlayback(canvas)
+	var repair image.Rectangle
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		out := stampFrame(frame, overlay, textRect, textColors, playback.canvas, repair)
+		playback.draw(frame, disposal)
+		playback.dispose(frame, disposal)
+
+		switch {
+		case disposal == gif.DisposalPrevious:
+			// Restoring the canvas brings back anything still to repair
+		case disposal == gif.DisposalBackground && out.Rect != frame.Rect:
+			repair = out.Rect
+		default:
+			repair = image.Rectangle{}
+		}
+		g.Image[i] = out
+	}
+}
+
+// stampFrame returns a copy of frame with the text overlay drawn on it.
+// canvas is what a viewer shows before the frame, and repair the area a
+// previous frame's disposal cleared beyond what the original animation
+// clears. The frame keeps its bounds unless text falls outside them or
+// canvas pixels in repair must be painted back; new area is otherwise
+// transparent, so earlier frames still show through it.
+func stampFrame(frame *image.Paletted, overlay *image.RGBA, textRect image.Rectangle, textColors []color.Color, canvas *image.RGBA, repair image.Rectangle) *image.Paletted {
+	isText := func(x, y int) bool {
+		return overlay.RGBAAt(x, y).A >= textAlphaThreshold
+	}
+	// Pixels the frame leaves transparent, or does not cover, show the
+	// canvas; those in repair must be painted unless text covers them
+	repair = repair.Intersect(canvas.Rect)
+	needsRepair := func(x, y int) bool {
+		if canvas.RGBAAt(x, y).A == 0 || (image.Pt(x, y).In(textRect) && isText(x, y)) {
+			return false
+		}
+		if !image.Pt(x, y).In(frame.Rect) {
+			return true
+		}
+		_, _, _, a := frame.Palette[frame.ColorIndexAt(x, y)].RGBA()
+		return a == 0
+	}
+
+	// Step 1: Grow the frame to the text and repaired pixels outside it
+	bounds := frame.Rect
+	if !textRect.In(frame.Rect) {
+		for y := textRect.Min.Y; y < textRect.Max.Y; y++ {
+			for x := textRect.Min.X; x < textRect.Max.X; x++ {
+				if !image.Pt(x, y).In(frame.Rect) && isText(x, y) {
+					bounds = bounds.Union(image.Rect(x, y, x+1, y+1))
+				}
+			}
+		}
+	}
+	var repairRect image.Rectangle
+	for y := repair.Min.Y; y < repair.Max.Y; y++ {
+		for x := repair.Min.X; x < repair.Max.X; x++ {
+			if needsRepair(x, y) {
+				repairRect = repairRect.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	bounds = bounds.Union(repairRect)
+
+	// Step 2: Make room in the palette for the new colors
+	pal := newFramePalette(frame)
+	transparent := -1
+	if bounds != frame.Rect {
+		transparent = pal.reserveTransparent()
+	}
+	textIndex := make([]uint8, len(textColors))
+	for i, c := range textColors {
+		textIndex[i] = uint8(pal.reserve(c))
+	}
+	repairIndex := map[color.RGBA]uint8{}
+	for y := repairRect.Min.Y; y < repairRect.Max.Y; y++ {
+		for x := repairRect.Min.X; x < repairRect.Max.X; x++ {
+			if c := canvas.RGBAAt(x, y); needsRepair(x, y) {
+				if _, ok := repairIndex[c]; !ok {
+					repairIndex[c] = uint8(pal.reserve(c))
+				}
+			}
+		}
+	}
+
+	// Step 3: Draw the frame, the repaired pixels and the text
+	out := image.NewPaletted(bounds, pal.colors)
+	if transparent >= 0 {
+		for i := range out.Pix {
+			out.Pix[i] = uint8(transparent)
+		}
+	}
+	for y := frame.Rect.Min.Y; y < frame.Rect.Max.Y; y++ {
+		for x := frame.Rect.Min.X; x < frame.Rect.Max.X; x++ {
+			out.SetColorIndex(x, y, pal.remap[frame.ColorIndexAt(x, y)])
+		}
+	}
+	for y := repairRect.Min.Y; y < repairRect.Max.Y; y++ {
+		for x := repairRect.Min.X; x < repairRect.Max.X; x++ {
+			if needsRepair(x, y) {
+				out.SetColorIndex(x, y, repairIndex[canvas.RGBAAt(x, y)])
+			}
+		}
+	}
+
+	for y := textRect.Min.Y; y < textRect.Max.Y; y++ {
+		for x := textRect.Min.X; x < textRect.Max.X; x++ {
+			o := overlay.RGBAAt(x, y)
+			if o.A < textAlphaThreshold {
+				continue
+			}
+			out.SetColorIndex(x, y, textIndex[nearestColor(textColors, unpremultiply(o))])
+		}
+	}
+
+	return out
+}
+
+// gifPlayback composites frames onto a canvas as a viewer shows them,
+// following each frame's disposal method
+type gifPlayback struct {
+	canvas   *image.RGBA
+	previous *image.RGBA // the canvas before the frame, for DisposalPrevious
+}
+
+func newGIFPlayback(bounds image.Rectangle) *gifPlayback {
+	return &gifPlayback{canvas: image.NewRGBA(bounds)}
+}
+
+// draw shows frame over the canvas
+func (p *gifPlayback) draw(frame *image.Paletted, disposal byte) {
+	if disposal == gif.DisposalPrevious {
+		if p.previous == nil {
+			p.previous = image.NewRGBA(p.canvas.Rect)
+		}
+		copy(p.previous.Pix, p.canvas.Pix)
+	}
+	draw.Draw(p.canvas, frame.Rect, frame, frame.Rect.Min, draw.Over)
+}
+
+// dispose clears frame from the canvas as its disposal method asks
+func (p *gifPlayback) dispose(frame *image.Paletted, disposal byte) {
+	switch disposal {
+	case gif.DisposalBackground:
+		draw.Draw(p.canvas, frame.Rect, image.Transparent, image.Point{}, draw.Src)
+	case gif.DisposalPrevious:
+		copy(p.canvas.Pix, p.previous.Pix)
+	}
+}
+
+// framePalette is a copy of a frame's palette that text colors are added to.
+// When the palette is full, the least used entries are replaced and their
+// pixels remapped to the nearest remaining color.
+type framePalette struct {
+	colors   color.Palette
+	usage    []int
+	reserved []bool
+	remap    []uint8 // original index -> new index
+}
+
+func newFramePalette(frame *image.Paletted) *framePalette {
+	p := &framePalette{
+		colors:   append(color.Palette(nil), frame.Palette...),
+		usage:    make([]int, len(frame.Palette)),
+		reserved: make([]bool, len(frame.Palette)),
+		remap:    make([]uint8, 256),
+	}
+	for i := range p.remap {
+		p.remap[i] = uint8(i)
+	}
+	// Transparent pixels must stay transparent, so their entry is kept
+	for i, c := range p.colors {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			p.reserved[i] = true
+		}
+	}
+	for y := frame.Rect.Min.Y; y < frame.Rect.Max.Y; y++ {
+		for x := frame.Rect.Min.X; x < frame.Rect.Max.X; x++ {
+			if i := int(frame.ColorIndexAt(x, y)); i < len(p.usage) {
+				p.usage[i]++
+			}
+		}
+	}
+	return p
+}
+
+// reserveTransparent returns the index of a fully transparent entry
+func (p *framePalette) reserveTransparent() int {
+	for i, c := range p.colors {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			p.reserved[i] = true
+			return i
+		}
+	}
+	return p.add(color.RGBA{})
+}
+
+// reserve returns the index of an exact match for c, adding it if needed
+func (p *framePalette) reserve(c color.Color) int {
+	r, g, b, a := c.RGBA()
+	for i, existing := range p.colors {
+		er, eg, eb, ea := existing.RGBA()
+		if r == er && g == eg && b == eb && a == ea {
+			p.reserved[i] = true
+			return i
+		}
+	}
+	return p.add(c)
+}
+
+func (p *framePalette) add(c color.Color) int {
+	if len(p.colors) < 256 {
+		p.colors = append(p.colors, c)
+		p.usage = append(p.usage, 0)
+		p.reserved = append(p.reserved, true)
+		return len(p.colors) - 1
+	}
+
+	victim := -1
+	for i := range p.colors {
+		if !p.reserved[i] && (victim < 0 || p.usage[i] < p.usage[victim]) {
+			victim = i
+		}
+	}
+	// With every entry taken, c is drawn in the nearest opaque one
+	if victim < 0 {
+		best, bestDist := 0, uint64(1<<63)
+		for i, candidate := range p.colors {
+			if _, _, _, a := candidate.RGBA(); a == 0 {
+				continue
+			}
+			if d := colorDistance(c, candidate); d < bestDist {
+				best, bestDist = i, d
+			}
+		}
+		return best
+	}
+
+	// Pixels that used the replaced color move to the nearest other entry
+	old := p.colors[victim]
+	best, bestDist := victim, uint64(1<<63)
+	for i, candidate := range p.colors {
+		if i == victim || p.reserved[i] {
+			continue
+		}
+		if d := colorDistance(old, candidate); d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	for i, mapped := range p.remap {
+		if int(mapped) == victim {
+			p.remap[i] = uint8(best)
+		}
+	}
+	p.usage[best] += p.usage[victim]
+
+	p.colors[victim] = c
+	p.usage[victim] = 0
+	p.reserved[victim] = true
+	return victim
+}
+
+// opaqueBounds returns the bounding box of pixels that will be stamped as text
+func opaqueBounds(img *image.RGBA) image.Rectangle {
+	var r image.Rectangle
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if img.RGBAAt(x, y).A >= textAlphaThreshold {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return r
+}
+
+func unpremultiply(c color.RGBA) color.NRGBA {
+	return color.NRGBAModel.Convert(c).(color.NRGBA)
+}
+
+func nearestColor(colors []color.Color, c color.Color) int {
+	best, bestDist := 0, uint64(1<<63)
+	for i, candidate := range colors {
+		if d := colorDistance(c, candidate); d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	return best
+}
+
+func colorDistance(a, b color.Color) uint64 {
+	ar, ag, ab, _ := a.RGBA()
+	br, bg, bb, _ := b.RGBA()
+	sq := func(x, y uint32) uint64 {
+		d := int64(x) - int64(y)
+		return uint64(d * d)
+	}
+	return sq(ar, br) + sq(ag, bg) + sq(ab, bb)
+}
+
+// appendColor appends c unless an identical color is already present
+func appendColor(colors []color.Color, c color.Color) []color.Color {
+	for _, existing := range colors {
+		if colorDistance(existing, c) == 0 {
+			return colors
+		}
+	}
+	return append(colors, c)
+}
@@ -0,0 +1,165 @@
+package ollama
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"testing"
+)
+
+// playFrames returns what a viewer shows for each frame of g
+func playFrames(g *gif.GIF, canvas image.Rectangle) []*image.RGBA {
+	playback := newGIFPlayback(canvas)
+	var shown []*image.RGBA
+	for i, frame := range g.Image {
+		playback.draw(frame, g.Disposal[i])
+		snapshot := image.NewRGBA(canvas)
+		copy(snapshot.Pix, playback.canvas.Pix)
+		shown = append(shown, snapshot)
+		playback.dispose(frame, g.Disposal[i])
+	}
+	return shown
+}
+
+func TestStampGIFKeepsDisposedContent(t *testing.T) {
+	canvas := image.Rect(0, 0, 60, 40)
+	red := color.RGBA{200, 0, 0, 255}
+	white := color.RGBA{255, 255, 255, 255}
+	palette := color.Palette{color.RGBA{}, red, color.RGBA{0, 0, 200, 255}, color.RGBA{0, 200, 0, 255}}
+	frame := func(r image.Rectangle, index uint8) *image.Paletted {
+		f := image.NewPaletted(r, palette)
+		for i := range f.Pix {
+			f.Pix[i] = index
+		}
+		return f
+	}
+
+	// A red background, a blue square cleared to the background after it is
+	// shown, then a green square in the other corner
+	tests := []struct {
+		name     string
+		frames   []*image.Paletted
+		disposal []byte
+	}{
+		{"background", []*image.Paletted{
+			frame(canvas, 1),
+			frame(image.Rect(0, 0, 10, 10), 2),
+			frame(image.Rect(50, 30, 60, 40), 3),
+		}, []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone}},
+		{"previous", []*image.Paletted{
+			frame(canvas, 1),
+			frame(image.Rect(0, 0, 10, 10), 2),
+			frame(image.Rect(20, 0, 30, 10), 3),
+			frame(image.Rect(50, 30, 60, 40), 2),
+		}, []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalPrevious, gif.DisposalNone}},
+	}
+
+	// The text: a white bar across the bottom
+	overlay := image.NewRGBA(canvas)
+	textRect := image.Rect(5, 30, 55, 35)
+	draw.Draw(overlay, textRect, image.NewUniform(white), image.Point{}, draw.Src)
+
+	for _, tt := range tests {
+		original := &gif.GIF{Image: tt.frames, Disposal: tt.disposal, Delay: make([]int, len(tt.frames))}
+		want := playFrames(original, canvas)
+		for _, img := range want {
+			draw.Draw(img, textRect, image.NewUniform(white), image.Point{}, draw.Src)
+		}
+
+		stamped := &gif.GIF{
+			Image:    append([]*image.Paletted(nil), tt.frames...),
+			Disposal: append([]byte(nil), tt.disposal...),
+			Delay:    make([]int, len(tt.frames)),
+		}
+		stampGIF(stamped, canvas, overlay, []color.Color{white})
+
+		// Frames the text fits in keep their bounds, and none changes its
+		// disposal method
+		if stamped.Image[0].Rect != canvas {
+			t.Errorf("%s: full frame grew to %v", tt.name, stamped.Image[0].Rect)
+		}
+		for i, d := range stamped.Disposal {
+			if d != tt.disposal[i] {
+				t.Errorf("%s: frame %d disposal %d, want %d", tt.name, i, d, tt.disposal[i])
+			}
+		}
+
+		// Round trip through the encoder, as the file would be written
+		var buf bytes.Buffer
+		if err := gif.EncodeAll(&buf, stamped); err != nil {
+			t.Fatalf("%s: encode: %v", tt.name, err)
+		}
+		decoded, err := gif.DecodeAll(&buf)
+		if err != nil {
+			t.Fatalf("%s: decode: %v", tt.name, err)
+		}
+
+		got := playFrames(decoded, canvas)
+		for i := range want {
+		pixels:
+			for y := canvas.Min.Y; y < canvas.Max.Y; y++ {
+				for x := canvas.Min.X; x < canvas.Max.X; x++ {
+					if g, w := got[i].RGBAAt(x, y), want[i].RGBAAt(x, y); g != w {
+						t.Errorf("%s: frame %d pixel (%d, %d) = %v, want %v", tt.name, i, x, y, g, w)
+						break pixels
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestScanGIF(t *testing.T) {
+	palette := color.Palette{color.RGBA{}, color.RGBA{200, 0, 0, 255}}
+	encode := func(g *gif.GIF) []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := gif.EncodeAll(&buf, g); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		return buf.Bytes()
+	}
+	animation := func(rects ...image.Rectangle) []byte {
+		g := &gif.GIF{LoopCount: 0}
+		for i, r := range rects {
+			// Alternate local and global palettes, so both are skipped
+			pal := palette
+			if i%2 == 1 {
+				pal = color.Palette{color.RGBA{0, 0, 200, 255}, color.RGBA{0, 200, 0, 255}, color.RGBA{}}
+			}
+			g.Image = append(g.Image, image.NewPaletted(r, pal))
+			g.Delay = append(g.Delay, 5)
+			g.Disposal = append(g.Disposal, gif.DisposalBackground)
+		}
+		return encode(g)
+	}
+
+	valid := animation(image.Rect(0, 0, 300, 200), image.Rect(10, 10, 50, 40), image.Rect(0, 0, 300, 200))
+	tests := []struct {
+		name   string
+		data   []byte
+		frames int
+		pixels int64
+		ok     bool
+	}{
+		{"single frame", animation(image.Rect(0, 0, 64, 48)), 1, 64 * 48, true},
+		{"animation", valid, 3, 300*200*2 + 40*30, true},
+		{"truncated", valid[:len(valid)-20], 0, 0, false},
+		{"no trailer", valid[:len(valid)-1], 0, 0, false},
+		{"not a gif", []byte("\x89PNG\r\n\x1a\n0000000000"), 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		frames, pixels, err := ScanGIF(tt.data)
+		if (err == nil) != tt.ok || frames != tt.frames || pixels != tt.pixels {
+			t.Errorf("%s: ScanGIF = %d frames, %d pixels, %v; want %d frames, %d pixels, ok %v",
+				tt.name, frames, pixels, err, tt.frames, tt.pixels, tt.ok)
+		}
+		// The scan agrees with the decoder on what a GIF holds
+		if g, err := gif.DecodeAll(bytes.NewReader(tt.data)); err == nil && tt.ok && len(g.Image) != frames {
+			t.Errorf("%s: decoder found %d frames, scan %d", tt.name, len(g.Image), frames)
+		}
+	}
+}
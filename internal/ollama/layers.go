@@ -0,0 +1,458 @@
+package ollama
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"meme-generator/internal/spec"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fogleman/gg"
+	"golang.org/x/image/draw"
+)
+
+// LayerKind is a type of annotation layer
+type LayerKind = spec.LayerKind
+
+const (
+	LayerBubble    LayerKind = "bubble"    // speech bubble with a tail
+	LayerThought   LayerKind = "thought"   // thought bubble trailing circles
+	LayerArrow     LayerKind = "arrow"     // arrow from X,Y to the tail point
+	LayerCircle    LayerKind = "circle"    // ring around the bounds
+	LayerHighlight LayerKind = "highlight" // translucent box over the bounds
+	LayerSticker   LayerKind = "sticker"   // image fitted to the bounds
+)
+
+// LayerKinds lists every layer kind in display order
+var LayerKinds = []LayerKind{LayerBubble, LayerThought, LayerArrow, LayerCircle, LayerHighlight, LayerSticker}
+
+const (
+	// MaxLayers limits the layers on one generation
+	MaxLayers = 20
+	// MaxLayerTextLength limits the text in a bubble
+	MaxLayerTextLength = 200
+	// minLayerSize is the smallest layer width or height, as a fraction of
+	// the image size
+	minLayerSize = 0.02
+)
+
+// Layer is an annotation drawn over a meme's captions
+type Layer = spec.Layer
+
+// defaultLayerColors are used when a layer has no color
+var defaultLayerColors = map[LayerKind]string{
+	LayerArrow:     "#E53935",
+	LayerCircle:    "#E53935",
+	LayerHighlight: "#FFEB3B",
+}
+
+// NormalizeLayers validates layers, clamping positions onto the image and
+// filling in default colors
+func NormalizeLayers(layers []Layer) ([]Layer, error) {
+	if len(layers) > MaxLayers {
+		return nil, fmt.Errorf("at most %d layers are allowed", MaxLayers)
+	}
+
+	normalized := make([]Layer, 0, len(layers))
+	for _, l := range layers {
+		l.X, l.Y = clampUnit(l.X), clampUnit(l.Y)
+		l.TailX, l.TailY = clampUnit(l.TailX), clampUnit(l.TailY)
+		l.Width = max(minLayerSize, clampUnit(l.Width))
+		l.Height = max(minLayerSize, clampUnit(l.Height))
+		// Bounds are moved back onto the image rather than shrunk; an
+		// arrow's X,Y is a point, which is already on it
+		if l.Kind != LayerArrow {
+			l.X = min(l.X, 1-l.Width)
+			l.Y = min(l.Y, 1-l.Height)
+		}
+		l.Text = strings.TrimSpace(l.Text)
+
+		switch l.Kind {
+		case LayerBubble, LayerThought:
+			if l.Text == "" {
+				return nil, fmt.Errorf("%s layers need text", l.Kind)
+			}
+			if utf8.RuneCountInString(l.Text) > MaxLayerTextLength {
+				return nil, fmt.Errorf("bubble text must be at most %d characters", MaxLayerTextLength)
+			}
+		case LayerArrow, LayerCircle, LayerHighlight:
+			l.Text = ""
+		case LayerSticker:
+			l.Text = ""
+			if !validSticker(l.Sticker) {
+				return nil, fmt.Errorf("unknown sticker: %q", l.Sticker)
+			}
+		default:
+			return nil, fmt.Errorf("unknown layer kind: %q", l.Kind)
+		}
+		if l.Kind != LayerSticker {
+			l.Sticker = ""
+		}
+
+		if def, ok := defaultLayerColors[l.Kind]; ok {
+			if l.Color == "" {
+				l.Color = def
+			}
+			if _, err := parseHexColor(l.Color); err != nil {
+				return nil, err
+			}
+		} else {
+			l.Color = ""
+		}
+		normalized = append(normalized, l)
+	}
+	return normalized, nil
+}
+
+func clampUnit(v float64) float64 {
+	if math.IsNaN(v) {
+		return 0
+	}
+	return max(0, min(1, v))
+}
+
+// ApplyLayers draws annotation layers onto the image at srcPath and writes
+// the result to destPath, which may be the same file. Stills are written as
+// PNG; GIF frames get the layers matched to their palettes, like the
+// watermark.
+func (c *Client) ApplyLayers(srcPath, destPath string, layers []Layer) error {
+	if strings.EqualFold(filepath.Ext(srcPath), ".gif") {
+		return c.rewriteGIF(srcPath, destPath, func(g *gif.GIF) error {
+			overlay, err := c.LayerOverlay(layers, g.Config.Width, g.Config.Height)
+			if err != nil {
+				return err
+			}
+			for _, frame := range g.Image {
+				stampPaletted(frame, overlay, image.Point{}, 1)
+			}
+			return nil
+		})
+	}
+
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+	src, _, err := image.Decode(file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	dc := gg.NewContextForImage(src)
+	if err := c.drawLayers(dc, layers); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(destPath, func(w io.Writer) error {
+		if err := png.Encode(w, dc.Image()); err != nil {
+			return fmt.Errorf("failed to encode image: %w", err)
+		}
+		return nil
+	})
+}
+
+// LayerOverlay draws layers onto a transparent image of the given size
+func (c *Client) LayerOverlay(layers []Layer, width, height int) (*image.RGBA, error) {
+	dc := gg.NewContext(width, height)
+	if err := c.drawLayers(dc, layers); err != nil {
+		return nil, err
+	}
+	overlay, ok := dc.Image().(*image.RGBA)
+	if !ok {
+		return nil, fmt.Errorf("unexpected overlay image type %T", dc.Image())
+	}
+	return overlay, nil
+}
+
+// drawLayers draws layers in order, so later layers cover earlier ones
+func (c *Client) drawLayers(dc *gg.Context, layers []Layer) error {
+	width, height := float64(dc.Width()), float64(dc.Height())
+	line := max(2, 0.006*min(width, height))
+
+	for _, l := range layers {
+		x, y := l.X*width, l.Y*height
+		w, h := l.Width*width, l.Height*height
+		tailX, tailY := l.TailX*width, l.TailY*height
+
+		dc.Push()
+		var err error
+		switch l.Kind {
+		case LayerBubble, LayerThought:
+			err = c.drawBubble(dc, l, x, y, w, h, tailX, tailY, line)
+		case LayerArrow:
+			drawArrow(dc, layerColor(l), x, y, tailX, tailY, line*2.5)
+		case LayerCircle:
+			dc.SetColor(layerColor(l))
+			dc.SetLineWidth(line * 2)
+			dc.DrawEllipse(x+w/2, y+h/2, w/2, h/2)
+			dc.Stroke()
+		case LayerHighlight:
+			r, g, b, _ := layerColor(l).RGBA()
+			dc.SetRGBA(float64(r)/0xFFFF, float64(g)/0xFFFF, float64(b)/0xFFFF, 0.35)
+			dc.DrawRectangle(x, y, w, h)
+			dc.Fill()
+		case LayerSticker:
+			err = c.drawSticker(dc, l.Sticker, x, y, w, h)
+		}
+		dc.Pop()
+		if err != nil {
+			return fmt.Errorf("failed to draw %s layer: %w", l.Kind, err)
+		}
+	}
+	return nil
+}
+
+func layerColor(l Layer) color.Color {
+	if c, err := parseHexColor(l.Color); err == nil {
+		return c
+	}
+	return color.Black
+}
+
+// drawBubble draws a speech or thought bubble filling the bounds with its
+// text wrapped inside. Outlines are stroked at double width and then
+// covered by the fill, so the body and tail join without a seam.
+func (c *Client) drawBubble(dc *gg.Context, l Layer, x, y, w, h, tailX, tailY, line float64) error {
+	cx, cy, rx, ry := x+w/2, y+h/2, w/2, h/2
+
+	var shapes []func()
+	shapes = append(shapes, func() { dc.DrawEllipse(cx, cy, rx, ry) })
+	if l.Kind == LayerBubble {
+		// A wedge from the middle of the bubble to the tail point; the
+		// part inside the body is covered by the fill
+		dx, dy := tailX-cx, tailY-cy
+		if length := math.Hypot(dx, dy); length > 0 {
+			spread := 0.25 * min(rx, ry)
+			px, py := -dy/length*spread, dx/length*spread
+			shapes = append(shapes, func() {
+				dc.MoveTo(cx+px, cy+py)
+				dc.LineTo(tailX, tailY)
+				dc.LineTo(cx-px, cy-py)
+				dc.ClosePath()
+			})
+		}
+	} else {
+		// Puffs around the edge make a cloud, and shrinking circles lead
+		// towards the tail point
+		puff := 0.3 * min(rx, ry)
+		for i := 0; i < 12; i++ {
+			angle := float64(i) * 2 * math.Pi / 12
+			px, py := cx+rx*math.Cos(angle), cy+ry*math.Sin(angle)
+			shapes = append(shapes, func() { dc.DrawCircle(px, py, puff) })
+		}
+		angle := math.Atan2(tailY-cy, tailX-cx)
+		edgeX, edgeY := cx+(rx+puff)*math.Cos(angle), cy+(ry+puff)*math.Sin(angle)
+		for i, size := range []float64{0.5, 0.33, 0.2} {
+			t := (float64(i) + 1) / 3
+			px, py := edgeX+(tailX-edgeX)*t, edgeY+(tailY-edgeY)*t
+			r := puff * size
+			shapes = append(shapes, func() { dc.DrawCircle(px, py, r) })
+		}
+	}
+
+	dc.SetColor(color.Black)
+	dc.SetLineWidth(line * 2)
+	for _, shape := range shapes {
+		shape()
+		dc.Stroke()
+	}
+	dc.SetColor(color.White)
+	for _, shape := range shapes {
+		shape()
+		dc.Fill()
+	}
+
+	// The largest rectangle inside an ellipse is sqrt(2) times its radii
+	fontSize, lines := c.fitText(dc, l.Text, rx*math.Sqrt2*0.9, ry*math.Sqrt2*0.9)
+	if err := c.loadFont(dc, fontSize); err != nil {
+		return err
+	}
+	lineHeight := fontSize * boxLineSpacing
+	firstY := cy - lineHeight*float64(len(lines)-1)/2
+	dc.SetColor(color.Black)
+	for i, text := range lines {
+		dc.DrawStringAnchored(text, cx, firstY+lineHeight*float64(i), 0.5, 0.5)
+	}
+	return nil
+}
+
+// drawArrow draws a line from one point to another with a filled head at
+// the second
+func drawArrow(dc *gg.Context, c color.Color, x1, y1, x2, y2, width float64) {
+	length := math.Hypot(x2-x1, y2-y1)
+	if length == 0 {
+		return
+	}
+	ux, uy := (x2-x1)/length, (y2-y1)/length
+	head := min(width*4, length/2)
+	baseX, baseY := x2-ux*head, y2-uy*head
+
+	dc.SetColor(c)
+	dc.SetLineWidth(width)
+	dc.SetLineCapRound()
+	dc.DrawLine(x1, y1, baseX, baseY)
+	dc.Stroke()
+
+	dc.MoveTo(x2, y2)
+	dc.LineTo(baseX-uy*head*0.6, baseY+ux*head*0.6)
+	dc.LineTo(baseX+uy*head*0.6, baseY-ux*head*0.6)
+	dc.ClosePath()
+	dc.Fill()
+}
+
+// StickersDir is the subdirectory of the output directory that uploaded
+// stickers are kept in
+const StickersDir = "stickers"
+
+var uploadedSticker = regexp.MustCompile(`^` + StickersDir + `/sticker-[0-9a-f]{12}\.png$`)
+
+// BuiltinStickers lists the stickers drawn in code, by name
+var BuiltinStickers = []string{"sunglasses", "deal-with-it"}
+
+func validSticker(name string) bool {
+	for _, s := range BuiltinStickers {
+		if name == s {
+			return true
+		}
+	}
+	return uploadedSticker.MatchString(filepath.ToSlash(name))
+}
+
+// SaveSticker stores an uploaded sticker as a PNG in StickersDir and
+// returns its path relative to the output directory
+func (c *Client) SaveSticker(data []byte) (string, error) {
+	return c.saveAsset(StickersDir, "sticker", data)
+}
+
+// ListStickers returns the uploaded stickers, oldest first, including
+// those uploaded to other replicas
+func (c *Client) ListStickers() ([]string, error) {
+	stored, err := c.store.List(StickersDir + "/")
+	if err != nil {
+		log.Printf("Warning: Failed to list stored stickers: %v", err)
+	}
+	for _, obj := range stored {
+		c.fetchMissing(filepath.Join(c.outputDir, filepath.FromSlash(obj.Key)))
+	}
+
+	matches, err := filepath.Glob(filepath.Join(c.outputDir, StickersDir, "sticker-*.png"))
+	if err != nil {
+		return nil, err
+	}
+
+	type sticker struct {
+		name    string
+		modTime int64
+	}
+	var found []sticker
+	for _, path := range matches {
+		name := filepath.ToSlash(filepath.Join(StickersDir, filepath.Base(path)))
+		if info, err := os.Stat(path); err == nil && validSticker(name) {
+			found = append(found, sticker{name, info.ModTime().UnixNano()})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].modTime < found[j].modTime })
+
+	names := make([]string, len(found))
+	for i, s := range found {
+		names[i] = s.name
+	}
+	return names, nil
+}
+
+// drawSticker draws a sticker as large as fits in the bounds, centered
+func (c *Client) drawSticker(dc *gg.Context, name string, x, y, w, h float64) error {
+	var sticker image.Image
+	switch name {
+	case "sunglasses":
+		sticker = sunglasses()
+	case "deal-with-it":
+		var err error
+		if sticker, err = c.dealWithIt(w, h); err != nil {
+			return err
+		}
+	default:
+		if !validSticker(name) {
+			return fmt.Errorf("unknown sticker: %q", name)
+		}
+		path := filepath.Join(c.outputDir, filepath.FromSlash(name))
+		c.fetchMissing(path)
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open sticker: %w", err)
+		}
+		sticker, _, err = image.Decode(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decode sticker: %w", err)
+		}
+	}
+
+	bounds := sticker.Bounds()
+	scale := min(w/float64(bounds.Dx()), h/float64(bounds.Dy()))
+	size := image.Pt(max(1, int(float64(bounds.Dx())*scale)), max(1, int(float64(bounds.Dy())*scale)))
+	scaled := image.NewRGBA(image.Rectangle{Max: size})
+
+	// Pixel art stays crisp
+	var scaler draw.Scaler = draw.CatmullRom
+	if name == "sunglasses" {
+		scaler = draw.NearestNeighbor
+	}
+	scaler.Scale(scaled, scaled.Bounds(), sticker, bounds, draw.Src, nil)
+
+	dc.DrawImageAnchored(scaled, int(x+w/2), int(y+h/2), 0.5, 0.5)
+	return nil
+}
+
+// sunglassesPixels is the classic pixel art shades; '#' is black, 'w' is a
+// white glint
+var sunglassesPixels = []string{
+	"######################",
+	"######################",
+	" #ww#######  #ww##### ",
+	" ##w######    #w##### ",
+	"  #######      #####  ",
+	"   #####        ###   ",
+}
+
+func sunglasses() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, len(sunglassesPixels[0]), len(sunglassesPixels)))
+	for y, row := range sunglassesPixels {
+		for x, p := range row {
+			switch p {
+			case '#':
+				img.Set(x, y, color.Black)
+			case 'w':
+				img.Set(x, y, color.White)
+			}
+		}
+	}
+	return img
+}
+
+// dealWithIt renders the "DEAL WITH IT" caption sticker at the size of the
+// bounds
+func (c *Client) dealWithIt(w, h float64) (image.Image, error) {
+	dc := gg.NewContext(max(1, int(w)), max(1, int(h)))
+	fontSize, lines := c.fitText(dc, "DEAL WITH IT", w*0.9, h*0.9)
+	if err := c.loadFont(dc, fontSize); err != nil {
+		return nil, err
+	}
+	lineHeight := fontSize * boxLineSpacing
+	firstY := h/2 - lineHeight*float64(len(lines)-1)/2
+	for i, text := range lines {
+		c.drawTextWithOutline(dc, text, w/2, firstY+lineHeight*float64(i), color.White, color.Black)
+	}
+	return dc.Image(), nil
+}
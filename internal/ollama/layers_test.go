@@ -0,0 +1,39 @@
+package ollama
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNormalizeLayersBounds(t *testing.T) {
+	tests := []struct {
+		name string
+		in   Layer
+		want Layer
+	}{
+		{"inside", Layer{Kind: LayerCircle, X: 0.1, Y: 0.2, Width: 0.3, Height: 0.4}, Layer{X: 0.1, Y: 0.2, Width: 0.3, Height: 0.4}},
+		{"at right edge", Layer{Kind: LayerCircle, X: 1, Y: 1, Width: 0, Height: 0}, Layer{X: 0.98, Y: 0.98, Width: 0.02, Height: 0.02}},
+		{"overhanging", Layer{Kind: LayerHighlight, X: 0.9, Y: 0.5, Width: 0.5, Height: 0.8}, Layer{X: 0.5, Y: 0.2, Width: 0.5, Height: 0.8}},
+		{"too large", Layer{Kind: LayerCircle, X: 0.5, Y: -1, Width: 3, Height: math.NaN()}, Layer{X: 0, Y: 0, Width: 1, Height: 0.02}},
+		{"arrow point", Layer{Kind: LayerArrow, X: 1, Y: 1, TailX: 0, TailY: 0}, Layer{X: 1, Y: 1, Width: 0.02, Height: 0.02}},
+	}
+
+	for _, tt := range tests {
+		got, err := NormalizeLayers([]Layer{tt.in})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		l := got[0]
+		if !near(l.X, tt.want.X) || !near(l.Y, tt.want.Y) || !near(l.Width, tt.want.Width) || !near(l.Height, tt.want.Height) {
+			t.Errorf("%s: got bounds (%g, %g, %g, %g), want (%g, %g, %g, %g)", tt.name,
+				l.X, l.Y, l.Width, l.Height, tt.want.X, tt.want.Y, tt.want.Width, tt.want.Height)
+		}
+		if l.Kind != LayerArrow && (l.X+l.Width > 1+1e-9 || l.Y+l.Height > 1+1e-9) {
+			t.Errorf("%s: bounds (%g, %g, %g, %g) leave the image", tt.name, l.X, l.Y, l.Width, l.Height)
+		}
+	}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
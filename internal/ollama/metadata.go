@@ -0,0 +1,331 @@
+package ollama
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Models used for each step, recorded in embedded metadata
+const (
+	ImageModel = "x/flux2-klein"
+	TextModel  = "gemma3:270m"
+)
+
+// metadataKeyword is the PNG text chunk keyword, and the XMP element name,
+// that metadata is stored under as JSON
+const metadataKeyword = "meme-generator"
+
+// Metadata describes how a meme was made. It is embedded in downloaded
+// files so a meme can be traced back to its generation or reproduced.
+type Metadata struct {
+	Software     string       `json:"software"`
+	GenerationID int64        `json:"generation_id"`
+	Prompt       string       `json:"prompt"`
+	Source       string       `json:"source"`
+	TemplateID   string       `json:"template_id,omitempty"`
+	TopText      string       `json:"top_text,omitempty"`
+	BottomText   string       `json:"bottom_text,omitempty"`
+	Captions     []string     `json:"captions,omitempty"`
+	Effects      []Effect     `json:"effects,omitempty"`
+	Layers       []Layer      `json:"layers,omitempty"`
+	Comic        *ComicScript `json:"comic,omitempty"`
+	ImageModel   string       `json:"image_model,omitempty"`
+	Seed         int64        `json:"seed,omitempty"` // the image model drew the image with
+	TextModel    string       `json:"text_model,omitempty"`
+	VisionModel  string       `json:"vision_model,omitempty"`
+	AltText      string       `json:"alt_text,omitempty"`
+	CreatedAt    time.Time    `json:"created_at"`
+}
+
+// EmbedMetadata returns a copy of an encoded PNG, JPEG or WebP image with
+// metadata added: PNG text chunks plus XMP for PNG, and XMP for JPEG and
+// WebP. Other formats are returned unchanged.
+func EmbedMetadata(data []byte, meta Metadata) ([]byte, error) {
+	meta.Software = metadataKeyword
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	xmp := xmpPacket(meta, encoded)
+
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return embedPNG(data, meta, encoded, xmp)
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return embedJPEG(data, xmp)
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return embedWebP(data, xmp)
+	}
+	return data, nil
+}
+
+// ReadMetadata extracts metadata written by EmbedMetadata. It returns nil
+// when the file carries none.
+func ReadMetadata(data []byte) (*Metadata, error) {
+	var encoded []byte
+	if bytes.HasPrefix(data, pngSignature) {
+		encoded = pngTextChunk(data, metadataKeyword)
+	}
+	if encoded == nil {
+		encoded = xmpMetadataJSON(data)
+	}
+	if encoded == nil {
+		return nil, nil
+	}
+
+	var meta Metadata
+	if err := json.Unmarshal(encoded, &meta); err != nil {
+		return nil, fmt.Errorf("invalid embedded metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// embedPNG inserts text chunks after IHDR. Plain ASCII values use tEXt,
+// anything else iTXt so it stays UTF-8.
+func embedPNG(data []byte, meta Metadata, encoded, xmp []byte) ([]byte, error) {
+	if len(data) < 33 || string(data[12:16]) != "IHDR" {
+		return nil, fmt.Errorf("png does not start with IHDR")
+	}
+	ihdrEnd := 8 + 12 + int(binary.BigEndian.Uint32(data[8:12]))
+
+	var chunks bytes.Buffer
+	text := func(keyword, value string) {
+		if value == "" {
+			return
+		}
+		if isPlainText(value) {
+			writePNGChunk(&chunks, "tEXt", []byte(keyword+"\x00"+value))
+			return
+		}
+		// Keyword, null, compression flag and method, empty language tag
+		// and translated keyword, then the UTF-8 text
+		writePNGChunk(&chunks, "iTXt", []byte(keyword+"\x00\x00\x00\x00\x00"+value))
+	}
+	text("Title", meta.Prompt)
+	text("Description", meta.AltText)
+	text("Software", metadataKeyword)
+	text("Creation Time", meta.CreatedAt.UTC().Format(time.RFC1123))
+	if meta.Seed != 0 {
+		text("Seed", strconv.FormatInt(meta.Seed, 10))
+	}
+	text(metadataKeyword, string(encoded))
+	writePNGChunk(&chunks, "iTXt", append([]byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"), xmp...))
+
+	out := make([]byte, 0, len(data)+chunks.Len())
+	out = append(out, data[:ihdrEnd]...)
+	out = append(out, chunks.Bytes()...)
+	return append(out, data[ihdrEnd:]...), nil
+}
+
+func writePNGChunk(buf *bytes.Buffer, kind string, payload []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(payload)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(kind))
+	crc.Write(payload)
+	buf.WriteString(kind)
+	buf.Write(payload)
+	binary.Write(buf, binary.BigEndian, crc.Sum32())
+}
+
+// pngTextChunk returns the text of the first tEXt or uncompressed iTXt
+// chunk with the given keyword
+func pngTextChunk(data []byte, keyword string) []byte {
+	for pos := len(pngSignature); pos+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		if length < 0 || pos+12+length > len(data) {
+			return nil
+		}
+		kind := string(data[pos+4 : pos+8])
+		payload := data[pos+8 : pos+8+length]
+		pos += 12 + length
+		if kind == "IEND" {
+			return nil
+		}
+
+		name, rest, ok := bytes.Cut(payload, []byte{0})
+		if !ok || string(name) != keyword {
+			continue
+		}
+		switch kind {
+		case "tEXt":
+			return rest
+		case "iTXt":
+			// Compression flag and method, then language tag and
+			// translated keyword
+			if len(rest) < 2 || rest[0] != 0 {
+				continue
+			}
+			fields := bytes.SplitN(rest[2:], []byte{0}, 3)
+			if len(fields) == 3 {
+				return fields[2]
+			}
+		}
+	}
+	return nil
+}
+
+// isPlainText reports whether s can go in a tEXt chunk as is
+func isPlainText(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 || (s[i] < 0x20 && s[i] != '\n') {
+			return false
+		}
+	}
+	return true
+}
+
+// embedJPEG inserts an XMP APP1 segment after SOI and any JFIF APP0 segment
+func embedJPEG(data, xmp []byte) ([]byte, error) {
+	payload := append([]byte("http://ns.adobe.com/xap/1.0/\x00"), xmp...)
+	if len(payload)+2 > 0xFFFF {
+		return nil, fmt.Errorf("metadata too large for a JPEG segment")
+	}
+
+	pos := 2
+	if len(data) >= 6 && data[2] == 0xFF && data[3] == 0xE0 {
+		pos = 4 + int(binary.BigEndian.Uint16(data[4:6]))
+	}
+	if pos > len(data) {
+		return nil, fmt.Errorf("truncated jpeg")
+	}
+
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+
+	out := make([]byte, 0, len(data)+len(segment)+len(payload))
+	out = append(out, data[:pos]...)
+	out = append(out, segment...)
+	out = append(out, payload...)
+	return append(out, data[pos:]...), nil
+}
+
+// embedWebP adds an XMP chunk. Simple WebP files are converted to the
+// extended format, which needs a VP8X header giving the canvas size.
+func embedWebP(data, xmp []byte) ([]byte, error) {
+	if len(data) < 20 {
+		return nil, fmt.Errorf("truncated webp")
+	}
+	chunks := data[12:]
+	kind := string(chunks[0:4])
+	payload := chunks[8:]
+
+	var header []byte
+	switch kind {
+	case "VP8X":
+		// Already extended: set the XMP flag in place
+		out := append([]byte(nil), data...)
+		out[20] |= 0x04
+		return appendWebPChunk(out, "XMP ", xmp), nil
+	case "VP8L":
+		if len(payload) < 5 || payload[0] != vp8lSignature {
+			return nil, fmt.Errorf("invalid VP8L header")
+		}
+		// The alpha flag is left unset: VP8L carries its own alpha, and
+		// x/image/webp rejects the flag without an ALPH chunk
+		bits := binary.LittleEndian.Uint32(payload[1:5])
+		header = vp8xHeader(bits&0x3FFF+1, (bits>>14)&0x3FFF+1)
+	case "VP8 ":
+		if len(payload) < 10 {
+			return nil, fmt.Errorf("invalid VP8 header")
+		}
+		width := uint32(binary.LittleEndian.Uint16(payload[6:8]) & 0x3FFF)
+		height := uint32(binary.LittleEndian.Uint16(payload[8:10]) & 0x3FFF)
+		header = vp8xHeader(width, height)
+	default:
+		return nil, fmt.Errorf("unsupported webp chunk %q", kind)
+	}
+
+	out := make([]byte, 0, len(data)+len(header)+len(xmp)+8)
+	out = append(out, data[:12]...)
+	out = append(out, header...)
+	out = append(out, chunks...)
+	return appendWebPChunk(out, "XMP ", xmp), nil
+}
+
+// vp8xHeader returns an extended format header with the XMP flag set
+func vp8xHeader(width, height uint32) []byte {
+	header := make([]byte, 18)
+	copy(header, "VP8X")
+	binary.LittleEndian.PutUint32(header[4:8], 10)
+	header[8] = 0x04 // XMP
+	putUint24(header[12:15], width-1)
+	putUint24(header[15:18], height-1)
+	return header
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// appendWebPChunk appends a chunk and updates the RIFF size
+func appendWebPChunk(data []byte, kind string, payload []byte) []byte {
+	data = append(data, kind...)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(payload)))
+	data = append(data, payload...)
+	if len(payload)%2 == 1 {
+		data = append(data, 0)
+	}
+	binary.LittleEndian.PutUint32(data[4:8], uint32(len(data)-8))
+	return data
+}
+
+// xmpPacket builds an XMP packet with the prompt as the title, the alt text
+// as the description, the seed and the full metadata as JSON
+func xmpPacket(meta Metadata, encoded []byte) []byte {
+	var buf bytes.Buffer
+	escape := func(s string) string {
+		var b strings.Builder
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+
+	buf.WriteString("<?xpacket begin=\"\xEF\xBB\xBF\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	buf.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmlns:meme="https://github.com/aaronbrown1988/meme-generator/ns/1.0/">
+`)
+	fmt.Fprintf(&buf, "   <xmp:CreatorTool>%s</xmp:CreatorTool>\n", metadataKeyword)
+	fmt.Fprintf(&buf, "   <xmp:CreateDate>%s</xmp:CreateDate>\n", meta.CreatedAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&buf, "   <dc:title><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:title>\n", escape(meta.Prompt))
+	if meta.AltText != "" {
+		fmt.Fprintf(&buf, "   <dc:description><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:description>\n", escape(meta.AltText))
+	}
+	if meta.Seed != 0 {
+		fmt.Fprintf(&buf, "   <meme:seed>%d</meme:seed>\n", meta.Seed)
+	}
+	fmt.Fprintf(&buf, "   <meme:json>%s</meme:json>\n", escape(string(encoded)))
+	buf.WriteString("  </rdf:Description>\n </rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"w\"?>")
+	return buf.Bytes()
+}
+
+// xmpMetadataJSON finds the meme:json element of an embedded XMP packet
+func xmpMetadataJSON(data []byte) []byte {
+	start := bytes.Index(data, []byte("<meme:json>"))
+	if start < 0 {
+		return nil
+	}
+	end := bytes.Index(data[start:], []byte("</meme:json>"))
+	if end < 0 {
+		return nil
+	}
+
+	var element struct {
+		Text string `xml:",chardata"`
+	}
+	if err := xml.Unmarshal(append(append([]byte("<v>"), data[start+len("<meme:json>"):start+end]...), "</v>"...), &element); err != nil {
+		return nil
+	}
+	return []byte(element.Text)
+}
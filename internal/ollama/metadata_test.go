@@ -0,0 +1,214 @@
+package ollama
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/image/webp"
+)
+
+func TestEmbedMetadataRoundTrip(t *testing.T) {
+	opaque := image.NewNRGBA(image.Rect(0, 0, 40, 30))
+	sticker := image.NewNRGBA(image.Rect(0, 0, 40, 30))
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			opaque.SetNRGBA(x, y, color.NRGBA{uint8(x * 6), uint8(y * 8), 90, 255})
+			// A round sticker with a transparent background
+			if (x-20)*(x-20)+(y-15)*(y-15) < 12*12 {
+				sticker.SetNRGBA(x, y, color.NRGBA{230, 40, 40, 255})
+			}
+		}
+	}
+	encode := func(fn func(*bytes.Buffer) error) []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := fn(&buf); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		decode func(r *bytes.Reader) (image.Image, error)
+		chunk  string // first WebP chunk after embedding
+	}{
+		{"png", encode(func(b *bytes.Buffer) error { return png.Encode(b, opaque) }),
+			func(r *bytes.Reader) (image.Image, error) { return png.Decode(r) }, ""},
+		{"png sticker", encode(func(b *bytes.Buffer) error { return png.Encode(b, sticker) }),
+			func(r *bytes.Reader) (image.Image, error) { return png.Decode(r) }, ""},
+		{"jpeg", encode(func(b *bytes.Buffer) error { return jpeg.Encode(b, opaque, nil) }),
+			func(r *bytes.Reader) (image.Image, error) { return jpeg.Decode(r) }, ""},
+		{"lossless webp", encode(func(b *bytes.Buffer) error { return encodeWebP(b, opaque, 0) }),
+			func(r *bytes.Reader) (image.Image, error) { return webp.Decode(r) }, "VP8X"},
+		{"lossless webp sticker", encode(func(b *bytes.Buffer) error { return encodeWebP(b, sticker, 0) }),
+			func(r *bytes.Reader) (image.Image, error) { return webp.Decode(r) }, "VP8X"},
+		{"lossy webp", encode(func(b *bytes.Buffer) error { return encodeWebPLossy(b, opaque, 75) }),
+			func(r *bytes.Reader) (image.Image, error) { return webp.Decode(r) }, "VP8X"},
+		{"lossy webp sticker", encode(func(b *bytes.Buffer) error { return encodeWebPLossy(b, sticker, 75) }),
+			func(r *bytes.Reader) (image.Image, error) { return webp.Decode(r) }, "VP8X"},
+	}
+
+	meta := Metadata{
+		GenerationID: 42,
+		Prompt:       `A cat saying "</meme:json>" & more`,
+		Source:       "generated",
+		TopText:      "Ünïcode ☃",
+		Captions:     []string{"one", "two"},
+		ImageModel:   ImageModel,
+		Seed:         1234,
+		AltText:      "A cat in a hat",
+		CreatedAt:    time.Date(2026, 2, 24, 17, 25, 0, 0, time.UTC),
+	}
+	want := meta
+	want.Software = metadataKeyword
+
+	for _, tt := range tests {
+		out, err := EmbedMetadata(tt.data, meta)
+		if err != nil {
+			t.Fatalf("%s: EmbedMetadata: %v", tt.name, err)
+		}
+		got, err := ReadMetadata(out)
+		if err != nil {
+			t.Fatalf("%s: ReadMetadata: %v", tt.name, err)
+		}
+		if got == nil || !reflect.DeepEqual(*got, want) {
+			t.Errorf("%s: ReadMetadata = %+v, want %+v", tt.name, got, want)
+		}
+
+		// Decoders still read the image, with its transparency
+		before, err := tt.decode(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Fatalf("%s: decode original: %v", tt.name, err)
+		}
+		after, err := tt.decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("%s: decode with metadata: %v", tt.name, err)
+		}
+		if after.Bounds() != before.Bounds() {
+			t.Errorf("%s: bounds %v, want %v", tt.name, after.Bounds(), before.Bounds())
+		}
+		for _, p := range []image.Point{{0, 0}, {20, 15}, {39, 29}} {
+			if a, b := after.At(p.X, p.Y), before.At(p.X, p.Y); !reflect.DeepEqual(color.NRGBAModel.Convert(a), color.NRGBAModel.Convert(b)) {
+				t.Errorf("%s: pixel %v = %v, want %v", tt.name, p, a, b)
+			}
+		}
+
+		if tt.chunk != "" {
+			if kind := string(out[12:16]); kind != tt.chunk {
+				t.Errorf("%s: first chunk %q, want %q", tt.name, kind, tt.chunk)
+			}
+			if out[20]&0x04 == 0 {
+				t.Errorf("%s: XMP flag not set", tt.name)
+			}
+			if size := int(out[4]) | int(out[5])<<8 | int(out[6])<<16 | int(out[7])<<24; size != len(out)-8 {
+				t.Errorf("%s: RIFF size %d, want %d", tt.name, size, len(out)-8)
+			}
+		}
+
+		// The XMP packet is well-formed and carries the seed
+		start := bytes.Index(out, []byte("<x:xmpmeta"))
+		end := bytes.Index(out, []byte("</x:xmpmeta>"))
+		if start < 0 || end < start {
+			t.Fatalf("%s: no XMP packet", tt.name)
+		}
+		var xmp struct {
+			Seed string `xml:"RDF>Description>seed"`
+		}
+		if err := xml.Unmarshal(out[start:end+len("</x:xmpmeta>")], &xmp); err != nil {
+			t.Errorf("%s: XMP does not parse: %v", tt.name, err)
+		} else if xmp.Seed != "1234" {
+			t.Errorf("%s: XMP seed %q, want 1234", tt.name, xmp.Seed)
+		}
+	}
+}
+
+func TestEmbedMetadataOtherFormats(t *testing.T) {
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black}), nil); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	out, err := EmbedMetadata(buf.Bytes(), Metadata{Prompt: "a gif"})
+	if err != nil || !bytes.Equal(out, buf.Bytes()) {
+		t.Errorf("EmbedMetadata changed a GIF: %v", err)
+	}
+	if meta, err := ReadMetadata(out); meta != nil || err != nil {
+		t.Errorf("ReadMetadata of a GIF = %v, %v; want nil", meta, err)
+	}
+
+	if _, err := EmbedMetadata([]byte("RIFF\x04\x00\x00\x00WEBPVP8"), Metadata{}); err == nil {
+		t.Error("EmbedMetadata accepted a truncated WebP")
+	}
+}
+
+func TestPNGTextChunk(t *testing.T) {
+	var pixels bytes.Buffer
+	if err := png.Encode(&pixels, image.NewGray(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	// withChunks inserts chunks after IHDR, as embedPNG does
+	withChunks := func(chunks ...[2]string) []byte {
+		var buf bytes.Buffer
+		for _, c := range chunks {
+			writePNGChunk(&buf, c[0], []byte(c[1]))
+		}
+		data := pixels.Bytes()
+		return append(append(append([]byte(nil), data[:33]...), buf.Bytes()...), data[33:]...)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string // "" for no chunk
+	}{
+		{"tEXt", withChunks([2]string{"tEXt", "Seed\x001234"}), "1234"},
+		{"iTXt", withChunks([2]string{"iTXt", "Seed\x00\x00\x00en\x00Graine\x00☃"}), "☃"},
+		{"compressed iTXt", withChunks([2]string{"iTXt", "Seed\x00\x01\x00\x00\x00x\x9c"}), ""},
+		{"other keyword", withChunks([2]string{"tEXt", "Title\x00a cat"}), ""},
+		{"first wins", withChunks([2]string{"tEXt", "Seed\x001"}, [2]string{"tEXt", "Seed\x002"}), "1"},
+		{"none", pixels.Bytes(), ""},
+		{"truncated", withChunks([2]string{"tEXt", "Seed\x001234"})[:40], ""},
+	}
+	for _, tt := range tests {
+		if got := pngTextChunk(tt.data, "Seed"); string(got) != tt.want || (got == nil) != (tt.want == "") {
+			t.Errorf("%s: pngTextChunk = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestXMPMetadataJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string // "" for none
+	}{
+		{"escaped", `<meme:json>{"prompt":"a &lt;b&gt; &amp; c"}</meme:json>`, `{"prompt":"a <b> & c"}`},
+		{"packet", string(xmpPacket(Metadata{Prompt: "x"}, []byte(`{"prompt":"x"}`))), `{"prompt":"x"}`},
+		{"no end", `<meme:json>{"prompt":"x"}`, ""},
+		{"bad xml", `<meme:json>a < b</meme:json>`, ""},
+		{"none", `<x:xmpmeta></x:xmpmeta>`, ""},
+	}
+	for _, tt := range tests {
+		got := xmpMetadataJSON([]byte(tt.data))
+		if string(got) != tt.want || (got == nil) != (tt.want == "") {
+			t.Errorf("%s: xmpMetadataJSON = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Values that look like markup survive a round trip
+	prompt := strings.Repeat(`</meme:json><meme:json>`, 2)
+	encoded := []byte(`{"prompt":"` + strings.ReplaceAll(prompt, `"`, `\"`) + `"}`)
+	if got := xmpMetadataJSON(xmpPacket(Metadata{Prompt: prompt}, encoded)); !bytes.Equal(got, encoded) {
+		t.Errorf("xmpMetadataJSON = %q, want %q", got, encoded)
+	}
+}
@@ -2,92 +2,156 @@ package ollama
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"image"
+	"image/color"
 	"image/png"
+	"io"
+	"math"
+	"math/rand/v2"
+	"meme-generator/internal/storage"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strings"
+	"time"
 
 	"github.com/fogleman/gg"
 	"github.com/golang/freetype/truetype"
 	"golang.org/x/image/font/gofont/gomonobold"
 )
 
+// Client runs the models and renders memes in the output directory. The
+// files it creates from scratch (generated and uploaded images, composed
+// strips, stickers and logos) are put in store, and the ones it reads as
+// inputs are fetched from it when missing.
 type Client struct {
 	outputDir string
+	store     storage.Storage
+	host      string // base URL of the Ollama API
+	http      *http.Client
 }
 
-func NewClient(outputDir string) *Client {
+func NewClient(outputDir string, store storage.Storage) *Client {
 	return &Client{
 		outputDir: outputDir,
+		store:     store,
+		host:      ollamaHost(),
+		http:      &http.Client{Timeout: imageTimeout},
 	}
 }
 
-func (c *Client) GenerateImage(prompt, systemPrompt string) (string, error) {
+const (
+	// defaultHost is where the Ollama API listens unless OLLAMA_HOST says
+	// otherwise
+	defaultHost = "http://127.0.0.1:11434"
+	// imageTimeout bounds one image generation, which can take minutes on
+	// a CPU
+	imageTimeout = 15 * time.Minute
+)
+
+// ollamaHost returns the base URL of the Ollama API from OLLAMA_HOST, as
+// the ollama CLI reads it: the scheme and port may be left out
+func ollamaHost() string {
+	host := strings.TrimSpace(os.Getenv("OLLAMA_HOST"))
+	if host == "" {
+		return defaultHost
+	}
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil || u.Hostname() == "" {
+		return defaultHost
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "11434")
+	}
+	return strings.TrimSuffix(u.String(), "/")
+}
+
+// NewSeed picks a seed for the image model. Seeds are positive, as 0
+// records that a generation's seed is unknown.
+func NewSeed() int64 {
+	return rand.Int64N(math.MaxInt32) + 1
+}
+
+// GenerateImage draws an image with the image model and saves it in the
+// output directory under a name made from the prompt. It goes through the
+// Ollama API rather than `ollama run`, as only the API takes a seed: the
+// same prompt, system prompt and seed draw the same image again.
+func (c *Client) GenerateImage(prompt, systemPrompt string, seed int64) (string, error) {
 	fullPrompt := prompt
 	if systemPrompt != "" {
 		fullPrompt = systemPrompt + "\n\n" + prompt
 	}
 
-	cmd := exec.Command("ollama", "run", "x/flux2-klein", fullPrompt)
-
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("ollama command failed: %w, stderr: %s", err, stderr.String())
+	body, err := json.Marshal(map[string]interface{}{
+		"model":   ImageModel,
+		"prompt":  fullPrompt,
+		"stream":  false,
+		"options": map[string]interface{}{"seed": seed},
+	})
+	if err != nil {
+		return "", err
 	}
-
-	output := strings.TrimSpace(stdout.String())
-
-	if output == "" {
-		return "", fmt.Errorf("ollama produced no output")
+	resp, err := c.http.Post(c.host+"/api/generate", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("ollama request failed: %w", err)
 	}
+	defer resp.Body.Close()
 
-	filename, err := extractFilename(output)
+	var result struct {
+		Image string `json:"image"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("invalid ollama response (%s): %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || result.Error != "" {
+		return "", fmt.Errorf("ollama image generation failed (%s): %s", resp.Status, result.Error)
+	}
+	if result.Image == "" {
+		return "", fmt.Errorf("ollama produced no image")
+	}
+	data, err := base64.StdEncoding.DecodeString(result.Image)
 	if err != nil {
-		return "", fmt.Errorf("failed to extract filename from output: %w", err)
+		return "", fmt.Errorf("invalid image from ollama: %w", err)
 	}
-
-	cwdPath := filepath.Join(".", filename)
-	if _, err := os.Stat(cwdPath); os.IsNotExist(err) {
-		return "", fmt.Errorf("generated image not found at: %s", cwdPath)
+	if _, err := png.DecodeConfig(bytes.NewReader(data)); err != nil {
+		return "", fmt.Errorf("invalid image from ollama: %w", err)
 	}
 
-	destPath := filepath.Join(c.outputDir, filename)
-	if err := os.Rename(cwdPath, destPath); err != nil {
-		return "", fmt.Errorf("failed to move image to %s: %w", destPath, err)
+	filename, err := c.NewFilename(prompt, ".png")
+	if err != nil {
+		return "", err
 	}
-
-	return filename, nil
-}
-
-func extractFilename(output string) (string, error) {
-	re := regexp.MustCompile(`Image saved to:\s+(.+\.png)`)
-	matches := re.FindStringSubmatch(output)
-
-	if len(matches) < 2 {
-		return "", fmt.Errorf("could not find 'Image saved to:' pattern in output")
+	destPath := filepath.Join(c.outputDir, filename)
+	if err := os.WriteFile(destPath, data, 0644); err != nil {
+		os.Remove(destPath)
+		return "", fmt.Errorf("failed to save image: %w", err)
 	}
+	c.publish(destPath)
 
-	filename := strings.TrimSpace(matches[1])
 	return filename, nil
 }
 
-// GenerateText calls Ollama with gemma3:270m to generate meme text
-func (c *Client) GenerateText(userPrompt string) (topText, bottomText string, err error) {
+// GenerateText calls Ollama with gemma3:270m to generate meme text. If the
+// image has been described by a vision model, the description is included
+// so the text fits the picture.
+func (c *Client) GenerateText(userPrompt, description string) (topText, bottomText string, err error) {
 	// Construct prompt asking for JSON meme text
 	fullPrompt := fmt.Sprintf(
-		"Generate meme text for: %s\n\nRespond ONLY with valid JSON in this exact format: {\"topText\":\"text here\",\"bottomText\":\"text here\"}. Keep text SHORT and FUNNY.",
-		userPrompt,
+		"Generate meme text for: %s%s\n\nRespond ONLY with valid JSON in this exact format: {\"topText\":\"text here\",\"bottomText\":\"text here\"}. Keep text SHORT and FUNNY.",
+		userPrompt, imageContext(description),
 	)
 
-	cmd := exec.Command("ollama", "run", "gemma3:270m", fullPrompt)
+	cmd := exec.Command("ollama", "run", TextModel, fullPrompt)
 
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
@@ -112,6 +176,14 @@ func (c *Client) GenerateText(userPrompt string) (topText, bottomText string, er
 	return topText, bottomText, nil
 }
 
+// imageContext formats a vision model description for a text prompt
+func imageContext(description string) string {
+	if description == "" {
+		return ""
+	}
+	return fmt.Sprintf("\n\nThe image shows: %s\nThe text must fit what is in the image.", description)
+}
+
 // parseTextJSON extracts top and bottom text from JSON, handling field name variations
 func parseTextJSON(output string) (string, string, error) {
 	// Try to extract JSON from output (model might include extra text)
@@ -137,6 +209,149 @@ func parseTextJSON(output string) (string, string, error) {
 	return topText, bottomText, nil
 }
 
+// GenerateBoxText calls Ollama with gemma3:270m to write one caption per
+// template text box. Labels describe what each box is for. Boxes with given
+// text keep it, and the model sees it so the rest of the text fits.
+func (c *Client) GenerateBoxText(userPrompt, templateName string, labels, given []string) ([]string, error) {
+	var boxes strings.Builder
+	for i, label := range labels {
+		if label == "" {
+			label = "caption"
+		}
+		if i < len(given) && given[i] != "" {
+			fmt.Fprintf(&boxes, "%d. %s (already written, repeat it exactly: %q)\n", i+1, label, given[i])
+		} else {
+			fmt.Fprintf(&boxes, "%d. %s\n", i+1, label)
+		}
+	}
+
+	fullPrompt := fmt.Sprintf(
+		"Write text for the %q meme template about: %s\n\nThe template has %d text boxes:\n%s\nRespond ONLY with valid JSON in this exact format: {\"texts\":[\"box 1 text\",\"box 2 text\"]} with exactly %d strings. Keep text SHORT and FUNNY.",
+		templateName, userPrompt, len(labels), boxes.String(), len(labels),
+	)
+
+	cmd := exec.Command("ollama", "run", TextModel, fullPrompt)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ollama text generation failed: %w, stderr: %s", err, stderr.String())
+	}
+
+	output := strings.TrimSpace(stdout.String())
+	if output == "" {
+		return nil, fmt.Errorf("ollama produced no text output")
+	}
+
+	texts, err := parseBoxTextJSON(output, len(labels))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse text JSON: %w (output: %s)", err, output)
+	}
+	for i := range texts {
+		if i < len(given) && given[i] != "" {
+			texts[i] = given[i]
+		}
+	}
+
+	return texts, nil
+}
+
+// parseBoxTextJSON extracts a list of captions, accepting either
+// {"texts":[...]} or a bare array. Missing entries are left empty.
+func parseBoxTextJSON(output string, count int) ([]string, error) {
+	var raw []interface{}
+
+	if start, end := strings.Index(output, "{"), strings.LastIndex(output, "}"); start != -1 && end > start {
+		var result map[string]interface{}
+		if err := json.Unmarshal([]byte(output[start:end+1]), &result); err == nil {
+			for _, key := range []string{"texts", "captions", "text"} {
+				if list, ok := result[key].([]interface{}); ok {
+					raw = list
+					break
+				}
+			}
+		}
+	}
+	if raw == nil {
+		start, end := strings.Index(output, "["), strings.LastIndex(output, "]")
+		if start == -1 || end <= start {
+			return nil, fmt.Errorf("no JSON list found in output")
+		}
+		if err := json.Unmarshal([]byte(output[start:end+1]), &raw); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+	}
+
+	texts := make([]string, count)
+	for i := 0; i < count && i < len(raw); i++ {
+		if str, ok := raw[i].(string); ok {
+			texts[i] = strings.TrimSpace(str)
+		}
+	}
+	return texts, nil
+}
+
+// maxSuggestedTags is how many tags SuggestTags asks for
+const maxSuggestedTags = 5
+
+// SuggestTags calls Ollama with gemma3:270m to suggest short topic tags for
+// a meme from its prompt and caption text. Tags are returned as written by
+// the model, for the caller to normalize.
+func (c *Client) SuggestTags(prompt, text string) ([]string, error) {
+	if text != "" {
+		text = fmt.Sprintf("\nIts text reads: %s", text)
+	}
+	fullPrompt := fmt.Sprintf(
+		"Suggest up to %d short tags to file this meme under, naming its subjects and mood. The meme is about: %s%s\n\nRespond ONLY with valid JSON in this exact format: {\"tags\":[\"tag\",\"tag\"]}. Use one or two lowercase words per tag.",
+		maxSuggestedTags, prompt, text,
+	)
+
+	cmd := exec.Command("ollama", "run", TextModel, fullPrompt)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ollama text generation failed: %w, stderr: %s", err, stderr.String())
+	}
+
+	output := strings.TrimSpace(stdout.String())
+	if output == "" {
+		return nil, fmt.Errorf("ollama produced no text output")
+	}
+
+	var raw []interface{}
+	if start, end := strings.Index(output, "{"), strings.LastIndex(output, "}"); start != -1 && end > start {
+		var result map[string]interface{}
+		if err := json.Unmarshal([]byte(output[start:end+1]), &result); err == nil {
+			raw, _ = result["tags"].([]interface{})
+		}
+	}
+	if raw == nil {
+		start, end := strings.Index(output, "["), strings.LastIndex(output, "]")
+		if start == -1 || end <= start {
+			return nil, fmt.Errorf("no tags found in output: %s", output)
+		}
+		if err := json.Unmarshal([]byte(output[start:end+1]), &raw); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w (output: %s)", err, output)
+		}
+	}
+
+	var tags []string
+	for _, item := range raw {
+		if tag, ok := item.(string); ok && strings.TrimSpace(tag) != "" {
+			tags = append(tags, tag)
+		}
+		if len(tags) == maxSuggestedTags {
+			break
+		}
+	}
+	return tags, nil
+}
+
 // getStringField tries multiple field name variations and returns the first match
 func getStringField(m map[string]interface{}, keys ...string) string {
 	for _, key := range keys {
@@ -149,8 +364,25 @@ func getStringField(m map[string]interface{}, keys ...string) string {
 	return ""
 }
 
+// Caption is a single line of meme text positioned on an image
+type Caption struct {
+	Text     string
+	FontSize float64
+	X        float64
+	Y        float64
+	Fill     color.Color
+	Stroke   color.Color
+}
+
+// OverlayOptions controls how meme text is laid out on an image
+type OverlayOptions struct {
+	// SmartPlacement moves captions into the calmest band of each half of
+	// the image and picks contrasting colors, instead of fixed 10%/90% heights
+	SmartPlacement bool
+}
+
 // OverlayMemeText adds top and bottom text to an image using classic meme styling
-func (c *Client) OverlayMemeText(imagePath, topText, bottomText string) error {
+func (c *Client) OverlayMemeText(imagePath, topText, bottomText string, opts OverlayOptions) error {
 	// Skip if no text to overlay
 	if topText == "" && bottomText == "" {
 		return nil
@@ -170,38 +402,74 @@ func (c *Client) OverlayMemeText(imagePath, topText, bottomText string) error {
 
 	// Create drawing context
 	dc := gg.NewContextForImage(img)
-	width := float64(dc.Width())
-	height := float64(dc.Height())
 
-	// Draw top text
-	if topText != "" {
-		fontSize := c.calculateOptimalFontSize(dc, strings.ToUpper(topText), width, height)
-		if err := c.loadFont(dc, fontSize); err != nil {
-			return fmt.Errorf("failed to load font for top text: %w", err)
-		}
-		c.drawTextWithOutline(dc, strings.ToUpper(topText), width/2, height*0.1)
+	captions := c.layoutCaptions(dc, img, topText, bottomText, opts)
+	if err := c.drawCaptions(dc, captions); err != nil {
+		return err
 	}
 
-	// Draw bottom text (recalculate font size for different text length)
-	if bottomText != "" {
-		fontSize := c.calculateOptimalFontSize(dc, strings.ToUpper(bottomText), width, height)
-		if err := c.loadFont(dc, fontSize); err != nil {
-			return fmt.Errorf("failed to load font for bottom text: %w", err)
+	// Save the modified image over the original, atomically so a failed
+	// encode leaves the original intact
+	return writeFileAtomic(imagePath, func(w io.Writer) error {
+		if err := png.Encode(w, dc.Image()); err != nil {
+			return fmt.Errorf("failed to encode image: %w", err)
 		}
-		c.drawTextWithOutline(dc, strings.ToUpper(bottomText), width/2, height*0.9)
+		return nil
+	})
+}
+
+// layoutCaptions sizes and positions top and bottom text for an image.
+// Font size is calculated separately for each caption since lengths differ.
+func (c *Client) layoutCaptions(dc *gg.Context, img image.Image, topText, bottomText string, opts OverlayOptions) []Caption {
+	width := float64(dc.Width())
+	height := float64(dc.Height())
+
+	var analysis *imageAnalysis
+	if opts.SmartPlacement {
+		analysis = analyseImage(img)
 	}
 
-	// Save the modified image
-	outFile, err := os.Create(imagePath)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+	lines := []struct {
+		text     string
+		relative float64
+		top      bool
+	}{
+		{topText, 0.1, true},
+		{bottomText, 0.9, false},
 	}
-	defer outFile.Close()
 
-	if err := png.Encode(outFile, dc.Image()); err != nil {
-		return fmt.Errorf("failed to encode image: %w", err)
+	var captions []Caption
+	for _, line := range lines {
+		if line.text == "" {
+			continue
+		}
+
+		text := strings.ToUpper(line.text)
+		caption := Caption{
+			Text:     text,
+			FontSize: c.calculateOptimalFontSize(dc, text, width, height),
+			X:        width / 2,
+			Y:        height * line.relative,
+			Fill:     color.White,
+			Stroke:   color.Black,
+		}
+		if analysis != nil {
+			caption.Y, caption.Fill, caption.Stroke = analysis.place(caption.FontSize, line.top)
+		}
+		captions = append(captions, caption)
 	}
 
+	return captions
+}
+
+// drawCaptions renders laid-out captions onto a drawing context
+func (c *Client) drawCaptions(dc *gg.Context, captions []Caption) error {
+	for _, caption := range captions {
+		if err := c.loadFont(dc, caption.FontSize); err != nil {
+			return fmt.Errorf("failed to load font for %q: %w", caption.Text, err)
+		}
+		c.drawTextWithOutline(dc, caption.Text, caption.X, caption.Y, caption.Fill, caption.Stroke)
+	}
 	return nil
 }
 
@@ -257,10 +525,12 @@ func (c *Client) calculateOptimalFontSize(dc *gg.Context, text string, width, he
 	return fontSize
 }
 
+// impactPath is where Impact.ttf is loaded from when it is installed
+const impactPath = "assets/fonts/Impact.ttf"
+
 // loadFont tries to load Impact.ttf, falls back to embedded gomonobold
 func (c *Client) loadFont(dc *gg.Context, size float64) error {
 	// Try to load Impact.ttf from assets/fonts
-	impactPath := "assets/fonts/Impact.ttf"
 	if _, err := os.Stat(impactPath); err == nil {
 		if err := dc.LoadFontFace(impactPath, size); err == nil {
 			return nil
@@ -280,20 +550,37 @@ func (c *Client) loadFont(dc *gg.Context, size float64) error {
 	return nil
 }
 
-// drawTextWithOutline draws white text with black outline (classic meme style)
-func (c *Client) drawTextWithOutline(dc *gg.Context, text string, x, y float64) {
-	// Draw black outline (stroke)
+// memeFont returns the font loadFont draws with, for tracing glyph outlines
+func memeFont() (*truetype.Font, error) {
+	if data, err := os.ReadFile(impactPath); err == nil {
+		if font, err := truetype.Parse(data); err == nil {
+			return font, nil
+		}
+	}
+	font, err := truetype.Parse(gomonobold.TTF)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse fallback font: %w", err)
+	}
+	return font, nil
+}
+
+// drawTextWithOutline draws filled text with an outline (classic meme style is white on black).
+// A nil stroke draws the text without an outline.
+func (c *Client) drawTextWithOutline(dc *gg.Context, text string, x, y float64, fill, stroke color.Color) {
+	// Draw outline (stroke)
 	outlineSize := 3.0
-	dc.SetRGB(0, 0, 0) // Black
-	for dx := -outlineSize; dx <= outlineSize; dx++ {
-		for dy := -outlineSize; dy <= outlineSize; dy++ {
-			if dx != 0 || dy != 0 {
-				dc.DrawStringAnchored(text, x+dx, y+dy, 0.5, 0.5)
+	if stroke != nil {
+		dc.SetColor(stroke)
+		for dx := -outlineSize; dx <= outlineSize; dx++ {
+			for dy := -outlineSize; dy <= outlineSize; dy++ {
+				if dx != 0 || dy != 0 {
+					dc.DrawStringAnchored(text, x+dx, y+dy, 0.5, 0.5)
+				}
 			}
 		}
 	}
 
-	// Draw white text on top
-	dc.SetRGB(1, 1, 1) // White
+	// Draw fill text on top
+	dc.SetColor(fill)
 	dc.DrawStringAnchored(text, x, y, 0.5, 0.5)
 }
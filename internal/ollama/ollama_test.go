@@ -0,0 +1,103 @@
+package ollama
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/png"
+	"meme-generator/internal/storage"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateImageSendsSeed(t *testing.T) {
+	var pixels bytes.Buffer
+	if err := png.Encode(&pixels, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	var got struct {
+		Model   string `json:"model"`
+		Prompt  string `json:"prompt"`
+		Stream  bool   `json:"stream"`
+		Options struct {
+			Seed int64 `json:"seed"`
+		} `json:"options"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/generate" {
+			http.Error(w, `{"error":"not found"}`, http.StatusNotFound)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, `{"error":"bad request"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"model": got.Model,
+			"image": base64.StdEncoding.EncodeToString(pixels.Bytes()),
+			"done":  true,
+		})
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	store, err := storage.NewLocal(dir)
+	if err != nil {
+		t.Fatalf("NewLocal: %v", err)
+	}
+	c := &Client{outputDir: dir, store: store, host: server.URL, http: server.Client()}
+
+	filename, err := c.GenerateImage("A cat in a hat", "Flat colors.", 1234)
+	if err != nil {
+		t.Fatalf("GenerateImage: %v", err)
+	}
+	if got.Model != ImageModel || got.Prompt != "Flat colors.\n\nA cat in a hat" || got.Stream || got.Options.Seed != 1234 {
+		t.Errorf("request = %+v, want model %s, the system prompt first, no streaming and seed 1234", got, ImageModel)
+	}
+	if prompt, _, ok := ParseFilename(filename); !ok || prompt != "a cat in a hat" {
+		t.Errorf("filename %q is not named after the prompt", filename)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, filename))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(data, pixels.Bytes()) {
+		t.Error("saved image differs from the one the API returned")
+	}
+
+	// Errors from the API are reported, and leave no file behind
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"model \"x/flux2-klein\" not found"}`))
+	})
+	if _, err := c.GenerateImage("A dog", "", 1); err == nil {
+		t.Error("GenerateImage succeeded when the API failed")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("output directory holds %d files, want only the first image", len(entries))
+	}
+}
+
+func TestOllamaHost(t *testing.T) {
+	tests := []struct {
+		env  string
+		want string
+	}{
+		{"", defaultHost},
+		{"127.0.0.1", "http://127.0.0.1:11434"},
+		{"ollama:8080", "http://ollama:8080"},
+		{"https://ollama.example.com", "https://ollama.example.com:11434"},
+		{"http://[::1]:11434/", "http://[::1]:11434"},
+	}
+	for _, tt := range tests {
+		t.Setenv("OLLAMA_HOST", tt.env)
+		if got := ollamaHost(); got != tt.want {
+			t.Errorf("ollamaHost() with OLLAMA_HOST=%q = %q, want %q", tt.env, got, tt.want)
+		}
+	}
+}
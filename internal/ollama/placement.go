@@ -0,0 +1,227 @@
+package ollama
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// analysisWidth is the width of the downscaled grid used for image analysis.
+// Analysing at full resolution is slow and adds nothing for text placement.
+const analysisWidth = 160
+
+// minTextContrast is the WCAG contrast ratio required for large text
+const minTextContrast = 3.0
+
+// imageAnalysis holds per-row statistics used to find calm bands for captions
+type imageAnalysis struct {
+	rows    int
+	scale   float64   // source pixels per grid cell
+	rowCost []float64 // edge density + saliency, 0 (calm) to 1 (busy)
+	rowLum  []float64 // mean relative luminance of each row
+	rowLum2 []float64 // mean squared relative luminance of each row
+}
+
+// analyseImage downscales the image to a luminance grid and scores each row
+// by edge density (Sobel magnitude) and contrast saliency
+func analyseImage(img image.Image) *imageAnalysis {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	scale := float64(srcW) / analysisWidth
+	if scale < 1 {
+		scale = 1
+	}
+	cols := int(float64(srcW) / scale)
+	rows := int(float64(srcH) / scale)
+	if cols < 3 || rows < 3 {
+		return nil
+	}
+
+	lum := make([]float64, cols*rows)
+	for gy := 0; gy < rows; gy++ {
+		for gx := 0; gx < cols; gx++ {
+			lum[gy*cols+gx] = sampleLuminance(img, bounds, gx, gy, scale)
+		}
+	}
+	// Saliency is local contrast: how much a cell stands out from its surroundings
+	blurred := boxBlur(lum, cols, rows, 4)
+
+	// Only the central 90% of each row is covered by text
+	minX := int(float64(cols) * 0.05)
+	maxX := cols - minX
+
+	analysis := &imageAnalysis{
+		rows:    rows,
+		scale:   scale,
+		rowCost: make([]float64, rows),
+		rowLum:  make([]float64, rows),
+		rowLum2: make([]float64, rows),
+	}
+
+	at := func(x, y int) float64 {
+		x = clampInt(x, 0, cols-1)
+		y = clampInt(y, 0, rows-1)
+		return lum[y*cols+x]
+	}
+
+	for gy := 0; gy < rows; gy++ {
+		var edges, saliency, sumLum, sumLum2, weights float64
+		for gx := minX; gx < maxX; gx++ {
+			gxv := at(gx+1, gy-1) + 2*at(gx+1, gy) + at(gx+1, gy+1) -
+				at(gx-1, gy-1) - 2*at(gx-1, gy) - at(gx-1, gy+1)
+			gyv := at(gx-1, gy+1) + 2*at(gx, gy+1) + at(gx+1, gy+1) -
+				at(gx-1, gy-1) - 2*at(gx, gy-1) - at(gx+1, gy-1)
+			edges += math.Min(math.Hypot(gxv, gyv)/4, 1)
+
+			// Subjects tend to sit in the horizontal centre of the frame
+			centre := 1 - 0.5*math.Abs(float64(gx)-float64(cols)/2)/(float64(cols)/2)
+			saliency += math.Abs(at(gx, gy)-blurred[gy*cols+gx]) * centre
+			weights += centre
+
+			sumLum += at(gx, gy)
+			sumLum2 += at(gx, gy) * at(gx, gy)
+		}
+		n := float64(maxX - minX)
+
+		// Smooth subjects such as faces have few edges, so also assume the
+		// subject sits slightly above the vertical centre of the frame
+		prior := math.Exp(-math.Pow((float64(gy)/float64(rows)-0.45)/0.15, 2))
+
+		analysis.rowCost[gy] = 0.5*(edges/n) + 0.3*math.Min(saliency/weights*4, 1) + 0.2*prior
+		analysis.rowLum[gy] = sumLum / n
+		analysis.rowLum2[gy] = sumLum2 / n
+	}
+
+	return analysis
+}
+
+// place finds the calmest band for a caption of the given font size and
+// returns its vertical centre plus fill and stroke colors with enough contrast.
+// Top captions are searched in the upper half, bottom captions in the lower.
+func (a *imageAnalysis) place(fontSize float64, top bool) (y float64, fill, stroke color.Color) {
+	band := int(math.Ceil(fontSize * 1.3 / a.scale))
+	if band < 1 {
+		band = 1
+	} else if band > a.rows {
+		band = a.rows
+	}
+	margin := int(math.Ceil(float64(a.rows) * 0.03))
+
+	start, end := margin, a.rows/2-band
+	defaultCentre := float64(a.rows) * 0.1
+	if !top {
+		start, end = a.rows/2, a.rows-margin-band
+		defaultCentre = float64(a.rows) * 0.9
+	}
+	if end < start {
+		start = clampInt(int(defaultCentre)-band/2, 0, a.rows-band)
+		end = start
+	}
+
+	best, bestCost := start, math.Inf(1)
+	var bestLum float64
+	for s := start; s <= end; s++ {
+		var cost, l, l2 float64
+		for r := s; r < s+band; r++ {
+			cost += a.rowCost[r]
+			l += a.rowLum[r]
+			l2 += a.rowLum2[r]
+		}
+		cost /= float64(band)
+		l /= float64(band)
+		variance := l2/float64(band) - l*l
+
+		// Mixed brightness makes text hard to read, and moving far from the
+		// classic position is only worth it for a clearly calmer band
+		cost += math.Sqrt(math.Max(variance, 0))
+		cost += 0.5 * math.Abs(float64(s)+float64(band)/2-defaultCentre) / float64(a.rows)
+
+		if cost < bestCost {
+			best, bestCost, bestLum = s, cost, l
+		}
+	}
+
+	fill, stroke = pickTextColors(bestLum)
+	return (float64(best) + float64(band)/2) * a.scale, fill, stroke
+}
+
+// pickTextColors keeps the classic white-on-black styling unless the
+// background is too bright for white fill to stand out
+func pickTextColors(backgroundLum float64) (fill, stroke color.Color) {
+	if contrastRatio(1, backgroundLum) >= minTextContrast {
+		return color.White, color.Black
+	}
+	return color.Black, color.White
+}
+
+// contrastRatio returns the WCAG contrast ratio between two relative luminances
+func contrastRatio(l1, l2 float64) float64 {
+	if l1 < l2 {
+		l1, l2 = l2, l1
+	}
+	return (l1 + 0.05) / (l2 + 0.05)
+}
+
+// boxBlur averages each cell of a grid with its neighbours within radius
+func boxBlur(grid []float64, cols, rows, radius int) []float64 {
+	horizontal := make([]float64, len(grid))
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			var sum float64
+			for dx := -radius; dx <= radius; dx++ {
+				sum += grid[y*cols+clampInt(x+dx, 0, cols-1)]
+			}
+			horizontal[y*cols+x] = sum / float64(2*radius+1)
+		}
+	}
+
+	out := make([]float64, len(grid))
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			var sum float64
+			for dy := -radius; dy <= radius; dy++ {
+				sum += horizontal[clampInt(y+dy, 0, rows-1)*cols+x]
+			}
+			out[y*cols+x] = sum / float64(2*radius+1)
+		}
+	}
+	return out
+}
+
+// sampleLuminance averages a 3x3 sample of source pixels covering one grid cell
+func sampleLuminance(img image.Image, bounds image.Rectangle, gx, gy int, scale float64) float64 {
+	var sum float64
+	for sy := 0; sy < 3; sy++ {
+		for sx := 0; sx < 3; sx++ {
+			x := bounds.Min.X + int((float64(gx)+(float64(sx)+0.5)/3)*scale)
+			y := bounds.Min.Y + int((float64(gy)+(float64(sy)+0.5)/3)*scale)
+			sum += relativeLuminance(img.At(x, y))
+		}
+	}
+	return sum / 9
+}
+
+// relativeLuminance converts a color to WCAG relative luminance (0 to 1)
+func relativeLuminance(c color.Color) float64 {
+	r, g, b, _ := c.RGBA()
+	return 0.2126*linearize(r) + 0.7152*linearize(g) + 0.0722*linearize(b)
+}
+
+func linearize(v uint32) float64 {
+	s := float64(v) / 0xffff
+	if s <= 0.03928 {
+		return s / 12.92
+	}
+	return math.Pow((s+0.055)/1.055, 2.4)
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
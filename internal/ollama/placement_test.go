@@ -0,0 +1,128 @@
+package ollama
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// testScene is a w x h image whose rows above split are a black and white
+// checkerboard and the rest plain bg
+func testScene(w, h, split int, bg color.Gray) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := bg
+			if y < split {
+				c = color.Gray{uint8(255 * ((x/8 + y/8) % 2))}
+			}
+			img.SetGray(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestAnalyseImage(t *testing.T) {
+	if a := analyseImage(image.NewGray(image.Rect(0, 0, 2, 100))); a != nil {
+		t.Errorf("analyseImage of a 2px wide image = %+v, want nil", a)
+	}
+
+	// 320x240 analyses on a 160x120 grid, busy above row 60
+	img := testScene(320, 240, 120, color.Gray{40})
+	a := analyseImage(img)
+	if a == nil || a.rows != 120 || a.scale != 2 {
+		t.Fatalf("analyseImage = %+v, want 120 rows at scale 2", a)
+	}
+	mean := func(v []float64) float64 {
+		var sum float64
+		for _, x := range v {
+			sum += x
+		}
+		return sum / float64(len(v))
+	}
+	busy, plain := mean(a.rowCost[5:55]), mean(a.rowCost[65:115])
+	if busy < plain+0.3 {
+		t.Errorf("busy rows cost %.2f, plain rows %.2f", busy, plain)
+	}
+	if want := relativeLuminance(color.Gray{40}); math.Abs(a.rowLum[100]-want) > 1e-9 || math.Abs(a.rowLum2[100]-want*want) > 1e-9 {
+		t.Errorf("plain row luminance %v (%v squared), want %v", a.rowLum[100], a.rowLum2[100], want)
+	}
+	if l := a.rowLum[20]; l < 0.4 || l > 0.6 {
+		t.Errorf("checkerboard row luminance %v, want about half", l)
+	}
+
+	// Analysis only depends on the pixels, not where the bounds start
+	offset := image.NewGray(image.Rect(0, 0, 330, 250))
+	for y := 0; y < 240; y++ {
+		copy(offset.Pix[(y+10)*offset.Stride+10:], img.Pix[y*img.Stride:(y+1)*img.Stride])
+	}
+	b := analyseImage(offset.SubImage(image.Rect(10, 10, 330, 250)))
+	for r := range a.rowCost {
+		if b.rowCost[r] != a.rowCost[r] || b.rowLum[r] != a.rowLum[r] {
+			t.Fatalf("row %d of offset image differs", r)
+		}
+	}
+}
+
+func TestPlace(t *testing.T) {
+	tests := []struct {
+		name     string
+		img      image.Image
+		fontSize float64
+		top      bool
+		minY     float64 // of the caption's centre, in source pixels
+		maxY     float64
+		fill     color.Color
+	}{
+		// The classic top position is busy, so the caption moves below it
+		// but stays in the top half
+		{"busy top", testScene(320, 480, 120, color.Gray{30}), 40, true, 120 + 26, 240 - 26, color.White},
+		// A plain background keeps the classic positions
+		{"plain top", testScene(320, 480, 0, color.Gray{30}), 40, true, 14, 70, color.White},
+		{"plain bottom", testScene(320, 480, 0, color.Gray{30}), 40, false, 410, 466, color.White},
+		// White text does not stand out on a light background
+		{"light bottom", testScene(320, 480, 240, color.Gray{230}), 40, false, 410, 466, color.Black},
+		// A checkerboard averages to mid grey, also too bright for white
+		{"busy top, light bottom", testScene(320, 480, 240, color.Gray{230}), 40, true, 0, 240, color.Black},
+		// A caption taller than half the image still lands inside it
+		{"huge caption", testScene(320, 60, 0, color.Gray{30}), 200, true, 0, 60, color.White},
+	}
+	for _, tt := range tests {
+		a := analyseImage(tt.img)
+		y, fill, stroke := a.place(tt.fontSize, tt.top)
+		if y < tt.minY || y > tt.maxY {
+			t.Errorf("%s: caption centred at y=%.1f, want %.0f to %.0f", tt.name, y, tt.minY, tt.maxY)
+		}
+		if fill != tt.fill {
+			t.Errorf("%s: fill %v, want %v", tt.name, fill, tt.fill)
+		}
+		if stroke == fill {
+			t.Errorf("%s: stroke and fill are both %v", tt.name, fill)
+		}
+	}
+}
+
+func TestPickTextColors(t *testing.T) {
+	tests := []struct {
+		lum  float64
+		fill color.Color
+	}{
+		{0, color.White},
+		{0.2, color.White},
+		// White text on 0.3 has the 3:1 contrast large text needs
+		{0.29, color.White},
+		{0.31, color.Black},
+		{1, color.Black},
+	}
+	for _, tt := range tests {
+		fill, stroke := pickTextColors(tt.lum)
+		wantStroke := color.Color(color.Black)
+		if tt.fill == color.Black {
+			wantStroke = color.White
+		}
+		if fill != tt.fill || stroke != wantStroke {
+			t.Errorf("pickTextColors(%v) = %v, %v; want %v, %v", tt.lum, fill, stroke, tt.fill, wantStroke)
+		}
+	}
+}
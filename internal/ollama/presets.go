@@ -0,0 +1,181 @@
+package ollama
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// FitMode is how an image is fitted to a preset with a different aspect ratio
+type FitMode string
+
+const (
+	FitCrop FitMode = "crop" // cut away the least detailed edges
+	FitPad  FitMode = "pad"  // scale to fit and fill the rest with the background
+	FitAuto FitMode = "auto" // crop when little would be lost, otherwise pad
+)
+
+// maxAutoCropLoss is the largest fraction of an image FitAuto will crop
+// away. Memes usually have captions at the edges, so anything more is
+// likely to cut into the text.
+const maxAutoCropLoss = 0.2
+
+// Preset is a fixed canvas size and format that memes can be exported for,
+// such as a social media post or a chat sticker
+type Preset struct {
+	Name    string // used in URLs and filenames
+	Label   string
+	Width   int
+	Height  int
+	Format  OutputFormat
+	Quality int
+	Fit     FitMode
+	// Background fills the padding; nil leaves it transparent
+	Background color.Color
+}
+
+// Presets is the registry of export presets, in display order. Add an entry
+// here to make a new preset available for download.
+var Presets = []Preset{
+	{Name: "square", Label: "Square 1:1", Width: 1080, Height: 1080, Format: FormatJPEG, Quality: 90, Fit: FitAuto, Background: color.Black},
+	{Name: "slide", Label: "16:9 slide", Width: 1920, Height: 1080, Format: FormatJPEG, Quality: 90, Fit: FitAuto, Background: color.Black},
+	{Name: "story", Label: "9:16 story", Width: 1080, Height: 1920, Format: FormatJPEG, Quality: 90, Fit: FitAuto, Background: color.Black},
+	{Name: "sticker", Label: "Sticker (WebP)", Width: 512, Height: 512, Format: FormatWebP, Fit: FitPad},
+	{Name: "slack-emoji", Label: "Slack emoji", Width: 128, Height: 128, Format: FormatPNG, Fit: FitAuto},
+}
+
+// LookupPreset returns the preset with the given name
+func LookupPreset(name string) (Preset, bool) {
+	for _, p := range Presets {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Preset{}, false
+}
+
+// PresetFilename returns the filename used for a preset export of an image
+func PresetFilename(filename string, p Preset) string {
+	stem := strings.TrimSuffix(filename, filepath.Ext(filename))
+	return fmt.Sprintf("%s-preset-%s%s", stem, p.Name, p.Format.Extension())
+}
+
+// Render scales img onto the preset's canvas, cropping or padding it to the
+// preset's aspect ratio
+func (p Preset) Render(img image.Image) image.Image {
+	bounds := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, p.Width, p.Height))
+	if p.Background != nil {
+		draw.Draw(out, out.Bounds(), image.NewUniform(p.Background), image.Point{}, draw.Src)
+	}
+
+	// Largest window of the image with the preset's aspect ratio
+	cropW, cropH := bounds.Dx(), max(1, bounds.Dx()*p.Height/p.Width)
+	if cropH > bounds.Dy() {
+		cropW, cropH = max(1, bounds.Dy()*p.Width/p.Height), bounds.Dy()
+	}
+	loss := 1 - float64(cropW*cropH)/float64(bounds.Dx()*bounds.Dy())
+
+	if p.Fit == FitCrop || (p.Fit == FitAuto && loss <= maxAutoCropLoss) {
+		draw.CatmullRom.Scale(out, out.Bounds(), img, cropWindow(img, cropW, cropH), draw.Over, nil)
+		return out
+	}
+
+	scale := math.Min(float64(p.Width)/float64(bounds.Dx()), float64(p.Height)/float64(bounds.Dy()))
+	w := max(1, int(math.Round(float64(bounds.Dx())*scale)))
+	h := max(1, int(math.Round(float64(bounds.Dy())*scale)))
+	dst := image.Rect(0, 0, w, h).Add(image.Pt((p.Width-w)/2, (p.Height-h)/2))
+	draw.CatmullRom.Scale(out, dst, img, bounds, draw.Over, nil)
+	return out
+}
+
+// cropWindow returns the w×h window of img with the most detail, preferring
+// the centre when detail is evenly spread, so crops keep the subject and
+// captions rather than blindly taking the middle
+func cropWindow(img image.Image, w, h int) image.Rectangle {
+	bounds := img.Bounds()
+	x := (bounds.Dx() - w) / 2
+	y := (bounds.Dy() - h) / 2
+
+	cols, rows, scale := edgeProfiles(img)
+	if cols != nil {
+		if w < bounds.Dx() {
+			x = clampInt(int(float64(bestWindow(cols, int(float64(w)/scale)))*scale), 0, bounds.Dx()-w)
+		}
+		if h < bounds.Dy() {
+			y = clampInt(int(float64(bestWindow(rows, int(float64(h)/scale)))*scale), 0, bounds.Dy()-h)
+		}
+	}
+
+	return image.Rect(0, 0, w, h).Add(bounds.Min).Add(image.Pt(x, y))
+}
+
+// edgeProfiles sums Sobel edge strength over each column and row of a
+// downscaled luminance grid. It returns nil for images too small to analyse.
+func edgeProfiles(img image.Image) (cols, rows []float64, scale float64) {
+	bounds := img.Bounds()
+	scale = math.Max(1, float64(max(bounds.Dx(), bounds.Dy()))/analysisWidth)
+	gridW := int(float64(bounds.Dx()) / scale)
+	gridH := int(float64(bounds.Dy()) / scale)
+	if gridW < 3 || gridH < 3 {
+		return nil, nil, scale
+	}
+
+	lum := make([]float64, gridW*gridH)
+	for gy := 0; gy < gridH; gy++ {
+		for gx := 0; gx < gridW; gx++ {
+			lum[gy*gridW+gx] = sampleLuminance(img, bounds, gx, gy, scale)
+		}
+	}
+	at := func(x, y int) float64 {
+		return lum[clampInt(y, 0, gridH-1)*gridW+clampInt(x, 0, gridW-1)]
+	}
+
+	cols = make([]float64, gridW)
+	rows = make([]float64, gridH)
+	for gy := 0; gy < gridH; gy++ {
+		for gx := 0; gx < gridW; gx++ {
+			gxv := at(gx+1, gy-1) + 2*at(gx+1, gy) + at(gx+1, gy+1) -
+				at(gx-1, gy-1) - 2*at(gx-1, gy) - at(gx-1, gy+1)
+			gyv := at(gx-1, gy+1) + 2*at(gx, gy+1) + at(gx+1, gy+1) -
+				at(gx-1, gy-1) - 2*at(gx, gy-1) - at(gx+1, gy-1)
+			edge := math.Min(math.Hypot(gxv, gyv)/4, 1)
+			cols[gx] += edge
+			rows[gy] += edge
+		}
+	}
+	return cols, rows, scale
+}
+
+// bestWindow returns the start of the size-cell window of profile with the
+// highest total, discounted by up to a quarter for distance from the centre
+func bestWindow(profile []float64, size int) int {
+	size = clampInt(size, 1, len(profile))
+	centre := (len(profile) - size) / 2
+	if centre == 0 {
+		return 0
+	}
+
+	var sum float64
+	for _, v := range profile[:size] {
+		sum += v
+	}
+
+	best, bestScore := centre, -1.0
+	for start := 0; ; start++ {
+		distance := math.Abs(float64(start-centre)) / float64(centre)
+		if score := sum * (1 - 0.25*distance); score > bestScore {
+			best, bestScore = start, score
+		}
+		if start+size >= len(profile) {
+			break
+		}
+		sum += profile[start+size] - profile[start]
+	}
+	return best
+}
@@ -0,0 +1,170 @@
+package ollama
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// ImageSize is a named width that responsive copies of images are rendered at
+type ImageSize struct {
+	Name  string
+	Width int
+}
+
+// ImageSizes lists the responsive sizes, smallest first
+var ImageSizes = []ImageSize{
+	{Name: "thumb", Width: 320},
+	{Name: "medium", Width: 768},
+}
+
+// LookupImageSize returns the width of a named size
+func LookupImageSize(name string) (int, bool) {
+	for _, size := range ImageSizes {
+		if size.Name == name {
+			return size.Width, true
+		}
+	}
+	return 0, false
+}
+
+// SizesDir is the subdirectory of the output directory that resized copies
+// are cached in
+const SizesDir = "sizes"
+
+// resizeQuality is the JPEG quality of resized copies
+const resizeQuality = 82
+
+// SizedFilename returns where the resized copy of an image is cached,
+// relative to the output directory
+func SizedFilename(filename string, width int) string {
+	stem := strings.TrimSuffix(filename, filepath.Ext(filename))
+	return filepath.Join(SizesDir, fmt.Sprintf("%s-w%d.jpg", stem, width))
+}
+
+// ResizeImage returns a copy of an image scaled down to width, rendering
+// and caching it on first use. The returned path is relative to the output
+// directory. Animated GIFs and images no wider than width are returned
+// unchanged.
+func (c *Client) ResizeImage(filename string, width int) (string, error) {
+	if strings.EqualFold(filepath.Ext(filename), ".gif") {
+		return filename, nil
+	}
+
+	sized := SizedFilename(filename, width)
+	destPath := filepath.Join(c.outputDir, sized)
+	if isFresh(destPath, filepath.Join(c.outputDir, filename)) {
+		return sized, nil
+	}
+
+	file, err := os.Open(filepath.Join(c.outputDir, filename))
+	if err != nil {
+		return "", fmt.Errorf("failed to open image: %w", err)
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode image: %w", err)
+	}
+	if config.Width <= width {
+		return filename, nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	scaled := scaleToWidth(img, width)
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create sizes directory: %w", err)
+	}
+	if err := writeFileAtomic(destPath, func(w io.Writer) error {
+		return jpeg.Encode(w, scaled, &jpeg.Options{Quality: resizeQuality})
+	}); err != nil {
+		return "", err
+	}
+
+	return sized, nil
+}
+
+// WritePreview writes a JPEG of the image at imagePath scaled down to at
+// most width pixels wide, for previews that are not worth caching
+func WritePreview(w io.Writer, imagePath string, width int) error {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	return jpeg.Encode(w, scaleToWidth(img, min(width, img.Bounds().Dx())), &jpeg.Options{Quality: resizeQuality})
+}
+
+// scaleToWidth scales an image to width, keeping its aspect ratio, and
+// flattens it onto white for JPEG encoding
+func scaleToWidth(img image.Image, width int) *image.RGBA {
+	bounds := img.Bounds()
+	height := max(1, bounds.Dy()*width/bounds.Dx())
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(scaled, scaled.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Over, nil)
+	return scaled
+}
+
+// isFresh reports whether a derived file exists and is at least as new as
+// the file it was made from, so copies of re-rendered images are remade
+func isFresh(path, sourcePath string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	source, err := os.Stat(sourcePath)
+	if err != nil {
+		return true
+	}
+	return !info.ModTime().Before(source.ModTime())
+}
+
+// writeFileAtomic writes a file through a temporary file in the same
+// directory, so a failed or concurrent write never leaves a truncated file
+// at path
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set permissions: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to move file to %s: %w", path, err)
+	}
+	return nil
+}
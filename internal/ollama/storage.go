@@ -0,0 +1,62 @@
+package ollama
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"meme-generator/internal/storage"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// storageKey returns the storage key of a file in the output directory,
+// or false for files outside it
+func (c *Client) storageKey(path string) (string, bool) {
+	rel, err := filepath.Rel(c.outputDir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// publish puts a file the client wrote in the output directory in
+// storage, so other replicas can find it. Failures are only logged, as
+// this replica can still use the file itself.
+func (c *Client) publish(path string) {
+	key, ok := c.storageKey(path)
+	if !ok {
+		return
+	}
+	if err := storage.PutFile(c.store, key, path); err != nil {
+		log.Printf("Warning: Failed to store %s: %v", key, err)
+	}
+}
+
+// fetchMissing downloads a file the client is about to read from storage
+// when it is missing from the output directory, as when another replica
+// wrote it. Files storage does not have are left for the reader to report.
+func (c *Client) fetchMissing(path string) {
+	key, ok := c.storageKey(path)
+	if !ok {
+		return
+	}
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+	if err := storage.GetFile(c.store, key, path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Warning: Failed to fetch %s from storage: %v", key, err)
+	}
+}
+
+// RemoveFile deletes a file from the output directory and from storage
+func (c *Client) RemoveFile(filename string) error {
+	if err := os.Remove(filepath.Join(c.outputDir, filename)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := c.store.Delete(filepath.ToSlash(filename)); err != nil {
+		return fmt.Errorf("failed to delete %s from storage: %w", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package ollama
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fogleman/gg"
+)
+
+// TextBox is a region of a template image that holds one caption. Position
+// and size are fractions of the image dimensions so layouts survive resizing.
+type TextBox struct {
+	// Label describes what belongs in the box, e.g. "the thing being rejected".
+	// It is passed to the text model and shown as a placeholder in the UI.
+	Label  string  `json:"label"`
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+	// Fill and Stroke are hex colors. Fill defaults to white and Stroke to
+	// black; set Stroke to "none" for plain text on light panels.
+	Fill      string `json:"fill,omitempty"`
+	Stroke    string `json:"stroke,omitempty"`
+	Uppercase bool   `json:"uppercase,omitempty"`
+}
+
+// Validate checks that the box lies inside the image and has usable colors
+func (b TextBox) Validate() error {
+	if b.Width <= 0 || b.Height <= 0 {
+		return fmt.Errorf("text box %q has no area", b.Label)
+	}
+	if b.X < 0 || b.Y < 0 || b.X+b.Width > 1.0001 || b.Y+b.Height > 1.0001 {
+		return fmt.Errorf("text box %q extends outside the image", b.Label)
+	}
+	if _, _, err := b.colors(); err != nil {
+		return fmt.Errorf("text box %q: %w", b.Label, err)
+	}
+	return nil
+}
+
+func (b TextBox) colors() (fill, stroke color.Color, err error) {
+	fill, stroke = color.White, color.Black
+	if b.Fill != "" {
+		if fill, err = parseHexColor(b.Fill); err != nil {
+			return nil, nil, err
+		}
+	}
+	switch {
+	case strings.EqualFold(b.Stroke, "none"):
+		stroke = nil
+	case b.Stroke != "":
+		if stroke, err = parseHexColor(b.Stroke); err != nil {
+			return nil, nil, err
+		}
+	}
+	return fill, stroke, nil
+}
+
+// parseHexColor parses #rgb or #rrggbb
+func parseHexColor(s string) (color.Color, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return nil, fmt.Errorf("invalid color %q", s)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid color %q", s)
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}, nil
+}
+
+// boxLineSpacing is the line height as a multiple of the font size
+const boxLineSpacing = 1.15
+
+// layoutTextBoxes word-wraps each text into its box at the largest font size
+// that fits, producing one caption per line. Texts beyond the number of
+// boxes are ignored and empty texts leave their box blank.
+func (c *Client) layoutTextBoxes(dc *gg.Context, boxes []TextBox, texts []string) []Caption {
+	width := float64(dc.Width())
+	height := float64(dc.Height())
+
+	var captions []Caption
+	for i, box := range boxes {
+		if i >= len(texts) || strings.TrimSpace(texts[i]) == "" {
+			continue
+		}
+
+		text := strings.TrimSpace(texts[i])
+		if box.Uppercase {
+			text = strings.ToUpper(text)
+		}
+		fill, stroke, err := box.colors()
+		if err != nil {
+			fill, stroke = color.White, color.Black
+		}
+
+		// 5% padding on each side, as with top/bottom captions
+		boxWidth := box.Width * width * 0.9
+		boxHeight := box.Height * height * 0.9
+		fontSize, lines := c.fitText(dc, text, boxWidth, boxHeight)
+
+		centerX := (box.X + box.Width/2) * width
+		centerY := (box.Y + box.Height/2) * height
+		lineHeight := fontSize * boxLineSpacing
+		firstY := centerY - lineHeight*float64(len(lines)-1)/2
+
+		for j, line := range lines {
+			captions = append(captions, Caption{
+				Text:     line,
+				FontSize: fontSize,
+				X:        centerX,
+				Y:        firstY + lineHeight*float64(j),
+				Fill:     fill,
+				Stroke:   stroke,
+			})
+		}
+	}
+
+	return captions
+}
+
+// fitText finds the largest font size at which text, word-wrapped to
+// maxWidth, fits within maxHeight, and returns the wrapped lines
+func (c *Client) fitText(dc *gg.Context, text string, maxWidth, maxHeight float64) (float64, []string) {
+	fits := func(size float64) ([]string, bool) {
+		if err := c.loadFont(dc, size); err != nil {
+			return []string{text}, false
+		}
+		lines := dc.WordWrap(text, maxWidth)
+		if float64(len(lines))*size*boxLineSpacing > maxHeight {
+			return lines, false
+		}
+		for _, line := range lines {
+			// Single words longer than the box are never wrapped
+			if w, _ := dc.MeasureString(line); w > maxWidth {
+				return lines, false
+			}
+		}
+		return lines, true
+	}
+
+	minSize := 12.0
+	maxSize := min(120, max(minSize, maxHeight))
+
+	// Binary search as in calculateOptimalFontSize
+	best := minSize
+	bestLines, _ := fits(minSize)
+	for lo, hi := minSize, maxSize; hi-lo >= 1; {
+		size := (lo + hi) / 2
+		if lines, ok := fits(size); ok {
+			best, bestLines, lo = size, lines, size
+		} else {
+			hi = size
+		}
+	}
+	if lines, ok := fits(maxSize); ok {
+		best, bestLines = maxSize, lines
+	}
+
+	return best, bestLines
+}
+
+// OverlayTemplateText captions a template image by filling its text boxes,
+// writing the result to destPath as a PNG
+func (c *Client) OverlayTemplateText(srcPath, destPath string, boxes []TextBox, texts []string) error {
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	dc := gg.NewContextForImage(img)
+	if err := c.drawCaptions(dc, c.layoutTextBoxes(dc, boxes, texts)); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(destPath, func(w io.Writer) error {
+		if err := png.Encode(w, dc.Image()); err != nil {
+			return fmt.Errorf("failed to encode image: %w", err)
+		}
+		return nil
+	})
+}
+
+// OverlayGIFTemplateText fills the text boxes of an animated template on
+// every frame, like OverlayGIFText
+func (c *Client) OverlayGIFTemplateText(srcPath, destPath string, boxes []TextBox, texts []string) error {
+	return c.rewriteGIF(srcPath, destPath, func(g *gif.GIF) error {
+		return c.captionGIF(g, func(dc *gg.Context, _ image.Image) []Caption {
+			return c.layoutTextBoxes(dc, boxes, texts)
+		})
+	})
+}
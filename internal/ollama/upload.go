@@ -0,0 +1,56 @@
+package ollama
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+
+	_ "golang.org/x/image/webp"
+)
+
+// SaveUpload stores an uploaded image in the output directory as a new base
+// image and returns its filename. Still images are rotated upright according
+// to their EXIF orientation and re-encoded as PNG; GIFs are re-encoded frame
+// for frame. Re-encoding drops all metadata (EXIF, GPS, XMP, ICC profiles
+// and comments) from the stored file.
+func (c *Client) SaveUpload(data []byte, format, name string) (string, error) {
+	var buf bytes.Buffer
+	ext := ".png"
+
+	if format == "gif" {
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return "", fmt.Errorf("failed to decode gif: %w", err)
+		}
+		if err := gif.EncodeAll(&buf, g); err != nil {
+			return "", fmt.Errorf("failed to encode gif: %w", err)
+		}
+		ext = ".gif"
+	} else {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return "", fmt.Errorf("failed to decode image: %w", err)
+		}
+		img = applyOrientation(img, exifOrientation(data, format))
+		if err := png.Encode(&buf, img); err != nil {
+			return "", fmt.Errorf("failed to encode image: %w", err)
+		}
+	}
+
+	filename, err := c.NewFilename(name, ext)
+	if err != nil {
+		return "", err
+	}
+	destPath := filepath.Join(c.outputDir, filename)
+	if err := os.WriteFile(destPath, buf.Bytes(), 0644); err != nil {
+		os.Remove(destPath)
+		return "", fmt.Errorf("failed to save upload: %w", err)
+	}
+	c.publish(destPath)
+
+	return filename, nil
+}
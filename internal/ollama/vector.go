@@ -0,0 +1,554 @@
+package ollama
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/fogleman/gg"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// VectorFormat is a vector format memes can be exported in. Captions are
+// written as glyph outlines over the embedded base image, so they stay
+// sharp at any size and look the same without the font installed. Layers
+// and the watermark are embedded as transparent images over the captions.
+type VectorFormat string
+
+const (
+	FormatSVG VectorFormat = "svg"
+	FormatPDF VectorFormat = "pdf"
+)
+
+// VectorFormats lists every vector format in display order
+var VectorFormats = []VectorFormat{FormatSVG, FormatPDF}
+
+// ParseVectorFormat validates a vector format name
+func ParseVectorFormat(s string) (VectorFormat, bool) {
+	for _, f := range VectorFormats {
+		if strings.EqualFold(strings.TrimSpace(s), string(f)) {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// Extension returns the file extension for the format, including the dot
+func (f VectorFormat) Extension() string {
+	return "." + string(f)
+}
+
+// ContentType returns the MIME type for the format
+func (f VectorFormat) ContentType() string {
+	if f == FormatPDF {
+		return "application/pdf"
+	}
+	return "image/svg+xml"
+}
+
+// VectorFilename returns the filename used for a vector export of an image
+func VectorFilename(filename string, format VectorFormat) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + "-vector" + format.Extension()
+}
+
+// VectorSpec is what a meme is rendered from: the same inputs as the raster
+// renderer, so both lay captions out identically
+type VectorSpec struct {
+	Title      string // document title, usually the prompt
+	BasePath   string
+	Effects    []Effect // only base stage effects can be exported
+	TopText    string
+	BottomText string
+	Boxes      []TextBox // template text boxes, filled from Captions
+	Captions   []string
+	Layers     []Layer // drawn over the captions
+	Overlay    OverlayOptions
+	Watermark  *Watermark // stamped over the captions when set
+}
+
+// ExportVector renders a meme as SVG or PDF into the output directory,
+// named after filename, and returns the export's filename and size
+func (c *Client) ExportVector(filename string, spec VectorSpec, format VectorFormat) (string, int64, error) {
+	if len(EffectsForStage(spec.Effects, StageFinal)) > 0 {
+		return "", 0, fmt.Errorf("final stage effects cannot be applied to vector captions")
+	}
+
+	file, err := os.Open(spec.BasePath)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to open image: %w", err)
+	}
+	src, _, err := image.Decode(file)
+	file.Close()
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	var base image.Image = src
+	if effects := EffectsForStage(spec.Effects, StageBase); len(effects) > 0 {
+		if base, err = applyEffects(src, effects); err != nil {
+			return "", 0, err
+		}
+	}
+
+	width, height := base.Bounds().Dx(), base.Bounds().Dy()
+	dc := gg.NewContext(width, height)
+	var captions []Caption
+	if len(spec.Boxes) > 0 {
+		captions = c.layoutTextBoxes(dc, spec.Boxes, spec.Captions)
+	} else if spec.TopText != "" || spec.BottomText != "" {
+		captions = c.layoutCaptions(dc, base, spec.TopText, spec.BottomText, spec.Overlay)
+	}
+
+	doc := vectorDoc{title: spec.Title, width: width, height: height, base: base}
+	if doc.paths, err = c.captionPaths(dc, captions); err != nil {
+		return "", 0, err
+	}
+	if len(spec.Layers) > 0 {
+		overlay, err := c.LayerOverlay(spec.Layers, width, height)
+		if err != nil {
+			return "", 0, err
+		}
+		doc.overlays = append(doc.overlays, vectorOverlay{img: toNRGBA(overlay), opacity: 1})
+	}
+	if spec.Watermark != nil {
+		stamp, at, err := c.watermarkStamp(*spec.Watermark, width, height)
+		if err != nil {
+			return "", 0, err
+		}
+		doc.overlays = append(doc.overlays, vectorOverlay{img: toNRGBA(stamp), at: at, opacity: spec.Watermark.Opacity})
+	}
+
+	exported := VectorFilename(filename, format)
+	destPath := filepath.Join(c.outputDir, exported)
+	if err := writeFileAtomic(destPath, func(w io.Writer) error {
+		if format == FormatPDF {
+			return doc.writePDF(w)
+		}
+		return doc.writeSVG(w)
+	}); err != nil {
+		return "", 0, err
+	}
+
+	info, err := os.Stat(destPath)
+	if err != nil {
+		return "", 0, err
+	}
+	return exported, info.Size(), nil
+}
+
+// vectorDoc is a laid-out meme: the base image, the caption outlines drawn
+// over it and the images drawn over those, in order
+type vectorDoc struct {
+	title         string
+	width, height int
+	base          image.Image
+	paths         []captionPath
+	overlays      []vectorOverlay
+}
+
+// vectorOverlay is an image drawn over the captions
+type vectorOverlay struct {
+	img     *image.NRGBA
+	at      image.Point
+	opacity float64
+}
+
+// captionPath is the outline of one caption's glyphs
+type captionPath struct {
+	text   string
+	ops    []pathOp
+	fill   color.Color
+	stroke color.Color // nil for no outline
+}
+
+// pathOp is a move, line, quadratic curve or close, with the points it
+// needs in image coordinates
+type pathOp struct {
+	kind byte // 'M', 'L', 'Q' or 'Z'
+	pts  [2][2]float64
+}
+
+// outlineWidth matches the 3px outline drawTextWithOutline draws around
+// each side of the text
+const outlineWidth = 6.0
+
+// captionPaths traces the glyph outlines of laid-out captions. Strings are
+// measured and anchored with gg exactly as drawTextWithOutline does.
+func (c *Client) captionPaths(dc *gg.Context, captions []Caption) ([]captionPath, error) {
+	if len(captions) == 0 {
+		return nil, nil
+	}
+
+	f, err := memeFont()
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []captionPath
+	var glyph truetype.GlyphBuf
+	for _, caption := range captions {
+		if err := c.loadFont(dc, caption.FontSize); err != nil {
+			return nil, fmt.Errorf("failed to load font for %q: %w", caption.Text, err)
+		}
+		w, h := dc.MeasureString(caption.Text)
+		x := caption.X - w/2
+		y := caption.Y + h/2
+
+		scale := fixed.Int26_6(0.5 + caption.FontSize*64)
+		var ops []pathOp
+		prev := truetype.Index(0)
+		for i, r := range caption.Text {
+			index := f.Index(r)
+			if i > 0 {
+				x += float64(f.Kern(scale, prev, index)) / 64
+			}
+			if err := glyph.Load(f, scale, index, font.HintingNone); err != nil {
+				return nil, fmt.Errorf("failed to load glyph %q: %w", r, err)
+			}
+			start := 0
+			for _, end := range glyph.Ends {
+				ops = appendContour(ops, glyph.Points[start:end], x, y)
+				start = end
+			}
+			x += float64(glyph.AdvanceWidth) / 64
+			prev = index
+		}
+
+		paths = append(paths, captionPath{text: caption.Text, ops: ops, fill: caption.Fill, stroke: caption.Stroke})
+	}
+	return paths, nil
+}
+
+// appendContour converts a TrueType contour, whose off-curve points are
+// quadratic control points with implied on-curve points between them, into
+// path operations. It follows the freetype rasterizer's drawContour.
+func appendContour(ops []pathOp, points []truetype.Point, dx, dy float64) []pathOp {
+	if len(points) == 0 {
+		return ops
+	}
+	at := func(p truetype.Point) [2]float64 {
+		return [2]float64{dx + float64(p.X)/64, dy - float64(p.Y)/64}
+	}
+	mid := func(a, b [2]float64) [2]float64 {
+		return [2]float64{(a[0] + b[0]) / 2, (a[1] + b[1]) / 2}
+	}
+
+	start := at(points[0])
+	others := points[1:]
+	if points[0].Flags&1 == 0 {
+		last := points[len(points)-1]
+		if last.Flags&1 != 0 {
+			start, others = at(last), points[:len(points)-1]
+		} else {
+			start, others = mid(start, at(last)), points
+		}
+	}
+
+	ops = append(ops, pathOp{kind: 'M', pts: [2][2]float64{start}})
+	q0, on0 := start, true
+	for _, p := range others {
+		q, on := at(p), p.Flags&1 != 0
+		switch {
+		case on && on0:
+			ops = append(ops, pathOp{kind: 'L', pts: [2][2]float64{q}})
+		case on:
+			ops = append(ops, pathOp{kind: 'Q', pts: [2][2]float64{q0, q}})
+		case !on0:
+			ops = append(ops, pathOp{kind: 'Q', pts: [2][2]float64{q0, mid(q0, q)}})
+		}
+		q0, on0 = q, on
+	}
+	if !on0 {
+		ops = append(ops, pathOp{kind: 'Q', pts: [2][2]float64{q0, start}})
+	}
+	return append(ops, pathOp{kind: 'Z'})
+}
+
+// writeSVG writes the document as SVG with the base image and stamp
+// embedded as PNG data URIs
+func (d *vectorDoc) writeSVG(w io.Writer) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="%d" height="%d" viewBox="0 0 %d %d">
+`, d.width, d.height, d.width, d.height)
+	if d.title != "" {
+		fmt.Fprintf(&buf, "<title>%s</title>\n", xmlEscape(d.title))
+	}
+
+	uri, err := pngDataURI(d.base)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(&buf, `<image width="%d" height="%d" xlink:href="%s"/>`+"\n", d.width, d.height, uri)
+
+	for _, p := range d.paths {
+		path := p.svgPath()
+		fmt.Fprintf(&buf, `<g aria-label="%s">`+"\n", xmlEscape(p.text))
+		if p.stroke != nil {
+			fmt.Fprintf(&buf, `<path d="%s" fill="none" stroke="%s" stroke-width="%s" stroke-linejoin="round"/>`+"\n",
+				path, svgColor(p.stroke), formatNumber(outlineWidth))
+		}
+		fmt.Fprintf(&buf, `<path d="%s" fill="%s"/>`+"\n", path, svgColor(p.fill))
+		buf.WriteString("</g>\n")
+	}
+
+	for _, o := range d.overlays {
+		uri, err := pngDataURI(o.img)
+		if err != nil {
+			return err
+		}
+		size := o.img.Bounds().Size()
+		fmt.Fprintf(&buf, `<image x="%d" y="%d" width="%d" height="%d" opacity="%s" xlink:href="%s"/>`+"\n",
+			o.at.X, o.at.Y, size.X, size.Y, formatNumber(o.opacity), uri)
+	}
+
+	buf.WriteString("</svg>\n")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func (p captionPath) svgPath() string {
+	var b strings.Builder
+	for _, op := range p.ops {
+		b.WriteByte(op.kind)
+		switch op.kind {
+		case 'M', 'L':
+			fmt.Fprintf(&b, "%s %s", formatNumber(op.pts[0][0]), formatNumber(op.pts[0][1]))
+		case 'Q':
+			fmt.Fprintf(&b, "%s %s %s %s", formatNumber(op.pts[0][0]), formatNumber(op.pts[0][1]),
+				formatNumber(op.pts[1][0]), formatNumber(op.pts[1][1]))
+		}
+	}
+	return b.String()
+}
+
+func pngDataURI(img image.Image) (string, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", fmt.Errorf("failed to encode image: %w", err)
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func svgColor(c color.Color) string {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return fmt.Sprintf("#%02x%02x%02x", n.R, n.G, n.B)
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// formatNumber writes coordinates to two decimal places, without trailing
+// zeros
+func formatNumber(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 2, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+// writePDF writes the document as a single page PDF, one point per pixel.
+// Images are stored Flate compressed with a soft mask for transparency.
+func (d *vectorDoc) writePDF(w io.Writer) error {
+	pdf := &pdfWriter{}
+	pdf.buf.WriteString("%PDF-1.4\n%\xE2\xE3\xCF\xD3\n")
+
+	catalog := pdf.reserve()
+	pages := pdf.reserve()
+	page := pdf.reserve()
+
+	base, err := pdf.image(d.base)
+	if err != nil {
+		return err
+	}
+	xobjects := fmt.Sprintf("/Im0 %d 0 R", base)
+	extGStates := ""
+
+	var content bytes.Buffer
+	fmt.Fprintf(&content, "q %d 0 0 %d 0 0 cm /Im0 Do Q\n", d.width, d.height)
+
+	// Flip to image coordinates for the captions
+	fmt.Fprintf(&content, "q 1 0 0 -1 0 %d cm 1 j 1 J\n", d.height)
+	for _, p := range d.paths {
+		if p.stroke != nil {
+			fmt.Fprintf(&content, "%s RG %s w\n", pdfColor(p.stroke), formatNumber(outlineWidth))
+			p.writePDFPath(&content)
+			content.WriteString("S\n")
+		}
+		fmt.Fprintf(&content, "%s rg\n", pdfColor(p.fill))
+		p.writePDFPath(&content)
+		content.WriteString("f\n")
+	}
+	content.WriteString("Q\n")
+
+	for i, o := range d.overlays {
+		n, err := pdf.image(o.img)
+		if err != nil {
+			return err
+		}
+		state := pdf.object(fmt.Sprintf("<< /Type /ExtGState /ca %s >>", formatNumber(o.opacity)))
+		xobjects += fmt.Sprintf(" /Im%d %d 0 R", i+1, n)
+		extGStates += fmt.Sprintf(" /GS%d %d 0 R", i+1, state)
+
+		size := o.img.Bounds().Size()
+		fmt.Fprintf(&content, "q /GS%d gs %d 0 0 %d %d %d cm /Im%d Do Q\n",
+			i+1, size.X, size.Y, o.at.X, d.height-o.at.Y-size.Y, i+1)
+	}
+	if extGStates != "" {
+		extGStates = " /ExtGState <<" + extGStates + " >>"
+	}
+
+	contents, err := pdf.stream("", content.Bytes())
+	if err != nil {
+		return err
+	}
+
+	pdf.define(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pages))
+	pdf.define(pages, fmt.Sprintf("<< /Type /Pages /Kids [%d 0 R] /Count 1 >>", page))
+	pdf.define(page, fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %d %d] /Resources << /XObject << %s >>%s >> /Contents %d 0 R >>",
+		pages, d.width, d.height, xobjects, extGStates, contents))
+	info := pdf.object(fmt.Sprintf("<< /Title %s /Producer %s >>", pdfString(d.title), pdfString(metadataKeyword)))
+
+	return pdf.finish(w, catalog, info)
+}
+
+func (p captionPath) writePDFPath(b *bytes.Buffer) {
+	var current [2]float64
+	for _, op := range p.ops {
+		switch op.kind {
+		case 'M', 'L':
+			current = op.pts[0]
+			fmt.Fprintf(b, "%s %s %c\n", formatNumber(current[0]), formatNumber(current[1]), op.kind+('m'-'M'))
+		case 'Q':
+			// PDF only has cubic curves: raise the degree of the quadratic
+			ctrl, end := op.pts[0], op.pts[1]
+			c1 := [2]float64{current[0] + 2*(ctrl[0]-current[0])/3, current[1] + 2*(ctrl[1]-current[1])/3}
+			c2 := [2]float64{end[0] + 2*(ctrl[0]-end[0])/3, end[1] + 2*(ctrl[1]-end[1])/3}
+			fmt.Fprintf(b, "%s %s %s %s %s %s c\n", formatNumber(c1[0]), formatNumber(c1[1]),
+				formatNumber(c2[0]), formatNumber(c2[1]), formatNumber(end[0]), formatNumber(end[1]))
+			current = end
+		case 'Z':
+			b.WriteString("h\n")
+		}
+	}
+}
+
+func pdfColor(c color.Color) string {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return fmt.Sprintf("%s %s %s", formatNumber(float64(n.R)/255), formatNumber(float64(n.G)/255), formatNumber(float64(n.B)/255))
+}
+
+// pdfString encodes a text string as UTF-16BE hex, which any character
+// survives
+func pdfString(s string) string {
+	var b strings.Builder
+	b.WriteString("<FEFF")
+	for _, u := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", u)
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+// pdfWriter builds a PDF file object by object, tracking offsets for the
+// cross-reference table
+type pdfWriter struct {
+	buf     bytes.Buffer
+	offsets []int // by object number minus one; 0 until defined
+}
+
+// reserve allocates an object number to be defined later
+func (p *pdfWriter) reserve() int {
+	p.offsets = append(p.offsets, 0)
+	return len(p.offsets)
+}
+
+func (p *pdfWriter) define(n int, body string) {
+	p.offsets[n-1] = p.buf.Len()
+	fmt.Fprintf(&p.buf, "%d 0 obj\n%s\nendobj\n", n, body)
+}
+
+func (p *pdfWriter) object(body string) int {
+	n := p.reserve()
+	p.define(n, body)
+	return n
+}
+
+// stream writes a Flate compressed stream object with extra dictionary
+// entries
+func (p *pdfWriter) stream(dict string, data []byte) (int, error) {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	if _, err := zw.Write(data); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+
+	n := p.reserve()
+	p.offsets[n-1] = p.buf.Len()
+	fmt.Fprintf(&p.buf, "%d 0 obj\n<< %s/Filter /FlateDecode /Length %d >>\nstream\n", n, dict, compressed.Len())
+	p.buf.Write(compressed.Bytes())
+	p.buf.WriteString("\nendstream\nendobj\n")
+	return n, nil
+}
+
+// image writes an RGB image XObject, with a soft mask when the image has
+// any transparency
+func (p *pdfWriter) image(img image.Image) (int, error) {
+	nrgba := toNRGBA(img)
+	bounds := nrgba.Bounds()
+	rgb := make([]byte, 0, bounds.Dx()*bounds.Dy()*3)
+	alpha := make([]byte, 0, bounds.Dx()*bounds.Dy())
+	opaque := true
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := nrgba.Pix[nrgba.PixOffset(bounds.Min.X, y):nrgba.PixOffset(bounds.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			rgb = append(rgb, row[i], row[i+1], row[i+2])
+			alpha = append(alpha, row[i+3])
+			opaque = opaque && row[i+3] == 0xFF
+		}
+	}
+
+	dict := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /BitsPerComponent 8 ", bounds.Dx(), bounds.Dy())
+	smask := ""
+	if !opaque {
+		n, err := p.stream(dict+"/ColorSpace /DeviceGray ", alpha)
+		if err != nil {
+			return 0, err
+		}
+		smask = fmt.Sprintf("/SMask %d 0 R ", n)
+	}
+	return p.stream(dict+"/ColorSpace /DeviceRGB "+smask, rgb)
+}
+
+func (p *pdfWriter) finish(w io.Writer, root, info int) error {
+	xref := p.buf.Len()
+	fmt.Fprintf(&p.buf, "xref\n0 %d\n0000000000 65535 f \n", len(p.offsets)+1)
+	for _, offset := range p.offsets {
+		fmt.Fprintf(&p.buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&p.buf, "trailer\n<< /Size %d /Root %d 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(p.offsets)+1, root, info, xref)
+	_, err := w.Write(p.buf.Bytes())
+	return err
+}
@@ -0,0 +1,331 @@
+package ollama
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fogleman/gg"
+)
+
+// testVectorDoc lays out two captions, one without an outline, over a
+// gradient with a half transparent stamp in the corner
+func testVectorDoc(t *testing.T) *vectorDoc {
+	t.Helper()
+	base := image.NewNRGBA(image.Rect(0, 0, 120, 60))
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 120; x++ {
+			base.SetNRGBA(x, y, color.NRGBA{uint8(x * 2), uint8(y * 4), 100, 255})
+		}
+	}
+	stamp := image.NewNRGBA(image.Rect(0, 0, 10, 8))
+	for i := range stamp.Pix {
+		stamp.Pix[i] = uint8(i * 7)
+	}
+
+	c := &Client{}
+	paths, err := c.captionPaths(gg.NewContext(120, 60), []Caption{
+		{Text: "HI <&>", FontSize: 24, X: 60, Y: 18, Fill: color.White, Stroke: color.Black},
+		{Text: "ok", FontSize: 16, X: 60, Y: 48, Fill: color.NRGBA{255, 255, 0, 255}},
+	})
+	if err != nil {
+		t.Fatalf("captionPaths: %v", err)
+	}
+	return &vectorDoc{
+		title:    "Cat ☃ <&>",
+		width:    120,
+		height:   60,
+		base:     base,
+		paths:    paths,
+		overlays: []vectorOverlay{{img: stamp, at: image.Point{105, 48}, opacity: 0.5}},
+	}
+}
+
+func TestCaptionPaths(t *testing.T) {
+	doc := testVectorDoc(t)
+	if len(doc.paths) != 2 {
+		t.Fatalf("%d caption paths, want 2", len(doc.paths))
+	}
+	for _, p := range doc.paths {
+		// Every contour is closed, and the glyphs sit around the caption's
+		// anchor inside the image
+		moves, closes := 0, 0
+		for _, op := range p.ops {
+			switch op.kind {
+			case 'M':
+				moves++
+			case 'Z':
+				closes++
+			}
+			for _, pt := range op.pts[:1] {
+				if op.kind != 'Z' && (pt[0] < 0 || pt[0] > 120 || pt[1] < 0 || pt[1] > 60) {
+					t.Errorf("%q: point %v outside the image", p.text, pt)
+				}
+			}
+		}
+		if moves == 0 || moves != closes {
+			t.Errorf("%q: %d contours opened, %d closed", p.text, moves, closes)
+		}
+	}
+	if doc.paths[0].ops[0].kind != 'M' || doc.paths[1].stroke != nil {
+		t.Errorf("paths = %+v", doc.paths)
+	}
+}
+
+func TestWriteSVG(t *testing.T) {
+	doc := testVectorDoc(t)
+	var buf bytes.Buffer
+	if err := doc.writeSVG(&buf); err != nil {
+		t.Fatalf("writeSVG: %v", err)
+	}
+
+	type svgImage struct {
+		X       string `xml:"x,attr"`
+		Y       string `xml:"y,attr"`
+		Width   string `xml:"width,attr"`
+		Height  string `xml:"height,attr"`
+		Opacity string `xml:"opacity,attr"`
+		Href    string `xml:"http://www.w3.org/1999/xlink href,attr"`
+	}
+	var svg struct {
+		XMLName xml.Name
+		ViewBox string     `xml:"viewBox,attr"`
+		Title   string     `xml:"title"`
+		Images  []svgImage `xml:"image"`
+		Groups  []struct {
+			Label string `xml:"aria-label,attr"`
+			Paths []struct {
+				D      string `xml:"d,attr"`
+				Fill   string `xml:"fill,attr"`
+				Stroke string `xml:"stroke,attr"`
+			} `xml:"path"`
+		} `xml:"g"`
+	}
+	if err := xml.Unmarshal(buf.Bytes(), &svg); err != nil {
+		t.Fatalf("SVG does not parse: %v", err)
+	}
+	if svg.XMLName.Local != "svg" || svg.ViewBox != "0 0 120 60" || svg.Title != doc.title {
+		t.Errorf("svg %s viewBox %q title %q", svg.XMLName.Local, svg.ViewBox, svg.Title)
+	}
+
+	// The base image, then the stamp over the captions
+	decode := func(img svgImage) image.Image {
+		t.Helper()
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(img.Href, "data:image/png;base64,"))
+		if err != nil {
+			t.Fatalf("image data: %v", err)
+		}
+		decoded, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("image data: %v", err)
+		}
+		return decoded
+	}
+	if len(svg.Images) != 2 {
+		t.Fatalf("%d images, want 2", len(svg.Images))
+	}
+	if img := svg.Images[0]; img.Width != "120" || img.Height != "60" || color.NRGBAModel.Convert(decode(img).At(30, 10)) != doc.base.At(30, 10) {
+		t.Errorf("base image %+v does not match", img)
+	}
+	if img := svg.Images[1]; img.X != "105" || img.Y != "48" || img.Width != "10" || img.Height != "8" || img.Opacity != "0.5" ||
+		decode(img).Bounds().Size() != image.Pt(10, 8) {
+		t.Errorf("stamp image %+v does not match", img)
+	}
+
+	if len(svg.Groups) != 2 {
+		t.Fatalf("%d caption groups, want 2", len(svg.Groups))
+	}
+	outlined, plain := svg.Groups[0], svg.Groups[1]
+	if outlined.Label != "HI <&>" || len(outlined.Paths) != 2 {
+		t.Fatalf("outlined caption %+v", outlined)
+	}
+	if p := outlined.Paths[0]; p.Fill != "none" || p.Stroke != "#000000" || p.D != doc.paths[0].svgPath() {
+		t.Errorf("outline path fill %q stroke %q", p.Fill, p.Stroke)
+	}
+	if p := outlined.Paths[1]; p.Fill != "#ffffff" || p.D != doc.paths[0].svgPath() {
+		t.Errorf("text path fill %q", p.Fill)
+	}
+	if len(plain.Paths) != 1 || plain.Paths[0].Fill != "#ffff00" || plain.Paths[0].Stroke != "" {
+		t.Errorf("caption without an outline %+v", plain)
+	}
+	if d := outlined.Paths[1].D; !regexp.MustCompile(`^(M[-\d. ]+([LQ][-\d. ]+)*Z)+$`).MatchString(d) {
+		t.Errorf("path data %q is not moves, lines, curves and closes", d)
+	}
+}
+
+func TestSVGPath(t *testing.T) {
+	p := captionPath{ops: []pathOp{
+		{kind: 'M', pts: [2][2]float64{{1, 2.5}}},
+		{kind: 'L', pts: [2][2]float64{{3.333, -0.001}}},
+		{kind: 'Q', pts: [2][2]float64{{5, 6}, {7.1, 8}}},
+		{kind: 'Z'},
+	}}
+	if got, want := p.svgPath(), "M1 2.5L3.33 0Q5 6 7.1 8Z"; got != want {
+		t.Errorf("svgPath = %q, want %q", got, want)
+	}
+
+	// PDF has no quadratics, so the curve is raised to a cubic
+	var b bytes.Buffer
+	p.writePDFPath(&b)
+	if got, want := b.String(), "1 2.5 m\n3.33 0 l\n4.44 4 5.7 6.67 7.1 8 c\nh\n"; got != want {
+		t.Errorf("writePDFPath = %q, want %q", got, want)
+	}
+}
+
+// pdfObject is an object read back from a PDF, with its stream decompressed
+type pdfObject struct {
+	dict   string
+	stream []byte
+}
+
+// readPDF checks that a PDF's cross-reference table points at each object
+// and returns the objects by number, and the trailer
+func readPDF(t *testing.T, data []byte) (map[int]pdfObject, string) {
+	t.Helper()
+	if !bytes.HasPrefix(data, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(data, []byte("%%EOF\n")) {
+		t.Fatalf("PDF header or trailer missing")
+	}
+	tail := data[bytes.LastIndex(data, []byte("startxref\n"))+len("startxref\n"):]
+	xref, err := strconv.Atoi(string(tail[:bytes.IndexByte(tail, '\n')]))
+	if err != nil || !bytes.HasPrefix(data[xref:], []byte("xref\n0 ")) {
+		t.Fatalf("startxref does not point at the xref table")
+	}
+
+	table := data[xref+len("xref\n"):]
+	var count int
+	if _, err := fmt.Sscanf(string(table), "0 %d\n", &count); err != nil {
+		t.Fatalf("xref subsection: %v", err)
+	}
+	entries := table[bytes.IndexByte(table, '\n')+1:]
+	if string(entries[:20]) != "0000000000 65535 f \n" {
+		t.Errorf("first xref entry %q", entries[:20])
+	}
+
+	lengthRe := regexp.MustCompile(`/Length (\d+)`)
+	objects := map[int]pdfObject{}
+	for n := 1; n < count; n++ {
+		entry := string(entries[20*n : 20*n+20])
+		offset, err := strconv.Atoi(entry[:10])
+		if err != nil || !strings.HasSuffix(entry, " 00000 n \n") {
+			t.Fatalf("xref entry %d: %q", n, entry)
+		}
+		header := fmt.Sprintf("%d 0 obj\n", n)
+		if !bytes.HasPrefix(data[offset:], []byte(header)) {
+			t.Fatalf("xref entry %d points at %q", n, data[offset:min(offset+20, len(data))])
+		}
+
+		body := data[offset+len(header):]
+		end := bytes.Index(body, []byte("\nendobj\n"))
+		start := bytes.Index(body, []byte("\nstream\n"))
+		if start < 0 || start > end {
+			objects[n] = pdfObject{dict: string(body[:end])}
+			continue
+		}
+		dict := string(body[:start])
+		m := lengthRe.FindStringSubmatch(dict)
+		if m == nil {
+			t.Fatalf("object %d: stream without a length", n)
+		}
+		length, _ := strconv.Atoi(m[1])
+		raw := body[start+len("\nstream\n"):]
+		if !bytes.HasPrefix(raw[length:], []byte("\nendstream\nendobj\n")) {
+			t.Fatalf("object %d: /Length %d does not end at endstream", n, length)
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(raw[:length]))
+		if err != nil {
+			t.Fatalf("object %d: %v", n, err)
+		}
+		stream, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("object %d: %v", n, err)
+		}
+		objects[n] = pdfObject{dict: dict, stream: stream}
+	}
+
+	trailer := string(entries[20*count:])
+	if !strings.HasPrefix(trailer, fmt.Sprintf("trailer\n<< /Size %d ", count)) {
+		t.Errorf("trailer %q does not give the size %d", trailer, count)
+	}
+	return objects, trailer
+}
+
+func TestWritePDF(t *testing.T) {
+	doc := testVectorDoc(t)
+	var buf bytes.Buffer
+	if err := doc.writePDF(&buf); err != nil {
+		t.Fatalf("writePDF: %v", err)
+	}
+	objects, trailer := readPDF(t, buf.Bytes())
+
+	// ref finds an indirect reference to an object after key
+	ref := func(dict, key string) pdfObject {
+		t.Helper()
+		m := regexp.MustCompile(regexp.QuoteMeta(key) + ` \[?(\d+) 0 R`).FindStringSubmatch(dict)
+		if m == nil {
+			t.Fatalf("no %s in %q", key, dict)
+		}
+		n, _ := strconv.Atoi(m[1])
+		obj, ok := objects[n]
+		if !ok {
+			t.Fatalf("%s refers to missing object %d", key, n)
+		}
+		return obj
+	}
+
+	catalog := ref(trailer, "/Root")
+	if !strings.Contains(catalog.dict, "/Type /Catalog") {
+		t.Fatalf("root is %q", catalog.dict)
+	}
+	page := ref(ref(catalog.dict, "/Pages").dict, "/Kids")
+	if !strings.Contains(page.dict, "/Type /Page ") || !strings.Contains(page.dict, "/MediaBox [0 0 120 60]") {
+		t.Errorf("page %q", page.dict)
+	}
+	if info := ref(trailer, "/Info"); !strings.Contains(info.dict, "/Title "+pdfString(doc.title)) {
+		t.Errorf("info %q does not carry the title", info.dict)
+	}
+
+	// The base image is opaque RGB; the stamp has a soft mask of its alpha
+	base := ref(page.dict, "/Im0")
+	if !strings.Contains(base.dict, "/Width 120 /Height 60") || strings.Contains(base.dict, "/SMask") || len(base.stream) != 120*60*3 {
+		t.Errorf("base image %q, %d bytes", base.dict, len(base.stream))
+	}
+	if !bytes.Equal(base.stream[:3], []byte{0, 0, 100}) {
+		t.Errorf("base image starts with %v", base.stream[:3])
+	}
+	stamp := ref(page.dict, "/Im1")
+	mask := ref(stamp.dict, "/SMask")
+	if len(stamp.stream) != 10*8*3 || !strings.Contains(mask.dict, "/DeviceGray") || len(mask.stream) != 10*8 || mask.stream[1] != 7*7 {
+		t.Errorf("stamp %q with mask %q", stamp.dict, mask.dict)
+	}
+	if state := ref(page.dict, "/GS1"); !strings.Contains(state.dict, "/ca 0.5") {
+		t.Errorf("stamp opacity %q", state.dict)
+	}
+
+	content := string(ref(page.dict, "/Contents").stream)
+	for _, want := range []string{
+		"q 120 0 0 60 0 0 cm /Im0 Do Q\n",
+		"q 1 0 0 -1 0 60 cm 1 j 1 J\n",
+		"0 0 0 RG 6 w\n",
+		"1 1 1 rg\n",
+		"1 1 0 rg\n",
+		"q /GS1 gs 10 0 0 8 105 4 cm /Im1 Do Q\n",
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("content stream lacks %q", want)
+		}
+	}
+	// Each outline is stroked then filled, and the plain caption only filled
+	if strokes, fills := strings.Count(content, "\nS\n"), strings.Count(content, "\nf\n"); strokes != 1 || fills != 2 {
+		t.Errorf("%d strokes and %d fills, want 1 and 2", strokes, fills)
+	}
+}
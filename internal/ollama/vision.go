@@ -0,0 +1,88 @@
+package ollama
+
+import (
+	"bytes"
+	"fmt"
+	"image/gif"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultVisionModel is used when no vision model is configured
+const DefaultVisionModel = "llava"
+
+// DescribeImage asks a local vision model what an image shows, so captions
+// can be written about the actual picture rather than just the prompt.
+// Animated GIFs are described from their first frame.
+func (c *Client) DescribeImage(imagePath, model string) (string, error) {
+	if model == "" {
+		model = DefaultVisionModel
+	}
+
+	path, err := filepath.Abs(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve image path: %w", err)
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".gif") {
+		frame, err := firstFramePNG(path)
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(frame)
+		path = frame
+	}
+
+	// `ollama run` attaches image files whose paths appear in the prompt
+	prompt := fmt.Sprintf(
+		"Describe this image in one or two sentences. Mention the people, animals, objects, actions and facial expressions a meme caption could refer to. %s",
+		path,
+	)
+
+	cmd := exec.Command("ollama", "run", model, prompt)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("ollama vision model failed: %w, stderr: %s", err, stderr.String())
+	}
+
+	description := strings.Join(strings.Fields(stdout.String()), " ")
+	if description == "" {
+		return "", fmt.Errorf("ollama produced no description")
+	}
+
+	return description, nil
+}
+
+// firstFramePNG writes the first frame of a GIF to a temporary PNG file
+func firstFramePNG(gifPath string) (string, error) {
+	file, err := os.Open(gifPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open gif: %w", err)
+	}
+	defer file.Close()
+
+	frame, err := gif.Decode(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode gif: %w", err)
+	}
+
+	tmp, err := os.CreateTemp("", "frame-*.png")
+	if err != nil {
+		return "", fmt.Errorf("failed to create frame file: %w", err)
+	}
+	defer tmp.Close()
+
+	if err := png.Encode(tmp, frame); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to encode frame: %w", err)
+	}
+
+	return tmp.Name(), nil
+}
@@ -0,0 +1,840 @@
+package ollama
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+)
+
+// VP8 (lossy WebP) keyframe encoding, see RFC 6386. Each macroblock is
+// predicted as a whole from its already reconstructed neighbours, and the
+// difference is transformed, quantized and coded with token probabilities
+// fitted to the image. Decoders smooth the block edges with the loop filter.
+const (
+	vp8NumPlanes   = 4
+	vp8NumBands    = 8
+	vp8NumContexts = 3
+	vp8NumProbs    = 11
+
+	// Token planes, section 13.3
+	vp8PlaneYAfterY2 = 0 // luma blocks whose DC is coded in the Y2 block
+	vp8PlaneY2       = 1
+	vp8PlaneChroma   = 2
+
+	vp8MaxLevel = 2048 // largest quantized coefficient the tokens can code
+)
+
+// Whole-block prediction modes, section 12.2
+const (
+	vp8PredDC = iota
+	vp8PredTM
+	vp8PredVE
+	vp8PredHE
+)
+
+var vp8PredModes = []uint8{vp8PredDC, vp8PredTM, vp8PredVE, vp8PredHE}
+
+// Where the luma and chroma blocks sit in the reconstruction workspace. The
+// layout matches golang.org/x/image/vp8: each block has the row above and the
+// column left of it available for prediction.
+const (
+	vp8WorkYY, vp8WorkYX = 1, 8
+	vp8WorkUY, vp8WorkUX = 18, 8
+	vp8WorkVY, vp8WorkVX = 18, 24
+)
+
+// vp8Quant are the DC and AC quantizer step sizes of each plane
+type vp8Quant struct {
+	y1, y2, uv [2]int32
+}
+
+// vp8Macroblock is a macroblock's prediction modes and quantized levels
+type vp8Macroblock struct {
+	yMode, uvMode uint8
+	skip          bool // every level is zero
+	// levels holds 16 luma, 4 U, 4 V and the Y2 block, each in zigzag order
+	levels [25][16]int16
+}
+
+type vp8Encoder struct {
+	mbw, mbh int
+	quant    vp8Quant
+	// Source and reconstructed planes, padded to whole macroblocks. The
+	// reconstruction is what a decoder will see, so predicting from it
+	// keeps the encoder and decoder in step.
+	srcY, srcU, srcV []uint8
+	recY, recU, recV []uint8
+	work             [26][32]uint8
+	mbs              []vp8Macroblock
+}
+
+// encodeWebPLossy writes img as a lossy WebP (VP8). Quality 1-100 picks the
+// quantizer. Transparent images get a losslessly compressed alpha channel.
+func encodeWebPLossy(w io.Writer, img image.Image, quality int) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 || width > 1<<14-1 || height > 1<<14-1 {
+		return fmt.Errorf("webp: unsupported image size %dx%d", width, height)
+	}
+
+	nrgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(nrgba, nrgba.Rect, img, bounds.Min, draw.Src)
+
+	qi := (100 - max(1, min(100, quality))) * 127 / 99
+	e := newVP8Encoder(nrgba, qi)
+	for mby := 0; mby < e.mbh; mby++ {
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			e.encodeMacroblock(mbx, mby)
+		}
+	}
+	frame := e.frame(width, height, qi)
+
+	alpha, hasAlpha := alphaPlane(nrgba)
+	if !hasAlpha {
+		return writeWebPFile(w, webpChunk{"VP8 ", frame})
+	}
+
+	// The alpha plane is a VP8L image without its header, carried in the
+	// green channel. Copying it to red and blue too leaves nothing for the
+	// subtract-green transform to code.
+	bw := &bitWriter{}
+	writeVP8LImage(bw, alpha, width, height)
+	alphaChunk := append([]byte{1}, bw.bytes()...) // compression 1, no filtering
+
+	header := make([]byte, 10)
+	header[0] = 0x10 // alpha
+	putUint24(header[4:7], uint32(width-1))
+	putUint24(header[7:10], uint32(height-1))
+	return writeWebPFile(w, webpChunk{"VP8X", header}, webpChunk{"ALPH", alphaChunk}, webpChunk{"VP8 ", frame})
+}
+
+// alphaPlane returns the alpha channel as ARGB pixels for the VP8L encoder,
+// and whether any pixel is transparent
+func alphaPlane(img *image.NRGBA) ([]uint32, bool) {
+	argb := make([]uint32, 0, len(img.Pix)/4)
+	hasAlpha := false
+	for i := 3; i < len(img.Pix); i += 4 {
+		a := uint32(img.Pix[i])
+		if a != 0xff {
+			hasAlpha = true
+		}
+		argb = append(argb, 0xff000000|a<<16|a<<8|a)
+	}
+	return argb, hasAlpha
+}
+
+// newVP8Encoder converts img to YCbCr 4:2:0 with the BT.601 coefficients VP8
+// decoders expect, padding it to whole macroblocks by repeating the last row
+// and column
+func newVP8Encoder(img *image.NRGBA, qi int) *vp8Encoder {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	e := &vp8Encoder{
+		mbw:   (width + 15) / 16,
+		mbh:   (height + 15) / 16,
+		quant: newVP8Quant(qi),
+	}
+	yw, yh := e.mbw*16, e.mbh*16
+	cw, ch := yw/2, yh/2
+	e.srcY, e.recY = make([]uint8, yw*yh), make([]uint8, yw*yh)
+	e.srcU, e.recU = make([]uint8, cw*ch), make([]uint8, cw*ch)
+	e.srcV, e.recV = make([]uint8, cw*ch), make([]uint8, cw*ch)
+	e.mbs = make([]vp8Macroblock, e.mbw*e.mbh)
+
+	pixel := func(x, y int) (r, g, b int) {
+		p := img.Pix[img.PixOffset(min(x, width-1), min(y, height-1)):]
+		return int(p[0]), int(p[1]), int(p[2])
+	}
+	const half = 1 << 15
+	for y := 0; y < yh; y++ {
+		for x := 0; x < yw; x++ {
+			r, g, b := pixel(x, y)
+			e.srcY[y*yw+x] = uint8((16839*r + 33059*g + 6420*b + 16<<16 + half) >> 16)
+		}
+	}
+	for y := 0; y < ch; y++ {
+		for x := 0; x < cw; x++ {
+			// Chroma is taken from the sum of each 2x2 block
+			var r, g, b int
+			for _, d := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				pr, pg, pb := pixel(2*x+d[0], 2*y+d[1])
+				r, g, b = r+pr, g+pg, b+pb
+			}
+			e.srcU[y*cw+x] = clampUint8((-9719*r - 19081*g + 28800*b + 128<<18 + 4*half) >> 18)
+			e.srcV[y*cw+x] = clampUint8((28800*r - 24116*g - 4684*b + 128<<18 + 4*half) >> 18)
+		}
+	}
+	return e
+}
+
+// newVP8Quant returns the step sizes for quantizer index qi, as a decoder
+// derives them, section 9.6
+func newVP8Quant(qi int) vp8Quant {
+	dc, ac := int32(vp8DCQuant[qi]), int32(vp8ACQuant[qi])
+	return vp8Quant{
+		y1: [2]int32{dc, ac},
+		y2: [2]int32{dc * 2, max(8, ac*155/100)},
+		uv: [2]int32{int32(vp8DCQuant[min(qi, 117)]), ac},
+	}
+}
+
+// encodeMacroblock picks prediction modes for a macroblock, quantizes what
+// the prediction misses and reconstructs the result as a decoder will
+func (e *vp8Encoder) encodeMacroblock(mbx, mby int) {
+	e.prepareWork(mbx, mby)
+	mb := &e.mbs[mby*e.mbw+mbx]
+	yw, cw := e.mbw*16, e.mbw*8
+
+	// Luma: one 16x16 prediction, with the DC of each 4x4 block coded
+	// together in the Y2 block
+	srcY := e.srcY[mby*16*yw+mbx*16:]
+	mb.yMode = e.bestMode(16, mbx, mby, []int{vp8WorkYY, vp8WorkYX}, [][]uint8{srcY}, yw)
+	predY := e.predict(vp8WorkYY, vp8WorkYX, 16, mb.yMode, mbx, mby)
+
+	var coeffs [16][16]int32
+	var dc [16]int32
+	for b := range coeffs {
+		coeffs[b] = vp8ForwardDCT(srcY[(b/4)*4*yw+(b%4)*4:], yw, predY[(b/4)*4:], (b%4)*4)
+		dc[b] = coeffs[b][0]
+	}
+	y2 := vp8ForwardWHT(dc)
+	for i := 0; i < 16; i++ {
+		mb.levels[24][i] = vp8Quantize(y2[vp8Zigzag[i]], e.quant.y2[min(i, 1)], false)
+	}
+	for b := range coeffs {
+		for i := 1; i < 16; i++ {
+			mb.levels[b][i] = vp8Quantize(coeffs[b][vp8Zigzag[i]], e.quant.y1[1], true)
+		}
+	}
+
+	var y2Coeffs [16]int16
+	for i, level := range mb.levels[24] {
+		y2Coeffs[vp8Zigzag[i]] = int16(int32(level) * e.quant.y2[min(i, 1)])
+	}
+	dcs := vp8InverseWHT(y2Coeffs)
+	e.reconstruct(vp8WorkYY, vp8WorkYX, 16, &predY, func(b int) [16]int16 {
+		c := e.dequantize(&mb.levels[b], e.quant.y1)
+		c[0] = dcs[b]
+		return c
+	})
+
+	// Chroma: U and V share one 8x8 prediction mode
+	srcU := e.srcU[mby*8*cw+mbx*8:]
+	srcV := e.srcV[mby*8*cw+mbx*8:]
+	mb.uvMode = e.bestMode(8, mbx, mby, []int{vp8WorkUY, vp8WorkUX, vp8WorkVY, vp8WorkVX}, [][]uint8{srcU, srcV}, cw)
+	for plane, src := range [][]uint8{srcU, srcV} {
+		wy, wx := vp8WorkUY, vp8WorkUX+16*plane
+		pred := e.predict(wy, wx, 8, mb.uvMode, mbx, mby)
+		base := 16 + 4*plane
+		for b := 0; b < 4; b++ {
+			c := vp8ForwardDCT(src[(b/2)*4*cw+(b%2)*4:], cw, pred[(b/2)*4:], (b%2)*4)
+			for i := 0; i < 16; i++ {
+				mb.levels[base+b][i] = vp8Quantize(c[vp8Zigzag[i]], e.quant.uv[min(i, 1)], i > 0)
+			}
+		}
+		e.reconstruct(wy, wx, 8, &pred, func(b int) [16]int16 {
+			return e.dequantize(&mb.levels[base+b], e.quant.uv)
+		})
+	}
+
+	mb.skip = true
+	for b := range mb.levels {
+		for _, level := range mb.levels[b] {
+			if level != 0 {
+				mb.skip = false
+			}
+		}
+	}
+
+	// Keep the reconstruction for the macroblocks predicted from this one
+	for y := 0; y < 16; y++ {
+		copy(e.recY[(mby*16+y)*yw+mbx*16:], e.work[vp8WorkYY+y][vp8WorkYX:vp8WorkYX+16])
+	}
+	for y := 0; y < 8; y++ {
+		copy(e.recU[(mby*8+y)*cw+mbx*8:], e.work[vp8WorkUY+y][vp8WorkUX:vp8WorkUX+8])
+		copy(e.recV[(mby*8+y)*cw+mbx*8:], e.work[vp8WorkVY+y][vp8WorkVX:vp8WorkVX+8])
+	}
+}
+
+// prepareWork fills in the row above and column left of each block in the
+// workspace, with the fixed values decoders use at the image edges
+func (e *vp8Encoder) prepareWork(mbx, mby int) {
+	yw, cw := e.mbw*16, e.mbw*8
+	for y := 0; y < 17; y++ {
+		e.work[y][7] = 0x81
+		if mbx > 0 && y > 0 {
+			e.work[y][7] = e.recY[(mby*16+y-1)*yw+mbx*16-1]
+		}
+	}
+	for y := 17; y < 26; y++ {
+		e.work[y][7], e.work[y][23] = 0x81, 0x81
+		if mbx > 0 && y > 17 {
+			e.work[y][7] = e.recU[(mby*8+y-18)*cw+mbx*8-1]
+			e.work[y][23] = e.recV[(mby*8+y-18)*cw+mbx*8-1]
+		}
+	}
+	if mby == 0 {
+		for x := 7; x < 24; x++ {
+			e.work[0][x] = 0x7f
+		}
+		for x := 7; x < 16; x++ {
+			e.work[17][x], e.work[17][x+16] = 0x7f, 0x7f
+		}
+		return
+	}
+	for x := 0; x < 16; x++ {
+		e.work[0][8+x] = e.recY[(mby*16-1)*yw+mbx*16+x]
+	}
+	for x := 0; x < 8; x++ {
+		e.work[17][8+x] = e.recU[(mby*8-1)*cw+mbx*8+x]
+		e.work[17][24+x] = e.recV[(mby*8-1)*cw+mbx*8+x]
+	}
+	if mbx > 0 {
+		e.work[0][7] = e.recY[(mby*16-1)*yw+mbx*16-1]
+		e.work[17][7] = e.recU[(mby*8-1)*cw+mbx*8-1]
+		e.work[17][23] = e.recV[(mby*8-1)*cw+mbx*8-1]
+	}
+}
+
+// predict returns the size x size prediction of the block at (y, x) in the
+// workspace, section 12.2. DC prediction averages only the neighbours that
+// are inside the image.
+func (e *vp8Encoder) predict(y, x, size int, mode uint8, mbx, mby int) (pred [16][16]uint8) {
+	above, corner := e.work[y-1][x:x+size], int32(e.work[y-1][x-1])
+	for j := 0; j < size; j++ {
+		left := int32(e.work[y+j][x-1])
+		for i := 0; i < size; i++ {
+			switch mode {
+			case vp8PredTM:
+				pred[j][i] = clampUint8(int(left + int32(above[i]) - corner))
+			case vp8PredVE:
+				pred[j][i] = above[i]
+			case vp8PredHE:
+				pred[j][i] = uint8(left)
+			}
+		}
+	}
+	if mode != vp8PredDC {
+		return pred
+	}
+
+	sum, n := 0, 0
+	if mby > 0 {
+		for i := 0; i < size; i++ {
+			sum += int(above[i])
+		}
+		n += size
+	}
+	if mbx > 0 {
+		for j := 0; j < size; j++ {
+			sum += int(e.work[y+j][x-1])
+		}
+		n += size
+	}
+	avg := uint8(0x80)
+	if n > 0 {
+		avg = uint8((sum + n/2) / n)
+	}
+	for j := 0; j < size; j++ {
+		for i := 0; i < size; i++ {
+			pred[j][i] = avg
+		}
+	}
+	return pred
+}
+
+// bestMode returns the prediction mode with the smallest absolute error over
+// the given blocks, which are the workspace positions at (at[2k], at[2k+1])
+// of src[k]
+func (e *vp8Encoder) bestMode(size, mbx, mby int, at []int, src [][]uint8, stride int) uint8 {
+	best, bestErr := uint8(vp8PredDC), math.MaxInt
+	for _, mode := range vp8PredModes {
+		sad := 0
+		for k, s := range src {
+			pred := e.predict(at[2*k], at[2*k+1], size, mode, mbx, mby)
+			for j := 0; j < size; j++ {
+				for i := 0; i < size; i++ {
+					d := int(s[j*stride+i]) - int(pred[j][i])
+					sad += max(d, -d)
+				}
+			}
+		}
+		if sad < bestErr {
+			best, bestErr = mode, sad
+		}
+	}
+	return best
+}
+
+// reconstruct writes a prediction to the workspace and adds the inverse
+// transform of each 4x4 block's dequantized coefficients
+func (e *vp8Encoder) reconstruct(y, x, size int, pred *[16][16]uint8, coeffs func(b int) [16]int16) {
+	for j := 0; j < size; j++ {
+		copy(e.work[y+j][x:x+size], pred[j][:size])
+	}
+	blocks := size / 4
+	for b := 0; b < blocks*blocks; b++ {
+		c := coeffs(b)
+		vp8InverseDCT(&e.work, y+(b/blocks)*4, x+(b%blocks)*4, &c)
+	}
+}
+
+// dequantize returns a block's coefficients in raster order, as a decoder
+// reads them
+func (e *vp8Encoder) dequantize(levels *[16]int16, q [2]int32) [16]int16 {
+	var c [16]int16
+	for i, level := range levels {
+		c[vp8Zigzag[i]] = int16(int32(level) * q[min(i, 1)])
+	}
+	return c
+}
+
+// vp8Quantize rounds a coefficient to a multiple of the step size q. AC
+// coefficients round towards zero a little more, since small ones cost more
+// to code than they add.
+func vp8Quantize(c, q int32, ac bool) int16 {
+	bias := q / 2
+	if ac {
+		bias = q / 3
+	}
+	level := min((max(c, -c)+bias)/q, vp8MaxLevel)
+	if c < 0 {
+		return int16(-level)
+	}
+	return int16(level)
+}
+
+// vp8ForwardDCT transforms the difference between a 4x4 block of src and
+// its prediction, which starts at column x of pred. This is the transform of
+// the reference encoder, which vp8InverseDCT undoes.
+func vp8ForwardDCT(src []uint8, stride int, pred [][16]uint8, x int) [16]int32 {
+	var tmp, out [16]int32
+	for j := 0; j < 4; j++ {
+		var d [4]int32
+		for i := range d {
+			d[i] = int32(src[j*stride+i]) - int32(pred[j][x+i])
+		}
+		a1 := (d[0] + d[3]) * 8
+		b1 := (d[1] + d[2]) * 8
+		c1 := (d[1] - d[2]) * 8
+		d1 := (d[0] - d[3]) * 8
+		tmp[4*j+0] = a1 + b1
+		tmp[4*j+2] = a1 - b1
+		tmp[4*j+1] = (c1*2217 + d1*5352 + 14500) >> 12
+		tmp[4*j+3] = (d1*2217 - c1*5352 + 7500) >> 12
+	}
+	for i := 0; i < 4; i++ {
+		a1 := tmp[i] + tmp[12+i]
+		b1 := tmp[4+i] + tmp[8+i]
+		c1 := tmp[4+i] - tmp[8+i]
+		d1 := tmp[i] - tmp[12+i]
+		out[i] = (a1 + b1 + 7) >> 4
+		out[8+i] = (a1 - b1 + 7) >> 4
+		out[4+i] = (c1*2217+d1*5352+12000)>>16 + btoi32(d1 != 0)
+		out[12+i] = (d1*2217 - c1*5352 + 51000) >> 16
+	}
+	return out
+}
+
+// vp8InverseDCT adds the inverse transform of c to the 4x4 block at (y, x)
+// of the workspace, exactly as a decoder does, section 14.3
+func vp8InverseDCT(work *[26][32]uint8, y, x int, c *[16]int16) {
+	const (
+		c1 = 85627 // 65536 * cos(pi/8) * sqrt(2)
+		c2 = 35468 // 65536 * sin(pi/8) * sqrt(2)
+	)
+	var m [4][4]int32
+	for i := 0; i < 4; i++ {
+		a := int32(c[i]) + int32(c[8+i])
+		b := int32(c[i]) - int32(c[8+i])
+		cc := (int32(c[4+i])*c2)>>16 - (int32(c[12+i])*c1)>>16
+		d := (int32(c[4+i])*c1)>>16 + (int32(c[12+i])*c2)>>16
+		m[i] = [4]int32{a + d, b + cc, b - cc, a - d}
+	}
+	for j := 0; j < 4; j++ {
+		dc := m[0][j] + 4
+		a := dc + m[2][j]
+		b := dc - m[2][j]
+		cc := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+		row := work[y+j][x : x+4]
+		for i, v := range [4]int32{a + d, b + cc, b - cc, a - d} {
+			row[i] = clampUint8(int(int32(row[i]) + v>>3))
+		}
+	}
+}
+
+// vp8ForwardWHT transforms the DC coefficients of the 16 luma blocks, in
+// raster order, into the Y2 block. The Walsh-Hadamard matrix is its own
+// inverse up to scale, so this is vp8InverseWHT run backwards.
+func vp8ForwardWHT(dc [16]int32) [16]int32 {
+	hadamard := func(a, b, c, d int32) (int32, int32, int32, int32) {
+		return a + b + c + d, a + b - c - d, a - b - c + d, a - b + c - d
+	}
+	var tmp, out [16]int32
+	for i := 0; i < 4; i++ {
+		tmp[i], tmp[4+i], tmp[8+i], tmp[12+i] = hadamard(dc[i], dc[4+i], dc[8+i], dc[12+i])
+	}
+	for j := 0; j < 4; j++ {
+		r := tmp[4*j:]
+		out[4*j], out[4*j+1], out[4*j+2], out[4*j+3] = hadamard(r[0], r[1], r[2], r[3])
+	}
+	for i, v := range out {
+		// Halve, rounding to nearest
+		if v < 0 {
+			out[i] = -((-v + 1) >> 1)
+		} else {
+			out[i] = (v + 1) >> 1
+		}
+	}
+	return out
+}
+
+// vp8InverseWHT returns the DC coefficients of the 16 luma blocks from the
+// dequantized Y2 block, exactly as a decoder does, section 14.3
+func vp8InverseWHT(c [16]int16) [16]int16 {
+	var m [16]int32
+	for i := 0; i < 4; i++ {
+		a0 := int32(c[i]) + int32(c[12+i])
+		a1 := int32(c[4+i]) + int32(c[8+i])
+		a2 := int32(c[4+i]) - int32(c[8+i])
+		a3 := int32(c[i]) - int32(c[12+i])
+		m[i], m[8+i], m[4+i], m[12+i] = a0+a1, a0-a1, a3+a2, a3-a2
+	}
+	var dc [16]int16
+	for i := 0; i < 4; i++ {
+		r := m[4*i:]
+		d := r[0] + 3
+		a0, a1, a2, a3 := d+r[3], r[1]+r[2], r[1]-r[2], d-r[3]
+		dc[4*i], dc[4*i+1], dc[4*i+2], dc[4*i+3] = int16((a0+a1)>>3), int16((a3+a2)>>3), int16((a0-a1)>>3), int16((a3-a2)>>3)
+	}
+	return dc
+}
+
+// frame writes the compressed VP8 keyframe, section 9
+func (e *vp8Encoder) frame(width, height, qi int) []byte {
+	// Count which way each token branch goes, then code the tokens with
+	// probabilities fitted to those counts
+	var counts [vp8NumPlanes][vp8NumBands][vp8NumContexts][vp8NumProbs][2]uint32
+	probs := vp8DefaultTokenProb
+	e.writeTokens(&vp8TokenWriter{probs: &probs, counts: &counts})
+
+	hdr := newVP8BoolEncoder()
+	hdr.writeLiteral(0, 1) // color space
+	hdr.writeLiteral(0, 1) // pixel clamping required
+	hdr.writeLiteral(0, 1) // no segmentation
+	// Coarser quantization leaves harder block edges, so the loop filter
+	// gets stronger with the quantizer
+	hdr.writeLiteral(0, 1) // normal filter
+	hdr.writeLiteral(uint32(qi*3/8), 6)
+	hdr.writeLiteral(0, 3) // sharpness
+	hdr.writeLiteral(0, 1) // no filter adjustments
+	hdr.writeLiteral(0, 2) // one token partition
+	hdr.writeLiteral(uint32(qi), 7)
+	for range 5 {
+		hdr.writeLiteral(0, 1) // no quantizer deltas
+	}
+	hdr.writeLiteral(0, 1) // refresh entropy probabilities
+
+	for i := range probs {
+		for j := range probs[i] {
+			for k := range probs[i][j] {
+				for l := range probs[i][j][k] {
+					update := vp8TokenUpdateProb[i][j][k][l]
+					c := counts[i][j][k][l]
+					fitted := vp8FitProb(c)
+					saved := vp8BranchCost(probs[i][j][k][l], c) - vp8BranchCost(fitted, c) - 8 -
+						vp8BoolCost(update, true) + vp8BoolCost(update, false)
+					if saved > 0 {
+						hdr.writeBool(true, update)
+						hdr.writeLiteral(uint32(fitted), 8)
+						probs[i][j][k][l] = fitted
+					} else {
+						hdr.writeBool(false, update)
+					}
+				}
+			}
+		}
+	}
+
+	skipped := 0
+	for _, mb := range e.mbs {
+		if mb.skip {
+			skipped++
+		}
+	}
+	skipProb := uint8(max(1, min(255, 256*(len(e.mbs)-skipped)/len(e.mbs))))
+	hdr.writeLiteral(uint32(btoi32(skipped > 0)), 1)
+	if skipped > 0 {
+		hdr.writeLiteral(uint32(skipProb), 8)
+	}
+
+	// Macroblock headers, section 11.2
+	for _, mb := range e.mbs {
+		if skipped > 0 {
+			hdr.writeBool(mb.skip, skipProb)
+		}
+		hdr.writeBool(true, 145) // 16x16 luma prediction
+		switch mb.yMode {
+		case vp8PredDC, vp8PredVE:
+			hdr.writeBool(false, 156)
+			hdr.writeBool(mb.yMode == vp8PredVE, 163)
+		default:
+			hdr.writeBool(true, 156)
+			hdr.writeBool(mb.yMode == vp8PredTM, 128)
+		}
+		hdr.writeBool(mb.uvMode != vp8PredDC, 142)
+		if mb.uvMode != vp8PredDC {
+			hdr.writeBool(mb.uvMode != vp8PredVE, 114)
+			if mb.uvMode != vp8PredVE {
+				hdr.writeBool(mb.uvMode == vp8PredTM, 183)
+			}
+		}
+	}
+
+	tokens := newVP8BoolEncoder()
+	e.writeTokens(&vp8TokenWriter{enc: tokens, probs: &probs})
+
+	first, second := hdr.finish(), tokens.finish()
+	out := make([]byte, 10, 10+len(first)+len(second))
+	size := uint32(len(first))
+	out[0] = byte(1<<4 | size<<5) // key frame, version 0, shown
+	out[1] = byte(size >> 3)
+	out[2] = byte(size >> 11)
+	out[3], out[4], out[5] = 0x9d, 0x01, 0x2a
+	out[6], out[7] = byte(width), byte(width>>8)
+	out[8], out[9] = byte(height), byte(height>>8)
+	out = append(out, first...)
+	return append(out, second...)
+}
+
+// writeTokens codes the quantized levels of every macroblock that is not
+// skipped. Each block's first token depends on whether the blocks above and
+// left of it had any, section 13.3.
+func (e *vp8Encoder) writeTokens(t *vp8TokenWriter) {
+	aboveY2 := make([]uint8, e.mbw)
+	above := make([][8]uint8, e.mbw) // 4 luma, 2 U and 2 V columns
+	for mby := 0; mby < e.mbh; mby++ {
+		var leftY2 uint8
+		var left [8]uint8 // 4 luma, 2 U and 2 V rows
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			mb := &e.mbs[mby*e.mbw+mbx]
+			if mb.skip {
+				leftY2, aboveY2[mbx] = 0, 0
+				left, above[mbx] = [8]uint8{}, [8]uint8{}
+				continue
+			}
+
+			nz := t.writeBlock(&mb.levels[24], vp8PlaneY2, leftY2+aboveY2[mbx], 0)
+			leftY2, aboveY2[mbx] = nz, nz
+			for b := 0; b < 16; b++ {
+				y, x := b/4, b%4
+				nz := t.writeBlock(&mb.levels[b], vp8PlaneYAfterY2, left[y]+above[mbx][x], 1)
+				left[y], above[mbx][x] = nz, nz
+			}
+			for b := 0; b < 8; b++ {
+				// U then V, each 2x2 blocks
+				y, x := 4+2*(b/4)+(b%4)/2, 4+2*(b/4)+b%2
+				nz := t.writeBlock(&mb.levels[16+b], vp8PlaneChroma, left[y]+above[mbx][x], 0)
+				left[y], above[mbx][x] = nz, nz
+			}
+		}
+	}
+}
+
+// vp8TokenWriter codes coefficient tokens. Without an encoder it only counts
+// which way each probability-coded branch goes.
+type vp8TokenWriter struct {
+	enc    *vp8BoolEncoder
+	probs  *[vp8NumPlanes][vp8NumBands][vp8NumContexts][vp8NumProbs]uint8
+	counts *[vp8NumPlanes][vp8NumBands][vp8NumContexts][vp8NumProbs][2]uint32
+}
+
+func (t *vp8TokenWriter) branch(bit bool, p *[vp8NumProbs]uint8, counts *[vp8NumProbs][2]uint32, node int) {
+	if t.enc == nil {
+		counts[node][btoi32(bit)]++
+		return
+	}
+	t.enc.writeBool(bit, p[node])
+}
+
+func (t *vp8TokenWriter) fixed(bit bool, prob uint8) {
+	if t.enc != nil {
+		t.enc.writeBool(bit, prob)
+	}
+}
+
+// writeBlock codes the levels of one block from position first on, section
+// 13.2, and returns 1 if any were coded before the end of block token
+func (t *vp8TokenWriter) writeBlock(levels *[16]int16, plane int, ctx uint8, first int) uint8 {
+	last := -1
+	for i := 15; i >= first; i-- {
+		if levels[i] != 0 {
+			last = i
+			break
+		}
+	}
+
+	var counts *[vp8NumProbs][2]uint32
+	afterZero := false
+	for i := first; i < 16; i++ {
+		band := vp8Bands[i]
+		p := &t.probs[plane][band][ctx]
+		if t.counts != nil {
+			counts = &t.counts[plane][band][ctx]
+		}
+		// There is no end of block token straight after a zero
+		if !afterZero {
+			t.branch(i <= last, p, counts, 0)
+			if i > last {
+				return btou8(last >= first)
+			}
+		}
+
+		v := int(levels[i])
+		negative := v < 0
+		v = max(v, -v)
+		t.branch(v != 0, p, counts, 1)
+		if v == 0 {
+			ctx, afterZero = 0, true
+			continue
+		}
+		afterZero = false
+		ctx = 2
+		t.branch(v > 1, p, counts, 2)
+		switch {
+		case v == 1:
+			ctx = 1
+		case v <= 4:
+			t.branch(false, p, counts, 3)
+			t.branch(v > 2, p, counts, 4)
+			if v > 2 {
+				t.branch(v == 4, p, counts, 5)
+			}
+		case v <= 10:
+			t.branch(true, p, counts, 3)
+			t.branch(false, p, counts, 6)
+			t.branch(v > 6, p, counts, 7)
+			if v <= 6 {
+				t.fixed(v == 6, 159)
+			} else {
+				t.fixed((v-7)&2 != 0, 165)
+				t.fixed((v-7)&1 != 0, 145)
+			}
+		default:
+			t.branch(true, p, counts, 3)
+			t.branch(true, p, counts, 6)
+			cat := 0
+			for cat < 3 && v >= 3+(8<<(cat+1)) {
+				cat++
+			}
+			t.branch(cat >= 2, p, counts, 8)
+			t.branch(cat&1 == 1, p, counts, 9+cat/2)
+			extra := v - (3 + 8<<cat)
+			bitProbs := vp8CategoryProbs[cat]
+			for k, prob := range bitProbs {
+				t.fixed(extra>>(len(bitProbs)-1-k)&1 == 1, prob)
+			}
+		}
+		t.fixed(negative, 128)
+	}
+	return 1
+}
+
+// vp8FitProb returns the probability of a zero bit that best codes counts
+func vp8FitProb(counts [2]uint32) uint8 {
+	total := counts[0] + counts[1]
+	if total == 0 {
+		return 128
+	}
+	return uint8(max(1, min(255, (256*uint64(counts[0])+uint64(total)/2)/uint64(total))))
+}
+
+// vp8BranchCost returns the bits needed to code counts with probability p
+func vp8BranchCost(p uint8, counts [2]uint32) float64 {
+	return float64(counts[0])*vp8BoolCost(p, false) + float64(counts[1])*vp8BoolCost(p, true)
+}
+
+// vp8BoolCost returns the bits needed to code one bit with probability p
+func vp8BoolCost(p uint8, bit bool) float64 {
+	if bit {
+		return -math.Log2(float64(256-int(p)) / 256)
+	}
+	return -math.Log2(float64(p) / 256)
+}
+
+// vp8BoolEncoder is the boolean entropy encoder, section 7.3
+type vp8BoolEncoder struct {
+	out      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newVP8BoolEncoder() *vp8BoolEncoder {
+	return &vp8BoolEncoder{rng: 255, bitCount: 24}
+}
+
+// writeBool codes one bit, where prob/256 is the chance that it is zero
+func (e *vp8BoolEncoder) writeBool(bit bool, prob uint8) {
+	split := 1 + (e.rng-1)*uint32(prob)>>8
+	if bit {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			// Carry into the bytes already written
+			for i := len(e.out) - 1; i >= 0; i-- {
+				e.out[i]++
+				if e.out[i] != 0 {
+					break
+				}
+			}
+		}
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.out = append(e.out, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+// writeLiteral codes the n low bits of v, most significant first, at even odds
+func (e *vp8BoolEncoder) writeLiteral(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		e.writeBool(v>>i&1 == 1, 128)
+	}
+}
+
+// finish pushes out the bits still held in the encoder and returns the output
+func (e *vp8BoolEncoder) finish() []byte {
+	for range 32 {
+		e.writeBool(false, 128)
+	}
+	return e.out
+}
+
+func clampUint8(v int) uint8 {
+	return uint8(max(0, min(255, v)))
+}
+
+func btoi32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func btou8(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,300 @@
+package ollama
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fogleman/gg"
+	"golang.org/x/image/draw"
+)
+
+// WatermarkPosition is the corner, or centre, a watermark is placed in
+type WatermarkPosition string
+
+const (
+	WatermarkTopLeft     WatermarkPosition = "top-left"
+	WatermarkTopRight    WatermarkPosition = "top-right"
+	WatermarkBottomLeft  WatermarkPosition = "bottom-left"
+	WatermarkBottomRight WatermarkPosition = "bottom-right"
+	WatermarkCenter      WatermarkPosition = "center"
+)
+
+// WatermarkPositions lists every position in display order
+var WatermarkPositions = []WatermarkPosition{
+	WatermarkTopLeft, WatermarkTopRight, WatermarkBottomLeft, WatermarkBottomRight, WatermarkCenter,
+}
+
+// ParseWatermarkPosition validates a position name
+func ParseWatermarkPosition(s string) (WatermarkPosition, error) {
+	for _, p := range WatermarkPositions {
+		if string(p) == s {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported watermark position: %q", s)
+}
+
+// WatermarksDir is the subdirectory of the output directory that watermark
+// logos are kept in
+const WatermarksDir = "watermarks"
+
+// SharedDir is the subdirectory of the output directory that watermarked
+// copies for share links are cached in
+const SharedDir = "shared"
+
+// Watermark is a text or logo stamp drawn over finished memes
+type Watermark struct {
+	Text     string
+	LogoPath string // logo image, drawn instead of Text when set
+	Position WatermarkPosition
+	Opacity  float64 // 0 to 1
+	Scale    float64 // watermark width as a fraction of the image width
+}
+
+// Configured reports whether the watermark has anything to draw
+func (wm Watermark) Configured() bool {
+	return wm.Text != "" || wm.LogoPath != ""
+}
+
+// ApplyWatermark stamps a watermark onto the image at srcPath and writes the
+// result to destPath, which may be the same file. Stills are written as
+// PNG. GIF frames keep their palettes, so the watermark is matched to each
+// frame's nearest colors.
+func (c *Client) ApplyWatermark(srcPath, destPath string, wm Watermark) error {
+	if strings.EqualFold(filepath.Ext(srcPath), ".gif") {
+		return c.rewriteGIF(srcPath, destPath, func(g *gif.GIF) error {
+			stamp, at, err := c.watermarkStamp(wm, g.Config.Width, g.Config.Height)
+			if err != nil {
+				return err
+			}
+			for _, frame := range g.Image {
+				stampPaletted(frame, stamp, at, wm.Opacity)
+			}
+			return nil
+		})
+	}
+
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+	src, _, err := image.Decode(file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	img := toNRGBA(src)
+	stamp, at, err := c.watermarkStamp(wm, img.Bounds().Dx(), img.Bounds().Dy())
+	if err != nil {
+		return err
+	}
+	mask := image.NewUniform(color.Alpha{A: uint8(math.Round(wm.Opacity * 255))})
+	draw.DrawMask(img, stamp.Bounds().Add(at), stamp, image.Point{}, mask, image.Point{}, draw.Over)
+
+	return writeFileAtomic(destPath, func(w io.Writer) error {
+		if err := png.Encode(w, img); err != nil {
+			return fmt.Errorf("failed to encode image: %w", err)
+		}
+		return nil
+	})
+}
+
+// WatermarkedCopy returns a watermarked copy of an image for share links,
+// rendering and caching it on first use. The cache key includes the
+// watermark, so changing the watermark settings renders a new copy.
+func (c *Client) WatermarkedCopy(filename string, wm Watermark) (string, error) {
+	key := sha256.New()
+	fmt.Fprintf(key, "%s\x00%s\x00%g\x00%g\x00", wm.Text, wm.Position, wm.Opacity, wm.Scale)
+	if wm.LogoPath != "" {
+		c.fetchMissing(wm.LogoPath)
+		logo, err := os.ReadFile(wm.LogoPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read watermark logo: %w", err)
+		}
+		key.Write(logo)
+	}
+
+	stem := strings.TrimSuffix(filename, filepath.Ext(filename))
+	ext := ".png"
+	if strings.EqualFold(filepath.Ext(filename), ".gif") {
+		ext = ".gif"
+	}
+	shared := filepath.Join(SharedDir, fmt.Sprintf("%s-wm-%s%s", stem, hex.EncodeToString(key.Sum(nil)[:6]), ext))
+
+	srcPath := filepath.Join(c.outputDir, filename)
+	destPath := filepath.Join(c.outputDir, shared)
+	if isFresh(destPath, srcPath) {
+		return shared, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create shared directory: %w", err)
+	}
+	if err := c.ApplyWatermark(srcPath, destPath, wm); err != nil {
+		return "", err
+	}
+	return shared, nil
+}
+
+// WatermarkedCopies lists the cached share link copies of an image,
+// relative to the output directory
+func (c *Client) WatermarkedCopies(filename string) ([]string, error) {
+	stem := strings.TrimSuffix(filename, filepath.Ext(filename))
+	matches, err := filepath.Glob(filepath.Join(c.outputDir, SharedDir, stem+"-wm-*"))
+	if err != nil {
+		return nil, err
+	}
+	copies := make([]string, len(matches))
+	for i, path := range matches {
+		copies[i] = filepath.Join(SharedDir, filepath.Base(path))
+	}
+	return copies, nil
+}
+
+// RemoveWatermarkedCopies deletes the cached share link copies of an image
+func (c *Client) RemoveWatermarkedCopies(filename string) error {
+	copies, err := c.WatermarkedCopies(filename)
+	if err != nil {
+		return err
+	}
+	for _, shared := range copies {
+		if err := os.Remove(filepath.Join(c.outputDir, shared)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveWatermarkLogo stores an uploaded logo as a PNG in WatermarksDir and
+// returns its path relative to the output directory
+func (c *Client) SaveWatermarkLogo(data []byte) (string, error) {
+	return c.saveAsset(WatermarksDir, "logo", data)
+}
+
+// saveAsset stores an uploaded image as a PNG in a subdirectory of the
+// output directory, named by a hash of its contents, and returns its path
+// relative to the output directory
+func (c *Client) saveAsset(dir, prefix string, data []byte) (string, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode %s: %w", prefix, err)
+	}
+
+	sum := sha256.Sum256(data)
+	asset := filepath.Join(dir, prefix+"-"+hex.EncodeToString(sum[:6])+".png")
+	destPath := filepath.Join(c.outputDir, asset)
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s directory: %w", dir, err)
+	}
+	if err := writeFileAtomic(destPath, func(w io.Writer) error {
+		return png.Encode(w, img)
+	}); err != nil {
+		return "", err
+	}
+	c.publish(destPath)
+	return asset, nil
+}
+
+// watermarkStamp renders the watermark at full opacity, sized for an image
+// of the given dimensions, and returns it with the point it is drawn at
+func (c *Client) watermarkStamp(wm Watermark, width, height int) (*image.RGBA, image.Point, error) {
+	stampWidth := max(1, int(float64(width)*wm.Scale))
+
+	var stamp *image.RGBA
+	if wm.LogoPath != "" {
+		c.fetchMissing(wm.LogoPath)
+		file, err := os.Open(wm.LogoPath)
+		if err != nil {
+			return nil, image.Point{}, fmt.Errorf("failed to open watermark logo: %w", err)
+		}
+		logo, _, err := image.Decode(file)
+		file.Close()
+		if err != nil {
+			return nil, image.Point{}, fmt.Errorf("failed to decode watermark logo: %w", err)
+		}
+
+		bounds := logo.Bounds()
+		stampHeight := max(1, bounds.Dy()*stampWidth/bounds.Dx())
+		stamp = image.NewRGBA(image.Rect(0, 0, stampWidth, stampHeight))
+		draw.CatmullRom.Scale(stamp, stamp.Bounds(), logo, bounds, draw.Src, nil)
+	} else {
+		// Measure at a reference size, then scale the font so the text
+		// fills the stamp width
+		const referenceSize = 100.0
+		dc := gg.NewContext(1, 1)
+		if err := c.loadFont(dc, referenceSize); err != nil {
+			return nil, image.Point{}, err
+		}
+		textWidth, _ := dc.MeasureString(wm.Text)
+		fontSize := math.Max(8, referenceSize*float64(stampWidth)/math.Max(textWidth, 1))
+
+		stampHeight := int(math.Ceil(fontSize * 1.4))
+		dc = gg.NewContext(stampWidth+8, stampHeight)
+		if err := c.loadFont(dc, fontSize); err != nil {
+			return nil, image.Point{}, err
+		}
+		c.drawTextWithOutline(dc, wm.Text, float64(dc.Width())/2, float64(stampHeight)/2, color.White, color.Black)
+
+		var ok bool
+		if stamp, ok = dc.Image().(*image.RGBA); !ok {
+			return nil, image.Point{}, fmt.Errorf("unexpected watermark image type %T", dc.Image())
+		}
+	}
+
+	margin := int(0.03 * float64(min(width, height)))
+	size := stamp.Bounds().Size()
+	at := image.Pt(width-size.X-margin, height-size.Y-margin)
+	switch wm.Position {
+	case WatermarkTopLeft:
+		at = image.Pt(margin, margin)
+	case WatermarkTopRight:
+		at = image.Pt(width-size.X-margin, margin)
+	case WatermarkBottomLeft:
+		at = image.Pt(margin, height-size.Y-margin)
+	case WatermarkCenter:
+		at = image.Pt((width-size.X)/2, (height-size.Y)/2)
+	}
+	return stamp, at, nil
+}
+
+// stampPaletted blends a stamp into a paletted frame, snapping each blended
+// pixel to the nearest color already in the frame's palette. Transparent
+// pixels are left alone so earlier frames show through as before.
+func stampPaletted(frame *image.Paletted, stamp *image.RGBA, at image.Point, opacity float64) {
+	area := stamp.Bounds().Add(at).Intersect(frame.Bounds())
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			s := stamp.RGBAAt(x-at.X, y-at.Y)
+			if s.A == 0 {
+				continue
+			}
+			_, _, _, fa := frame.At(x, y).RGBA()
+			if fa == 0 {
+				continue
+			}
+			fr, fg, fb, _ := frame.At(x, y).RGBA()
+
+			// Stamp colors are premultiplied, so blending is a weighted sum
+			a := float64(s.A) / 255 * opacity
+			blend := func(sc uint8, fc uint32) uint8 {
+				return uint8(math.Round(float64(sc)*opacity + float64(fc>>8)*(1-a)))
+			}
+			frame.SetColorIndex(x, y, uint8(frame.Palette.Index(color.RGBA{
+				R: blend(s.R, fr), G: blend(s.G, fg), B: blend(s.B, fb), A: 255,
+			})))
+		}
+	}
+}
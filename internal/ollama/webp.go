@@ -0,0 +1,589 @@
+package ollama
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+// VP8L (lossless WebP) bitstream constants, see
+// https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+const (
+	vp8lSignature          = 0x2f
+	vp8lTransformPredictor = 0
+	vp8lTransformSubGreen  = 2
+	vp8lPredictorBits      = 5 // predictor modes are chosen per 32x32 tile
+	vp8lMaxCodeLength      = 15
+	vp8lMaxCopyLength      = 4096
+	vp8lMinCopyLength      = 3
+	vp8lNumLiteralCodes    = 256
+	vp8lNumLengthCodes     = 24
+	vp8lNumDistanceCodes   = 40
+	vp8lDistanceAbove      = 1 // plane code for the pixel one row up
+	vp8lDistanceLeft       = 2 // plane code for the previous pixel
+)
+
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// vp8lPredictorModes are the predictors tried for each tile: left, top,
+// average of left and top, and the gradient predictor
+var vp8lPredictorModes = []int{1, 2, 7, 12}
+
+// encodeWebP writes img as a lossless WebP (VP8L). When quantBits > 0 the low
+// bits of each color channel are rounded away first, trading fidelity for
+// size in the same way as libwebp's near-lossless mode.
+func encodeWebP(w io.Writer, img image.Image, quantBits uint) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 || width > 1<<14 || height > 1<<14 {
+		return fmt.Errorf("webp: unsupported image size %dx%d", width, height)
+	}
+
+	argb, hasAlpha := toARGB(img, quantBits)
+
+	bw := &bitWriter{}
+	bw.writeBits(vp8lSignature, 8)
+	bw.writeBits(uint32(width-1), 14)
+	bw.writeBits(uint32(height-1), 14)
+	if hasAlpha {
+		bw.writeBits(1, 1)
+	} else {
+		bw.writeBits(0, 1)
+	}
+	bw.writeBits(0, 3) // version
+	writeVP8LImage(bw, argb, width, height)
+
+	return writeWebPFile(w, webpChunk{"VP8L", bw.bytes()})
+}
+
+// writeVP8LImage writes the transforms and entropy-coded pixels of a VP8L
+// image, which is everything after its header. argb is modified in place.
+func writeVP8LImage(bw *bitWriter, argb []uint32, width, height int) {
+	// Transforms are listed in the order they are applied; the decoder
+	// undoes them in reverse
+	bw.writeBits(1, 1)
+	bw.writeBits(vp8lTransformSubGreen, 2)
+	subtractGreen(argb)
+
+	bw.writeBits(1, 1)
+	bw.writeBits(vp8lTransformPredictor, 2)
+	bw.writeBits(vp8lPredictorBits-2, 3)
+	residuals, modes, tilesW := predict(argb, width, height)
+	writeEntropyImage(bw, modes, tilesW, false)
+
+	bw.writeBits(0, 1) // no more transforms
+	writeEntropyImage(bw, residuals, width, true)
+}
+
+// webpChunk is one chunk of a WebP file's RIFF container
+type webpChunk struct {
+	fourCC string
+	data   []byte
+}
+
+// writeWebPFile writes chunks in a RIFF container, padding each to an even
+// length
+func writeWebPFile(w io.Writer, chunks ...webpChunk) error {
+	size := 4
+	for _, c := range chunks {
+		size += 8 + len(c.data) + len(c.data)&1
+	}
+	header := make([]byte, 12)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(size))
+	copy(header[8:12], "WEBP")
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	for _, c := range chunks {
+		chunkHeader := make([]byte, 8)
+		copy(chunkHeader[0:4], c.fourCC)
+		binary.LittleEndian.PutUint32(chunkHeader[4:8], uint32(len(c.data)))
+		if _, err := w.Write(chunkHeader); err != nil {
+			return err
+		}
+		if _, err := w.Write(c.data); err != nil {
+			return err
+		}
+		if len(c.data)&1 == 1 {
+			if _, err := w.Write([]byte{0}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// toARGB converts an image to non-premultiplied ARGB pixels, optionally
+// rounding away the low quantBits of each color channel. Alpha is kept exact.
+func toARGB(img image.Image, quantBits uint) ([]uint32, bool) {
+	bounds := img.Bounds()
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok {
+		nrgba = image.NewNRGBA(bounds)
+		draw.Draw(nrgba, bounds, img, bounds.Min, draw.Src)
+	}
+
+	quantize := func(v uint8) uint32 {
+		if quantBits == 0 {
+			return uint32(v)
+		}
+		q := (uint32(v) + 1<<(quantBits-1)) >> quantBits << quantBits
+		if q > 255 {
+			q = 255
+		}
+		return q
+	}
+
+	width, height := bounds.Dx(), bounds.Dy()
+	argb := make([]uint32, width*height)
+	hasAlpha := false
+	for y := 0; y < height; y++ {
+		row := nrgba.Pix[(y+bounds.Min.Y-nrgba.Rect.Min.Y)*nrgba.Stride:]
+		for x := 0; x < width; x++ {
+			p := row[(x+bounds.Min.X-nrgba.Rect.Min.X)*4:]
+			if p[3] != 0xff {
+				hasAlpha = true
+			}
+			argb[y*width+x] = uint32(p[3])<<24 | quantize(p[0])<<16 | quantize(p[1])<<8 | quantize(p[2])
+		}
+	}
+	return argb, hasAlpha
+}
+
+// subtractGreen removes the green channel from red and blue in place
+func subtractGreen(argb []uint32) {
+	for i, p := range argb {
+		g := (p >> 8) & 0xff
+		r := ((p >> 16) - g) & 0xff
+		b := (p - g) & 0xff
+		argb[i] = p&0xff00ff00 | r<<16 | b
+	}
+}
+
+// predict picks a predictor mode for each tile and returns the residual
+// image plus the sub-image of chosen modes (stored in the green channel)
+func predict(argb []uint32, width, height int) (residuals, modes []uint32, tilesW int) {
+	tileSize := 1 << vp8lPredictorBits
+	tilesW = (width + tileSize - 1) >> vp8lPredictorBits
+	tilesH := (height + tileSize - 1) >> vp8lPredictorBits
+	modes = make([]uint32, tilesW*tilesH)
+
+	for ty := 0; ty < tilesH; ty++ {
+		for tx := 0; tx < tilesW; tx++ {
+			bestMode, bestCost := vp8lPredictorModes[0], -1
+			for _, mode := range vp8lPredictorModes {
+				cost := 0
+				for y := ty * tileSize; y < min((ty+1)*tileSize, height); y++ {
+					for x := tx * tileSize; x < min((tx+1)*tileSize, width); x++ {
+						cost += residualCost(argb[y*width+x], predictPixel(argb, width, x, y, mode))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					bestMode, bestCost = mode, cost
+				}
+			}
+			modes[ty*tilesW+tx] = 0xff000000 | uint32(bestMode)<<8
+		}
+	}
+
+	residuals = make([]uint32, len(argb))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			mode := int(modes[(y>>vp8lPredictorBits)*tilesW+(x>>vp8lPredictorBits)] >> 8 & 0xf)
+			residuals[y*width+x] = subPixels(argb[y*width+x], predictPixel(argb, width, x, y, mode))
+		}
+	}
+	return residuals, modes, tilesW
+}
+
+// predictPixel applies a predictor mode, including the fixed rules the
+// format uses for the first row and column
+func predictPixel(argb []uint32, width, x, y, mode int) uint32 {
+	switch {
+	case x == 0 && y == 0:
+		return 0xff000000
+	case y == 0:
+		return argb[x-1]
+	case x == 0:
+		return argb[(y-1)*width]
+	}
+
+	left := argb[y*width+x-1]
+	top := argb[(y-1)*width+x]
+	topLeft := argb[(y-1)*width+x-1]
+
+	switch mode {
+	case 1:
+		return left
+	case 2:
+		return top
+	case 7:
+		return mapChannels(func(l, t, _ uint32) uint32 { return (l + t) / 2 }, left, top, 0)
+	default: // 12
+		return mapChannels(func(l, t, tl uint32) uint32 {
+			v := int(l) + int(t) - int(tl)
+			return uint32(max(0, min(255, v)))
+		}, left, top, topLeft)
+	}
+}
+
+// mapChannels applies fn to each 8-bit channel of three ARGB pixels
+func mapChannels(fn func(a, b, c uint32) uint32, a, b, c uint32) uint32 {
+	var out uint32
+	for shift := 0; shift < 32; shift += 8 {
+		out |= (fn(a>>shift&0xff, b>>shift&0xff, c>>shift&0xff) & 0xff) << shift
+	}
+	return out
+}
+
+// subPixels subtracts each channel of b from a modulo 256
+func subPixels(a, b uint32) uint32 {
+	return mapChannels(func(x, y, _ uint32) uint32 { return x - y }, a, b, 0)
+}
+
+// residualCost approximates how expensive a residual is to entropy code
+func residualCost(pixel, prediction uint32) int {
+	diff := subPixels(pixel, prediction)
+	cost := 0
+	for shift := 0; shift < 32; shift += 8 {
+		v := int(int8(diff >> shift))
+		if v < 0 {
+			v = -v
+		}
+		cost += v
+	}
+	return cost
+}
+
+// vp8lToken is either a literal pixel or a backward reference
+type vp8lToken struct {
+	argb     uint32
+	length   int // zero for literals
+	distance int // plane code of the reference
+}
+
+// tokenize finds runs that repeat the previous pixel or the row above. Long
+// runs are common in flat regions, transparent padding and zero residuals.
+func tokenize(pix []uint32, width int) []vp8lToken {
+	var tokens []vp8lToken
+	for i := 0; i < len(pix); {
+		leftRun, aboveRun := 0, 0
+		if i > 0 {
+			for i+leftRun < len(pix) && leftRun < vp8lMaxCopyLength && pix[i+leftRun] == pix[i+leftRun-1] {
+				leftRun++
+			}
+		}
+		if i >= width {
+			for i+aboveRun < len(pix) && aboveRun < vp8lMaxCopyLength && pix[i+aboveRun] == pix[i+aboveRun-width] {
+				aboveRun++
+			}
+		}
+
+		switch {
+		case aboveRun >= vp8lMinCopyLength && aboveRun >= leftRun:
+			tokens = append(tokens, vp8lToken{length: aboveRun, distance: vp8lDistanceAbove})
+			i += aboveRun
+		case leftRun >= vp8lMinCopyLength:
+			tokens = append(tokens, vp8lToken{length: leftRun, distance: vp8lDistanceLeft})
+			i += leftRun
+		default:
+			tokens = append(tokens, vp8lToken{argb: pix[i]})
+			i++
+		}
+	}
+	return tokens
+}
+
+// prefixEncode splits a length or distance into a prefix symbol and extra bits
+func prefixEncode(value int) (symbol int, extraBits uint, extra uint32) {
+	d := uint32(value - 1)
+	if d < 4 {
+		return int(d), 0, 0
+	}
+	highBit := uint(bits.Len32(d) - 1)
+	second := (d >> (highBit - 1)) & 1
+	extraBits = highBit - 1
+	return int(2*highBit + uint(second)), extraBits, d & (1<<extraBits - 1)
+}
+
+// writeEntropyImage writes an image using one group of five prefix codes
+func writeEntropyImage(bw *bitWriter, pix []uint32, width int, topLevel bool) {
+	bw.writeBits(0, 1) // no color cache
+	if topLevel {
+		bw.writeBits(0, 1) // no meta prefix codes
+	}
+
+	tokens := tokenize(pix, width)
+
+	histograms := [5][]uint32{
+		make([]uint32, vp8lNumLiteralCodes+vp8lNumLengthCodes),
+		make([]uint32, 256),
+		make([]uint32, 256),
+		make([]uint32, 256),
+		make([]uint32, vp8lNumDistanceCodes),
+	}
+	for _, t := range tokens {
+		if t.length == 0 {
+			histograms[0][t.argb>>8&0xff]++
+			histograms[1][t.argb>>16&0xff]++
+			histograms[2][t.argb&0xff]++
+			histograms[3][t.argb>>24]++
+			continue
+		}
+		lengthSymbol, _, _ := prefixEncode(t.length)
+		distanceSymbol, _, _ := prefixEncode(t.distance)
+		histograms[0][vp8lNumLiteralCodes+lengthSymbol]++
+		histograms[4][distanceSymbol]++
+	}
+
+	var codes [5]prefixCode
+	for i, hist := range histograms {
+		codes[i] = newPrefixCode(hist, vp8lMaxCodeLength)
+		codes[i].write(bw)
+	}
+
+	for _, t := range tokens {
+		if t.length == 0 {
+			codes[0].writeSymbol(bw, int(t.argb>>8&0xff))
+			codes[1].writeSymbol(bw, int(t.argb>>16&0xff))
+			codes[2].writeSymbol(bw, int(t.argb&0xff))
+			codes[3].writeSymbol(bw, int(t.argb>>24))
+			continue
+		}
+		symbol, n, extra := prefixEncode(t.length)
+		codes[0].writeSymbol(bw, vp8lNumLiteralCodes+symbol)
+		bw.writeBits(extra, n)
+		symbol, n, extra = prefixEncode(t.distance)
+		codes[4].writeSymbol(bw, symbol)
+		bw.writeBits(extra, n)
+	}
+}
+
+// prefixCode is a canonical Huffman code
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint32
+	used    int
+}
+
+func newPrefixCode(hist []uint32, maxLength int) prefixCode {
+	lengths := huffmanCodeLengths(hist, maxLength)
+	used := 0
+	for _, l := range lengths {
+		if l > 0 {
+			used++
+		}
+	}
+	return prefixCode{lengths: lengths, codes: canonicalCodes(lengths), used: used}
+}
+
+// writeSymbol writes a symbol's code. Codes are stored most significant bit
+// first in an LSB-first stream, so the bits are reversed. A code with a
+// single symbol takes no bits at all.
+func (p prefixCode) writeSymbol(bw *bitWriter, symbol int) {
+	if p.used <= 1 {
+		return
+	}
+	n := uint(p.lengths[symbol])
+	bw.writeBits(bits.Reverse32(p.codes[symbol])>>(32-n), n)
+}
+
+// write stores the code lengths, themselves compressed with a code-length code
+func (p prefixCode) write(bw *bitWriter) {
+	if p.used == 0 {
+		// Simple code with the single symbol 0
+		bw.writeBits(1, 1)
+		bw.writeBits(0, 1)
+		bw.writeBits(0, 1)
+		bw.writeBits(0, 1)
+		return
+	}
+
+	type clToken struct {
+		symbol    int
+		extra     uint32
+		extraBits uint
+	}
+	var tokens []clToken
+	prev := uint8(8)
+	for i := 0; i < len(p.lengths); {
+		v := p.lengths[i]
+		run := 1
+		for i+run < len(p.lengths) && p.lengths[i+run] == v {
+			run++
+		}
+		i += run
+
+		if v == 0 {
+			for run >= 3 {
+				if run >= 11 {
+					n := min(run, 138)
+					tokens = append(tokens, clToken{18, uint32(n - 11), 7})
+					run -= n
+				} else {
+					n := min(run, 10)
+					tokens = append(tokens, clToken{17, uint32(n - 3), 3})
+					run -= n
+				}
+			}
+		} else {
+			if v != prev {
+				tokens = append(tokens, clToken{symbol: int(v)})
+				prev = v
+				run--
+			}
+			for run >= 3 {
+				n := min(run, 6)
+				tokens = append(tokens, clToken{16, uint32(n - 3), 2})
+				run -= n
+			}
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, clToken{symbol: int(v)})
+		}
+	}
+
+	hist := make([]uint32, len(vp8lCodeLengthOrder))
+	for _, t := range tokens {
+		hist[t.symbol]++
+	}
+	clCode := newPrefixCode(hist, 7)
+
+	count := len(vp8lCodeLengthOrder)
+	for count > 4 && clCode.lengths[vp8lCodeLengthOrder[count-1]] == 0 {
+		count--
+	}
+
+	bw.writeBits(0, 1) // normal code
+	bw.writeBits(uint32(count-4), 4)
+	for _, symbol := range vp8lCodeLengthOrder[:count] {
+		bw.writeBits(uint32(clCode.lengths[symbol]), 3)
+	}
+	bw.writeBits(0, 1) // code lengths cover the whole alphabet
+
+	for _, t := range tokens {
+		clCode.writeSymbol(bw, t.symbol)
+		bw.writeBits(t.extra, t.extraBits)
+	}
+}
+
+// huffmanCodeLengths builds Huffman code lengths no longer than maxLength.
+// If the tree is too deep, rare symbols are given larger counts and the tree
+// is rebuilt until it fits.
+func huffmanCodeLengths(hist []uint32, maxLength int) []uint8 {
+	type node struct {
+		count       uint64
+		symbol      int
+		left, right int
+	}
+
+	lengths := make([]uint8, len(hist))
+	for minCount := uint64(1); ; minCount *= 2 {
+		var nodes []node
+		var queue []int
+		for symbol, count := range hist {
+			if count > 0 {
+				nodes = append(nodes, node{max(uint64(count), minCount), symbol, -1, -1})
+				queue = append(queue, len(nodes)-1)
+			}
+		}
+
+		switch len(queue) {
+		case 0:
+			return lengths
+		case 1:
+			lengths[nodes[0].symbol] = 1
+			return lengths
+		}
+
+		for len(queue) > 1 {
+			sort.SliceStable(queue, func(i, j int) bool {
+				return nodes[queue[i]].count < nodes[queue[j]].count
+			})
+			a, b := queue[0], queue[1]
+			nodes = append(nodes, node{nodes[a].count + nodes[b].count, -1, a, b})
+			queue = append(queue[2:], len(nodes)-1)
+		}
+
+		tooDeep := false
+		var walk func(i, depth int)
+		walk = func(i, depth int) {
+			if nodes[i].symbol >= 0 {
+				if depth > maxLength {
+					tooDeep = true
+				}
+				lengths[nodes[i].symbol] = uint8(min(depth, 255))
+				return
+			}
+			walk(nodes[i].left, depth+1)
+			walk(nodes[i].right, depth+1)
+		}
+		walk(queue[0], 0)
+
+		if !tooDeep {
+			return lengths
+		}
+		clear(lengths)
+	}
+}
+
+// canonicalCodes assigns canonical Huffman codes from code lengths
+func canonicalCodes(lengths []uint8) []uint32 {
+	var counts [256]uint32
+	for _, l := range lengths {
+		counts[l]++
+	}
+	counts[0] = 0
+
+	var next [256]uint32
+	code := uint32(0)
+	for l := 1; l < len(next); l++ {
+		code = (code + counts[l-1]) << 1
+		next[l] = code
+	}
+
+	codes := make([]uint32, len(lengths))
+	for symbol, l := range lengths {
+		if l > 0 {
+			codes[symbol] = next[l]
+			next[l]++
+		}
+	}
+	return codes
+}
+
+// bitWriter packs values least significant bit first, as VP8L requires
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (b *bitWriter) writeBits(v uint32, n uint) {
+	b.acc |= uint64(v&(1<<n-1)) << b.nbits
+	b.nbits += n
+	for b.nbits >= 8 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc >>= 8
+		b.nbits -= 8
+	}
+}
+
+func (b *bitWriter) bytes() []byte {
+	if b.nbits > 0 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc, b.nbits = 0, 0
+	}
+	return b.buf
+}
+
+// webpQuantBits maps a 0-100 quality to the number of low bits dropped per channel
+func webpQuantBits(quality int) uint {
+	return uint(min(4, max(0, (100-quality)/20)))
+}
@@ -0,0 +1,215 @@
+package ollama
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func TestEncodeWebPRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	noise := func(w, h int, alpha bool) image.Image {
+		img := image.NewNRGBA(image.Rect(0, 0, w, h))
+		for i := range img.Pix {
+			img.Pix[i] = uint8(rng.Intn(256))
+			if !alpha && i%4 == 3 {
+				img.Pix[i] = 0xff
+			}
+		}
+		return img
+	}
+	gradient := func(w, h int) image.Image {
+		img := image.NewNRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				img.SetNRGBA(x, y, color.NRGBA{uint8(x * 255 / w), uint8(y * 255 / h), 128, 255})
+			}
+		}
+		return img
+	}
+
+	tests := []struct {
+		name string
+		img  image.Image
+	}{
+		{"1x1", noise(1, 1, false)},
+		{"odd size", gradient(37, 19)},
+		{"tall", gradient(3, 101)},
+		{"alpha", noise(17, 17, true)},
+		{"noise", noise(64, 48, false)},
+		{"offset bounds", noise(40, 30, false).(*image.NRGBA).SubImage(image.Rect(5, 3, 28, 22))},
+	}
+
+	for _, tt := range tests {
+		for _, quality := range []int{100, 70, 1} {
+			var buf bytes.Buffer
+			if err := encodeWebP(&buf, tt.img, webpQuantBits(quality)); err != nil {
+				t.Fatalf("%s quality %d: encode: %v", tt.name, quality, err)
+			}
+			got, err := webp.Decode(&buf)
+			if err != nil {
+				t.Fatalf("%s quality %d: decode: %v", tt.name, quality, err)
+			}
+
+			bounds := tt.img.Bounds()
+			if got.Bounds().Dx() != bounds.Dx() || got.Bounds().Dy() != bounds.Dy() {
+				t.Fatalf("%s quality %d: decoded size %v, want %v", tt.name, quality, got.Bounds().Size(), bounds.Size())
+			}
+
+			// Dropping n low bits moves a channel by at most 2^(n-1) when rounding
+			tolerance := 0
+			if bits := webpQuantBits(quality); bits > 0 {
+				tolerance = 1 << (bits - 1)
+			}
+			for y := 0; y < bounds.Dy(); y++ {
+				for x := 0; x < bounds.Dx(); x++ {
+					want := color.NRGBAModel.Convert(tt.img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+					have := color.NRGBAModel.Convert(got.At(got.Bounds().Min.X+x, got.Bounds().Min.Y+y)).(color.NRGBA)
+					if !closeNRGBA(want, have, tolerance) {
+						t.Fatalf("%s quality %d: pixel (%d,%d) = %v, want %v (±%d)", tt.name, quality, x, y, have, want, tolerance)
+					}
+				}
+			}
+		}
+	}
+}
+
+func closeNRGBA(a, b color.NRGBA, tolerance int) bool {
+	diff := func(x, y uint8) bool {
+		d := int(x) - int(y)
+		return d <= tolerance && -d <= tolerance
+	}
+	// Fully transparent pixels may keep any color
+	if a.A == 0 && b.A == 0 {
+		return true
+	}
+	return diff(a.R, b.R) && diff(a.G, b.G) && diff(a.B, b.B) && diff(a.A, b.A)
+}
+
+func TestEncodeWebPLossyRoundTrip(t *testing.T) {
+	// A smooth background with hard edged white blocks, like a caption over
+	// a photo. Color changes slowly, since VP8 keeps chroma at half
+	// resolution.
+	scene := func(w, h int, alpha bool) *image.NRGBA {
+		img := image.NewNRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				c := color.NRGBA{uint8(64 + x*128/max(w, 64)), uint8(64 + y*128/max(h, 64)), 160, 255}
+				if (x/12+y/9)%5 == 0 {
+					c = color.NRGBA{250, 250, 250, 255}
+				}
+				if alpha {
+					c.A = uint8(x * 255 / max(1, w-1))
+				}
+				img.SetNRGBA(x, y, c)
+			}
+		}
+		return img
+	}
+
+	tests := []struct {
+		name string
+		img  image.Image
+	}{
+		{"1x1", scene(1, 1, false)},
+		{"odd size", scene(37, 19, false)},
+		{"tall", scene(3, 101, false)},
+		{"alpha", scene(33, 17, true)},
+		{"scene", scene(160, 120, false)},
+		{"offset bounds", scene(60, 50, false).SubImage(image.Rect(5, 3, 48, 41))},
+	}
+
+	for _, tt := range tests {
+		for _, q := range []struct {
+			quality int
+			minPSNR float64
+		}{{95, 33}, {75, 30}, {10, 24}} {
+			var buf bytes.Buffer
+			if err := encodeWebPLossy(&buf, tt.img, q.quality); err != nil {
+				t.Fatalf("%s quality %d: encode: %v", tt.name, q.quality, err)
+			}
+			got, err := webp.Decode(&buf)
+			if err != nil {
+				t.Fatalf("%s quality %d: decode: %v", tt.name, q.quality, err)
+			}
+
+			bounds := tt.img.Bounds()
+			if got.Bounds().Dx() != bounds.Dx() || got.Bounds().Dy() != bounds.Dy() {
+				t.Fatalf("%s quality %d: decoded size %v, want %v", tt.name, q.quality, got.Bounds().Size(), bounds.Size())
+			}
+
+			var sse float64
+			for y := 0; y < bounds.Dy(); y++ {
+				for x := 0; x < bounds.Dx(); x++ {
+					want := color.NRGBAModel.Convert(tt.img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+					have, alpha := decodedVP8Pixel(got, x, y)
+					// Alpha is compressed losslessly
+					if alpha != want.A {
+						t.Fatalf("%s quality %d: pixel (%d,%d) alpha %d, want %d", tt.name, q.quality, x, y, alpha, want.A)
+					}
+					for i, v := range []uint8{want.R, want.G, want.B} {
+						d := float64(int(v) - int(have[i]))
+						sse += d * d
+					}
+				}
+			}
+			mse := sse / float64(3*bounds.Dx()*bounds.Dy())
+			if psnr := 10 * math.Log10(255*255/max(mse, 1e-9)); psnr < q.minPSNR {
+				t.Errorf("%s quality %d: PSNR %.1f dB, want at least %.0f", tt.name, q.quality, psnr, q.minPSNR)
+			}
+		}
+	}
+}
+
+func TestEncodeWebPLossySize(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 192))
+	for y := 0; y < 192; y++ {
+		for x := 0; x < 256; x++ {
+			v := 128 + 100*math.Sin(float64(x)/9)*math.Cos(float64(y)/13)
+			img.SetNRGBA(x, y, color.NRGBA{uint8(v), uint8(x), uint8(255 - v), 255})
+		}
+	}
+
+	size := func(encode func(*bytes.Buffer) error) int {
+		var buf bytes.Buffer
+		if err := encode(&buf); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		return buf.Len()
+	}
+	lossless := size(func(b *bytes.Buffer) error { return encodeWebP(b, img, 0) })
+	high := size(func(b *bytes.Buffer) error { return encodeWebPLossy(b, img, 90) })
+	low := size(func(b *bytes.Buffer) error { return encodeWebPLossy(b, img, 30) })
+	if !(low < high && high < lossless) {
+		t.Errorf("sizes: quality 30 %d bytes, quality 90 %d, lossless %d; want each smaller than the next", low, high, lossless)
+	}
+}
+
+// decodedVP8Pixel returns a decoded lossy WebP pixel as RGB and alpha. VP8
+// uses BT.601 studio range YCbCr, not the full range image.YCbCr converts
+// with.
+func decodedVP8Pixel(img image.Image, x, y int) ([3]uint8, uint8) {
+	alpha := uint8(0xff)
+	ycbcr, ok := img.(*image.YCbCr)
+	if nycbcra, isAlpha := img.(*image.NYCbCrA); isAlpha {
+		ycbcr, ok = &nycbcra.YCbCr, true
+		alpha = nycbcra.A[nycbcra.AOffset(x, y)]
+	}
+	if !ok {
+		panic("not a VP8 image")
+	}
+	yy := float64(ycbcr.Y[ycbcr.YOffset(x, y)]) - 16
+	cb := float64(ycbcr.Cb[ycbcr.COffset(x, y)]) - 128
+	cr := float64(ycbcr.Cr[ycbcr.COffset(x, y)]) - 128
+	clamp := func(v float64) uint8 { return uint8(max(0, min(255, math.Round(v)))) }
+	return [3]uint8{
+		clamp(1.164*yy + 1.596*cr),
+		clamp(1.164*yy - 0.392*cb - 0.813*cr),
+		clamp(1.164*yy + 2.017*cb),
+	}, alpha
+}
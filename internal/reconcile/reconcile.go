@@ -0,0 +1,298 @@
+// Package reconcile compares the image directory, and the working
+// directory `ollama run` saves images to, with the database: images no
+// generation refers to, generations whose image is missing, and
+// generations with the same image. Orphan images can be imported as
+// generations.
+package reconcile
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"meme-generator/internal/db"
+	"meme-generator/internal/ollama"
+	"meme-generator/internal/storage"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// imageExtensions are the orphan files considered images
+var imageExtensions = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true}
+
+// settleTime is how old an image in the working directory must be to count
+// as an orphan, as a generation in progress moves its image out of there
+// once `ollama run` finishes
+const settleTime = time.Minute
+
+// workDirPrefix marks the keys of orphans in the working directory
+const workDirPrefix = "./"
+
+// Orphan is an image file no generation refers to
+type Orphan struct {
+	Name       string // filename
+	InWorkDir  bool   // in the working directory rather than the image directory
+	Size       int64
+	Hash       string
+	Prompt     string    // recovered from an ollama filename, or made from the filename
+	Created    time.Time // from an ollama filename, or the file's modification time
+	FromOllama bool      // the filename is in the `ollama run` format
+	// DuplicateOf is a generation with the same image or base image, and
+	// SameAs the key of an orphan listed earlier with the same content
+	DuplicateOf int64
+	SameAs      string
+}
+
+// Key identifies an orphan in forms and on the command line: its
+// filename, prefixed with ./ if it is in the working directory
+func (o Orphan) Key() string {
+	if o.InWorkDir {
+		return workDirPrefix + o.Name
+	}
+	return o.Name
+}
+
+// Importable reports whether importing the orphan would add an image that
+// is not already a generation
+func (o Orphan) Importable() bool {
+	return o.DuplicateOf == 0 && o.SameAs == ""
+}
+
+// Duplicate is a set of generations with the same image
+type Duplicate struct {
+	Hash        string
+	Generations []db.Generation
+}
+
+// Report is what a scan found
+type Report struct {
+	Orphans    []Orphan        // image directory first, then the working directory
+	Missing    []db.Generation // generations whose image file is gone
+	Duplicates []Duplicate
+}
+
+// Orphan returns the orphan with the given key
+func (r *Report) Orphan(key string) (Orphan, bool) {
+	for _, o := range r.Orphans {
+		if o.Key() == key {
+			return o, true
+		}
+	}
+	return Orphan{}, false
+}
+
+// Reconciler scans and imports files for one database
+type Reconciler struct {
+	db       *db.DB
+	ollama   *ollama.Client
+	store    storage.Storage
+	imageDir string
+	workDir  string
+}
+
+// New returns a Reconciler for the images in imageDir, where the database
+// expects them, and workDir, where `ollama run` leaves them. Images missing
+// from imageDir but kept in store are not missing, only not fetched yet.
+func New(database *db.DB, ollamaClient *ollama.Client, store storage.Storage, imageDir, workDir string) *Reconciler {
+	return &Reconciler{
+		db:       database,
+		ollama:   ollamaClient,
+		store:    store,
+		imageDir: imageDir,
+		workDir:  workDir,
+	}
+}
+
+// Scan compares the files on disk with the database. Subdirectories of the
+// image directory hold caches and assets that are managed elsewhere, so
+// only its top level is scanned.
+func (r *Reconciler) Scan() (*Report, error) {
+	report := &Report{}
+
+	// Step 1: Check every generation's image, grouping them by content, and
+	// note the content of their bases
+	gens, err := r.db.ListImageGenerations()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list generations: %w", err)
+	}
+	byHash := make(map[string][]db.Generation)
+	baseHashes := make(map[string]int64)
+	var hashes []string
+	for _, gen := range gens {
+		path := filepath.Join(r.imageDir, gen.ImagePath)
+		local := true
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			_, err := r.store.Stat(filepath.ToSlash(gen.ImagePath))
+			if errors.Is(err, fs.ErrNotExist) {
+				report.Missing = append(report.Missing, gen)
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to check storage for %s: %w", gen.ImagePath, err)
+			}
+			local = false
+		}
+		hash := gen.ImageHash
+		if hash == "" {
+			if !local {
+				continue
+			}
+			if hash, err = ollama.FileHash(path); err != nil {
+				return nil, fmt.Errorf("failed to hash %s: %w", gen.ImagePath, err)
+			}
+		}
+		if len(byHash[hash]) == 0 {
+			hashes = append(hashes, hash)
+		}
+		byHash[hash] = append(byHash[hash], gen)
+
+		// A copy of the uncaptioned base is no new image either
+		if gen.BasePath != "" && gen.BasePath != gen.ImagePath {
+			if hash, err := ollama.FileHash(filepath.Join(r.imageDir, gen.BasePath)); err == nil {
+				if _, ok := baseHashes[hash]; !ok {
+					baseHashes[hash] = gen.ID
+				}
+			}
+		}
+	}
+	for _, hash := range hashes {
+		if len(byHash[hash]) > 1 {
+			report.Duplicates = append(report.Duplicates, Duplicate{Hash: hash, Generations: byHash[hash]})
+		}
+	}
+
+	// Step 2: Find the images nothing refers to
+	referenced, err := r.db.ListReferencedFiles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list referenced files: %w", err)
+	}
+	orphans, err := r.scanDir(r.imageDir, false, referenced)
+	if err != nil {
+		return nil, err
+	}
+	if r.workDir != "" && !sameDir(r.workDir, r.imageDir) {
+		found, err := r.scanDir(r.workDir, true, nil)
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, found...)
+	}
+
+	// Step 3: Mark orphans that are copies of a generation or of each other
+	seen := make(map[string]string)
+	for i := range orphans {
+		o := &orphans[i]
+		if matches := byHash[o.Hash]; len(matches) > 0 {
+			o.DuplicateOf = matches[0].ID
+		} else if id, ok := baseHashes[o.Hash]; ok {
+			o.DuplicateOf = id
+		} else if key, ok := seen[o.Hash]; ok {
+			o.SameAs = key
+		} else {
+			seen[o.Hash] = o.Key()
+		}
+	}
+	report.Orphans = orphans
+
+	return report, nil
+}
+
+// scanDir lists the images at the top level of dir that are not in
+// referenced
+func (r *Reconciler) scanDir(dir string, inWorkDir bool, referenced map[string]bool) ([]Orphan, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+
+	var orphans []Orphan
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || referenced[name] {
+			continue
+		}
+		if !imageExtensions[strings.ToLower(filepath.Ext(name))] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		if inWorkDir && time.Since(info.ModTime()) < settleTime {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		hash, err := ollama.FileHash(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash %s: %w", path, err)
+		}
+
+		o := Orphan{Name: name, InWorkDir: inWorkDir, Size: info.Size(), Hash: hash}
+		if prompt, created, ok := ollama.ParseFilename(name); ok {
+			o.Prompt, o.Created, o.FromOllama = prompt, created, true
+		} else {
+			o.Prompt = promptFromFilename(name)
+			o.Created = info.ModTime()
+		}
+		orphans = append(orphans, o)
+	}
+	return orphans, nil
+}
+
+// Import records an orphan as a finished generation, with the recovered
+// prompt and creation time and the image as its base. Orphans in the
+// working directory are moved into the image directory first, renamed if
+// the name is taken. It returns the new generation's ID.
+func (r *Reconciler) Import(o Orphan) (int64, error) {
+	filename := o.Name
+	if o.InWorkDir {
+		if _, err := os.Stat(filepath.Join(r.imageDir, filename)); err == nil {
+			if filename, err = r.ollama.NewFilename(o.Prompt, filepath.Ext(o.Name)); err != nil {
+				return 0, err
+			}
+		}
+		if err := os.Rename(filepath.Join(r.workDir, o.Name), filepath.Join(r.imageDir, filename)); err != nil {
+			if filename != o.Name {
+				os.Remove(filepath.Join(r.imageDir, filename))
+			}
+			return 0, fmt.Errorf("failed to move %s: %w", o.Name, err)
+		}
+	}
+
+	source := db.SourceUpload
+	if o.FromOllama {
+		source = db.SourceModel
+	}
+	id, err := r.db.InsertImportedGeneration(o.Prompt, source, filename, o.Hash, o.Created)
+	if err != nil {
+		if o.InWorkDir {
+			if moveErr := os.Rename(filepath.Join(r.imageDir, filename), filepath.Join(r.workDir, o.Name)); moveErr != nil {
+				return 0, fmt.Errorf("failed to record %s (%v) and to move it back: %w", o.Name, err, moveErr)
+			}
+		}
+		return 0, fmt.Errorf("failed to record %s: %w", o.Name, err)
+	}
+	return id, nil
+}
+
+// promptFromFilename turns a filename that is not in the ollama format
+// into a prompt, e.g. "Cat_photo (2).jpg" gives "Cat photo 2"
+func promptFromFilename(name string) string {
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	words := strings.FieldsFunc(stem, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return "Imported image"
+	}
+	return strings.Join(words, " ")
+}
+
+// sameDir reports whether two paths are the same directory
+func sameDir(a, b string) bool {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
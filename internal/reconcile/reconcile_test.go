@@ -0,0 +1,242 @@
+package reconcile
+
+import (
+	"meme-generator/internal/db"
+	"meme-generator/internal/ollama"
+	"meme-generator/internal/storage"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testReconciler returns a Reconciler over empty image, working and
+// storage directories and a fresh database
+func testReconciler(t *testing.T) (r *Reconciler, database *db.DB, imageDir, workDir string) {
+	t.Helper()
+	dir := t.TempDir()
+	imageDir, workDir = filepath.Join(dir, "generated"), filepath.Join(dir, "work")
+	if err := os.MkdirAll(filepath.Join(imageDir, "cache"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.Mkdir(workDir, 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	store, err := storage.NewLocal(filepath.Join(dir, "bucket"))
+	if err != nil {
+		t.Fatalf("NewLocal: %v", err)
+	}
+	database, err = db.New(filepath.Join(dir, "memes.db"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return New(database, ollama.NewClient(imageDir, store), store, imageDir, workDir), database, imageDir, workDir
+}
+
+// writeFile writes content to dir/name, dated modified
+func writeFile(t *testing.T, dir, name, content string, modified time.Time) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	r, database, imageDir, workDir := testReconciler(t)
+	old := time.Now().Add(-time.Hour)
+
+	insert := func(prompt, image, base string) int64 {
+		t.Helper()
+		id, err := database.InsertGeneration(prompt, db.SourceModel, image, db.StatusSuccess, "")
+		if err != nil {
+			t.Fatalf("InsertGeneration: %v", err)
+		}
+		if base != "" {
+			if err := database.UpdateGenerationBase(id, base); err != nil {
+				t.Fatalf("UpdateGenerationBase: %v", err)
+			}
+		}
+		return id
+	}
+	cat := insert("cat", "cat-20260224-172500.png", "")
+	catCopy := insert("cat again", "cat-copy.png", "")
+	gone := insert("gone", "gone.png", "")
+	insert("kept in storage", "remote.png", "")
+	dog := insert("dog", "dog-meme.png", "dog.png")
+	trashed := insert("trashed", "trashed.png", "")
+	if _, err := database.TrashGenerations([]int64{trashed}); err != nil {
+		t.Fatalf("TrashGenerations: %v", err)
+	}
+	writeFile(t, filepath.Join(filepath.Dir(imageDir), "bucket"), "remote.png", "remote", old)
+
+	for name, content := range map[string]string{
+		"cat-20260224-172500.png": "cat",
+		"cat-copy.png":            "cat",
+		"dog-meme.png":            "dog meme",
+		"dog.png":                 "dog",
+		// Orphans: copies of a generation and of a base, and a new image
+		"Cat_photo (2).jpg":          "cat",
+		"dog base copy.jpg":          "dog",
+		"sunset-20250101-080000.png": "sunset",
+		// Not images, hidden, or managed elsewhere
+		"notes.txt":       "notes",
+		".hidden.png":     "hidden",
+		"cache/thumb.png": "thumb",
+	} {
+		writeFile(t, imageDir, name, content, old)
+	}
+	writeFile(t, workDir, "sunset-20250101-080000.png", "sunset", old)
+	writeFile(t, workDir, "Beach day.webp", "beach", old)
+	// Still being written by a generation in progress
+	writeFile(t, workDir, "fresh-20250101-090000.png", "fresh", time.Now())
+
+	report, err := r.Scan()
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+
+	if len(report.Missing) != 1 || report.Missing[0].ID != gone {
+		t.Errorf("Missing = %+v, want only generation %d", report.Missing, gone)
+	}
+	if len(report.Duplicates) != 1 {
+		t.Fatalf("Duplicates = %+v, want one", report.Duplicates)
+	}
+	if d := report.Duplicates[0]; len(d.Generations) != 2 || d.Generations[0].ID != cat || d.Generations[1].ID != catCopy {
+		t.Errorf("Duplicates[0] = %+v, want generations %d and %d", d, cat, catCopy)
+	}
+
+	type orphan struct {
+		key         string
+		prompt      string
+		fromOllama  bool
+		duplicateOf int64
+		sameAs      string
+	}
+	var got []orphan
+	for _, o := range report.Orphans {
+		got = append(got, orphan{o.Key(), o.Prompt, o.FromOllama, o.DuplicateOf, o.SameAs})
+	}
+	want := []orphan{
+		{"Cat_photo (2).jpg", "Cat photo 2", false, cat, ""},
+		{"dog base copy.jpg", "dog base copy", false, dog, ""},
+		{"sunset-20250101-080000.png", "sunset", true, 0, ""},
+		{"./Beach day.webp", "Beach day", false, 0, ""},
+		{"./sunset-20250101-080000.png", "sunset", true, 0, "sunset-20250101-080000.png"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Orphans =\n%+v\nwant\n%+v", got, want)
+	}
+
+	o, ok := report.Orphan("sunset-20250101-080000.png")
+	if !ok || !o.Importable() || o.Size != int64(len("sunset")) {
+		t.Errorf("Orphan(sunset) = %+v, %v", o, ok)
+	}
+	if want := time.Date(2025, 1, 1, 8, 0, 0, 0, time.Local); !o.Created.Equal(want) {
+		t.Errorf("sunset created %v, want %v from its filename", o.Created, want)
+	}
+	if o, _ := report.Orphan("./Beach day.webp"); !o.InWorkDir || !o.Created.Equal(old) {
+		t.Errorf("beach created %v, want the file's modification time %v", o.Created, old)
+	}
+	if _, ok := report.Orphan("fresh-20250101-090000.png"); ok {
+		t.Error("an image still settling in the working directory is an orphan")
+	}
+}
+
+func TestImport(t *testing.T) {
+	r, database, imageDir, workDir := testReconciler(t)
+	old := time.Now().Add(-time.Hour)
+	writeFile(t, imageDir, "sunset-20250101-080000.png", "first sunset", old)
+	writeFile(t, workDir, "sunset-20250101-080000.png", "second sunset", old)
+	writeFile(t, workDir, "Beach day.webp", "beach", old)
+
+	report, err := r.Scan()
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	for _, tt := range []struct {
+		key, source string
+	}{
+		{"sunset-20250101-080000.png", db.SourceModel},
+		{"./sunset-20250101-080000.png", db.SourceModel},
+		{"./Beach day.webp", db.SourceUpload},
+	} {
+		o, ok := report.Orphan(tt.key)
+		if !ok {
+			t.Fatalf("no orphan %s", tt.key)
+		}
+		id, err := r.Import(o)
+		if err != nil {
+			t.Fatalf("Import(%s): %v", tt.key, err)
+		}
+		gen, err := database.GetGeneration(id)
+		if err != nil {
+			t.Fatalf("GetGeneration: %v", err)
+		}
+		if gen.Prompt != o.Prompt || gen.Source != tt.source || gen.Status != db.StatusSuccess ||
+			gen.BasePath != gen.ImagePath || gen.ImageHash != o.Hash || !gen.CreatedAt.Equal(o.Created.Truncate(time.Second)) {
+			t.Errorf("Import(%s) recorded %+v", tt.key, gen)
+		}
+		if hash, err := ollama.FileHash(filepath.Join(imageDir, gen.ImagePath)); err != nil || hash != o.Hash {
+			t.Errorf("Import(%s): %s holds another image: %v", tt.key, gen.ImagePath, err)
+		}
+		// The name in the image directory was taken, so the second sunset
+		// gets a new one
+		if tt.key == "./sunset-20250101-080000.png" && (gen.ImagePath == o.Name || !strings.HasPrefix(gen.ImagePath, "sunset-")) {
+			t.Errorf("Import(%s) saved as %s", tt.key, gen.ImagePath)
+		}
+	}
+	if entries, _ := os.ReadDir(workDir); len(entries) != 0 {
+		t.Errorf("working directory still holds %d files", len(entries))
+	}
+	if report, err := r.Scan(); err != nil || len(report.Orphans) != 0 {
+		t.Errorf("after importing, Scan = %+v, %v; want no orphans", report, err)
+	}
+
+	// An import the database rejects leaves the image where it was
+	writeFile(t, workDir, "Beach day.webp", "another beach", old)
+	report, err = r.Scan()
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	o, ok := report.Orphan("./Beach day.webp")
+	if !ok {
+		t.Fatal("no orphan ./Beach day.webp")
+	}
+	before, _ := os.ReadDir(imageDir)
+	database.Close()
+	if _, err := r.Import(o); err == nil {
+		t.Fatal("Import succeeded with the database closed")
+	}
+	if data, err := os.ReadFile(filepath.Join(workDir, o.Name)); err != nil || string(data) != "another beach" {
+		t.Errorf("image not moved back: %q, %v", data, err)
+	}
+	if after, _ := os.ReadDir(imageDir); len(after) != len(before) {
+		t.Errorf("image directory holds %d entries, want %d as before", len(after), len(before))
+	}
+}
+
+func TestPromptFromFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Cat_photo (2).jpg", "Cat photo 2"},
+		{"IMG-0042.PNG", "IMG 0042"},
+		{"  déjà--vu  .webp", "déjà vu"},
+		{"no-extension", "no extension"},
+		{"___.png", "Imported image"},
+		{".png", "Imported image"},
+	}
+	for _, tt := range tests {
+		if got := promptFromFilename(tt.name); got != tt.want {
+			t.Errorf("promptFromFilename(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Package spec holds the parts of a meme's render spec that are stored as
+// JSON with each generation: its effects pipeline, annotation layers and
+// comic script. The database stores them and the ollama package renders
+// them, so they live here rather than in either.
+package spec
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EffectStage is the point in rendering an effect is applied at
+type EffectStage string
+
+// Effect is one step of a generation's effects pipeline
+type Effect struct {
+	Name   string             `json:"name"`
+	Stage  EffectStage        `json:"stage"`
+	Params map[string]float64 `json:"params,omitempty"`
+}
+
+// LayerKind is a type of annotation layer
+type LayerKind string
+
+// Layer is an annotation drawn over a meme's captions. Positions are
+// fractions of the image size, so layers survive resizing. Later layers in
+// a list are drawn on top of earlier ones.
+type Layer struct {
+	Kind    LayerKind `json:"kind"`
+	X       float64   `json:"x"` // left edge of the bounds, or an arrow's start
+	Y       float64   `json:"y"` // top edge of the bounds, or an arrow's start
+	Width   float64   `json:"width,omitempty"`
+	Height  float64   `json:"height,omitempty"`
+	TailX   float64   `json:"tail_x,omitempty"` // where a bubble's tail or an arrow points
+	TailY   float64   `json:"tail_y,omitempty"`
+	Text    string    `json:"text,omitempty"`    // bubble text
+	Color   string    `json:"color,omitempty"`   // hex color of arrows, circles and highlights
+	Sticker string    `json:"sticker,omitempty"` // built-in sticker name or uploaded sticker path
+}
+
+// ComicScript is a panel-by-panel script for a comic strip, written by the
+// text model from a premise
+type ComicScript struct {
+	Title      string       `json:"title,omitempty"`
+	Style      string       `json:"style,omitempty"`      // art style shared by every panel
+	Characters string       `json:"characters,omitempty"` // what the cast looks like, repeated in every panel
+	Panels     []ComicPanel `json:"panels"`
+}
+
+// ComicPanel is one panel of a comic script
+type ComicPanel struct {
+	Scene    string      `json:"scene"`
+	Dialogue []ComicLine `json:"dialogue,omitempty"`
+}
+
+// ComicLine is a line of dialogue, shown in a speech bubble
+type ComicLine struct {
+	Speaker string `json:"speaker,omitempty"`
+	Text    string `json:"text"`
+}
+
+// PanelPrompt returns the image prompt for one panel. Every panel is drawn
+// with the strip's seed, and the script's style and character descriptions
+// are repeated in every prompt, so the panels look alike.
+func (s *ComicScript) PanelPrompt(i int) string {
+	var b strings.Builder
+	if s.Style != "" {
+		fmt.Fprintf(&b, "%s. ", strings.TrimRight(s.Style, "."))
+	}
+	if s.Characters != "" {
+		fmt.Fprintf(&b, "Characters: %s. ", strings.TrimRight(s.Characters, "."))
+	}
+	fmt.Fprintf(&b, "Comic panel %d of %d: %s. No text, letters or speech bubbles.", i+1, len(s.Panels), strings.TrimRight(s.Panels[i].Scene, "."))
+	return b.String()
+}
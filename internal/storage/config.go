@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// FromEnv returns the backend configured by environment variables, and a
+// description of it for the log:
+//
+//	STORAGE_BACKEND       local (the default) or s3
+//	STORAGE_DIR           directory for local storage (default: imageDir)
+//	S3_ENDPOINT           e.g. https://s3.eu-west-1.amazonaws.com
+//	S3_REGION             default us-east-1
+//	S3_BUCKET
+//	S3_ACCESS_KEY_ID
+//	S3_SECRET_ACCESS_KEY
+//	S3_PREFIX             prepended to every key, e.g. memes/
+//	S3_PATH_STYLE         true for MinIO and most other stand-ins
+//
+// Local storage in the image directory itself stores nothing twice.
+func FromEnv(imageDir string) (Storage, string, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "local":
+		dir := os.Getenv("STORAGE_DIR")
+		if dir == "" {
+			dir = imageDir
+		}
+		local, err := NewLocal(dir)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create storage directory: %w", err)
+		}
+		return local, fmt.Sprintf("local directory %s", dir), nil
+
+	case "s3":
+		pathStyle := false
+		if value := os.Getenv("S3_PATH_STYLE"); value != "" {
+			var err error
+			if pathStyle, err = strconv.ParseBool(value); err != nil {
+				return nil, "", fmt.Errorf("S3_PATH_STYLE must be true or false")
+			}
+		}
+		cfg := S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			Prefix:    os.Getenv("S3_PREFIX"),
+			PathStyle: pathStyle,
+		}
+		s3, err := NewS3(cfg)
+		if err != nil {
+			return nil, "", err
+		}
+		return s3, fmt.Sprintf("S3 bucket %s at %s", cfg.Bucket, cfg.Endpoint), nil
+
+	default:
+		return nil, "", fmt.Errorf("unknown STORAGE_BACKEND %q (want local or s3)", backend)
+	}
+}
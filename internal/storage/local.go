@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Local keeps objects as files under a directory. Pointed at the image
+// directory it stores nothing twice; pointed at a shared mount it lets
+// replicas share images.
+type Local struct {
+	dir string
+}
+
+// NewLocal returns a Local backend for dir, creating it if needed
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Local{dir: dir}, nil
+}
+
+func (l *Local) path(key string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(key))
+}
+
+// Put writes the object's file atomically
+func (l *Local) Put(key string, r io.Reader, size int64, contentType string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	return writeFileAtomic(l.path(key), r)
+}
+
+// Get opens the object's file
+func (l *Local) Get(key string) (io.ReadCloser, Object, error) {
+	obj, err := l.Stat(key)
+	if err != nil {
+		return nil, Object{}, err
+	}
+	file, err := os.Open(l.path(key))
+	if os.IsNotExist(err) {
+		return nil, Object{}, notExist(key)
+	}
+	if err != nil {
+		return nil, Object{}, err
+	}
+	return file, obj, nil
+}
+
+// Stat describes the object's file, hashing its content
+func (l *Local) Stat(key string) (Object, error) {
+	if err := validKey(key); err != nil {
+		return Object{}, err
+	}
+	file, err := os.Open(l.path(key))
+	if os.IsNotExist(err) {
+		return Object{}, notExist(key)
+	}
+	if err != nil {
+		return Object{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return Object{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return Object{}, notExist(key)
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return Object{}, err
+	}
+	return Object{Key: key, Size: info.Size(), Modified: info.ModTime(), SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// Delete removes the object's file
+func (l *Local) Delete(key string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	if err := os.Remove(l.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List walks the directory for files whose keys start with prefix.
+// Hidden files, such as those being written, are left out.
+func (l *Local) List(prefix string) ([]Object, error) {
+	var objects []Object
+	err := filepath.WalkDir(l.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && p != l.dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(l.dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, Object{Key: key, Size: info.Size(), Modified: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// SignedURL is not supported, as files are served by the app
+func (l *Local) SignedURL(key string, expiry time.Duration) (string, error) {
+	return "", ErrNoSignedURLs
+}
@@ -0,0 +1,155 @@
+// Package storage keeps generated images where every replica of the app
+// can reach them: a directory, on a local disk or a shared mount, or an
+// S3-compatible bucket. Images are still rendered from files in the image
+// directory; storage is where finished ones are kept and found again.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNoSignedURLs is returned by SignedURL when a backend cannot serve
+// objects itself, so callers must serve them
+var ErrNoSignedURLs = errors.New("storage backend cannot serve objects directly")
+
+// Object describes a stored object
+type Object struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+	SHA256   string // hex digest of the content; empty in listings and for objects stored without one
+}
+
+// Storage stores objects by key. Keys are slash-separated paths relative
+// to the image directory, such as "a-cat-20260224-172500.png". Errors for
+// missing objects match fs.ErrNotExist.
+type Storage interface {
+	// Put stores size bytes from r under key, replacing any object there
+	Put(key string, r io.Reader, size int64, contentType string) error
+	// Get opens an object for reading; the caller closes it
+	Get(key string) (io.ReadCloser, Object, error)
+	// Stat describes an object, with its SHA256 where known
+	Stat(key string) (Object, error)
+	// Delete removes an object. Deleting a missing object is not an error.
+	Delete(key string) error
+	// List returns the objects whose keys start with prefix, sorted by key
+	List(prefix string) ([]Object, error)
+	// SignedURL returns a URL that fetches an object without credentials
+	// until expiry, or ErrNoSignedURLs
+	SignedURL(key string, expiry time.Duration) (string, error)
+}
+
+// validKey rejects keys that could escape the storage root
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, `\`) || path.Clean(key) != key || strings.HasPrefix(key, "../") || key == ".." {
+		return fmt.Errorf("invalid storage key %q", key)
+	}
+	return nil
+}
+
+// localPath is implemented by backends that keep objects as files, so
+// copying between a file and the object it already is can be skipped
+type localPath interface {
+	path(key string) string
+}
+
+// Holds reports whether the object under key is the file at filePath
+// itself, as when local storage is the image directory
+func Holds(s Storage, key, filePath string) bool {
+	lp, ok := s.(localPath)
+	return ok && sameFile(lp.path(key), filePath)
+}
+
+// PutFile stores the file at path under key
+func PutFile(s Storage, key, filePath string) error {
+	if Holds(s, key, filePath) {
+		return nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return s.Put(key, file, info.Size(), contentType(key))
+}
+
+// GetFile writes the object under key to the file at path, replacing it
+// atomically
+func GetFile(s Storage, key, filePath string) error {
+	if Holds(s, key, filePath) {
+		return nil
+	}
+
+	body, _, err := s.Get(key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return writeFileAtomic(filePath, body)
+}
+
+// contentType guesses an object's content type from its key
+func contentType(key string) string {
+	switch strings.ToLower(filepath.Ext(key)) {
+	case ".png":
+		return "image/png"
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".gif":
+		return "image/gif"
+	case ".webp":
+		return "image/webp"
+	case ".svg":
+		return "image/svg+xml"
+	case ".pdf":
+		return "application/pdf"
+	}
+	return "application/octet-stream"
+}
+
+// writeFileAtomic writes r to a temporary file next to path and renames it
+// into place, so readers never see a partial file
+func writeFileAtomic(filePath string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".storage-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+// sameFile reports whether two paths are the same existing file
+func sameFile(a, b string) bool {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
+
+// notExist wraps fs.ErrNotExist with the missing key
+func notExist(key string) error {
+	return fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+}